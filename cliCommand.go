@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/service"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/term"
+)
+
+// cliCommand a subcommand run without the GUI
+type cliCommand struct {
+	name string
+	// usage the flags and arguments of the command
+	usage   string
+	summary string
+	// args how many arguments the command takes
+	args int
+	// flags registers the flags of the command, besides -json
+	flags func(c *cli, fs *flag.FlagSet)
+	run   func(c *cli, args []string) error
+}
+
+// cliCommands the subcommands, in the order they are listed in the usage
+var cliCommands = []cliCommand{
+	{
+		name:    "list",
+		summary: "list the titles of the notes",
+		run:     (*cli).list,
+	},
+	{
+		name:    "show",
+		usage:   "<title>",
+		summary: "print the content of a note",
+		args:    1,
+		run:     (*cli).show,
+	},
+	{
+		name:    "add",
+		usage:   "[-content text] [-hidden] <title>",
+		summary: "add a note, reading its content from stdin (after the password) unless -content is given",
+		args:    1,
+		flags: func(c *cli, fs *flag.FlagSet) {
+			fs.StringVar(&c.content, "content", "", "the content of the note")
+			fs.BoolVar(&c.hidden, "hidden", false, "mark the note as hidden")
+		},
+		run: (*cli).add,
+	},
+	{
+		name:    "edit",
+		usage:   "<title>",
+		summary: "edit the content of a note with $VISUAL or $EDITOR",
+		args:    1,
+		run:     (*cli).edit,
+	},
+	{
+		name:    "rm",
+		usage:   "<title>",
+		summary: "delete a note",
+		args:    1,
+		run:     (*cli).remove,
+	},
+	{
+		name:    "rename",
+		usage:   "<title> <new title>",
+		summary: "rename a note",
+		args:    2,
+		run:     (*cli).rename,
+	},
+	{
+		name:    "search",
+		usage:   "[-exact] <query>",
+		summary: "search the titles of the notes (fuzzy, unless -exact)",
+		args:    1,
+		flags: func(c *cli, fs *flag.FlagSet) {
+			fs.BoolVar(&c.exact, "exact", false, "only match the exact title")
+		},
+		run: (*cli).search,
+	},
+	{
+		name:    "sync",
+		summary: "sync the notes with the providers listed in the config",
+		run:     (*cli).sync,
+	},
+}
+
+// findCLICommand returns the subcommand with the given name
+func findCLICommand(name string) (cliCommand, bool) {
+	for _, command := range cliCommands {
+		if command.name == name {
+			return command, true
+		}
+	}
+	return cliCommand{}, false
+}
+
+// printCLIUsage writes the usage of the app, with its subcommands and the flags of the GUI
+func printCLIUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage:\n  ecnotes [flags]\t\tstart the GUI\n  ecnotes <command> [-json] [arguments]\n\nCommands:\n")
+	for _, command := range cliCommands {
+		fmt.Fprintf(w, "  %-8s %s\n", command.name, command.summary)
+	}
+	fmt.Fprintf(w, "\nRun 'ecnotes <command> -h' for the arguments of a command.\n\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// cliNote a note as printed by the subcommands
+type cliNote struct {
+	ID        int    `json:"id"`
+	Title     string `json:"title"`
+	Content   string `json:"content,omitempty"`
+	Hidden    bool   `json:"hidden"`
+	CreatedAt int64  `json:"created_at,omitempty"`
+	UpdatedAt int64  `json:"updated_at,omitempty"`
+}
+
+// cli the subcommands, run over the services of the open vault
+type cli struct {
+	noteService service.NoteService
+	// syncService creates the sync service of the open vault, with the providers listed in the config
+	syncService func() (service.SyncService, error)
+	// in the input of the command, following the password if it was read from there
+	in  io.Reader
+	out io.Writer
+	// editor opens a file in the editor of the user, and returns once it is closed
+	editor func(path string) error
+	// the flags of the command
+	json    bool
+	content string
+	hidden  bool
+	exact   bool
+}
+
+// runCLI runs a subcommand without initializing the GUI. The password of the key is read from the terminal or, when
+// stdin is not one, from its first line
+func runCLI(command cliCommand, args []string, stdin *os.File, out io.Writer, errOut io.Writer) error {
+	c := &cli{out: out, editor: runEditor}
+	args, err := c.parse(command, args, errOut)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	var in io.Reader = stdin
+	if !term.IsTerminal(int(stdin.Fd())) {
+		// the content of the notes added follows the password
+		in = bufio.NewReader(stdin)
+	}
+	h, err := openHeadless(in, errOut)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	c.in = in
+	c.noteService = h.noteService
+	c.syncService = h.syncService
+	return command.run(c, args)
+}
+
+// parse parses the flags of a subcommand, and returns its arguments
+func (c *cli) parse(command cliCommand, args []string, errOut io.Writer) ([]string, error) {
+	fs := flag.NewFlagSet("ecnotes "+command.name, flag.ContinueOnError)
+	fs.SetOutput(errOut)
+	fs.Usage = func() {
+		fmt.Fprintf(errOut, "Usage: ecnotes %s [-json] %s\n\n%s\n\nFlags:\n", command.name, command.usage, command.summary)
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&c.json, "json", false, "print the output as JSON")
+	if command.flags != nil {
+		command.flags(c, fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != command.args {
+		fs.Usage()
+		return nil, errors.New(common.ERR_INVALID_COMMAND_ARGUMENTS)
+	}
+	return fs.Args(), nil
+}
+
+// list prints the titles of the notes, sorted
+func (c *cli) list(_ []string) error {
+	notes, err := c.notes(func() []string {
+		titles := append([]string(nil), c.noteService.GetTitles()...)
+		sort.Strings(titles)
+		return titles
+	})
+	if err != nil {
+		return err
+	}
+	return c.printNotes(notes)
+}
+
+// show prints the content of a note
+func (c *cli) show(args []string) error {
+	note, err := c.note(args[0])
+	if err != nil {
+		return err
+	}
+	return c.print(newCLINote(note, true), func(w io.Writer) {
+		fmt.Fprint(w, note.Content)
+		if !strings.HasSuffix(note.Content, "\n") {
+			fmt.Fprintln(w)
+		}
+	})
+}
+
+// add adds a note
+func (c *cli) add(args []string) error {
+	content := c.content
+	if content == "" {
+		data, err := io.ReadAll(c.in)
+		if err != nil {
+			return err
+		}
+		content = string(data)
+	}
+	note := &model.Note{Title: args[0], Content: content, Hidden: c.hidden}
+	if err := c.noteService.CreateNote(note); err != nil {
+		return err
+	}
+	return c.print(newCLINote(note, false), func(w io.Writer) {
+		fmt.Fprintf(w, "Note %q added\n", note.Title)
+	})
+}
+
+// edit opens the content of a note in the editor of the user, and saves it if it changed. The content is written to
+// a private temporary folder, in memory when possible, and every file in it (eg. the swap and backup files of the
+// editor) is overwritten before it is deleted
+func (c *cli) edit(args []string) error {
+	note, err := c.note(args[0])
+	if err != nil {
+		return err
+	}
+	dir, err := editTempDir()
+	if err != nil {
+		return err
+	}
+	defer common.SecureDeleteDir(dir)
+	path := filepath.Join(dir, "note.md")
+	if err = os.WriteFile(path, []byte(note.Content), 0o600); err != nil {
+		return err
+	}
+	if err = c.editor(path); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if string(data) == note.Content {
+		return c.print(newCLINote(note, false), func(w io.Writer) {
+			fmt.Fprintf(w, "Note %q unchanged\n", note.Title)
+		})
+	}
+	note.Content = string(data)
+	if err = c.noteService.UpdateNoteContent(note); err != nil {
+		return err
+	}
+	return c.print(newCLINote(note, false), func(w io.Writer) {
+		fmt.Fprintf(w, "Note %q updated\n", note.Title)
+	})
+}
+
+// editTempDir creates the private folder of edit, in the memory-backed /dev/shm when it exists
+func editTempDir() (string, error) {
+	if dir, err := os.MkdirTemp("/dev/shm", "ecnotes-edit-"); err == nil {
+		return dir, nil
+	}
+	return os.MkdirTemp("", "ecnotes-edit-")
+}
+
+// remove deletes a note
+func (c *cli) remove(args []string) error {
+	id, err := c.noteID(args[0])
+	if err != nil {
+		return err
+	}
+	if err = c.noteService.DeleteNote(id); err != nil {
+		return err
+	}
+	return c.print(cliNote{ID: id, Title: args[0]}, func(w io.Writer) {
+		fmt.Fprintf(w, "Note %q deleted\n", args[0])
+	})
+}
+
+// rename renames a note
+func (c *cli) rename(args []string) error {
+	if _, err := c.noteID(args[0]); err != nil {
+		return err
+	}
+	id, err := c.noteService.UpdateNoteTitle(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	return c.print(cliNote{ID: id, Title: args[1]}, func(w io.Writer) {
+		fmt.Fprintf(w, "Note %q renamed to %q\n", args[0], args[1])
+	})
+}
+
+// search prints the titles of the notes matching the query, best matches first
+func (c *cli) search(args []string) error {
+	notes, err := c.notes(func() []string {
+		titles, _ := c.noteService.SearchNotes(args[0], !c.exact)
+		return titles
+	})
+	if err != nil {
+		return err
+	}
+	return c.printNotes(notes)
+}
+
+// sync syncs the notes with the providers listed in the config, until done or interrupted
+func (c *cli) sync(_ []string) error {
+	syncService, err := c.syncService()
+	if err != nil {
+		return err
+	}
+	providers := syncService.Providers()
+	if len(providers) == 0 {
+		return errors.New(common.ERR_NO_SYNC_PROVIDERS)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err = syncService.Sync(ctx); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(providers))
+	for _, p := range providers {
+		names = append(names, p.Name())
+	}
+	return c.print(map[string][]string{"providers": names}, func(w io.Writer) {
+		fmt.Fprintf(w, "Synced with %s\n", strings.Join(names, ", "))
+	})
+}
+
+// notes returns the notes with the titles returned by titles (once the title index is loaded), in that order
+func (c *cli) notes(titles func() []string) ([]cliNote, error) {
+	stored, err := c.noteService.GetNotes()
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]model.Note, len(stored))
+	for _, note := range stored {
+		byID[note.ID] = note
+	}
+	notes := make([]cliNote, 0, len(stored))
+	for _, title := range titles() {
+		note := byID[c.noteService.GetNoteIDFromTitle(title)]
+		notes = append(notes, cliNote{
+			ID:        note.ID,
+			Title:     title,
+			Hidden:    note.Hidden,
+			CreatedAt: note.CreatedAt,
+			UpdatedAt: note.UpdatedAt,
+		})
+	}
+	return notes, nil
+}
+
+// noteID returns the ID of the note with the given title
+func (c *cli) noteID(title string) (int, error) {
+	if _, err := c.noteService.GetNotes(); err != nil {
+		return 0, err
+	}
+	for _, t := range c.noteService.GetTitles() {
+		if t == title {
+			return c.noteService.GetNoteIDFromTitle(title), nil
+		}
+	}
+	return 0, errors.New(common.ERR_NOTE_NOT_FOUND)
+}
+
+// note returns the note with the given title, decrypted
+func (c *cli) note(title string) (*model.Note, error) {
+	id, err := c.noteID(title)
+	if err != nil {
+		return nil, err
+	}
+	return c.noteService.GetNoteWithContent(id)
+}
+
+// printNotes prints the titles of the notes, one per line
+func (c *cli) printNotes(notes []cliNote) error {
+	return c.print(notes, func(w io.Writer) {
+		for _, note := range notes {
+			fmt.Fprintln(w, note.Title)
+		}
+	})
+}
+
+// print writes v as JSON with -json, or what text writes otherwise
+func (c *cli) print(v interface{}, text func(w io.Writer)) error {
+	if c.json {
+		encoder := json.NewEncoder(c.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+	text(c.out)
+	return nil
+}
+
+// newCLINote returns a note as printed by the subcommands, with its content if withContent
+func newCLINote(note *model.Note, withContent bool) cliNote {
+	n := cliNote{
+		ID:        note.ID,
+		Title:     note.Title,
+		Hidden:    note.Hidden,
+		CreatedAt: note.CreatedAt,
+		UpdatedAt: note.UpdatedAt,
+	}
+	if withContent {
+		n.Content = note.Content
+	}
+	return n
+}
+
+// runEditor opens a file in $VISUAL or $EDITOR (which can carry arguments, eg. "code --wait"), on the terminal
+func runEditor(path string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	fields := strings.Fields(editor)
+	if len(fields) == 0 {
+		return errors.New(common.ERR_EDITOR_NOT_SET)
+	}
+	cmd := exec.Command(fields[0], append(fields[1:], path)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// headless the services of the open vault, set up without the GUI
+type headless struct {
+	configService  service.ConfigService
+	noteService    service.NoteService
+	noteRepository service.NoteServiceRepository
+	keyService     service.KeyService
+	obs            observer.Observer
+	logger         *log.Logger
+	logFile        *os.File
+}
+
+// openHeadless sets up the services without initializing the GUI, and unlocks the vault with the password read from
+// in. The logs only go to the log file: stdout is left to the output of the command
+func openHeadless(in io.Reader, prompt io.Writer) (*headless, error) {
+	configService, err := setupConfigService()
+	if err != nil {
+		return nil, fmt.Errorf("loading config: %w", err)
+	}
+	certService, err := setupCerts(configService)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificates: %w", err)
+	}
+	duressCertService, err := setupDuressCerts(configService)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificates: %w", err)
+	}
+	logger, logFile, err := setupLogger(configService)
+	if err != nil {
+		return nil, fmt.Errorf("setting up logger: %w", err)
+	}
+	logger.SetOutput(logFile)
+	h := &headless{configService: configService, obs: observer.NewObserver(), logger: logger, logFile: logFile}
+	cryptoService, err := setupCryptoService()
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	if h.noteService, h.noteRepository, err = setupDb(configService, cryptoService, h.obs, h.logger); err != nil {
+		h.Close()
+		return nil, err
+	}
+	// the duress password opens the decoy vault, as it does in the GUI
+	h.keyService = service.NewKeyService(certService, duressCertService, configService, cryptoService, h.noteService)
+	if err = unlockVault(h.keyService, configService, in, prompt); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// Close closes the log file
+func (h *headless) Close() error {
+	return h.logFile.Close()
+}
+
+// syncService creates the sync service of the open vault, with the providers listed in the config.
+// The paired devices are not synced from the command line
+func (h *headless) syncService() (service.SyncService, error) {
+	syncService := service.NewSyncService(h.noteService, h.configService, h.obs, h.logger)
+	if err := activateProviders(h.configService, syncService, h.noteRepository, h.keyService, h.obs, h.logger); err != nil {
+		return nil, err
+	}
+	return syncService, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/provider"
+	"github.com/iltoga/ecnotes-go/service"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runTestCLI runs a subcommand over the notes of c, and returns what it printed
+func runTestCLI(t *testing.T, c *cli, args ...string) (string, error) {
+	t.Helper()
+	command, ok := findCLICommand(args[0])
+	require.True(t, ok, args[0])
+	*c = cli{noteService: c.noteService, syncService: c.syncService, in: c.in, editor: c.editor}
+	out := &strings.Builder{}
+	c.out = out
+	cmdArgs, err := c.parse(command, args[1:], io.Discard)
+	if err != nil {
+		return "", err
+	}
+	err = command.run(c, cmdArgs)
+	return out.String(), err
+}
+
+func TestCLI_Parse(t *testing.T) {
+	c := &cli{}
+	command, ok := findCLICommand("rename")
+	require.True(t, ok)
+	_, err := c.parse(command, []string{"only one"}, io.Discard)
+	assert.EqualError(t, err, common.ERR_INVALID_COMMAND_ARGUMENTS)
+	args, err := c.parse(command, []string{"-json", "old", "new"}, io.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old", "new"}, args)
+	assert.True(t, c.json)
+
+	_, ok = findCLICommand("serve")
+	assert.False(t, ok)
+	// the arguments are checked before the vault is unlocked
+	command, _ = findCLICommand("show")
+	assert.EqualError(t, runCLI(command, nil, nil, io.Discard, io.Discard), common.ERR_INVALID_COMMAND_ARGUMENTS)
+	assert.NoError(t, runCLI(command, []string{"-h"}, nil, io.Discard, io.Discard))
+}
+
+func TestCLI_Notes(t *testing.T) {
+	c := &cli{noteService: noteService(t, true), in: strings.NewReader("milk\neggs\n")}
+
+	out, err := runTestCLI(t, c, "add", "groceries")
+	require.NoError(t, err)
+	assert.Equal(t, "Note \"groceries\" added\n", out)
+	_, err = runTestCLI(t, c, "add", "-content", "1234", "-hidden", "bank pin")
+	require.NoError(t, err)
+	_, err = runTestCLI(t, c, "add", "-content", "again", "groceries")
+	assert.EqualError(t, err, common.ERR_NOTE_ALREADY_EXISTS)
+
+	out, err = runTestCLI(t, c, "list")
+	require.NoError(t, err)
+	assert.Equal(t, "bank pin\ngroceries\n", out)
+	out, err = runTestCLI(t, c, "list", "-json")
+	require.NoError(t, err)
+	var notes []cliNote
+	require.NoError(t, json.Unmarshal([]byte(out), &notes))
+	require.Len(t, notes, 2)
+	assert.Equal(t, "bank pin", notes[0].Title)
+	assert.True(t, notes[0].Hidden)
+	assert.NotZero(t, notes[0].ID)
+	assert.NotZero(t, notes[0].UpdatedAt)
+	assert.Empty(t, notes[0].Content)
+
+	out, err = runTestCLI(t, c, "show", "groceries")
+	require.NoError(t, err)
+	assert.Equal(t, "milk\neggs\n", out)
+	out, err = runTestCLI(t, c, "show", "-json", "bank pin")
+	require.NoError(t, err)
+	var note cliNote
+	require.NoError(t, json.Unmarshal([]byte(out), &note))
+	assert.Equal(t, "1234", note.Content)
+	_, err = runTestCLI(t, c, "show", "missing")
+	assert.EqualError(t, err, common.ERR_NOTE_NOT_FOUND)
+
+	out, err = runTestCLI(t, c, "search", "grcr")
+	require.NoError(t, err)
+	assert.Equal(t, "groceries\n", out)
+	out, err = runTestCLI(t, c, "search", "-exact", "grcr")
+	require.NoError(t, err)
+	assert.Empty(t, out)
+
+	out, err = runTestCLI(t, c, "rename", "groceries", "shopping")
+	require.NoError(t, err)
+	assert.Equal(t, "Note \"groceries\" renamed to \"shopping\"\n", out)
+	_, err = runTestCLI(t, c, "rename", "groceries", "other")
+	assert.EqualError(t, err, common.ERR_NOTE_NOT_FOUND)
+
+	out, err = runTestCLI(t, c, "rm", "-json", "bank pin")
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal([]byte(out), &note))
+	assert.Equal(t, "bank pin", note.Title)
+	out, err = runTestCLI(t, c, "list")
+	require.NoError(t, err)
+	assert.Equal(t, "shopping\n", out)
+	_, err = runTestCLI(t, c, "rm", "bank pin")
+	assert.EqualError(t, err, common.ERR_NOTE_NOT_FOUND)
+}
+
+func TestCLI_Edit(t *testing.T) {
+	c := &cli{noteService: noteService(t, true)}
+	_, err := runTestCLI(t, c, "add", "-content", "milk\n", "groceries")
+	require.NoError(t, err)
+
+	var edited string
+	c.editor = func(path string) error {
+		edited = path
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		// the swap file of the editor is deleted as well
+		require.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(path), ".note.md.swp"), data, 0o600))
+		return os.WriteFile(path, append(data, "eggs\n"...), 0o600)
+	}
+	out, err := runTestCLI(t, c, "edit", "groceries")
+	require.NoError(t, err)
+	assert.Equal(t, "Note \"groceries\" updated\n", out)
+	assert.NoFileExists(t, edited)
+	assert.NoDirExists(t, filepath.Dir(edited))
+	out, err = runTestCLI(t, c, "show", "groceries")
+	require.NoError(t, err)
+	assert.Equal(t, "milk\neggs\n", out)
+
+	// closing the editor without saving changes nothing
+	c.editor = func(string) error { return nil }
+	out, err = runTestCLI(t, c, "edit", "groceries")
+	require.NoError(t, err)
+	assert.Equal(t, "Note \"groceries\" unchanged\n", out)
+
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", "")
+	assert.EqualError(t, runEditor(edited), common.ERR_EDITOR_NOT_SET)
+}
+
+func TestCLI_Sync(t *testing.T) {
+	folder := t.TempDir()
+	cfg := loadedConfig(map[string]string{
+		common.CONFIG_KVDB_PATH:      t.TempDir(),
+		common.CONFIG_SYNC_PROVIDERS: provider.FolderProviderName,
+		common.CONFIG_FOLDER_PATH:    folder,
+	})
+	cryptoService, err := setupCryptoService()
+	require.NoError(t, err)
+	cryptoService.SetSrv(service.NewCryptoServiceFactory(common.ENCRYPTION_ALGORITHM_AES_256_CBC))
+	require.NoError(t, cryptoService.GetSrv().GetKeyManager().ImportKey([]byte("test-key-32-bytes-test-key-32-by"), "test"))
+	obs := &observer.ObserverImpl{}
+	notes, noteRepository, err := setupDb(cfg, cryptoService, obs, logrus.StandardLogger())
+	require.NoError(t, err)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	providers := provider.FolderProviderName
+	c := &cli{
+		noteService: notes,
+		syncService: func() (service.SyncService, error) {
+			syncService := service.NewSyncService(notes, cfg, obs, logger)
+			if providers == "" {
+				return syncService, nil
+			}
+			return syncService, activateProviders(cfg, syncService, noteRepository, nil, obs, logger)
+		},
+	}
+	_, err = runTestCLI(t, c, "add", "-content", "milk", "groceries")
+	require.NoError(t, err)
+
+	out, err := runTestCLI(t, c, "sync", "-json")
+	require.NoError(t, err)
+	var synced map[string][]string
+	require.NoError(t, json.Unmarshal([]byte(out), &synced))
+	assert.Equal(t, []string{provider.FolderProviderName}, synced["providers"])
+	files, err := filepath.Glob(filepath.Join(folder, "*.note"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	providers = ""
+	_, err = runTestCLI(t, c, "sync")
+	assert.EqualError(t, err, common.ERR_NO_SYNC_PROVIDERS)
+}
+
+func TestReadPassword(t *testing.T) {
+	// the input following the password is left to the command
+	in := bufio.NewReader(strings.NewReader("secret\r\nnote content"))
+	password, err := readPassword(in, io.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", password)
+	rest, err := io.ReadAll(in)
+	require.NoError(t, err)
+	assert.Equal(t, "note content", string(rest))
+
+	password, err = readPassword(strings.NewReader("no newline"), io.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, "no newline", password)
+}
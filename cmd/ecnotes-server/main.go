@@ -0,0 +1,84 @@
+// ecnotes-server is a self-hostable, zero-knowledge sync backend for EcNotes.
+// It stores only the encrypted notes of each vault, and grants access to a vault with the tokens listed in a file.
+//
+// Usage:
+//
+//	ecnotes-server -tokens tokens.txt [-addr :8443] [-data ./ecnotes-server-data] [-tls-cert cert.pem -tls-key key.pem]
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/server"
+	log "github.com/sirupsen/logrus"
+)
+
+// shutdownTimeout how long the requests in flight are waited for on shutdown
+const shutdownTimeout = 10 * time.Second
+
+func main() {
+	addr := flag.String("addr", ":8443", "address to listen on")
+	dataDir := flag.String("data", "ecnotes-server-data", "folder holding the database")
+	tokensPath := flag.String("tokens", "", "file granting access to the vaults: one <vault>:<token> per line")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file (serve plain HTTP behind a TLS proxy when empty)")
+	tlsKey := flag.String("tls-key", "", "TLS key file")
+	logLevel := flag.String("log-level", "info", "log level")
+	flag.Parse()
+
+	logger := log.New()
+	if level, err := log.ParseLevel(*logLevel); err == nil {
+		logger.SetLevel(level)
+	}
+	if *tokensPath == "" {
+		logger.Fatal("-tokens is required")
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		logger.Fatal("-tls-cert and -tls-key must be set together")
+	}
+	tokens, err := server.LoadTokens(*tokensPath)
+	if err != nil {
+		logger.Fatalf("Error loading the tokens: %v", err)
+	}
+	if err = os.MkdirAll(*dataDir, 0o700); err != nil {
+		logger.Fatalf("Error creating the data folder: %v", err)
+	}
+	store, err := server.NewStore(*dataDir)
+	if err != nil {
+		logger.Fatalf("Error opening the database: %v", err)
+	}
+	defer store.Close()
+
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           server.NewServer(store, tokens, logger).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		logger.Info("Shutting down...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Errorf("Error shutting down: %v", err)
+		}
+	}()
+
+	logger.Infof("Listening on %s", *addr)
+	if *tlsCert != "" {
+		err = srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Errorf("Error serving: %v", err)
+	}
+}
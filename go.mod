@@ -3,6 +3,8 @@ module github.com/iltoga/ecnotes-go
 go 1.26.1
 
 require (
+	filippo.io/bigmod v0.1.0
+	filippo.io/nistec v0.0.4
 	fyne.io/fyne/v2 v2.7.3
 	github.com/lithammer/fuzzysearch v1.1.8
 	github.com/pelletier/go-toml v1.9.5
@@ -10,7 +12,9 @@ require (
 	github.com/stretchr/testify v1.11.1
 	github.com/xujiajun/nutsdb v0.11.1
 	golang.org/x/crypto v0.49.0
+	golang.org/x/net v0.52.0
 	golang.org/x/oauth2 v0.36.0
+	golang.org/x/term v0.41.0
 	google.golang.org/api v0.273.0
 )
 
@@ -70,7 +74,6 @@ require (
 	go.opentelemetry.io/otel/trace v1.42.0 // indirect
 	golang.org/x/image v0.38.0 // indirect
 	golang.org/x/mobile v0.0.0-20260312152759-81488f6aeb60 // indirect
-	golang.org/x/net v0.52.0 // indirect
 	golang.org/x/sys v0.42.0 // indirect
 	golang.org/x/text v0.35.0 // indirect
 	google.golang.org/appengine v1.6.8 // indirect
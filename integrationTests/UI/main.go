@@ -57,6 +57,15 @@ func (cs *CertServiceMockImpl) GetCert(name string) (*model.EncKey, error) {
 	return nil, errors.New(common.ERR_CERT_NOT_FOUND)
 }
 
+// GetCerts ....
+func (cs *CertServiceMockImpl) GetCerts() ([]model.EncKey, error) {
+	certs := make([]model.EncKey, 0, len(cs.certs))
+	for _, cert := range cs.certs {
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
 // AddCert ....
 func (cs *CertServiceMockImpl) AddCert(cert model.EncKey) error {
 	cs.certs[cert.Name] = cert
@@ -72,6 +81,12 @@ func (cs *CertServiceMockImpl) RemoveCert(name string) error {
 	return errors.New(common.ERR_CERT_NOT_FOUND)
 }
 
+// DestroyCerts ....
+func (cs *CertServiceMockImpl) DestroyCerts() error {
+	cs.certs = map[string]model.EncKey{}
+	return nil
+}
+
 // CountCerts ....
 func (cs *CertServiceMockImpl) CountCerts() (int, error) {
 	return len(cs.certs), nil
@@ -81,6 +96,9 @@ func (cs *CertServiceMockImpl) CountCerts() (int, error) {
 type NoteRepositoryMockImpl struct {
 	mockedNotes  []model.Note
 	mockedTitles []string
+	tombstones   map[int]model.Tombstone
+	syncBases    map[string]map[int]model.Note
+	outbox       map[string]map[int]model.OutboxEntry
 }
 
 // NewNoteRepositoryMock ....
@@ -221,6 +239,94 @@ func (nsr *NoteRepositoryMockImpl) GetIDFromTitle(title string) int {
 	return int(cryptoUtil.IndexFromString(title))
 }
 
+// SetBucket ....
+func (nsr *NoteRepositoryMockImpl) SetBucket(bucket string) {}
+
+// SaveTombstone ....
+func (nsr *NoteRepositoryMockImpl) SaveTombstone(tombstone model.Tombstone) error {
+	if nsr.tombstones == nil {
+		nsr.tombstones = make(map[int]model.Tombstone)
+	}
+	nsr.tombstones[tombstone.ID] = tombstone
+	return nil
+}
+
+// GetTombstones ....
+func (nsr *NoteRepositoryMockImpl) GetTombstones() ([]model.Tombstone, error) {
+	tombstones := make([]model.Tombstone, 0, len(nsr.tombstones))
+	for _, tombstone := range nsr.tombstones {
+		tombstones = append(tombstones, tombstone)
+	}
+	return tombstones, nil
+}
+
+// DeleteTombstones ....
+func (nsr *NoteRepositoryMockImpl) DeleteTombstones(ids ...int) error {
+	for _, id := range ids {
+		delete(nsr.tombstones, id)
+	}
+	return nil
+}
+
+// SaveSyncBases ....
+func (nsr *NoteRepositoryMockImpl) SaveSyncBases(providerName string, notes []model.Note) error {
+	if nsr.syncBases == nil {
+		nsr.syncBases = make(map[string]map[int]model.Note)
+	}
+	nsr.syncBases[providerName] = make(map[int]model.Note, len(notes))
+	for _, note := range notes {
+		nsr.syncBases[providerName][note.ID] = note
+	}
+	return nil
+}
+
+// GetSyncBase ....
+func (nsr *NoteRepositoryMockImpl) GetSyncBase(providerName string, id int) (*model.Note, error) {
+	base, ok := nsr.syncBases[providerName][id]
+	if !ok {
+		return nil, errors.New(common.ERR_NOTE_NOT_FOUND)
+	}
+	return &base, nil
+}
+
+// GetSyncBases ....
+func (nsr *NoteRepositoryMockImpl) GetSyncBases(providerName string) ([]model.Note, error) {
+	bases := make([]model.Note, 0, len(nsr.syncBases[providerName]))
+	for _, base := range nsr.syncBases[providerName] {
+		bases = append(bases, base)
+	}
+	return bases, nil
+}
+
+// SaveOutboxEntry ....
+func (nsr *NoteRepositoryMockImpl) SaveOutboxEntry(queue string, entry model.OutboxEntry) error {
+	if nsr.outbox == nil {
+		nsr.outbox = make(map[string]map[int]model.OutboxEntry)
+	}
+	if nsr.outbox[queue] == nil {
+		nsr.outbox[queue] = make(map[int]model.OutboxEntry)
+	}
+	nsr.outbox[queue][entry.ID] = entry
+	return nil
+}
+
+// GetOutboxEntries ....
+func (nsr *NoteRepositoryMockImpl) GetOutboxEntries(queue string) ([]model.OutboxEntry, error) {
+	entries := make([]model.OutboxEntry, 0, len(nsr.outbox[queue]))
+	for _, entry := range nsr.outbox[queue] {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// DeleteOutboxEntries ....
+func (nsr *NoteRepositoryMockImpl) DeleteOutboxEntries(queue string, ids ...int) error {
+	for _, id := range ids {
+		delete(nsr.outbox[queue], id)
+	}
+	return nil
+}
+
 // main this main mocks db service and runs the UI
 func main() {
 	configService := &service.ConfigServiceImpl{
@@ -256,7 +362,7 @@ func main() {
 	}
 
 	// wire key-lifecycle service
-	keyService := service.NewKeyService(certService, configService, cryptoServiceF, noteService)
+	keyService := service.NewKeyService(certService, nil, configService, cryptoServiceF, noteService)
 
 	// create a new ui
 	testUI = ui.NewUI(app.NewWithID("testAPP"), configService, noteService, certService, keyService, obs)
@@ -0,0 +1,122 @@
+package ecnotesServer_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/provider"
+	"github.com/iltoga/ecnotes-go/server"
+	"github.com/iltoga/ecnotes-go/service"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// device a device syncing its vault with the server
+type device struct {
+	noteService service.NoteService
+	syncService service.SyncService
+}
+
+func newDevice(t *testing.T, serverURL string, logger *logrus.Logger) *device {
+	t.Helper()
+	repo, err := service.NewNoteServiceRepository(t.TempDir(), "notes", true)
+	require.NoError(t, err)
+	// the devices share the encryption key, never the server
+	cryptoSrv := service.NewCryptoServiceAES(service.NewKeyManagementServiceAES())
+	require.NoError(t, cryptoSrv.GetKeyManager().ImportKey([]byte("1234567890123456"), "testKey1"))
+	configService := &service.ConfigServiceImpl{
+		Config:     map[string]string{},
+		Globals:    map[string]string{},
+		Loaded:     true,
+		ConfigMux:  &sync.RWMutex{},
+		GlobalsMux: &sync.RWMutex{},
+	}
+	obs := &observer.ObserverImpl{}
+	noteService := service.NewNoteService(repo, configService, obs, &service.CryptoServiceFactoryImpl{Srv: cryptoSrv}, logger)
+
+	sp, err := provider.NewServerProvider(
+		serverURL, "team", "team-token", logger, &observer.ObserverImpl{}, provider.NewOutbox(repo, provider.ServerProviderName, obs),
+	)
+	require.NoError(t, err)
+	syncService := service.NewSyncService(noteService, configService, obs, logger)
+	syncService.AddProvider(sp)
+	return &device{noteService: noteService, syncService: syncService}
+}
+
+func (d *device) sync(t *testing.T) {
+	t.Helper()
+	require.NoError(t, d.syncService.Sync(context.Background()))
+}
+
+func (d *device) content(t *testing.T, title string) string {
+	t.Helper()
+	id := d.noteService.GetNoteIDFromTitle(title)
+	require.NotZero(t, id, title)
+	note, err := d.noteService.GetNoteWithContent(id)
+	require.NoError(t, err)
+	return note.Content
+}
+
+func TestEcnotesServer_EndToEnd(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	store, err := server.NewStore(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+	tokens := server.NewTokens()
+	require.NoError(t, tokens.Add("team", "team-token"))
+	ts := httptest.NewServer(server.NewServer(store, tokens, logger).Handler())
+	defer ts.Close()
+
+	alice := newDevice(t, ts.URL, logger)
+	bob := newDevice(t, ts.URL, logger)
+
+	// a note created on a device reaches the other one
+	require.NoError(t, alice.noteService.CreateNote(&model.Note{Title: "Groceries", Content: "milk"}))
+	alice.sync(t)
+	bob.sync(t)
+	assert.Equal(t, []string{"Groceries"}, bob.noteService.GetTitles())
+	assert.Equal(t, "milk", bob.content(t, "Groceries"))
+
+	// the server only stores opaque blobs
+	changes, err := store.GetChanges("team", 0, 10)
+	require.NoError(t, err)
+	require.Len(t, changes.Records, 1)
+	assert.False(t, bytes.Contains(changes.Records[0].Blob, []byte("Groceries")))
+	assert.False(t, bytes.Contains(changes.Records[0].Blob, []byte("milk")))
+
+	// updates flow back. The versions of a note are told apart by their UpdatedAt (ms)
+	time.Sleep(2 * time.Millisecond)
+	id := bob.noteService.GetNoteIDFromTitle("Groceries")
+	require.NoError(t, bob.noteService.UpdateNoteContent(&model.Note{ID: id, Title: "Groceries", Content: "milk\neggs\nbread\n"}))
+	bob.sync(t)
+	alice.sync(t)
+	assert.Equal(t, "milk\neggs\nbread\n", alice.content(t, "Groceries"))
+
+	// changes made on both sides are merged
+	id = alice.noteService.GetNoteIDFromTitle("Groceries")
+	require.NoError(t, alice.noteService.UpdateNoteContent(&model.Note{ID: id, Title: "Groceries", Content: "oat milk\neggs\nbread\n"}))
+	time.Sleep(2 * time.Millisecond)
+	require.NoError(t, bob.noteService.UpdateNoteContent(&model.Note{ID: id, Title: "Groceries", Content: "milk\neggs\nbread\nbutter\n"}))
+	alice.sync(t)
+	bob.sync(t)
+	// without the background worker, the merged version is pushed by the next sync
+	bob.sync(t)
+	alice.sync(t)
+	assert.Equal(t, "oat milk\neggs\nbread\nbutter\n", alice.content(t, "Groceries"))
+	assert.Equal(t, "oat milk\neggs\nbread\nbutter\n", bob.content(t, "Groceries"))
+
+	// deletions are propagated
+	require.NoError(t, alice.noteService.DeleteNote(id))
+	alice.sync(t)
+	bob.sync(t)
+	assert.Empty(t, bob.noteService.GetTitles())
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/iltoga/ecnotes-go/model"
 	"github.com/iltoga/ecnotes-go/provider"
@@ -82,6 +83,7 @@ func getGP(t *testing.T) *provider.GoogleProvider {
 		credFilePath,
 		logrus.New(),           //TODO: mock logger
 		observer.NewObserver(), // TODO: mock observer
+		nil,                    // the notifiers and the worker are not used here
 	)
 	if err != nil {
 		t.Skipf("skipping google sync integration tests: provider init failed: %v", err)
@@ -180,7 +182,9 @@ func (s *googleSyncTest) TestPutAndDeleteNote() {
 	note, err = gp.GetNote(note.ID)
 	assert.NotNil(t, err)
 	assert.Nil(t, note)
-	// also check that the note ID is not in the cache
+	// once its tombstone is purged, the note ID is not in the cache anymore
+	err = gp.PurgeTombstones(time.Now().Add(time.Minute).UnixMilli())
+	assert.Nil(t, err)
 	_, ok := gp.CacheIDGet(noteID)
 	assert.False(t, ok)
 }
@@ -195,10 +199,14 @@ func (s *googleSyncTest) TestGetNoteIDs() {
 		panic(err)
 	}
 	assert.Equal(t, len(ids), 3)
-	// asssert ids
-	assert.Equal(t, ids[98304983], 0)
-	assert.Equal(t, ids[3782526374], 1)
-	assert.Equal(t, ids[1839475811], 2)
+	// asssert ids and their row in the sheet
+	assert.Equal(t, []int{98304983, 1839475811, 3782526374}, ids)
+	idx, _ := gp.CacheIDGet(98304983)
+	assert.Equal(t, idx, 0)
+	idx, _ = gp.CacheIDGet(3782526374)
+	assert.Equal(t, idx, 1)
+	idx, _ = gp.CacheIDGet(1839475811)
+	assert.Equal(t, idx, 2)
 
 	// read all note IDs from cache
 	// remove one element from cache
@@ -209,9 +217,7 @@ func (s *googleSyncTest) TestGetNoteIDs() {
 	}
 	assert.Equal(t, len(ids), 2)
 	// asssert ids
-	assert.Equal(t, ids[98304983], 0)
-	assert.Equal(t, ids[1839475811], 2)
-	assert.Empty(t, ids[3782526374])
+	assert.Equal(t, []int{98304983, 1839475811}, ids)
 }
 
 // TestFilterNotes ....
@@ -265,7 +271,7 @@ func (s *googleSyncTest) TestSyncNotes() {
 	// combine new notes and defaultNotes
 	dbNotes := append(defaultNotes, newNotes...)
 	// sync notes and assert it
-	_, err := gp.SyncNotes(context.Background(), dbNotes)
+	_, err := gp.SyncNotes(context.Background(), dbNotes, nil, nil)
 	assert.Nil(t, err)
 	// read and print all notes
 	notes, err := gp.GetNotes()
@@ -280,7 +286,9 @@ func (s *googleSyncTest) TestSyncNotes() {
 	assert.Equal(t, notes[3].CreatedAt, int64(1645516749891))
 	assert.Equal(t, notes[3].UpdatedAt, int64(1645516749891))
 
-	// delete the new note
+	// delete the new note and drop its tombstone, to leave the sheet as it was
 	err = gp.DeleteNote(11111111)
 	assert.Nil(t, err)
+	err = gp.PurgeTombstones(time.Now().Add(time.Minute).UnixMilli())
+	assert.Nil(t, err)
 }
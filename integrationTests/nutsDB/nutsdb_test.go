@@ -10,6 +10,7 @@ import (
 	"github.com/iltoga/ecnotes-go/model"
 	"github.com/iltoga/ecnotes-go/service"
 	"github.com/iltoga/ecnotes-go/service/observer"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -93,8 +94,8 @@ func (s *nutsDBSuiteTest) TestUpdateDeleteNote() {
 	// test update note's title (deletes old note and creates a new one)
 	newTitle := "Welcome to EcNotes - updated"
 	newContent := "This is your first note.\n\nYou can edit it by clicking on the title.\n\nUpdated!"
-	newID := noteRepository.GetIDFromTitle(newTitle)
-	oldID := noteRepository.GetIDFromTitle(newNote.Title)
+	newID := noteService.GetNoteIDFromTitle(newTitle)
+	oldID := noteService.GetNoteIDFromTitle(newNote.Title)
 	_, err = noteService.UpdateNoteTitle(newNote.Title, newTitle)
 	assert.NoError(t, err)
 	ok, err := noteRepository.NoteExists(oldID)
@@ -194,7 +195,7 @@ func initDB() {
 		Srv: service.NewCryptoServiceFactory(cert.Algo),
 	}
 	cryptoSrvF.Srv.GetKeyManager().ImportKey(cert.Key, cert.Name)
-	noteService = service.NewNoteService(noteRepository, configService, observer.NewObserver(), cryptoSrvF)
+	noteService = service.NewNoteService(noteRepository, configService, observer.NewObserver(), cryptoSrvF, logrus.StandardLogger())
 }
 
 func cleanup() {
@@ -0,0 +1,139 @@
+package peerSync_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/service"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// device an instance syncing its vault with the paired devices over loopback
+type device struct {
+	noteService service.NoteService
+	syncService service.SyncService
+	peerService service.PeerService
+}
+
+func newDevice(t *testing.T, name string, logger *logrus.Logger) *device {
+	t.Helper()
+	repo, err := service.NewNoteServiceRepository(t.TempDir(), "notes", true)
+	require.NoError(t, err)
+	// the devices share the encryption key
+	cryptoSrv := service.NewCryptoServiceAES(service.NewKeyManagementServiceAES())
+	require.NoError(t, cryptoSrv.GetKeyManager().ImportKey([]byte("1234567890123456"), "testKey1"))
+	configService := &service.ConfigServiceImpl{
+		Config: map[string]string{
+			common.CONFIG_P2P_PATH:        t.TempDir(),
+			common.CONFIG_P2P_LISTEN_ADDR: "127.0.0.1:0",
+			common.CONFIG_P2P_DEVICE_NAME: name,
+		},
+		Globals:    map[string]string{},
+		Loaded:     true,
+		ConfigMux:  &sync.RWMutex{},
+		GlobalsMux: &sync.RWMutex{},
+	}
+	obs := &observer.ObserverImpl{}
+	noteService := service.NewNoteService(repo, configService, obs, &service.CryptoServiceFactoryImpl{Srv: cryptoSrv}, logger)
+	syncService := service.NewSyncService(noteService, configService, obs, logger)
+	peerService, err := service.NewPeerService(configService, noteService, syncService, obs, logger)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	require.NoError(t, peerService.Start(ctx))
+	return &device{noteService: noteService, syncService: syncService, peerService: peerService}
+}
+
+func (d *device) address() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(d.peerService.Port()))
+}
+
+func (d *device) sync(t *testing.T) {
+	t.Helper()
+	require.NoError(t, d.syncService.Sync(context.Background()))
+}
+
+func (d *device) content(t *testing.T, title string) string {
+	t.Helper()
+	id := d.noteService.GetNoteIDFromTitle(title)
+	require.NotZero(t, id, title)
+	note, err := d.noteService.GetNoteWithContent(id)
+	require.NoError(t, err)
+	return note.Content
+}
+
+func TestPeerSync_EndToEnd(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	alice := newDevice(t, "alice", logger)
+	bob := newDevice(t, "bob", logger)
+
+	// bob pairs with alice, with the code alice shows
+	code, err := alice.peerService.StartPairing()
+	require.NoError(t, err)
+	peer, err := bob.peerService.Pair(context.Background(), alice.address(), code)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", peer.Name)
+	require.Len(t, alice.peerService.Peers(), 1)
+	assert.Equal(t, "bob", alice.peerService.Peers()[0].Name)
+	// each device syncs with the other
+	require.Len(t, alice.syncService.Providers(), 1)
+	require.Len(t, bob.syncService.Providers(), 1)
+
+	// a note created on a device reaches the other one, whichever syncs
+	require.NoError(t, alice.noteService.CreateNote(&model.Note{Title: "Groceries", Content: "milk\neggs\nbread\n"}))
+	bob.sync(t)
+	assert.Equal(t, []string{"Groceries"}, bob.noteService.GetTitles())
+	assert.Equal(t, "milk\neggs\nbread\n", bob.content(t, "Groceries"))
+
+	time.Sleep(2 * time.Millisecond)
+	require.NoError(t, bob.noteService.CreateNote(&model.Note{Title: "Todo", Content: "call mom"}))
+	alice.sync(t)
+	assert.ElementsMatch(t, []string{"Groceries", "Todo"}, alice.noteService.GetTitles())
+	assert.Equal(t, "call mom", alice.content(t, "Todo"))
+
+	// changes made on both sides are merged
+	id := alice.noteService.GetNoteIDFromTitle("Groceries")
+	require.NoError(t, alice.noteService.UpdateNoteContent(&model.Note{ID: id, Title: "Groceries", Content: "oat milk\neggs\nbread\n"}))
+	time.Sleep(2 * time.Millisecond)
+	require.NoError(t, bob.noteService.UpdateNoteContent(&model.Note{ID: id, Title: "Groceries", Content: "milk\neggs\nbread\nbutter\n"}))
+	bob.sync(t)
+	// the merged version is pushed by the next sync
+	bob.sync(t)
+	assert.Equal(t, "oat milk\neggs\nbread\nbutter\n", alice.content(t, "Groceries"))
+	assert.Equal(t, "oat milk\neggs\nbread\nbutter\n", bob.content(t, "Groceries"))
+
+	// deletions are propagated
+	require.NoError(t, alice.noteService.DeleteNote(id))
+	alice.sync(t)
+	assert.Equal(t, []string{"Todo"}, bob.noteService.GetTitles())
+}
+
+func TestPeerSync_WrongCode(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	alice := newDevice(t, "alice", logger)
+	bob := newDevice(t, "bob", logger)
+
+	code, err := alice.peerService.StartPairing()
+	require.NoError(t, err)
+	wrong := "AAAA-AAAA-AAAA"
+	if code == wrong {
+		wrong = "BBBB-BBBB-BBBB"
+	}
+	_, err = bob.peerService.Pair(context.Background(), alice.address(), wrong)
+	assert.Error(t, err)
+	assert.Empty(t, alice.peerService.Peers())
+	assert.Empty(t, bob.peerService.Peers())
+	assert.Empty(t, bob.syncService.Providers())
+}
@@ -2,7 +2,9 @@ package common
 
 import (
 	"encoding/json"
+	"io"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -99,3 +101,80 @@ func TestStringHelpersJSONCompatibility(t *testing.T) {
 	require.NoError(t, json.Unmarshal(raw, &decoded))
 	assert.NotEmpty(t, decoded.UpdatedAt)
 }
+
+func TestSecureDeleteFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "secret.json")
+	require.NoError(t, os.WriteFile(path, []byte("very secret content"), 0o600))
+
+	require.NoError(t, SecureDeleteFile(path))
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// deleting a missing file is a no-op
+	require.NoError(t, SecureDeleteFile(path))
+}
+
+func TestSecureDeleteDir(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "edit")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "backup"), 0o700))
+	content := []byte("very secret content")
+	paths := []string{filepath.Join(dir, "note.md"), filepath.Join(dir, ".note.md.swp"), filepath.Join(dir, "backup", "note.md~")}
+	files := make([]*os.File, 0, len(paths))
+	for _, path := range paths {
+		require.NoError(t, os.WriteFile(path, content, 0o600))
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	require.NoError(t, SecureDeleteDir(dir))
+	assert.NoDirExists(t, dir)
+	// every file was overwritten before it was removed
+	for _, f := range files {
+		data, err := io.ReadAll(f)
+		require.NoError(t, err)
+		assert.Len(t, data, len(content))
+		assert.NotEqual(t, content, data, f.Name())
+	}
+
+	// deleting a missing folder is a no-op
+	require.NoError(t, SecureDeleteDir(dir))
+}
+
+func TestMergeLines(t *testing.T) {
+	t.Parallel()
+
+	base := "one\ntwo\nthree\nfour\n"
+	tests := []struct {
+		name          string
+		local, remote string
+		want          string
+		ok            bool
+	}{
+		{"unchanged", base, base, base, true},
+		{"local only", "one\n2\nthree\nfour\n", base, "one\n2\nthree\nfour\n", true},
+		{"remote only", base, "one\ntwo\nthree\n4\n", "one\ntwo\nthree\n4\n", true},
+		{"different lines", "one\n2\nthree\nfour\n", "one\ntwo\nthree\n4\n", "one\n2\nthree\n4\n", true},
+		{"same change", "one\n2\nthree\nfour\n", "one\n2\nthree\nfour\n", "one\n2\nthree\nfour\n", true},
+		{"insert and delete", "zero\none\ntwo\nthree\nfour\n", "one\ntwo\nfour\n", "zero\none\ntwo\nfour\n", true},
+		{"append on both sides", base + "five\n", base + "six\n", "", false},
+		{"same line", "one\n2\nthree\nfour\n", "one\nTWO\nthree\nfour\n", "", false},
+	}
+	for _, tt := range tests {
+		merged, ok := MergeLines(base, tt.local, tt.remote)
+		assert.Equal(t, tt.ok, ok, tt.name)
+		assert.Equal(t, tt.want, merged, tt.name)
+	}
+
+	// without a base, only identical texts merge
+	_, ok := MergeLines("", "a\n", "b\n")
+	assert.False(t, ok)
+	merged, ok := MergeLines("", "a\n", "a\n")
+	assert.True(t, ok)
+	assert.Equal(t, "a\n", merged)
+}
@@ -28,9 +28,37 @@ const (
 	CONFIG_GOOGLE_PROVIDER_PATH         = "google_provider_path"
 	CONFIG_GOOGLE_CREDENTIALS_FILE_PATH = "google_credentials_file"
 	CONFIG_GOOGLE_SHEET_ID              = "google_sheet_id"
+	CONFIG_GOOGLE_OAUTH_CLIENT_FILE     = "google_oauth_client_file"
 	CONFIG_LOG_LEVEL                    = "log_level"
 	CONFIG_LOG_FILE_PATH                = "log_file_path"
 	CONFIG_KEY_FILE_PATH                = "key_file_path"
+	CONFIG_DURESS_KEY_FILE_PATH         = "duress_key_file_path"
+	CONFIG_NOTE_PADDING                 = "note_padding"
+	CONFIG_NOTE_PADDING_BLOCK_SIZE      = "note_padding_block_size"
+	CONFIG_NOTE_COMPRESSION             = "note_compression"
+	CONFIG_TOMBSTONE_TTL_DAYS           = "tombstone_ttl_days"
+	CONFIG_SYNC_INTERVAL_MINUTES        = "sync_interval_minutes"
+	CONFIG_SYNC_PROVIDERS               = "sync_providers"
+	CONFIG_WEBDAV_URL                   = "webdav_url"
+	CONFIG_WEBDAV_USERNAME              = "webdav_username"
+	CONFIG_WEBDAV_PASSWORD              = "webdav_password"
+	CONFIG_FOLDER_PATH                  = "folder_path"
+	CONFIG_FOLDER_GIT                   = "folder_git"
+	CONFIG_SERVER_URL                   = "server_url"
+	CONFIG_SERVER_VAULT                 = "server_vault"
+	CONFIG_SERVER_TOKEN                 = "server_token"
+	CONFIG_S3_ENDPOINT                  = "s3_endpoint"
+	CONFIG_S3_REGION                    = "s3_region"
+	CONFIG_S3_BUCKET                    = "s3_bucket"
+	CONFIG_S3_PREFIX                    = "s3_prefix"
+	CONFIG_S3_ACCESS_KEY                = "s3_access_key"
+	CONFIG_S3_SECRET_KEY                = "s3_secret_key"
+	CONFIG_P2P_ENABLED                  = "p2p_enabled"
+	CONFIG_P2P_PATH                     = "p2p_path"
+	CONFIG_P2P_LISTEN_ADDR              = "p2p_listen_addr"
+	CONFIG_P2P_DEVICE_NAME              = "p2p_device_name"
+	CONFIG_P2P_MDNS                     = "p2p_mdns"
+	CONFIG_KEY_TRANSFER_LISTEN_ADDR     = "key_transfer_listen_addr"
 
 	EncryptionKeyAction_Generate EncryptionKeyAction = iota
 	EncryptionKeyAction_Decrypt
@@ -74,6 +102,7 @@ const (
 	WDG_NOTE_LIST                      = "note_list"
 	WDG_PASSWORD_MODAL                 = "password_modal"
 	WDG_SEARCH_BOX                     = "search_box"
+	WDG_SYNC_STATUS                    = "sync_status"
 
 	// log levels
 	LOG_LEVEL_TRACE = "trace"
@@ -87,10 +116,47 @@ const (
 	ENCRYPTION_ALGORITHM_AES_256_CBC = "aes-256-cbc"
 	ENCRYPTION_ALGORITHM_RSA_OAEP    = "rsa-oaep"
 
+	// padding schemes applied to the note content before encryption, to hide its length
+	NOTE_PADDING_NONE  = "none"
+	NOTE_PADDING_POW2  = "pow2"
+	NOTE_PADDING_BLOCK = "block"
+
+	// compression applied to the note content before encryption
+	NOTE_COMPRESSION_NONE    = "none"
+	NOTE_COMPRESSION_DEFLATE = "deflate"
+
 	// RecoveryFallbackSalt is used when loading recovery payloads generated
 	// before per-key random salts were introduced (backwards compatibility only).
 	// Never use this for new keys – always generate a random salt via SecureRandomStr.
 	RecoveryFallbackSalt = "ecnotes-static-salt-v1"
+
+	// DEFAULT_NOTES_BUCKET is the nutsdb bucket holding the real vault
+	DEFAULT_NOTES_BUCKET = "notes"
+	// TOMBSTONES_BUCKET_SUFFIX is appended to a notes bucket to get the bucket holding its deletion tombstones
+	TOMBSTONES_BUCKET_SUFFIX = "_tombstones"
+	// SYNC_BASES_BUCKET_SUFFIX is appended to a notes bucket, followed by the name of a sync provider, to get the bucket
+	// holding the version of its notes last synced with that provider
+	SYNC_BASES_BUCKET_SUFFIX = "_sync_bases_"
+	// OUTBOX_BUCKET_SUFFIX is appended to a notes bucket, followed by the name of a sync provider, to get the bucket
+	// holding the changes waiting to be pushed to that provider
+	OUTBOX_BUCKET_SUFFIX = "_outbox_"
+	// CONFLICT_COPY_TITLE_FORMAT the title of the copy saved when the changes to a note can't be merged (title, time)
+	CONFLICT_COPY_TITLE_FORMAT = "%s (conflicted copy %s)"
+	// CONFLICT_COPY_TIME_FORMAT the time format used in the title of the conflicted copies
+	CONFLICT_COPY_TIME_FORMAT = "2006-01-02 15.04.05"
+	// DECOY_NOTES_BUCKET is the nutsdb bucket opened when the duress password is used
+	DECOY_NOTES_BUCKET = "notes_alt"
+	// DURESS_WIPE_MARKER is the name of the (empty) entry stored in the duress key store
+	// when the real key material must be destroyed as soon as the duress password is used
+	DURESS_WIPE_MARKER = "__wipe__"
+	// CERT_ALGO_SECRET the algorithm of the cert store entries holding a secret (eg. the refresh token of a sync
+	// provider) rather than an encryption key
+	CERT_ALGO_SECRET = "secret"
+
+	// ENCRYPTED_TITLE_PREFIX marks a note title encrypted at rest. Titles without it are legacy plaintext
+	ENCRYPTED_TITLE_PREFIX = "enc:"
+	// BASE64_CIPHERTEXT_PREFIX marks a base64 encoded ciphertext. Ciphertexts without it are hex encoded (legacy)
+	BASE64_CIPHERTEXT_PREFIX = "b64:"
 )
 
 var (
@@ -99,6 +165,23 @@ var (
 	DEFAULT_LOG_LEVEL               = LOG_LEVEL_ERROR
 	DEFAULT_LOG_FILE_PATH           = filepath.Join("logs", "ecnotes.log")
 	DEFAULT_KEY_FILE_PATH           = "key_store.json"
+	DEFAULT_DURESS_KEY_FILE_PATH    = "key_store_alt.json"
+	DEFAULT_NOTE_PADDING            = NOTE_PADDING_POW2
+	DEFAULT_NOTE_PADDING_BLOCK_SIZE = 256
+	DEFAULT_NOTE_COMPRESSION        = NOTE_COMPRESSION_DEFLATE
+	// DEFAULT_TOMBSTONE_TTL_DAYS devices offline for longer than this may resurrect deleted notes
+	DEFAULT_TOMBSTONE_TTL_DAYS = 90
+	// DEFAULT_SYNC_INTERVAL_MINUTES how often the remote changes are pulled (0 only syncs at startup and on request)
+	DEFAULT_SYNC_INTERVAL_MINUTES = 5
+	// DEFAULT_S3_REGION the region signing the S3 requests (MinIO and most S3-compatible services accept it)
+	DEFAULT_S3_REGION = "us-east-1"
+	// DEFAULT_P2P_PATH the directory holding the device certificate and the paired devices
+	DEFAULT_P2P_PATH = "p2p"
+	// DEFAULT_P2P_LISTEN_ADDR the address the paired devices connect to
+	DEFAULT_P2P_LISTEN_ADDR = ":47731"
+	// DEFAULT_KEY_TRANSFER_LISTEN_ADDR the address a new device connects to, to receive the encryption keys
+	DEFAULT_KEY_TRANSFER_LISTEN_ADDR = ":47732"
+
 	SUPPORTED_ENCRYPTION_ALGORITHMS = []string{
 		ENCRYPTION_ALGORITHM_AES_256_CBC,
 		ENCRYPTION_ALGORITHM_RSA_OAEP,
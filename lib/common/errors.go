@@ -21,4 +21,44 @@ const (
 	ERR_CERT_NOT_FOUND                        = "certificate not found"
 	ERR_CANNOT_DECRYPT_MISSING_KEY            = "message cannot be decrypted. Missing key?"
 	ERR_UNKNOWN_KEY_ACTION                    = "unknown key action"
+	ERR_DURESS_PASSWORD_EMPTY                 = "duress password is empty"
+	ERR_DURESS_PASSWORD_REUSED                = "duress password must differ from the key password"
+	ERR_DURESS_REQUIRES_PASSWORD              = "duress password requires a password-protected key"
+	ERR_NOTE_TOO_LARGE                        = "note is too large for the sync provider"
+	ERR_NOTE_CHUNKS_CORRUPTED                 = "note content chunks are missing or corrupted"
+	ERR_NOTE_ID_MISSING                       = "note ID is missing"
+	ERR_SHEET_NOT_FOUND                       = "sheet not found in the spreadsheet"
+	ERR_UNKNOWN_SYNC_PROVIDER                 = "unknown sync provider"
+	ERR_INVALID_WEBDAV_PROVIDER_CONFIG        = "invalid WebDAV provider configuration"
+	ERR_REMOTE_NOTE_CHANGED                   = "note changed on the sync provider in the meantime"
+	ERR_MALFORMED_NOTE_FILE                   = "malformed note file"
+	ERR_INVALID_FOLDER_PROVIDER_CONFIG        = "invalid folder provider configuration"
+	ERR_NOTE_CONTENT_MISMATCH                 = "note content doesn't match its metadata"
+	ERR_INVALID_SERVER_PROVIDER_CONFIG        = "invalid ecnotes server provider configuration"
+	ERR_INVALID_VAULT_NAME                    = "invalid vault name"
+	ERR_INVALID_TOKENS_FILE                   = "invalid tokens file"
+	ERR_UNAUTHORIZED                          = "missing or invalid token"
+	ERR_REVISION_CONFLICT                     = "note revision conflict"
+	ERR_INVALID_SYNC_RECORD                   = "invalid sync record"
+	ERR_INVALID_S3_PROVIDER_CONFIG            = "invalid S3 provider configuration"
+	ERR_INVALID_DEVICE_IDENTITY               = "invalid device identity"
+	ERR_PEER_NOT_PAIRED                       = "device not paired"
+	ERR_PEER_FINGERPRINT_MISMATCH             = "the device certificate doesn't match the paired fingerprint"
+	ERR_PEER_ADDRESS_UNKNOWN                  = "address of the paired device unknown"
+	ERR_INVALID_PAIRING_CODE                  = "invalid pairing code"
+	ERR_PAIRING_NOT_STARTED                   = "no pairing in progress"
+	ERR_PAIRING_FAILED                        = "pairing failed: wrong code or device"
+	ERR_VAULT_LOCKED                          = "vault is locked"
+	ERR_PEER_SYNC_NOT_STARTED                 = "peer-to-peer sync not started yet"
+	ERR_KEY_TRANSFER_FAILED                   = "key transfer failed: wrong code or device"
+	ERR_SYNC_PROVIDER_NOT_ACTIVE              = "sync provider not active"
+	ERR_SYNC_PLAN_OUTDATED                    = "the notes changed since the sync was planned: review the new plan"
+	ERR_INVALID_GOOGLE_CREDENTIALS            = "invalid Google credentials file"
+	ERR_GOOGLE_NOT_CONNECTED                  = "Google account not connected"
+	ERR_GOOGLE_AUTHORIZATION_FAILED           = "Google authorization failed"
+	ERR_GOOGLE_RATE_LIMITED                   = "Google API rate limit exceeded: retrying later"
+	ERR_INVALID_COMMAND_ARGUMENTS             = "invalid command arguments"
+	ERR_EDITOR_NOT_SET                        = "no editor set: set $EDITOR (or $VISUAL)"
+	ERR_NO_SYNC_PROVIDERS                     = "no sync providers in the config"
+	ERR_NOTE_FILE_UNREADABLE                  = "note file can't be read yet"
 )
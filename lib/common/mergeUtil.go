@@ -0,0 +1,132 @@
+package common
+
+import "strings"
+
+// maxMergeCells bounds the size of the table used to match the lines of two texts
+const maxMergeCells = 1 << 22
+
+// MergeLines merges two texts derived from a common base, line by line (diff3).
+// Changes to different regions of the base are combined; when both texts change the same region
+// in different ways, it returns false
+func MergeLines(base, local, remote string) (string, bool) {
+	switch {
+	case local == remote || remote == base:
+		return local, true
+	case local == base:
+		return remote, true
+	}
+	baseLines, localLines, remoteLines := splitLines(base), splitLines(local), splitLines(remote)
+	localMatch, ok := matchLines(baseLines, localLines)
+	if !ok {
+		return "", false
+	}
+	remoteMatch, ok := matchLines(baseLines, remoteLines)
+	if !ok {
+		return "", false
+	}
+
+	var merged strings.Builder
+	b, l, r := 0, 0, 0
+	for {
+		// the next base line kept by both texts closes the region changed since the previous one
+		next := b
+		for next < len(baseLines) && (localMatch[next] < 0 || remoteMatch[next] < 0) {
+			next++
+		}
+		lEnd, rEnd := len(localLines), len(remoteLines)
+		if next < len(baseLines) {
+			lEnd, rEnd = localMatch[next], remoteMatch[next]
+		}
+		chunk, ok := mergeChunk(baseLines[b:next], localLines[l:lEnd], remoteLines[r:rEnd])
+		if !ok {
+			return "", false
+		}
+		merged.WriteString(chunk)
+		if next == len(baseLines) {
+			break
+		}
+		merged.WriteString(baseLines[next])
+		b, l, r = next+1, lEnd+1, rEnd+1
+	}
+	return merged.String(), true
+}
+
+// mergeChunk merges a region of the base changed by either or both texts
+func mergeChunk(base, local, remote []string) (string, bool) {
+	baseChunk, localChunk, remoteChunk := strings.Join(base, ""), strings.Join(local, ""), strings.Join(remote, "")
+	switch {
+	case localChunk == baseChunk:
+		return remoteChunk, true
+	case remoteChunk == baseChunk || localChunk == remoteChunk:
+		return localChunk, true
+	}
+	return "", false
+}
+
+// splitLines splits a text into lines, keeping their line endings
+func splitLines(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// matchLines maps each line of base to the line of other it is matched to in their longest common subsequence (-1 if none).
+// It returns false when the texts are too large to be compared
+func matchLines(base, other []string) ([]int, bool) {
+	match := make([]int, len(base))
+	for i := range match {
+		match[i] = -1
+	}
+	// the common prefix and suffix don't need the table
+	prefix := 0
+	for prefix < len(base) && prefix < len(other) && base[prefix] == other[prefix] {
+		match[prefix] = prefix
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(base)-prefix && suffix < len(other)-prefix &&
+		base[len(base)-1-suffix] == other[len(other)-1-suffix] {
+		match[len(base)-1-suffix] = len(other) - 1 - suffix
+		suffix++
+	}
+	a, b := base[prefix:len(base)-suffix], other[prefix:len(other)-suffix]
+	if len(a) == 0 || len(b) == 0 {
+		return match, true
+	}
+	if len(a)*len(b) > maxMergeCells {
+		return nil, false
+	}
+	// lcs[i*cols+j] is the length of the longest common subsequence of a[i:] and b[j:]
+	cols := len(b) + 1
+	lcs := make([]int32, (len(a)+1)*cols)
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i*cols+j] = lcs[(i+1)*cols+j+1] + 1
+			case lcs[(i+1)*cols+j] >= lcs[i*cols+j+1]:
+				lcs[i*cols+j] = lcs[(i+1)*cols+j]
+			default:
+				lcs[i*cols+j] = lcs[i*cols+j+1]
+			}
+		}
+	}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			match[prefix+i] = prefix + j
+			i++
+			j++
+		case lcs[(i+1)*cols+j] >= lcs[i*cols+j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return match, true
+}
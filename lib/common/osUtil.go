@@ -1,8 +1,13 @@
 package common
 
 import (
+	"crypto/rand"
+	"io"
+	"io/fs"
 	"log"
+	"os"
 	"os/user"
+	"path/filepath"
 )
 
 // GetUserHomeDir returns the user's home directory.
@@ -13,3 +18,50 @@ func GetUserHomeDir() string {
 	}
 	return user.HomeDir
 }
+
+// SecureDeleteFile overwrites the file with random bytes, flushes it to disk and removes it.
+// A missing file is not an error.
+// Note: on journaling or copy-on-write filesystems the old blocks may survive the overwrite,
+// so this is a best effort that only protects against casual recovery.
+func SecureDeleteFile(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err = io.CopyN(f, rand.Reader, info.Size()); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// SecureDeleteDir overwrites every file in dir (see SecureDeleteFile) and removes it.
+// A missing folder is not an error.
+func SecureDeleteDir(dir string) error {
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			return SecureDeleteFile(path)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
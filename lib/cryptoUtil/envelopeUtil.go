@@ -0,0 +1,117 @@
+package cryptoUtil
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// PaddingScheme how a plaintext is padded inside the envelope, to hide its length
+type PaddingScheme int
+
+const (
+	// PaddingNone no padding: the ciphertext length reveals the plaintext length
+	PaddingNone PaddingScheme = iota
+	// PaddingPow2 pads to the next power of two (min EnvelopeMinSize bytes)
+	PaddingPow2
+	// PaddingBlock pads to the next multiple of a fixed block size
+	PaddingBlock
+)
+
+const (
+	envelopeMagic   = 0x00
+	envelopeVersion = 0x01
+	// envelopeFlagDeflate the payload is deflate compressed
+	envelopeFlagDeflate = 0x01
+	// magic | version | flags | uint32 payload length
+	envelopeHeaderSize = 7
+	// EnvelopeMinSize the smallest envelope produced by PaddingPow2
+	EnvelopeMinSize = 64
+)
+
+// ErrInvalidEnvelope is returned when an envelope header is corrupted
+var ErrInvalidEnvelope = errors.New("invalid envelope")
+
+// EnvelopeOptions options used to seal a plaintext in an envelope
+type EnvelopeOptions struct {
+	Padding   PaddingScheme
+	BlockSize int
+	// Compress deflate the plaintext, when it actually saves space
+	Compress bool
+}
+
+// SealEnvelope wraps a plaintext in an envelope with a small header and the requested padding.
+// The envelope is meant to be encrypted, so that the header and padding are authenticated with the payload.
+// Compression is applied before padding, so the padded size only reveals the compressed size bucket.
+func SealEnvelope(plaintext []byte, opts EnvelopeOptions) []byte {
+	var flags byte
+	if opts.Compress {
+		if compressed, err := deflate(plaintext); err == nil && len(compressed) < len(plaintext) {
+			plaintext = compressed
+			flags |= envelopeFlagDeflate
+		}
+	}
+	size := envelopeHeaderSize + len(plaintext)
+	switch opts.Padding {
+	case PaddingPow2:
+		padded := EnvelopeMinSize
+		for padded < size {
+			padded <<= 1
+		}
+		size = padded
+	case PaddingBlock:
+		if opts.BlockSize > 0 && size%opts.BlockSize != 0 {
+			size += opts.BlockSize - size%opts.BlockSize
+		}
+	}
+	envelope := make([]byte, size)
+	envelope[0] = envelopeMagic
+	envelope[1] = envelopeVersion
+	envelope[2] = flags
+	binary.BigEndian.PutUint32(envelope[3:envelopeHeaderSize], uint32(len(plaintext)))
+	copy(envelope[envelopeHeaderSize:], plaintext)
+	return envelope
+}
+
+// OpenEnvelope returns the plaintext sealed in an envelope, without the padding.
+// Data without an envelope header (eg. notes encrypted by older versions) is returned as it is:
+// text never starts with a NUL byte
+func OpenEnvelope(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != envelopeMagic {
+		return data, nil
+	}
+	if len(data) < envelopeHeaderSize || data[1] != envelopeVersion {
+		return nil, ErrInvalidEnvelope
+	}
+	size := binary.BigEndian.Uint32(data[3:envelopeHeaderSize])
+	if uint64(size) > uint64(len(data)-envelopeHeaderSize) {
+		return nil, ErrInvalidEnvelope
+	}
+	payload := data[envelopeHeaderSize : envelopeHeaderSize+int(size)]
+	if data[2]&envelopeFlagDeflate != 0 {
+		plaintext, err := io.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+		if err != nil {
+			return nil, ErrInvalidEnvelope
+		}
+		return plaintext, nil
+	}
+	return payload, nil
+}
+
+// deflate compresses data with the best deflate compression
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,79 @@
+package cryptoUtil_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/iltoga/ecnotes-go/lib/cryptoUtil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelope_PaddingSchemes(t *testing.T) {
+	t.Parallel()
+
+	pin := []byte("1234")
+	seed := []byte(strings.Repeat("abandon ", 24))
+	tests := []struct {
+		name     string
+		opts     cryptoUtil.EnvelopeOptions
+		pinSize  int
+		seedSize int
+	}{
+		{"none", cryptoUtil.EnvelopeOptions{Padding: cryptoUtil.PaddingNone}, 7 + 4, 7 + 192},
+		{"pow2", cryptoUtil.EnvelopeOptions{Padding: cryptoUtil.PaddingPow2}, 64, 256},
+		{"block", cryptoUtil.EnvelopeOptions{Padding: cryptoUtil.PaddingBlock, BlockSize: 128}, 128, 256},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealedPin := cryptoUtil.SealEnvelope(pin, tt.opts)
+			sealedSeed := cryptoUtil.SealEnvelope(seed, tt.opts)
+			assert.Len(t, sealedPin, tt.pinSize)
+			assert.Len(t, sealedSeed, tt.seedSize)
+
+			opened, err := cryptoUtil.OpenEnvelope(sealedPin)
+			require.NoError(t, err)
+			assert.Equal(t, pin, opened)
+			opened, err = cryptoUtil.OpenEnvelope(sealedSeed)
+			require.NoError(t, err)
+			assert.Equal(t, seed, opened)
+		})
+	}
+}
+
+func TestEnvelope_LegacyAndCorrupted(t *testing.T) {
+	t.Parallel()
+
+	legacy := []byte("plain old note")
+	opened, err := cryptoUtil.OpenEnvelope(legacy)
+	require.NoError(t, err)
+	assert.Equal(t, legacy, opened)
+
+	sealed := cryptoUtil.SealEnvelope([]byte("note"), cryptoUtil.EnvelopeOptions{})
+	sealed[6] = 0xff // payload length past the end
+	_, err = cryptoUtil.OpenEnvelope(sealed)
+	assert.ErrorIs(t, err, cryptoUtil.ErrInvalidEnvelope)
+
+	_, err = cryptoUtil.OpenEnvelope([]byte{0x00, 0x7f})
+	assert.ErrorIs(t, err, cryptoUtil.ErrInvalidEnvelope)
+}
+
+func TestEnvelope_Compression(t *testing.T) {
+	t.Parallel()
+
+	opts := cryptoUtil.EnvelopeOptions{Compress: true}
+	long := []byte(strings.Repeat("the same line over and over\n", 100))
+	sealed := cryptoUtil.SealEnvelope(long, opts)
+	assert.Less(t, len(sealed), len(long)/4)
+	opened, err := cryptoUtil.OpenEnvelope(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, long, opened)
+
+	// compressing a short note would make it longer: it is stored as it is
+	short := []byte("1234")
+	sealed = cryptoUtil.SealEnvelope(short, opts)
+	assert.Len(t, sealed, 7+len(short))
+	opened, err = cryptoUtil.OpenEnvelope(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, short, opened)
+}
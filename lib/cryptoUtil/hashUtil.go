@@ -1,7 +1,9 @@
 package cryptoUtil
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"hash/fnv"
 	"strings"
@@ -21,6 +23,17 @@ func IndexFromString(text string) uint32 {
 	return FNV32a(text)
 }
 
+// BlindIndex returns a keyed (HMAC-SHA256) index of an arbitrary string.
+// Unlike IndexFromString it can't be reversed with a dictionary attack by whoever doesn't own the key.
+// The index key is derived from key, so the same key can also be used for encryption.
+func BlindIndex(key []byte, text string) uint32 {
+	indexKey := hmac.New(sha256.New, key)
+	indexKey.Write([]byte("ecnotes title index"))
+	mac := hmac.New(sha256.New, indexKey.Sum(nil))
+	mac.Write([]byte(text))
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
+
 // GenerateRecoveryPassword derives a strong key from a security answer using PBKDF2-HMAC-SHA256.
 // The salt is unique per key (randomly generated at setup time and persisted in config),
 // preventing cross-key rainbow table attacks.  600 000 iterations matches the OWASP 2023
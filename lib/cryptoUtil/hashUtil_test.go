@@ -5,6 +5,23 @@ import (
 	"testing"
 )
 
+func TestBlindIndex(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	a := BlindIndex(key, "Coinbase 2FA seed")
+	if a != BlindIndex(key, "Coinbase 2FA seed") {
+		t.Fatal("expected same index for same key and text")
+	}
+	if a == BlindIndex(key, "Coinbase 2FA seed ") {
+		t.Fatal("different texts must produce different indexes")
+	}
+	if a == BlindIndex([]byte("another key"), "Coinbase 2FA seed") {
+		t.Fatal("different keys must produce different indexes")
+	}
+	if a == IndexFromString("Coinbase 2FA seed") {
+		t.Fatal("blind index must not match the unkeyed index")
+	}
+}
+
 func TestGenerateRecoveryPassword_Deterministic(t *testing.T) {
 	salt := []byte("test-salt-abc")
 	a := GenerateRecoveryPassword([]string{"MyPet"}, salt)
@@ -0,0 +1,233 @@
+package cryptoUtil
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+
+	"filippo.io/bigmod"
+	"filippo.io/nistec"
+)
+
+// SPAKE2Role the side of a SPAKE2 exchange. The two sides must play different roles
+type SPAKE2Role int
+
+const (
+	// SPAKE2RoleA the side that sends its message first
+	SPAKE2RoleA SPAKE2Role = iota
+	// SPAKE2RoleB the side that answers
+	SPAKE2RoleB
+)
+
+// spake2KeySize the size of the shared key and of the confirmation keys (RFC 9382 with SHA-256)
+const spake2KeySize = 16
+
+var (
+	// the M and N points of the P-256 ciphersuite of RFC 9382 (section 6), whose discrete logarithm nobody knows
+	spake2M = spake2MustPoint("02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f")
+	spake2N = spake2MustPoint("03d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b49")
+	// the order n of P-256, and 2^256 mod n
+	spake2Order = spake2MustModulus("ffffffff00000000ffffffffffffffffbce6faada7179e84f3b9cac2fc632551")
+	spake2R     = spake2MustHex("00000000ffffffff00000000000000004319055258e8617b0c46353d039cdaaf")
+)
+
+// SPAKE2 one side of a SPAKE2 exchange (RFC 9382, P-256-SHA256-HKDF-HMAC): the two sides prove each other the
+// knowledge of the same (possibly weak) password, and derive a strong shared key from it. An eavesdropper learns
+// nothing about the password, and an active attacker can test a single guess per exchange
+type SPAKE2 struct {
+	role     SPAKE2Role
+	idA, idB []byte
+	w        []byte
+	x        []byte
+	message  []byte
+	context  string
+}
+
+// SPAKE2Session the result of a SPAKE2 exchange. The shared key can only be trusted once the confirmation of the other
+// side has been verified
+type SPAKE2Session struct {
+	key              []byte
+	confirmation     []byte
+	peerConfirmation []byte
+}
+
+// NewSPAKE2 starts a SPAKE2 exchange with password. context binds the exchange to the protocol it is used in: both
+// sides must use the same
+func NewSPAKE2(role SPAKE2Role, password []byte, context string) (*SPAKE2, error) {
+	// w = H(password) mod n. 512 bits are reduced, so that the bias is negligible
+	sum := sha512.Sum512(append([]byte("ecnotes SPAKE2 password\n"), password...))
+	w, err := spake2Reduce(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	if w.IsZero() == 1 {
+		return nil, errors.New("invalid SPAKE2 password")
+	}
+	// the ephemeral scalar is generated as a P-256 ECDH key, which is always in [1, n-1]
+	ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return newSPAKE2(role, nil, nil, w.Bytes(spake2Order), ephemeral.Bytes(), context)
+}
+
+// newSPAKE2 starts a SPAKE2 exchange with the identities of the two sides, the password scalar w and the ephemeral
+// scalar x (32 bytes, big endian)
+func newSPAKE2(role SPAKE2Role, idA, idB, w, x []byte, context string) (*SPAKE2, error) {
+	// A sends pA = x·G + w·M, B sends pB = y·G + w·N
+	blind := spake2M
+	if role == SPAKE2RoleB {
+		blind = spake2N
+	}
+	xG, err := nistec.NewP256Point().ScalarBaseMult(x)
+	if err != nil {
+		return nil, err
+	}
+	wBlind, err := nistec.NewP256Point().ScalarMult(blind, w)
+	if err != nil {
+		return nil, err
+	}
+	return &SPAKE2{
+		role:    role,
+		idA:     idA,
+		idB:     idB,
+		w:       w,
+		x:       x,
+		message: xG.Add(xG, wBlind).Bytes(),
+		context: context,
+	}, nil
+}
+
+// Message returns the message to send to the other side
+func (s *SPAKE2) Message() []byte {
+	return s.message
+}
+
+// Finish completes the exchange with the message of the other side
+func (s *SPAKE2) Finish(peerMessage []byte) (*SPAKE2Session, error) {
+	// only the uncompressed encoding is accepted, so that the transcript is the same on both sides
+	if len(peerMessage) != 65 {
+		return nil, errors.New("invalid SPAKE2 message")
+	}
+	peer, err := nistec.NewP256Point().SetBytes(peerMessage)
+	if err != nil {
+		return nil, errors.New("invalid SPAKE2 message")
+	}
+	// remove the blinding of the other side: K = x·(pB - w·N) for A, K = y·(pA - w·M) for B
+	blind := spake2N
+	if s.role == SPAKE2RoleB {
+		blind = spake2M
+	}
+	w, err := bigmod.NewNat().SetBytes(s.w, spake2Order)
+	if err != nil {
+		return nil, err
+	}
+	negW := bigmod.NewNat().ExpandFor(spake2Order).Sub(w, spake2Order)
+	unblind, err := nistec.NewP256Point().ScalarMult(blind, negW.Bytes(spake2Order))
+	if err != nil {
+		return nil, err
+	}
+	k, err := nistec.NewP256Point().ScalarMult(unblind.Add(peer, unblind), s.x)
+	if err != nil {
+		return nil, err
+	}
+	// the point at infinity is encoded as a single byte
+	keyPoint := k.Bytes()
+	if len(keyPoint) == 1 {
+		return nil, errors.New("invalid SPAKE2 message")
+	}
+
+	messageA, messageB := s.message, peerMessage
+	if s.role == SPAKE2RoleB {
+		messageA, messageB = peerMessage, s.message
+	}
+	transcript := spake2Transcript(s.idA, s.idB, messageA, messageB, keyPoint, s.w)
+	hash := sha256.Sum256(transcript)
+	keyEnc, keyAuth := hash[:spake2KeySize], hash[spake2KeySize:]
+	confirmationKeys, err := hkdf.Key(sha256.New, keyAuth, nil, "ConfirmationKeys"+s.context, 2*spake2KeySize)
+	if err != nil {
+		return nil, err
+	}
+	macA := hmac.New(sha256.New, confirmationKeys[:spake2KeySize])
+	macA.Write(transcript)
+	macB := hmac.New(sha256.New, confirmationKeys[spake2KeySize:])
+	macB.Write(transcript)
+	session := &SPAKE2Session{key: keyEnc, confirmation: macA.Sum(nil), peerConfirmation: macB.Sum(nil)}
+	if s.role == SPAKE2RoleB {
+		session.confirmation, session.peerConfirmation = session.peerConfirmation, session.confirmation
+	}
+	return session, nil
+}
+
+// Confirmation returns the confirmation to send to the other side, proving the knowledge of the password
+func (ss *SPAKE2Session) Confirmation() []byte {
+	return ss.confirmation
+}
+
+// VerifyConfirmation checks (in constant time) the confirmation of the other side: if it doesn't match, the other side
+// doesn't know the password and the shared key must be discarded
+func (ss *SPAKE2Session) VerifyConfirmation(confirmation []byte) bool {
+	return hmac.Equal(confirmation, ss.peerConfirmation)
+}
+
+// Key derives a key of the given size from the shared key, for the given purpose
+func (ss *SPAKE2Session) Key(purpose string, size int) ([]byte, error) {
+	return hkdf.Key(sha256.New, ss.key, nil, purpose, size)
+}
+
+// spake2Transcript returns the transcript of an exchange: each field prefixed by its length (8 bytes, little endian)
+func spake2Transcript(fields ...[]byte) []byte {
+	transcript := make([]byte, 0, 512)
+	for _, field := range fields {
+		transcript = binary.LittleEndian.AppendUint64(transcript, uint64(len(field)))
+		transcript = append(transcript, field...)
+	}
+	return transcript
+}
+
+// spake2Reduce reduces a 64 bytes hash modulo n, in constant time: hash = hi·2^256 + lo
+func spake2Reduce(hash []byte) (*bigmod.Nat, error) {
+	hi, err := bigmod.NewNat().SetOverflowingBytes(hash[:32], spake2Order)
+	if err != nil {
+		return nil, err
+	}
+	lo, err := bigmod.NewNat().SetOverflowingBytes(hash[32:], spake2Order)
+	if err != nil {
+		return nil, err
+	}
+	r, err := bigmod.NewNat().SetBytes(spake2R, spake2Order)
+	if err != nil {
+		return nil, err
+	}
+	return hi.Mul(r, spake2Order).Add(lo, spake2Order), nil
+}
+
+func spake2MustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func spake2MustPoint(s string) *nistec.P256Point {
+	p, err := nistec.NewP256Point().SetBytes(spake2MustHex(s))
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func spake2MustModulus(s string) *bigmod.Modulus {
+	m, err := bigmod.NewModulus(spake2MustHex(s))
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
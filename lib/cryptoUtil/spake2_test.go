@@ -0,0 +1,125 @@
+package cryptoUtil
+
+import (
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func spake2Exchange(t *testing.T, passwordA, passwordB string) (*SPAKE2Session, *SPAKE2Session) {
+	t.Helper()
+	a, err := NewSPAKE2(SPAKE2RoleA, []byte(passwordA), "test")
+	require.NoError(t, err)
+	b, err := NewSPAKE2(SPAKE2RoleB, []byte(passwordB), "test")
+	require.NoError(t, err)
+	sessionA, err := a.Finish(b.Message())
+	require.NoError(t, err)
+	sessionB, err := b.Finish(a.Message())
+	require.NoError(t, err)
+	return sessionA, sessionB
+}
+
+func TestSPAKE2_SamePassword(t *testing.T) {
+	sessionA, sessionB := spake2Exchange(t, "ABCD-1234", "ABCD-1234")
+	assert.True(t, sessionA.VerifyConfirmation(sessionB.Confirmation()))
+	assert.True(t, sessionB.VerifyConfirmation(sessionA.Confirmation()))
+	// the confirmations of the two sides differ, so that one can't be reflected as the other
+	assert.NotEqual(t, sessionA.Confirmation(), sessionB.Confirmation())
+
+	keyA, err := sessionA.Key("purpose", 32)
+	require.NoError(t, err)
+	keyB, err := sessionB.Key("purpose", 32)
+	require.NoError(t, err)
+	assert.Equal(t, keyA, keyB)
+	assert.Len(t, keyA, 32)
+	other, err := sessionA.Key("other purpose", 32)
+	require.NoError(t, err)
+	assert.NotEqual(t, keyA, other)
+
+	// each exchange derives a new key
+	sessionC, _ := spake2Exchange(t, "ABCD-1234", "ABCD-1234")
+	keyC, err := sessionC.Key("purpose", 32)
+	require.NoError(t, err)
+	assert.NotEqual(t, keyA, keyC)
+}
+
+func TestSPAKE2_WrongPassword(t *testing.T) {
+	sessionA, sessionB := spake2Exchange(t, "ABCD-1234", "ABCD-1235")
+	assert.False(t, sessionA.VerifyConfirmation(sessionB.Confirmation()))
+	assert.False(t, sessionB.VerifyConfirmation(sessionA.Confirmation()))
+}
+
+func TestSPAKE2_SameRole(t *testing.T) {
+	a, err := NewSPAKE2(SPAKE2RoleA, []byte("ABCD-1234"), "test")
+	require.NoError(t, err)
+	a2, err := NewSPAKE2(SPAKE2RoleA, []byte("ABCD-1234"), "test")
+	require.NoError(t, err)
+	sessionA, err := a.Finish(a2.Message())
+	require.NoError(t, err)
+	sessionA2, err := a2.Finish(a.Message())
+	require.NoError(t, err)
+	assert.False(t, sessionA.VerifyConfirmation(sessionA2.Confirmation()))
+}
+
+func TestSPAKE2_InvalidMessage(t *testing.T) {
+	a, err := NewSPAKE2(SPAKE2RoleA, []byte("ABCD-1234"), "test")
+	require.NoError(t, err)
+	_, err = a.Finish(nil)
+	assert.Error(t, err)
+	_, err = a.Finish(make([]byte, 65))
+	assert.Error(t, err)
+	// a message not on the curve
+	message := append([]byte(nil), a.Message()...)
+	message[64] ^= 1
+	_, err = a.Finish(message)
+	assert.Error(t, err)
+}
+
+func TestSPAKE2_Reduce(t *testing.T) {
+	hash := make([]byte, 64)
+	for i := range hash {
+		hash[i] = byte(0xff - i)
+	}
+	w, err := spake2Reduce(hash)
+	require.NoError(t, err)
+	order, _ := new(big.Int).SetString("ffffffff00000000ffffffffffffffffbce6faada7179e84f3b9cac2fc632551", 16)
+	expected := new(big.Int).Mod(new(big.Int).SetBytes(hash), order)
+	assert.Equal(t, expected.FillBytes(make([]byte, 32)), w.Bytes(spake2Order))
+}
+
+// the first P-256 test vector of RFC 9382 (appendix B): A = "server", B = "client", no AAD
+func TestSPAKE2_RFC9382(t *testing.T) {
+	unhex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		require.NoError(t, err)
+		return b
+	}
+	w := unhex("2ee57912099d31560b3a44b1184b9b4866e904c49d12ac5042c97dca461b1a5f")
+	x := unhex("43dd0fd7215bdcb482879fca3220c6a968e66d70b1356cac18bb26c84a78d729")
+	y := unhex("dcb60106f276b02606d8ef0a328c02e4b629f84f89786af5befb0bc75b6e66be")
+
+	a, err := newSPAKE2(SPAKE2RoleA, []byte("server"), []byte("client"), w, x, "")
+	require.NoError(t, err)
+	b, err := newSPAKE2(SPAKE2RoleB, []byte("server"), []byte("client"), w, y, "")
+	require.NoError(t, err)
+	assert.Equal(t, unhex("04a56fa807caaa53a4d28dbb9853b9815c61a411118a6fe516a8798434751470f9"+
+		"010153ac33d0d5f2047ffdb1a3e42c9b4e6be662766e1eeb4116988ede5f912c"), a.Message())
+	assert.Equal(t, unhex("0406557e482bd03097ad0cbaa5df82115460d951e3451962f1eaf4367a420676d0"+
+		"9857ccbc522686c83d1852abfa8ed6e4a1155cf8f1543ceca528afb591a1e0b7"), b.Message())
+
+	sessionA, err := a.Finish(b.Message())
+	require.NoError(t, err)
+	sessionB, err := b.Finish(a.Message())
+	require.NoError(t, err)
+	assert.Equal(t, unhex("0e0672dc86f8e45565d338b0540abe69"), sessionA.key)
+	assert.Equal(t, sessionA.key, sessionB.key)
+	confirmationA := unhex("58ad4aa88e0b60d5061eb6b5dd93e80d9c4f00d127c65b3b35b1b5281fee38f0")
+	confirmationB := unhex("d3e2e547f1ae04f2dbdbf0fc4b79f8ecff2dff314b5d32fe9fcef2fb26dc459b")
+	assert.Equal(t, confirmationA, sessionA.Confirmation())
+	assert.Equal(t, confirmationB, sessionB.Confirmation())
+	assert.True(t, sessionA.VerifyConfirmation(confirmationB))
+	assert.True(t, sessionB.VerifyConfirmation(confirmationA))
+}
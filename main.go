@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"os"
@@ -22,6 +24,32 @@ import (
 func main() {
 	var err error
 
+	// the subcommands run without the GUI
+	if len(os.Args) > 1 {
+		if command, ok := findCLICommand(os.Args[1]); ok {
+			if err = runCLI(command, os.Args[2:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
+
+	flag.Usage = func() {
+		printCLIUsage(flag.CommandLine.Output())
+	}
+	syncPlan := flag.Bool("sync-plan", false, "print what a sync with the configured providers would do, without changing anything")
+	syncPlanOut := flag.String("sync-plan-out", "", "with -sync-plan, save the plans to this file, to apply them later with -sync-apply")
+	syncApply := flag.String("sync-apply", "", "apply the sync plans saved in this file, unless the notes changed since")
+	flag.Parse()
+	if *syncPlan || *syncApply != "" {
+		if err = runSyncCommand(*syncPlanOut, *syncApply); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// setup config service and load config
 	configService, err := setupConfigService()
 	if err != nil {
@@ -35,6 +63,11 @@ func main() {
 		fmt.Println("Error loading certificates:", err)
 		os.Exit(1)
 	}
+	duressCertService, err := setupDuressCerts(configService)
+	if err != nil {
+		fmt.Println("Error loading certificates:", err)
+		os.Exit(1)
+	}
 
 	// initialize logger
 	logger, logFile, err := setupLogger(configService)
@@ -51,7 +84,7 @@ func main() {
 	obs := observer.NewObserver()
 
 	// setup db connection
-	noteService, err := setupDb(configService, cryptoService, obs)
+	noteService, noteRepository, err := setupDb(configService, cryptoService, obs, logger)
 	if err != nil {
 		logger.Fatal(err)
 	}
@@ -61,23 +94,31 @@ func main() {
 	logger.Info("Starting...")
 	setupCloseHandler(cancel, logger, logFile)
 
-	// initialize external providers
-	// We run this in a goroutine so it doesn't block the UI
-	go func() {
-		if err := setupProviders(appCtx, configService, noteService, obs, logger); err != nil {
-			logger.Errorf("Error setting up providers: %v", err)
-		}
-	}()
+	syncService := service.NewSyncService(noteService, configService, obs, logger)
+	peerService := setupPeerService(configService, noteService, syncService, obs, logger)
 
 	// wire key-lifecycle service (owns all crypto-key operations)
-	keyService := service.NewKeyService(certService, configService, cryptoService, noteService)
+	keyService := service.NewKeyService(certService, duressCertService, configService, cryptoService, noteService)
 
 	// create a new ui
 	appUI := ui.NewUI(app.NewWithID("ec-notes"), configService, noteService, certService, keyService, obs)
+	appUI.SetSyncService(syncService)
+	if peerService != nil {
+		appUI.SetPeerService(peerService)
+	}
 	mainWindow := ui.NewMainWindow(appUI, cryptoService)
 
 	// add listener to ui service to trigger note list widget update whenever the note title array changes
 	obs.AddListener(observer.EVENT_UPDATE_NOTE_TITLES, mainWindow.UpdateNoteListWidget())
+	// tell the user about the notes the sync couldn't merge
+	obs.AddListener(observer.EVENT_NOTE_CONFLICT, mainWindow.NoteConflictListener())
+	// show how many changes are waiting to be pushed to the sync providers
+	obs.AddListener(observer.EVENT_SYNC_PENDING, mainWindow.SyncPendingListener())
+	// show how the sync goes, when the notes were last synced and why the sync failed
+	obs.AddListener(observer.EVENT_SYNC_STARTED, mainWindow.SyncStatusListener(observer.EVENT_SYNC_STARTED))
+	obs.AddListener(observer.EVENT_SYNC_PROGRESS, mainWindow.SyncStatusListener(observer.EVENT_SYNC_PROGRESS))
+	obs.AddListener(observer.EVENT_SYNC_COMPLETED, mainWindow.SyncStatusListener(observer.EVENT_SYNC_COMPLETED))
+	obs.AddListener(observer.EVENT_SYNC_FAILED, mainWindow.SyncStatusListener(observer.EVENT_SYNC_FAILED))
 
 	// TODO: load some defaults from configuration?
 	emptyOptions := make(map[string]interface{})
@@ -97,8 +138,20 @@ func main() {
 	// TODO: for now selcting a note opens is in 'update mode' and we probably don't need this event.
 	//       we should probably just add a button to toggle view/edit mode in the note details window
 	obs.AddListener(observer.EVENT_VIEW_NOTE, noteDetailWindow.UpdateNoteDetailsWidget())
+	// refresh or close the open note when a sync changes or deletes it
+	obs.AddListener(observer.EVENT_REMOTE_UPDATE_NOTE, noteDetailWindow.RemoteUpdateNoteListener())
+	obs.AddListener(observer.EVENT_REMOTE_DELETE_NOTE, noteDetailWindow.RemoteDeleteNoteListener())
 
 	noteDetailWindow.CreateWindow("testNoteDetails", 600, 800, false, make(map[string]interface{}))
+
+	// initialize external providers, once the listeners are registered, so that the UI hears about their errors.
+	// We run this in a goroutine so it doesn't block the UI
+	go func() {
+		if err := setupProviders(appCtx, configService, syncService, peerService, noteRepository, keyService, obs, logger); err != nil {
+			logger.Errorf("Error setting up providers: %v", err)
+			obs.Notify(observer.EVENT_SYNC_FAILED, &model.SyncEvent{At: common.GetCurrentTimestamp(), Err: err})
+		}
+	}()
 	appUI.Run()
 }
 
@@ -131,20 +184,34 @@ func setupCerts(configService service.ConfigService) (service.CertService, error
 	return certService, nil
 }
 
+// setupDuressCerts setup the cert service holding the decoy key opened by the duress password
+func setupDuressCerts(configService service.ConfigService) (service.CertService, error) {
+	keyFilePath, err := configService.GetConfig(common.CONFIG_DURESS_KEY_FILE_PATH)
+	if err != nil {
+		return nil, err
+	}
+	return service.NewCertService(keyFilePath), nil
+}
+
 // setupDb setup the database
-func setupDb(configService service.ConfigService, crypto service.CryptoServiceFactory, obs observer.Observer) (service.NoteService, error) {
+func setupDb(
+	configService service.ConfigService,
+	crypto service.CryptoServiceFactory,
+	obs observer.Observer,
+	logger *log.Logger,
+) (service.NoteService, service.NoteServiceRepository, error) {
 	kvdbPath, err := configService.GetConfig(common.CONFIG_KVDB_PATH)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defaultBucket := "notes"
+	defaultBucket := common.DEFAULT_NOTES_BUCKET
 	// TODO: pass env var to reset db (last parameter)
 	noteRepository, err := service.NewNoteServiceRepository(kvdbPath, defaultBucket, false)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	noteService := service.NewNoteService(noteRepository, configService, obs, crypto)
-	return noteService, nil
+	noteService := service.NewNoteService(noteRepository, configService, obs, crypto, logger)
+	return noteService, noteRepository, nil
 }
 
 // setupLogger setup logrus logger with config
@@ -190,57 +257,99 @@ func setupLogger(configService service.ConfigService) (*log.Logger, *os.File, er
 	return logger, logFile, nil
 }
 
-// setupProviders setup external providers
-func setupProviders(ctx context.Context, configService service.ConfigService, noteService service.NoteService, obs observer.Observer, logger *log.Logger) error {
-	// if we have google_sheet_id in config, setup google sheets provider
-	var (
-		sheetID string
-		gp      *provider.GoogleProvider
-		err     error
-	)
-	sheetID, err = configService.GetConfig(common.CONFIG_GOOGLE_SHEET_ID)
-	if err != nil {
-		// no google sheet id in config, skip
-		logger.Info("No google_sheet_id in config.toml, skipping google provider setup")
-		logger.Info("Google provider not activated: notes will NOT be synced to google sheet")
+// setupPeerService sets up the sync with the paired devices on the local network, if enabled. It returns nil otherwise
+func setupPeerService(
+	configService service.ConfigService,
+	noteService service.NoteService,
+	syncService service.SyncService,
+	obs observer.Observer,
+	logger *log.Logger,
+) service.PeerService {
+	if !service.PeerSyncEnabled(configService) {
 		return nil
 	}
-	credFilePath, _ := configService.GetConfig(common.CONFIG_GOOGLE_CREDENTIALS_FILE_PATH)
-	gp, err = provider.NewGoogleProvider("notes", sheetID, credFilePath, logger, obs)
+	peerService, err := service.NewPeerService(configService, noteService, syncService, obs, logger)
 	if err != nil {
-		return err
+		logger.Errorf("Error setting up the peer-to-peer sync: %v", err)
+		return nil
 	}
-	logger.Info("Google provider activated: notes will be synced to google sheet")
-	
-	// Start the provider background worker
-	gp.InitWorker(ctx)
-
-	// add listeners to sync notes to google sheet when note is created/updated/deleted
-	obs.AddListener(observer.EVENT_CREATE_NOTE, gp.UpdateNoteNotifier())
-	obs.AddListener(observer.EVENT_UPDATE_NOTE, gp.UpdateNoteNotifier())
-	obs.AddListener(observer.EVENT_DELETE_NOTE, gp.DeleteNoteNotifier())
-
-	logger.Info("Syncing notes from google sheets...")
-	var dbNotes []model.Note
-	var downloadedNotes []model.Note
-	if dbNotes, err = noteService.GetNotes(); err == nil {
-		downloadedNotes, err = gp.SyncNotes(ctx, dbNotes)
-		if err != nil {
-			logger.Errorf("Error syncing notes from google sheets: %v", err)
-			return err
+	return peerService
+}
+
+// setupProviders activates the paired devices and, once the vault is unlocked, the sync providers listed in the
+// config, and starts syncing the notes with them
+func setupProviders(
+	ctx context.Context,
+	configService service.ConfigService,
+	syncService service.SyncService,
+	peerService service.PeerService,
+	noteRepository service.NoteServiceRepository,
+	secrets provider.SecretReader,
+	obs observer.Observer,
+	logger *log.Logger,
+) error {
+	names := service.SyncProviderNames(configService)
+	if len(names) == 0 && peerService == nil {
+		logger.Info("No sync_providers in config.toml, skipping sync providers setup")
+		logger.Info("Notes will NOT be synced")
+		return nil
+	}
+	errs := make([]error, 0)
+	// the paired devices are synced too, and the ones paired later are added as they pair
+	if peerService != nil {
+		if err := peerService.Start(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("p2p: %w", err))
 		}
-		// if downloaded notes are not empty, update db with downloaded notes
-		if len(downloadedNotes) > 0 {
-			err = noteService.SaveEncryptedNotes(downloadedNotes)
-			if err != nil {
-				return err
-			}
+	}
+	// the credentials of the providers are kept in the cert store: they can't be read until the vault is unlocked
+	if len(names) > 0 {
+		if err := syncService.WaitUnlocked(ctx); err != nil {
+			// the app was closed first
+			return errors.Join(errs...)
+		}
+		if err := activateProviders(configService, syncService, noteRepository, secrets, obs, logger); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// the providers set up correctly are synced anyway
+	if len(syncService.Providers()) > 0 || peerService != nil {
+		syncService.Start(ctx)
+	}
+	return errors.Join(errs...)
+}
+
+// activateProviders activates the sync providers listed in the config. The providers set up correctly are activated
+// even if others fail
+func activateProviders(
+	configService service.ConfigService,
+	syncService service.SyncService,
+	noteRepository service.NoteServiceRepository,
+	secrets provider.SecretReader,
+	obs observer.Observer,
+	logger *log.Logger,
+) error {
+	registry := provider.NewDefaultRegistry()
+	errs := make([]error, 0)
+	for _, name := range service.SyncProviderNames(configService) {
+		p, err := registry.Create(name, provider.ProviderDeps{
+			Config: configService,
+			// the changes to push are stored in the db until the provider gets them. The UI is told how many are pending
+			Outbox: provider.NewOutbox(noteRepository, name, obs),
+			Logger: logger,
+			// the providers get a detached observer: note titles must reach the UI only through
+			// NoteService, which knows whether the real or the decoy vault is open
+			Observer: &observer.ObserverImpl{},
+			// the OAuth tokens and the credentials are read from the cert store, once the vault is unlocked
+			Secrets: secrets,
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
 		}
-		logger.Info("Sync complete")
-	} else {
-		logger.Errorf("Error fetching local notes for sync: %v", err)
+		syncService.AddProvider(p)
+		logger.Infof("%s provider activated: notes will be synced with it", name)
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
 // setupCloseHandler creates a 'listener' on a new goroutine which will notify the
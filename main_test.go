@@ -98,6 +98,18 @@ func TestSetupCerts(t *testing.T) {
 	require.NotNil(t, certService)
 }
 
+func TestSetupDuressCerts(t *testing.T) {
+	_, err := setupDuressCerts(loadedConfig(map[string]string{}))
+	require.Error(t, err)
+
+	cfg := loadedConfig(map[string]string{
+		common.CONFIG_DURESS_KEY_FILE_PATH: filepath.Join(t.TempDir(), "key_store_alt.json"),
+	})
+	certService, err := setupDuressCerts(cfg)
+	require.NoError(t, err)
+	require.NotNil(t, certService)
+}
+
 func TestSetupDb(t *testing.T) {
 	dir := t.TempDir()
 	cfg := loadedConfig(map[string]string{
@@ -106,9 +118,24 @@ func TestSetupDb(t *testing.T) {
 	cryptoFactory, err := setupCryptoService()
 	require.NoError(t, err)
 
-	noteService, err := setupDb(cfg, cryptoFactory, &observer.ObserverImpl{})
+	noteService, noteRepository, err := setupDb(cfg, cryptoFactory, &observer.ObserverImpl{}, logrus.StandardLogger())
 	require.NoError(t, err)
 	require.NotNil(t, noteService)
+	require.NotNil(t, noteRepository)
+}
+
+// noteService returns the note service of a new vault, unlocked if unlocked is set
+func noteService(t *testing.T, unlocked bool) service.NoteService {
+	t.Helper()
+	cryptoService, err := setupCryptoService()
+	require.NoError(t, err)
+	if unlocked {
+		cryptoService.SetSrv(service.NewCryptoServiceFactory(common.ENCRYPTION_ALGORITHM_AES_256_CBC))
+		require.NoError(t, cryptoService.GetSrv().GetKeyManager().ImportKey([]byte("test-key-32-bytes-test-key-32-by"), "test"))
+	}
+	noteService, _, err := setupDb(loadedConfig(map[string]string{common.CONFIG_KVDB_PATH: t.TempDir()}), cryptoService, &observer.ObserverImpl{}, logrus.StandardLogger())
+	require.NoError(t, err)
+	return noteService
 }
 
 func TestSetupProviders_NoGoogleSheetID(t *testing.T) {
@@ -116,7 +143,8 @@ func TestSetupProviders_NoGoogleSheetID(t *testing.T) {
 	logger := logrus.New()
 	logger.SetOutput(io.Discard)
 
-	err := setupProviders(context.Background(), cfg, nil, &observer.ObserverImpl{}, logger)
+	syncService := service.NewSyncService(nil, cfg, &observer.ObserverImpl{}, logger)
+	err := setupProviders(context.Background(), cfg, syncService, nil, nil, nil, &observer.ObserverImpl{}, logger)
 	require.NoError(t, err)
 }
 
@@ -128,10 +156,28 @@ func TestSetupProviders_InvalidGoogleProviderConfig(t *testing.T) {
 	logger := logrus.New()
 	logger.SetOutput(io.Discard)
 
-	err := setupProviders(context.Background(), cfg, nil, &observer.ObserverImpl{}, logger)
+	syncService := service.NewSyncService(noteService(t, true), cfg, &observer.ObserverImpl{}, logger)
+	err := setupProviders(context.Background(), cfg, syncService, nil, nil, nil, &observer.ObserverImpl{}, logger)
 	require.Error(t, err)
 }
 
+func TestSetupProviders_LockedVault(t *testing.T) {
+	cfg := loadedConfig(map[string]string{
+		common.CONFIG_SYNC_PROVIDERS: "folder",
+		common.CONFIG_FOLDER_PATH:    t.TempDir(),
+	})
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	// the providers are activated only once the vault is unlocked: the app is closed first
+	syncService := service.NewSyncService(noteService(t, false), cfg, &observer.ObserverImpl{}, logger)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := setupProviders(ctx, cfg, syncService, nil, nil, nil, &observer.ObserverImpl{}, logger)
+	require.NoError(t, err)
+	assert.Empty(t, syncService.Providers())
+}
+
 func TestSetupConfigService(t *testing.T) {
 	homeDir := t.TempDir()
 	t.Setenv("HOME", homeDir)
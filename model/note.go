@@ -11,3 +11,41 @@ type Note struct {
 	CreatedAt  int64  `json:"created_at"`
 	UpdatedAt  int64  `json:"updated_at"`
 }
+
+// Tombstone records the deletion of a note, so that the sync can propagate it to other devices
+type Tombstone struct {
+	ID        int   `json:"id"`
+	DeletedAt int64 `json:"deleted_at"`
+}
+
+// NoteConflict a note changed both locally and on another device since the last sync, whose changes couldn't be merged.
+// The local version is kept and the remote one is saved as a new note (the conflicted copy)
+type NoteConflict struct {
+	Note Note `json:"note"`
+	Copy Note `json:"copy"`
+}
+
+// OutboxEntry a change waiting to be pushed to a sync provider: either a note or the tombstone of a deleted one.
+// Only the latest change of each note is kept
+type OutboxEntry struct {
+	ID        int        `json:"id"`
+	Note      *Note      `json:"note,omitempty"`
+	Tombstone *Tombstone `json:"tombstone,omitempty"`
+	// Seq when the change was queued (ns): tells apart the successive changes of a note
+	Seq           int64  `json:"seq"`
+	Attempts      int    `json:"attempts"`
+	NextAttemptAt int64  `json:"next_attempt_at"`
+	LastError     string `json:"last_error,omitempty"`
+}
+
+// SyncEvent the state of a sync, sent to the observer as it goes. Provider is empty for the events about the sync of
+// all the providers
+type SyncEvent struct {
+	Provider string
+	// Done the providers synced so far, out of Total
+	Done  int
+	Total int
+	// At when the event happened (ms)
+	At  int64
+	Err error
+}
@@ -0,0 +1,22 @@
+package model
+
+// SyncRecord a note as stored by the ecnotes sync server: an opaque blob (the encrypted note) and its version metadata.
+// Deleted notes keep their record, without blob, until their tombstone is purged
+type SyncRecord struct {
+	ID int `json:"id"`
+	// Revision the server revision of the vault the record was last written at. In a write, the revision the client
+	// last saw (0 for a new note): the write fails if the record changed since then
+	Revision  int64  `json:"revision"`
+	UpdatedAt int64  `json:"updated_at"`
+	DeletedAt int64  `json:"deleted_at,omitempty"`
+	Blob      []byte `json:"blob,omitempty"`
+}
+
+// SyncChanges a page of the changes feed of a vault: the records written after a cursor, oldest first
+type SyncChanges struct {
+	Records []SyncRecord `json:"records"`
+	// Cursor where the next page starts
+	Cursor int64 `json:"cursor"`
+	// More whether more records are waiting after Cursor
+	More bool `json:"more"`
+}
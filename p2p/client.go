@@ -0,0 +1,199 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+)
+
+// requestTimeout the timeout of a single request to a peer
+const requestTimeout = 30 * time.Second
+
+// Client talks to a paired device. Its certificate is pinned: a device presenting another one is refused
+type Client struct {
+	peer   Peer
+	client *http.Client
+}
+
+// NewClient creates a client of a paired device, reached at address
+func NewClient(identity *Identity, peer Peer, address string) (*Client, error) {
+	if address == "" {
+		return nil, fmt.Errorf("%s: %s", common.ERR_PEER_ADDRESS_UNKNOWN, peer.Name)
+	}
+	peer.Address = address
+	config := clientTLSConfig(identity)
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		fingerprint, err := peerFingerprint(rawCerts)
+		if err != nil {
+			return err
+		}
+		if fingerprint != peer.Fingerprint {
+			return errors.New(common.ERR_PEER_FINGERPRINT_MISMATCH)
+		}
+		return nil
+	}
+	return &Client{
+		peer: peer,
+		client: &http.Client{
+			Timeout:   requestTimeout,
+			Transport: &http.Transport{TLSClientConfig: config},
+		},
+	}, nil
+}
+
+// Peer returns the device the client talks to
+func (c *Client) Peer() Peer {
+	return c.peer
+}
+
+// Index returns the versions of the notes of the peer
+func (c *Client) Index(ctx context.Context) (*Index, error) {
+	var index Index
+	if err := do(ctx, c.client, c.peer.Address, http.MethodGet, "/v1/index", nil, &index); err != nil {
+		return nil, err
+	}
+	if index.Notes == nil {
+		index.Notes = make(map[int]int64)
+	}
+	if index.Tombstones == nil {
+		index.Tombstones = make(map[int]int64)
+	}
+	return &index, nil
+}
+
+// Fetch returns the (encrypted) notes of the peer with the given IDs
+func (c *Client) Fetch(ctx context.Context, ids []int) ([]model.Note, error) {
+	notes := make([]model.Note, 0, len(ids))
+	if len(ids) == 0 {
+		return notes, nil
+	}
+	if err := do(ctx, c.client, c.peer.Address, http.MethodPost, "/v1/notes/fetch", FetchRequest{IDs: ids}, &notes); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// Push writes notes and tombstones to the peer, and returns the IDs of the ones it holds another version of
+func (c *Client) Push(ctx context.Context, req PushRequest) ([]int, error) {
+	if len(req.Notes) == 0 && len(req.Tombstones) == 0 {
+		return nil, nil
+	}
+	var resp PushResponse
+	if err := do(ctx, c.client, c.peer.Address, http.MethodPost, "/v1/push", req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Rejected, nil
+}
+
+// Pair pairs with the device in pairing mode at address, proving the knowledge of the code it shows. name is the name
+// of this device, and port the one it listens on (0 if none). The devices exchange the fingerprints of their
+// certificates, bound to the code: the paired device is returned
+func Pair(ctx context.Context, identity *Identity, address string, code string, name string, port int) (*Peer, error) {
+	normalized, err := normalizePairingCode(code, pairingCodeLength)
+	if err != nil {
+		return nil, err
+	}
+	// the certificate of the device isn't known yet: the handshake is done first, to bind the proof to it
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: requestTimeout}, Config: clientTLSConfig(identity)}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	state := conn.(*tls.Conn).ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		conn.Close()
+		return nil, errors.New(common.ERR_PAIRING_FAILED)
+	}
+	serverFingerprint := Fingerprint(state.PeerCertificates[0])
+	var once sync.Once
+	transport := &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var c net.Conn
+			once.Do(func() { c = conn })
+			if c == nil {
+				return nil, net.ErrClosed
+			}
+			return c, nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Timeout: requestTimeout, Transport: transport}
+
+	req := PairRequest{
+		Name:  name,
+		Port:  port,
+		Proof: pairingProof(normalized, pairingClientLabel, serverFingerprint, identity.Fingerprint),
+	}
+	var resp PairResponse
+	if err := do(ctx, client, address, http.MethodPost, "/v1/pair", req, &resp); err != nil {
+		return nil, err
+	}
+	if !validPairingProof(resp.Proof, pairingProof(normalized, pairingServerLabel, serverFingerprint, identity.Fingerprint)) {
+		return nil, errors.New(common.ERR_PAIRING_FAILED)
+	}
+	return &Peer{
+		Name:        resp.Name,
+		Fingerprint: serverFingerprint,
+		Address:     address,
+		PairedAt:    common.GetCurrentTimestamp(),
+	}, nil
+}
+
+// clientTLSConfig returns the TLS configuration presenting the device certificate. The self-signed certificate of
+// the peer can't be verified against a CA: it is checked against its fingerprint instead
+func clientTLSConfig(identity *Identity) *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{identity.Certificate},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+	}
+}
+
+// do sends a JSON request to a peer, and decodes the response into result
+func do(ctx context.Context, client *http.Client, address string, method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "https://"+address+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err == nil && apiErr.Error != "" {
+			return fmt.Errorf("peer %s %s: %s", method, path, apiErr.Error)
+		}
+		return fmt.Errorf("peer %s %s: %s", method, path, resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
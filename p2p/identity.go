@@ -0,0 +1,129 @@
+// Package p2p implements the peer-to-peer sync between two ecnotes instances on the same network: device identities,
+// pairing, the mutually authenticated TLS sync protocol, the mDNS discovery of the paired devices and the
+// password-authenticated transfer of the encryption keys to a new device
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+)
+
+const (
+	// identityCertFile the certificate of the device, in the identity folder
+	identityCertFile = "device.crt"
+	// identityKeyFile the private key of the device, in the identity folder
+	identityKeyFile = "device.key"
+	// identityValidity how long the device certificate is valid. Peers pin it, so it is never renewed
+	identityValidity = 20 * 365 * 24 * time.Hour
+)
+
+// Identity the self-signed certificate a device presents to its peers. Peers know each other by the fingerprint
+// of their certificate, exchanged when pairing
+type Identity struct {
+	Certificate tls.Certificate
+	// Fingerprint the hex SHA-256 of the certificate
+	Fingerprint string
+}
+
+// LoadIdentity loads the identity of the device from dir, creating it on first use
+func LoadIdentity(dir string) (*Identity, error) {
+	certPath := filepath.Join(dir, identityCertFile)
+	keyPath := filepath.Join(dir, identityKeyFile)
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		if err := createIdentity(dir, certPath, keyPath); err != nil {
+			return nil, err
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", common.ERR_INVALID_DEVICE_IDENTITY, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", common.ERR_INVALID_DEVICE_IDENTITY, err)
+	}
+	cert.Leaf = leaf
+	return &Identity{Certificate: cert, Fingerprint: Fingerprint(leaf)}, nil
+}
+
+// createIdentity generates the key pair and the self-signed certificate of the device
+func createIdentity(dir string, certPath string, keyPath string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "ecnotes device"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(identityValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	// the key first: a certificate without its key would be an unusable identity
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// Fingerprint returns the hex SHA-256 of a certificate
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// FormatFingerprint formats a fingerprint in groups of 4 characters, to be compared by a person
+func FormatFingerprint(fingerprint string) string {
+	groups := make([]string, 0, len(fingerprint)/4+1)
+	for len(fingerprint) > 4 {
+		groups = append(groups, fingerprint[:4])
+		fingerprint = fingerprint[4:]
+	}
+	groups = append(groups, fingerprint)
+	return strings.ToUpper(strings.Join(groups, " "))
+}
+
+// peerFingerprint returns the fingerprint of the certificate a peer presented
+func peerFingerprint(rawCerts [][]byte) (string, error) {
+	if len(rawCerts) == 0 {
+		return "", errors.New(common.ERR_PEER_NOT_PAIRED)
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return "", err
+	}
+	return Fingerprint(cert), nil
+}
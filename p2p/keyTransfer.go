@@ -0,0 +1,192 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/lib/cryptoUtil"
+)
+
+const (
+	// transferTimeout the time a key transfer can take, once the new device is connected
+	transferTimeout = 30 * time.Second
+	// transferMaxSize the maximum size of the messages a side of a key transfer reads
+	transferMaxSize = 1 << 20
+	// transferContext binds the SPAKE2 exchange to the key transfer
+	transferContext = "ecnotes key transfer v1"
+	// transferPayloadKey the purpose of the key encrypting the payload
+	transferPayloadKey = "ecnotes key transfer payload"
+)
+
+// transferMessage a message of a key transfer. The new device (SPAKE2 role A) sends its SPAKE2 message, the old one
+// answers with its own and its confirmation, the new one sends its confirmation and finally the old one sends the
+// payload, encrypted with the shared key. The new device acknowledges it with an empty message
+type transferMessage struct {
+	Message      []byte `json:"message,omitempty"`
+	Confirmation []byte `json:"confirmation,omitempty"`
+	Payload      []byte `json:"payload,omitempty"`
+}
+
+// NewTransferCode returns a random one-time key transfer code, formatted as XXXX-XXXX
+func NewTransferCode() (string, error) {
+	return newPairingCode(transferCodeLength)
+}
+
+// SendKeys serves a single key transfer on listener: payload is sent (encrypted) to the first device proving the
+// knowledge of code, and the listener is closed after the first attempt, whatever its outcome. The code never travels
+// on the network, so that an eavesdropper learns nothing, and a device in the middle can only try a single guess.
+// payload is sent as is: whatever it holds (eg. the credentials of the sync providers, see KeyService.SendKeys) is
+// handed to the new device
+func SendKeys(ctx context.Context, listener net.Listener, code string, payload []byte) error {
+	normalized, err := normalizePairingCode(code, transferCodeLength)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = listener.Close() })
+	defer stop()
+	conn, err := listener.Accept()
+	_ = listener.Close()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	defer conn.Close()
+	stopConn := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stopConn()
+	_ = conn.SetDeadline(time.Now().Add(transferTimeout))
+
+	spake, err := cryptoUtil.NewSPAKE2(cryptoUtil.SPAKE2RoleB, []byte(normalized), transferContext)
+	if err != nil {
+		return err
+	}
+	decoder, encoder := transferDecoder(conn), json.NewEncoder(conn)
+	var msg transferMessage
+	if err = decoder.Decode(&msg); err != nil {
+		return err
+	}
+	session, err := spake.Finish(msg.Message)
+	if err != nil {
+		return errors.New(common.ERR_KEY_TRANSFER_FAILED)
+	}
+	if err = encoder.Encode(transferMessage{Message: spake.Message(), Confirmation: session.Confirmation()}); err != nil {
+		return err
+	}
+	msg = transferMessage{}
+	if err = decoder.Decode(&msg); err != nil {
+		return transferError(err)
+	}
+	if !session.VerifyConfirmation(msg.Confirmation) {
+		return errors.New(common.ERR_KEY_TRANSFER_FAILED)
+	}
+	key, err := session.Key(transferPayloadKey, 32)
+	if err != nil {
+		return err
+	}
+	encrypted, err := cryptoUtil.EncryptAES256(key, payload)
+	if err != nil {
+		return err
+	}
+	if err = encoder.Encode(transferMessage{Payload: encrypted}); err != nil {
+		return err
+	}
+	// the acknowledgement tells the payload was received and decrypted
+	return transferError(decoder.Decode(&msg))
+}
+
+// ReceiveKeys receives the payload of a key transfer served at address, proving the knowledge of code
+func ReceiveKeys(ctx context.Context, address string, code string) ([]byte, error) {
+	normalized, err := normalizePairingCode(code, transferCodeLength)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: requestTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	_ = conn.SetDeadline(time.Now().Add(transferTimeout))
+
+	spake, err := cryptoUtil.NewSPAKE2(cryptoUtil.SPAKE2RoleA, []byte(normalized), transferContext)
+	if err != nil {
+		return nil, err
+	}
+	decoder, encoder := transferDecoder(conn), json.NewEncoder(conn)
+	if err = encoder.Encode(transferMessage{Message: spake.Message()}); err != nil {
+		return nil, err
+	}
+	var msg transferMessage
+	if err = decoder.Decode(&msg); err != nil {
+		return nil, transferError(err)
+	}
+	session, err := spake.Finish(msg.Message)
+	if err != nil || !session.VerifyConfirmation(msg.Confirmation) {
+		return nil, errors.New(common.ERR_KEY_TRANSFER_FAILED)
+	}
+	if err = encoder.Encode(transferMessage{Confirmation: session.Confirmation()}); err != nil {
+		return nil, err
+	}
+	msg = transferMessage{}
+	if err = decoder.Decode(&msg); err != nil {
+		return nil, transferError(err)
+	}
+	key, err := session.Key(transferPayloadKey, 32)
+	if err != nil {
+		return nil, err
+	}
+	// DecryptAES256 expects at least a nonce
+	if len(msg.Payload) < 12 {
+		return nil, errors.New(common.ERR_KEY_TRANSFER_FAILED)
+	}
+	payload, err := cryptoUtil.DecryptAES256(key, msg.Payload)
+	if err != nil {
+		return nil, errors.New(common.ERR_KEY_TRANSFER_FAILED)
+	}
+	if err = encoder.Encode(transferMessage{}); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// LocalAddresses returns the addresses (with port) the devices on the local network can reach this one at
+func LocalAddresses(port int) []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var addresses []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.To4() == nil {
+			continue
+		}
+		addresses = append(addresses, net.JoinHostPort(ipNet.IP.String(), strconv.Itoa(port)))
+	}
+	return addresses
+}
+
+// transferDecoder decodes the messages of a key transfer read from r, up to transferMaxSize bytes
+func transferDecoder(r io.Reader) *json.Decoder {
+	return json.NewDecoder(io.LimitReader(r, transferMaxSize))
+}
+
+// transferError the error of a key transfer the other side closed: it does so when the code is wrong
+func transferError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.New(common.ERR_KEY_TRANSFER_FAILED)
+	}
+	return err
+}
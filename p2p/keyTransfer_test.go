@@ -0,0 +1,79 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveKeys serves a key transfer of payload on loopback, and returns its address and the result of the transfer
+func serveKeys(t *testing.T, code string, payload []byte) (string, <-chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	done := make(chan error, 1)
+	go func() {
+		done <- SendKeys(ctx, listener, code, payload)
+	}()
+	return listener.Addr().String(), done
+}
+
+func TestNewTransferCode(t *testing.T) {
+	code, err := NewTransferCode()
+	require.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{4}-[0-9A-HJKMNP-TV-Z]{4}$`), code)
+}
+
+func TestKeyTransfer(t *testing.T) {
+	code, err := NewTransferCode()
+	require.NoError(t, err)
+	address, done := serveKeys(t, code, []byte("the cert store"))
+
+	// the code is accepted as typed by a person
+	payload, err := ReceiveKeys(context.Background(), address, strings.ToLower(strings.ReplaceAll(code, "-", " ")))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("the cert store"), payload)
+	assert.NoError(t, <-done)
+
+	// the transfer is served once
+	_, err = ReceiveKeys(context.Background(), address, code)
+	assert.Error(t, err)
+}
+
+func TestKeyTransfer_WrongCode(t *testing.T) {
+	address, done := serveKeys(t, "ABCD-EFGH", []byte("the cert store"))
+
+	_, err := ReceiveKeys(context.Background(), address, "ABCD-EFGJ")
+	assert.EqualError(t, err, common.ERR_KEY_TRANSFER_FAILED)
+	assert.EqualError(t, <-done, common.ERR_KEY_TRANSFER_FAILED)
+
+	// a single guess per transfer: the right code is too late
+	_, err = ReceiveKeys(context.Background(), address, "ABCD-EFGH")
+	assert.Error(t, err)
+}
+
+func TestKeyTransfer_InvalidCode(t *testing.T) {
+	_, err := ReceiveKeys(context.Background(), "127.0.0.1:1", "ABCD")
+	assert.EqualError(t, err, common.ERR_INVALID_PAIRING_CODE)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	assert.EqualError(t, SendKeys(context.Background(), listener, "ABCD-EFGH-JKMN", nil), common.ERR_INVALID_PAIRING_CODE)
+}
+
+func TestKeyTransfer_Canceled(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, SendKeys(ctx, listener, "ABCD-EFGH", nil), context.Canceled)
+}
@@ -0,0 +1,226 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// mdnsService the mDNS service type of the ecnotes devices
+	mdnsService = "_ecnotes._tcp.local."
+	// mdnsTTL the TTL (s) of the announced records
+	mdnsTTL = 120
+	// mdnsFingerprintKey the TXT key holding the fingerprint of the device
+	mdnsFingerprintKey = "fp="
+	// mdnsUnicastResponse the top bit of the class of a question asks for a unicast response
+	mdnsUnicastResponse = 1 << 15
+	// mdnsMaxPacket the maximum size of an mDNS packet
+	mdnsMaxPacket = 9000
+)
+
+// mdnsGroup the mDNS multicast group
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Announce answers the mDNS queries for ecnotes devices with the fingerprint and the port of this one, until ctx is
+// done. The answers are sent to the device asking, whose address the peers are reached at
+func Announce(ctx context.Context, fingerprint string, port int, logger *log.Logger) error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, mdnsMaxPacket)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		answer, ok := mdnsAnswer(buf[:n], fingerprint, port)
+		if !ok {
+			continue
+		}
+		if _, err := conn.WriteToUDP(answer, src); err != nil {
+			logger.Debugf("Error answering the mDNS query of %s: %v", src, err)
+		}
+	}
+}
+
+// Discover looks for the ecnotes devices on the network with mDNS, and returns the address of the ones answering
+// within timeout, by fingerprint
+func Discover(ctx context.Context, timeout time.Duration) (map[string]string, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	query, err := mdnsQuery()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(query, mdnsGroup); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	found := make(map[string]string)
+	buf := make([]byte, mdnsMaxPacket)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return found, nil
+			}
+			return found, err
+		}
+		if fingerprint, port, ok := parseMDNSAnswer(buf[:n]); ok {
+			found[fingerprint] = net.JoinHostPort(src.IP.String(), strconv.Itoa(port))
+		}
+	}
+}
+
+// mdnsQuery returns a query for the ecnotes devices, asking for unicast answers
+func mdnsQuery() ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(mdnsService),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET | mdnsUnicastResponse,
+	}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// mdnsAnswer returns the answer to a query for the ecnotes devices: the instance of this device, with its port (SRV)
+// and fingerprint (TXT). Other queries are not answered
+func mdnsAnswer(query []byte, fingerprint string, port int) ([]byte, bool) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil, false
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, false
+	}
+	var asked *dnsmessage.Question
+	for i, q := range questions {
+		if q.Type == dnsmessage.TypePTR && q.Class&^mdnsUnicastResponse == dnsmessage.ClassINET &&
+			strings.EqualFold(q.Name.String(), mdnsService) {
+			asked = &questions[i]
+		}
+	}
+	if asked == nil {
+		return nil, false
+	}
+	instance, err := dnsmessage.NewName(mdnsInstance(fingerprint) + "." + mdnsService)
+	if err != nil {
+		return nil, false
+	}
+	target, err := dnsmessage.NewName(mdnsInstance(fingerprint) + ".local.")
+	if err != nil {
+		return nil, false
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true})
+	resource := func(name dnsmessage.Name) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: mdnsTTL}
+	}
+	err = errors.Join(
+		b.StartQuestions(),
+		// answers to queries from other ports than 5353 repeat the question (RFC 6762, 6.7)
+		b.Question(dnsmessage.Question{Name: asked.Name, Type: asked.Type, Class: dnsmessage.ClassINET}),
+		b.StartAnswers(),
+		b.PTRResource(resource(asked.Name), dnsmessage.PTRResource{PTR: instance}),
+		b.SRVResource(resource(instance), dnsmessage.SRVResource{Target: target, Port: uint16(port)}),
+		b.TXTResource(resource(instance), dnsmessage.TXTResource{TXT: []string{mdnsFingerprintKey + fingerprint}}),
+	)
+	if err != nil {
+		return nil, false
+	}
+	answer, err := b.Finish()
+	if err != nil {
+		return nil, false
+	}
+	return answer, true
+}
+
+// parseMDNSAnswer returns the fingerprint and port of the ecnotes device announced in an mDNS answer
+func parseMDNSAnswer(answer []byte) (string, int, bool) {
+	var p dnsmessage.Parser
+	header, err := p.Start(answer)
+	if err != nil || !header.Response {
+		return "", 0, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return "", 0, false
+	}
+	fingerprint, port := "", 0
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		if !strings.HasSuffix(strings.ToLower(h.Name.String()), mdnsService) {
+			if err := p.SkipAnswer(); err != nil {
+				break
+			}
+			continue
+		}
+		switch h.Type {
+		case dnsmessage.TypeSRV:
+			srv, err := p.SRVResource()
+			if err != nil {
+				return "", 0, false
+			}
+			port = int(srv.Port)
+		case dnsmessage.TypeTXT:
+			txt, err := p.TXTResource()
+			if err != nil {
+				return "", 0, false
+			}
+			for _, value := range txt.TXT {
+				if v, ok := strings.CutPrefix(value, mdnsFingerprintKey); ok {
+					fingerprint = v
+				}
+			}
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return "", 0, false
+			}
+		}
+	}
+	if fingerprint == "" || port == 0 {
+		return "", 0, false
+	}
+	return fingerprint, port, true
+}
+
+// mdnsInstance returns the mDNS instance name of a device
+func mdnsInstance(fingerprint string) string {
+	if len(fingerprint) > 16 {
+		fingerprint = fingerprint[:16]
+	}
+	return "ecnotes-" + fingerprint
+}
@@ -0,0 +1,47 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestMDNS_AnswerQuery(t *testing.T) {
+	fingerprint := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	query, err := mdnsQuery()
+	require.NoError(t, err)
+
+	answer, ok := mdnsAnswer(query, fingerprint, 47731)
+	require.True(t, ok)
+	gotFingerprint, port, ok := parseMDNSAnswer(answer)
+	require.True(t, ok)
+	assert.Equal(t, fingerprint, gotFingerprint)
+	assert.Equal(t, 47731, port)
+
+	// answers are not answered, nor parsed as queries
+	_, ok = mdnsAnswer(answer, fingerprint, 47731)
+	assert.False(t, ok)
+	_, _, ok = parseMDNSAnswer(query)
+	assert.False(t, ok)
+}
+
+func TestMDNS_OtherQueries(t *testing.T) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	require.NoError(t, b.StartQuestions())
+	require.NoError(t, b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("_printer._tcp.local."),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	}))
+	query, err := b.Finish()
+	require.NoError(t, err)
+	_, ok := mdnsAnswer(query, "fingerprint", 47731)
+	assert.False(t, ok)
+
+	_, ok = mdnsAnswer([]byte("garbage"), "fingerprint", 47731)
+	assert.False(t, ok)
+	_, _, ok = parseMDNSAnswer([]byte("garbage"))
+	assert.False(t, ok)
+}
@@ -0,0 +1,82 @@
+package p2p
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+)
+
+const (
+	// pairingCodeAlphabet Crockford's base32: no I, L, O or U, so that the code is easy to read out and type
+	pairingCodeAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	// pairingCodeLength the number of characters of a pairing code (60 bits)
+	pairingCodeLength = 12
+	// transferCodeLength the number of characters of a key transfer code (40 bits): it is only used through SPAKE2,
+	// so that it can only be guessed once per transfer
+	transferCodeLength = 8
+	// pairingGroupLength the code is shown in groups of this many characters
+	pairingGroupLength = 4
+
+	// the labels of the pairing proofs, so that the proof of a side can't be replayed as the one of the other
+	pairingClientLabel = "ecnotes-pair-client"
+	pairingServerLabel = "ecnotes-pair-server"
+)
+
+// newPairingCode returns a random code of length characters, formatted in groups as XXXX-XXXX-XXXX
+func newPairingCode(length int) (string, error) {
+	random := make([]byte, length)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for i, r := range random {
+		if i > 0 && i%pairingGroupLength == 0 {
+			b.WriteByte('-')
+		}
+		// 256 is a multiple of 32: no bias
+		b.WriteByte(pairingCodeAlphabet[int(r)%len(pairingCodeAlphabet)])
+	}
+	return b.String(), nil
+}
+
+// normalizePairingCode returns a code of length characters as typed by a person without separators, in upper case
+// and with the characters that look alike replaced
+func normalizePairingCode(code string, length int) (string, error) {
+	var b strings.Builder
+	for _, c := range strings.ToUpper(code) {
+		switch c {
+		case '-', ' ':
+			continue
+		case 'O':
+			c = '0'
+		case 'I', 'L':
+			c = '1'
+		}
+		if !strings.ContainsRune(pairingCodeAlphabet, c) {
+			return "", errors.New(common.ERR_INVALID_PAIRING_CODE)
+		}
+		b.WriteRune(c)
+	}
+	if b.Len() != length {
+		return "", errors.New(common.ERR_INVALID_PAIRING_CODE)
+	}
+	return b.String(), nil
+}
+
+// pairingProof proves the knowledge of the (normalized) pairing code, bound to the certificates of both sides of the
+// TLS connection: a device in the middle, presenting its own certificate to each side, can't forge it without the code
+func pairingProof(code string, label string, serverFingerprint string, clientFingerprint string) string {
+	mac := hmac.New(sha256.New, []byte(code))
+	mac.Write([]byte(label + "\n" + serverFingerprint + "\n" + clientFingerprint))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validPairingProof tells in constant time whether a pairing proof is the expected one
+func validPairingProof(proof string, expected string) bool {
+	return hmac.Equal([]byte(proof), []byte(expected))
+}
@@ -0,0 +1,95 @@
+package p2p
+
+import (
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPairingCode(t *testing.T) {
+	codes := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		code, err := newPairingCode(pairingCodeLength)
+		require.NoError(t, err)
+		assert.Regexp(t, regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{4}-[0-9A-HJKMNP-TV-Z]{4}-[0-9A-HJKMNP-TV-Z]{4}$`), code)
+		normalized, err := normalizePairingCode(code, pairingCodeLength)
+		require.NoError(t, err)
+		assert.Len(t, normalized, pairingCodeLength)
+		codes[code] = true
+	}
+	assert.Len(t, codes, 100)
+}
+
+func TestNormalizePairingCode(t *testing.T) {
+	normalized, err := normalizePairingCode("ab0c-d1ef 2ghj", pairingCodeLength)
+	require.NoError(t, err)
+	assert.Equal(t, "AB0CD1EF2GHJ", normalized)
+
+	// the characters that look alike are read as the ones of the alphabet
+	normalized, err = normalizePairingCode("oBiC-DlEF-2GHJ", pairingCodeLength)
+	require.NoError(t, err)
+	assert.Equal(t, "0B1CD1EF2GHJ", normalized)
+
+	for _, code := range []string{"", "AB0C-D1EF", "AB0C-D1EF-2GHJ-K", "AB0C-D1EF-2GHU"} {
+		_, err := normalizePairingCode(code, pairingCodeLength)
+		assert.Error(t, err, code)
+	}
+}
+
+func TestPairingProof(t *testing.T) {
+	proof := pairingProof("AB0CD1EF2GHJ", pairingClientLabel, "server", "client")
+	assert.True(t, validPairingProof(proof, pairingProof("AB0CD1EF2GHJ", pairingClientLabel, "server", "client")))
+	// the proof is bound to the code, the side and both certificates
+	assert.False(t, validPairingProof(proof, pairingProof("AB0CD1EF2GHK", pairingClientLabel, "server", "client")))
+	assert.False(t, validPairingProof(proof, pairingProof("AB0CD1EF2GHJ", pairingServerLabel, "server", "client")))
+	assert.False(t, validPairingProof(proof, pairingProof("AB0CD1EF2GHJ", pairingClientLabel, "mitm", "client")))
+	assert.False(t, validPairingProof(proof, pairingProof("AB0CD1EF2GHJ", pairingClientLabel, "server", "mitm")))
+}
+
+func TestLoadIdentity(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "p2p")
+	identity, err := LoadIdentity(dir)
+	require.NoError(t, err)
+	assert.Len(t, identity.Fingerprint, 64)
+	assert.Equal(t, Fingerprint(identity.Certificate.Leaf), identity.Fingerprint)
+
+	// the identity is created once
+	reloaded, err := LoadIdentity(dir)
+	require.NoError(t, err)
+	assert.Equal(t, identity.Fingerprint, reloaded.Fingerprint)
+
+	other, err := LoadIdentity(t.TempDir())
+	require.NoError(t, err)
+	assert.NotEqual(t, identity.Fingerprint, other.Fingerprint)
+}
+
+func TestFormatFingerprint(t *testing.T) {
+	assert.Equal(t, "ABCD 0123 45", FormatFingerprint("abcd012345"))
+	assert.Equal(t, "ABCD", FormatFingerprint("abcd"))
+}
+
+func TestPeers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	peers, err := LoadPeers(path)
+	require.NoError(t, err)
+	assert.Empty(t, peers.List())
+
+	require.NoError(t, peers.Add(Peer{Name: "laptop", Fingerprint: "fp2", PairedAt: 1}))
+	require.NoError(t, peers.Add(Peer{Name: "desktop", Fingerprint: "fp1", Address: "10.0.0.1:1", PairedAt: 2}))
+	require.NoError(t, peers.SetAddress("fp2", "10.0.0.2:2"))
+	assert.Error(t, peers.SetAddress("unknown", "10.0.0.3:3"))
+
+	reloaded, err := LoadPeers(path)
+	require.NoError(t, err)
+	assert.Equal(t, []Peer{
+		{Name: "desktop", Fingerprint: "fp1", Address: "10.0.0.1:1", PairedAt: 2},
+		{Name: "laptop", Fingerprint: "fp2", Address: "10.0.0.2:2", PairedAt: 1},
+	}, reloaded.List())
+
+	require.NoError(t, reloaded.Remove("fp1"))
+	assert.False(t, reloaded.Paired("fp1"))
+	assert.True(t, reloaded.Paired("fp2"))
+}
@@ -0,0 +1,134 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+)
+
+// Peer a paired device
+type Peer struct {
+	// Name the name the device gave itself when pairing
+	Name string `json:"name"`
+	// Fingerprint the fingerprint of the device certificate: the only certificate it is trusted with
+	Fingerprint string `json:"fingerprint"`
+	// Address the host:port the device was last reached at
+	Address  string `json:"address,omitempty"`
+	PairedAt int64  `json:"paired_at"`
+}
+
+// Peers the paired devices, saved to a JSON file
+type Peers struct {
+	path  string
+	peers map[string]Peer
+	mux   sync.RWMutex
+}
+
+// LoadPeers loads the paired devices from the file at path. A missing file holds no devices
+func LoadPeers(path string) (*Peers, error) {
+	p := &Peers{path: path, peers: make(map[string]Peer)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var peers []Peer
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, err
+	}
+	for _, peer := range peers {
+		p.peers[peer.Fingerprint] = peer
+	}
+	return p, nil
+}
+
+// List returns the paired devices, sorted by name
+func (p *Peers) List() []Peer {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	return p.list()
+}
+
+// Get returns the paired device with the given fingerprint
+func (p *Peers) Get(fingerprint string) (Peer, bool) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	peer, ok := p.peers[fingerprint]
+	return peer, ok
+}
+
+// Paired tells whether the device with the given fingerprint is paired
+func (p *Peers) Paired(fingerprint string) bool {
+	_, ok := p.Get(fingerprint)
+	return ok
+}
+
+// Add pairs a device, replacing the one with the same fingerprint
+func (p *Peers) Add(peer Peer) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.peers[peer.Fingerprint] = peer
+	return p.save()
+}
+
+// SetAddress records the address a paired device was reached at
+func (p *Peers) SetAddress(fingerprint string, address string) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	peer, ok := p.peers[fingerprint]
+	if !ok {
+		return errors.New(common.ERR_PEER_NOT_PAIRED)
+	}
+	if peer.Address == address {
+		return nil
+	}
+	peer.Address = address
+	p.peers[fingerprint] = peer
+	return p.save()
+}
+
+// Remove unpairs a device
+func (p *Peers) Remove(fingerprint string) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	delete(p.peers, fingerprint)
+	return p.save()
+}
+
+// list returns the paired devices sorted by name. The caller must hold mux
+func (p *Peers) list() []Peer {
+	peers := make([]Peer, 0, len(p.peers))
+	for _, peer := range p.peers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Name != peers[j].Name {
+			return peers[i].Name < peers[j].Name
+		}
+		return peers[i].Fingerprint < peers[j].Fingerprint
+	})
+	return peers
+}
+
+// save writes the paired devices to the file (through a temporary file, so that it is never left half written).
+// The caller must hold mux
+func (p *Peers) save() error {
+	data, err := json.MarshalIndent(p.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0700); err != nil {
+		return err
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
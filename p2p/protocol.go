@@ -0,0 +1,64 @@
+package p2p
+
+import "github.com/iltoga/ecnotes-go/model"
+
+// Index the versions of the notes of a vault: the UpdatedAt of each note and the DeletedAt of each tombstone (ms)
+type Index struct {
+	Notes      map[int]int64 `json:"notes"`
+	Tombstones map[int]int64 `json:"tombstones"`
+}
+
+// Version returns the version of a note in the index: its UpdatedAt, the DeletedAt of its tombstone, or 0
+func (i *Index) Version(id int) int64 {
+	if updatedAt, ok := i.Notes[id]; ok {
+		return updatedAt
+	}
+	return i.Tombstones[id]
+}
+
+// FetchRequest asks a peer for some of its (encrypted) notes
+type FetchRequest struct {
+	IDs []int `json:"ids"`
+}
+
+// PushRequest the notes and tombstones pushed to a peer
+type PushRequest struct {
+	Notes      []PushedNote      `json:"notes,omitempty"`
+	Tombstones []PushedTombstone `json:"tombstones,omitempty"`
+}
+
+// PushedNote an (encrypted) note pushed to a peer. It is only written if the peer still holds the version of the note
+// the pusher last saw in its index (Base, see Index.Version)
+type PushedNote struct {
+	Note model.Note `json:"note"`
+	Base int64      `json:"base"`
+}
+
+// PushedTombstone a tombstone pushed to a peer. It is only written if the peer still holds the version of the note
+// the pusher last saw in its index (Base, see Index.Version)
+type PushedTombstone struct {
+	Tombstone model.Tombstone `json:"tombstone"`
+	Base      int64           `json:"base"`
+}
+
+// PushResponse the IDs of the pushed notes and tombstones the peer didn't write, because it holds another version
+type PushResponse struct {
+	Rejected []int `json:"rejected,omitempty"`
+}
+
+// PairRequest asks a device in pairing mode to pair with the sender
+type PairRequest struct {
+	// Name the name of the sender
+	Name string `json:"name"`
+	// Port the port the sender listens on, if any
+	Port int `json:"port,omitempty"`
+	// Proof proves that the sender knows the pairing code (see pairingProof)
+	Proof string `json:"proof"`
+}
+
+// PairResponse the answer of a device that accepted to pair
+type PairResponse struct {
+	Name string `json:"name"`
+	// Proof proves that the device knows the pairing code too
+	Proof string `json:"proof"`
+}
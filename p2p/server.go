@@ -0,0 +1,364 @@
+package p2p
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxPushSize the maximum size of a push request
+	maxPushSize = 64 * 1024 * 1024
+	// maxRequestSize the maximum size of the other requests
+	maxRequestSize = 1024 * 1024
+	// shutdownTimeout how long the server waits for the requests in progress when it stops
+	shutdownTimeout = 5 * time.Second
+)
+
+// Vault the local vault the paired devices sync with. NoteService implements it
+type Vault interface {
+	// CanSync tells whether the vault is unlocked and can be synced
+	CanSync() bool
+	// IsLocalOnly tells whether the open vault is local-only: it is never synced, and looks empty to the peers
+	IsLocalOnly() bool
+	// GetStoredNotes returns the notes as stored (encrypted), without side effects
+	GetStoredNotes() ([]model.Note, error)
+	GetTombstones() ([]model.Tombstone, error)
+	// SaveEncryptedNotes saves the (encrypted) notes received from a peer
+	SaveEncryptedNotes(notes []model.Note) error
+	// ApplyRemoteDeletes deletes the notes deleted on a peer
+	ApplyRemoteDeletes(tombstones []model.Tombstone) error
+}
+
+// pairingSession a pairing in progress
+type pairingSession struct {
+	code    string
+	expires time.Time
+}
+
+// Server serves the local vault to the paired devices, over TLS: both sides present their device certificate,
+// and only the paired ones are let through. A device in pairing mode also accepts one pairing request
+type Server struct {
+	identity *Identity
+	peers    *Peers
+	vault    Vault
+	name     string
+	logger   *log.Logger
+	// onPaired is called when a device pairs
+	onPaired func(peer Peer)
+	// vaultMux one push at a time, so that the versions a push is checked against don't change underneath it
+	vaultMux   sync.Mutex
+	pairing    *pairingSession
+	pairingMux sync.Mutex
+}
+
+// NewServer creates a new server. name is the name of the device, shown to the devices pairing with it
+func NewServer(identity *Identity, peers *Peers, vault Vault, name string, logger *log.Logger) *Server {
+	return &Server{
+		identity: identity,
+		peers:    peers,
+		vault:    vault,
+		name:     name,
+		logger:   logger,
+	}
+}
+
+// OnPaired sets the function called when a device pairs
+func (s *Server) OnPaired(onPaired func(peer Peer)) {
+	s.onPaired = onPaired
+}
+
+// StartPairing puts the server in pairing mode for ttl, and returns the code the other device must enter.
+// The pairing ends with the first attempt, right or wrong, so that the code can't be guessed
+func (s *Server) StartPairing(ttl time.Duration) (string, error) {
+	code, err := newPairingCode(pairingCodeLength)
+	if err != nil {
+		return "", err
+	}
+	normalized, err := normalizePairingCode(code, pairingCodeLength)
+	if err != nil {
+		return "", err
+	}
+	s.pairingMux.Lock()
+	defer s.pairingMux.Unlock()
+	s.pairing = &pairingSession{code: normalized, expires: time.Now().Add(ttl)}
+	return code, nil
+}
+
+// TLSConfig returns the TLS configuration of the server. The client certificates are checked by the handler
+func (s *Server) TLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{s.identity.Certificate},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}
+}
+
+// Serve serves the peers on listener, until ctx is done
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	srv := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	err := srv.Serve(tls.NewListener(listener, s.TLSConfig()))
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Handler returns the HTTP handler of the peer API (the server must be behind TLS, see TLSConfig):
+//
+//	POST /v1/pair         pairs the client, when in pairing mode
+//	GET  /v1/index        the versions of the notes
+//	POST /v1/notes/fetch  the (encrypted) notes with the given IDs
+//	POST /v1/push         writes notes and tombstones, if still at the version the client last saw
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/pair", s.pair)
+	mux.HandleFunc("GET /v1/index", s.paired(s.getIndex))
+	mux.HandleFunc("POST /v1/notes/fetch", s.paired(s.fetchNotes))
+	mux.HandleFunc("POST /v1/push", s.paired(s.push))
+	return mux
+}
+
+// paired lets a request through only if the client presented the certificate of a paired device, and the vault
+// is unlocked
+func (s *Server) paired(next func(w http.ResponseWriter, r *http.Request, peer Peer)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fingerprint, err := clientFingerprint(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, common.ERR_PEER_NOT_PAIRED)
+			return
+		}
+		peer, ok := s.peers.Get(fingerprint)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, common.ERR_PEER_NOT_PAIRED)
+			return
+		}
+		if !s.vault.CanSync() && !s.vault.IsLocalOnly() {
+			writeError(w, http.StatusServiceUnavailable, common.ERR_VAULT_LOCKED)
+			return
+		}
+		next(w, r, peer)
+	}
+}
+
+// pair pairs the client, if the server is in pairing mode and the client proves it knows the pairing code.
+// The server proves it knows it too, so that the client can trust its certificate
+func (s *Server) pair(w http.ResponseWriter, r *http.Request) {
+	fingerprint, err := clientFingerprint(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, common.ERR_PEER_NOT_PAIRED)
+		return
+	}
+	var req PairRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// one attempt per pairing
+	s.pairingMux.Lock()
+	session := s.pairing
+	s.pairing = nil
+	s.pairingMux.Unlock()
+	if session == nil || time.Now().After(session.expires) {
+		writeError(w, http.StatusForbidden, common.ERR_PAIRING_NOT_STARTED)
+		return
+	}
+	if !validPairingProof(req.Proof, pairingProof(session.code, pairingClientLabel, s.identity.Fingerprint, fingerprint)) {
+		s.logger.Warnf("Pairing attempt with a wrong code from %s", r.RemoteAddr)
+		writeError(w, http.StatusForbidden, common.ERR_PAIRING_FAILED)
+		return
+	}
+	peer := Peer{Name: req.Name, Fingerprint: fingerprint, PairedAt: common.GetCurrentTimestamp()}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil && req.Port > 0 {
+		peer.Address = net.JoinHostPort(host, strconv.Itoa(req.Port))
+	}
+	if err := s.peers.Add(peer); err != nil {
+		s.internalError(w, "saving the paired device", err)
+		return
+	}
+	s.logger.Infof("Paired with %s (%s)", peer.Name, FormatFingerprint(peer.Fingerprint))
+	if s.onPaired != nil {
+		s.onPaired(peer)
+	}
+	writeJSON(w, http.StatusOK, PairResponse{
+		Name:  s.name,
+		Proof: pairingProof(session.code, pairingServerLabel, s.identity.Fingerprint, fingerprint),
+	})
+}
+
+// getIndex returns the versions of the notes
+func (s *Server) getIndex(w http.ResponseWriter, r *http.Request, peer Peer) {
+	s.vaultMux.Lock()
+	defer s.vaultMux.Unlock()
+	index, err := s.index()
+	if err != nil {
+		s.internalError(w, "reading the notes", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, index)
+}
+
+// fetchNotes returns the (encrypted) notes with the given IDs. The missing ones are skipped
+func (s *Server) fetchNotes(w http.ResponseWriter, r *http.Request, peer Peer) {
+	var req FetchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	notes, err := s.notes()
+	if err != nil {
+		s.internalError(w, "reading the notes", err)
+		return
+	}
+	wanted := make(map[int]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		wanted[id] = true
+	}
+	fetched := make([]model.Note, 0, len(req.IDs))
+	for _, note := range notes {
+		if wanted[note.ID] {
+			fetched = append(fetched, note)
+		}
+	}
+	writeJSON(w, http.StatusOK, fetched)
+}
+
+// push writes the notes and tombstones still at the version the client last saw, and returns the IDs of the others
+func (s *Server) push(w http.ResponseWriter, r *http.Request, peer Peer) {
+	var req PushRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPushSize)).Decode(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, http.StatusRequestEntityTooLarge, common.ERR_NOTE_TOO_LARGE)
+			return
+		}
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, pushed := range req.Notes {
+		if pushed.Note.ID == 0 || pushed.Note.UpdatedAt <= 0 {
+			writeError(w, http.StatusBadRequest, common.ERR_INVALID_SYNC_RECORD)
+			return
+		}
+	}
+	for _, pushed := range req.Tombstones {
+		if pushed.Tombstone.ID == 0 || pushed.Tombstone.DeletedAt <= 0 {
+			writeError(w, http.StatusBadRequest, common.ERR_INVALID_SYNC_RECORD)
+			return
+		}
+	}
+
+	s.vaultMux.Lock()
+	defer s.vaultMux.Unlock()
+	index, err := s.index()
+	if err != nil {
+		s.internalError(w, "reading the notes", err)
+		return
+	}
+	resp := PushResponse{}
+	notes := make([]model.Note, 0, len(req.Notes))
+	for _, pushed := range req.Notes {
+		if index.Version(pushed.Note.ID) != pushed.Base {
+			resp.Rejected = append(resp.Rejected, pushed.Note.ID)
+			continue
+		}
+		notes = append(notes, pushed.Note)
+	}
+	tombstones := make([]model.Tombstone, 0, len(req.Tombstones))
+	for _, pushed := range req.Tombstones {
+		if index.Version(pushed.Tombstone.ID) != pushed.Base {
+			resp.Rejected = append(resp.Rejected, pushed.Tombstone.ID)
+			continue
+		}
+		tombstones = append(tombstones, pushed.Tombstone)
+	}
+	if len(notes) > 0 {
+		if err := s.vault.SaveEncryptedNotes(notes); err != nil {
+			s.internalError(w, "saving the notes", err)
+			return
+		}
+	}
+	if err := s.vault.ApplyRemoteDeletes(tombstones); err != nil {
+		s.internalError(w, "deleting the notes", err)
+		return
+	}
+	s.logger.Infof("%s pushed %d notes and %d deletions", peer.Name, len(notes), len(tombstones))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// notes returns the notes of the vault. A local-only vault looks empty, as if nothing had been synced yet
+func (s *Server) notes() ([]model.Note, error) {
+	if s.vault.IsLocalOnly() {
+		return []model.Note{}, nil
+	}
+	return s.vault.GetStoredNotes()
+}
+
+// index returns the versions of the notes of the vault. The caller must hold vaultMux
+func (s *Server) index() (*Index, error) {
+	notes, err := s.notes()
+	if err != nil {
+		return nil, err
+	}
+	tombstones := []model.Tombstone{}
+	if !s.vault.IsLocalOnly() {
+		if tombstones, err = s.vault.GetTombstones(); err != nil {
+			return nil, err
+		}
+	}
+	index := &Index{Notes: make(map[int]int64, len(notes)), Tombstones: make(map[int]int64, len(tombstones))}
+	for _, note := range notes {
+		index.Notes[note.ID] = note.UpdatedAt
+	}
+	for _, tombstone := range tombstones {
+		if _, ok := index.Notes[tombstone.ID]; !ok {
+			index.Tombstones[tombstone.ID] = tombstone.DeletedAt
+		}
+	}
+	return index, nil
+}
+
+// internalError logs an unexpected error, without telling the client the details
+func (s *Server) internalError(w http.ResponseWriter, action string, err error) {
+	s.logger.Errorf("Error %s for a paired device: %v", action, err)
+	writeError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+}
+
+// clientFingerprint returns the fingerprint of the certificate the client presented
+func clientFingerprint(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", errors.New(common.ERR_PEER_NOT_PAIRED)
+	}
+	return Fingerprint(r.TLS.PeerCertificates[0]), nil
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
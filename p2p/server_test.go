@@ -0,0 +1,302 @@
+package p2p
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/model"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memVault an in-memory vault
+type memVault struct {
+	notes      map[int]model.Note
+	tombstones map[int]model.Tombstone
+	locked     bool
+	localOnly  bool
+	mux        sync.Mutex
+}
+
+func newMemVault(notes ...model.Note) *memVault {
+	v := &memVault{notes: make(map[int]model.Note), tombstones: make(map[int]model.Tombstone)}
+	for _, note := range notes {
+		v.notes[note.ID] = note
+	}
+	return v
+}
+
+func (v *memVault) CanSync() bool {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	return !v.locked && !v.localOnly
+}
+
+func (v *memVault) IsLocalOnly() bool {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	return v.localOnly
+}
+
+func (v *memVault) GetStoredNotes() ([]model.Note, error) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	notes := make([]model.Note, 0, len(v.notes))
+	for _, note := range v.notes {
+		notes = append(notes, note)
+	}
+	sort.Slice(notes, func(i, j int) bool { return notes[i].ID < notes[j].ID })
+	return notes, nil
+}
+
+func (v *memVault) GetTombstones() ([]model.Tombstone, error) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	tombstones := make([]model.Tombstone, 0, len(v.tombstones))
+	for _, tombstone := range v.tombstones {
+		tombstones = append(tombstones, tombstone)
+	}
+	return tombstones, nil
+}
+
+func (v *memVault) SaveEncryptedNotes(notes []model.Note) error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	for _, note := range notes {
+		v.notes[note.ID] = note
+		delete(v.tombstones, note.ID)
+	}
+	return nil
+}
+
+func (v *memVault) ApplyRemoteDeletes(tombstones []model.Tombstone) error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	for _, tombstone := range tombstones {
+		delete(v.notes, tombstone.ID)
+		v.tombstones[tombstone.ID] = tombstone
+	}
+	return nil
+}
+
+func (v *memVault) note(id int) (model.Note, bool) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	note, ok := v.notes[id]
+	return note, ok
+}
+
+// testDevice a device serving its vault on loopback
+type testDevice struct {
+	identity *Identity
+	peers    *Peers
+	vault    *memVault
+	server   *Server
+	address  string
+}
+
+func newTestDevice(t *testing.T, name string, vault *memVault) *testDevice {
+	t.Helper()
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	dir := t.TempDir()
+	identity, err := LoadIdentity(dir)
+	require.NoError(t, err)
+	peers, err := LoadPeers(filepath.Join(dir, "peers.json"))
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := NewServer(identity, peers, vault, name, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, server.Serve(ctx, listener))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return &testDevice{identity: identity, peers: peers, vault: vault, server: server, address: listener.Addr().String()}
+}
+
+func (d *testDevice) port() int {
+	_, port, _ := net.SplitHostPort(d.address)
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// pair pairs d with other, in pairing mode
+func (d *testDevice) pair(t *testing.T, other *testDevice) {
+	t.Helper()
+	code, err := other.server.StartPairing(time.Minute)
+	require.NoError(t, err)
+	peer, err := Pair(context.Background(), d.identity, other.address, code, "client", d.port())
+	require.NoError(t, err)
+	require.NoError(t, d.peers.Add(*peer))
+}
+
+func TestServer_Pair(t *testing.T) {
+	alice := newTestDevice(t, "alice", newMemVault())
+	bob := newTestDevice(t, "bob", newMemVault())
+	var paired []Peer
+	alice.server.OnPaired(func(peer Peer) { paired = append(paired, peer) })
+
+	code, err := alice.server.StartPairing(time.Minute)
+	require.NoError(t, err)
+	peer, err := Pair(context.Background(), bob.identity, alice.address, code, "bob", bob.port())
+	require.NoError(t, err)
+	// each device learns the fingerprint of the other
+	assert.Equal(t, "alice", peer.Name)
+	assert.Equal(t, alice.identity.Fingerprint, peer.Fingerprint)
+	assert.Equal(t, alice.address, peer.Address)
+	require.Len(t, paired, 1)
+	assert.Equal(t, "bob", paired[0].Name)
+	assert.Equal(t, bob.identity.Fingerprint, paired[0].Fingerprint)
+	assert.Equal(t, bob.address, paired[0].Address)
+	assert.True(t, alice.peers.Paired(bob.identity.Fingerprint))
+
+	// the code can be used once
+	_, err = Pair(context.Background(), bob.identity, alice.address, code, "bob", bob.port())
+	assert.Error(t, err)
+}
+
+func TestServer_PairWrongCode(t *testing.T) {
+	alice := newTestDevice(t, "alice", newMemVault())
+	bob := newTestDevice(t, "bob", newMemVault())
+
+	// no pairing in progress
+	_, err := Pair(context.Background(), bob.identity, alice.address, "AAAA-AAAA-AAAA", "bob", 0)
+	assert.Error(t, err)
+
+	code, err := alice.server.StartPairing(time.Minute)
+	require.NoError(t, err)
+	wrong := "AAAA-AAAA-AAAA"
+	if code == wrong {
+		wrong = "BBBB-BBBB-BBBB"
+	}
+	_, err = Pair(context.Background(), bob.identity, alice.address, wrong, "bob", 0)
+	assert.Error(t, err)
+	// a wrong attempt ends the pairing: the code can't be guessed
+	_, err = Pair(context.Background(), bob.identity, alice.address, code, "bob", 0)
+	assert.Error(t, err)
+	assert.Empty(t, alice.peers.List())
+
+	// an expired pairing is refused
+	code, err = alice.server.StartPairing(-time.Second)
+	require.NoError(t, err)
+	_, err = Pair(context.Background(), bob.identity, alice.address, code, "bob", 0)
+	assert.Error(t, err)
+	assert.Empty(t, alice.peers.List())
+}
+
+func TestServer_OnlyPairedDevices(t *testing.T) {
+	alice := newTestDevice(t, "alice", newMemVault(model.Note{ID: 1, Title: "enc:a", UpdatedAt: 10}))
+	bob := newTestDevice(t, "bob", newMemVault())
+	mallory := newTestDevice(t, "mallory", newMemVault())
+
+	// bob knows alice, but alice doesn't know bob
+	require.NoError(t, bob.peers.Add(Peer{Name: "alice", Fingerprint: alice.identity.Fingerprint}))
+	client, err := NewClient(bob.identity, Peer{Name: "alice", Fingerprint: alice.identity.Fingerprint}, alice.address)
+	require.NoError(t, err)
+	_, err = client.Index(context.Background())
+	assert.Error(t, err)
+
+	bob.pair(t, alice)
+	index, err := client.Index(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[int]int64{1: 10}, index.Notes)
+
+	// a device presenting another certificate than the paired one is refused
+	client, err = NewClient(bob.identity, Peer{Name: "alice", Fingerprint: alice.identity.Fingerprint}, mallory.address)
+	require.NoError(t, err)
+	_, err = client.Index(context.Background())
+	assert.Error(t, err)
+
+	// a locked vault isn't synced
+	alice.vault.locked = true
+	client, err = NewClient(bob.identity, Peer{Name: "alice", Fingerprint: alice.identity.Fingerprint}, alice.address)
+	require.NoError(t, err)
+	_, err = client.Index(context.Background())
+	assert.Error(t, err)
+
+	// a local-only vault looks empty, rather than locked
+	alice.vault.mux.Lock()
+	alice.vault.locked, alice.vault.localOnly = false, true
+	alice.vault.tombstones[2] = model.Tombstone{ID: 2, DeletedAt: 20}
+	alice.vault.mux.Unlock()
+	index, err = client.Index(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, index.Notes)
+	assert.Empty(t, index.Tombstones)
+	fetched, err := client.Fetch(context.Background(), []int{1})
+	require.NoError(t, err)
+	assert.Empty(t, fetched)
+
+	_, err = NewClient(bob.identity, Peer{Name: "alice", Fingerprint: alice.identity.Fingerprint}, "")
+	assert.Error(t, err)
+}
+
+func TestServer_FetchAndPush(t *testing.T) {
+	alice := newTestDevice(t, "alice", newMemVault(
+		model.Note{ID: 1, Title: "enc:a", Content: "b64:a", UpdatedAt: 10},
+		model.Note{ID: 2, Title: "enc:b", Content: "b64:b", UpdatedAt: 20},
+	))
+	alice.vault.tombstones[3] = model.Tombstone{ID: 3, DeletedAt: 30}
+	bob := newTestDevice(t, "bob", newMemVault())
+	bob.pair(t, alice)
+	peer, _ := bob.peers.Get(alice.identity.Fingerprint)
+	client, err := NewClient(bob.identity, peer, peer.Address)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	index, err := client.Index(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[int]int64{1: 10, 2: 20}, index.Notes)
+	assert.Equal(t, map[int]int64{3: 30}, index.Tombstones)
+
+	notes, err := client.Fetch(ctx, []int{2, 4})
+	require.NoError(t, err)
+	require.Len(t, notes, 1)
+	assert.Equal(t, "b64:b", notes[0].Content)
+
+	// the notes are written only if they are still at the version the client last saw
+	rejected, err := client.Push(ctx, PushRequest{
+		Notes: []PushedNote{
+			{Note: model.Note{ID: 1, Title: "enc:a", Content: "b64:a2", UpdatedAt: 11}, Base: 10},
+			{Note: model.Note{ID: 2, Title: "enc:b", Content: "b64:b2", UpdatedAt: 21}, Base: 15},
+			{Note: model.Note{ID: 3, Title: "enc:c", Content: "b64:c", UpdatedAt: 31}, Base: 30},
+			{Note: model.Note{ID: 4, Title: "enc:d", Content: "b64:d", UpdatedAt: 40}, Base: 0},
+		},
+		Tombstones: []PushedTombstone{
+			{Tombstone: model.Tombstone{ID: 5, DeletedAt: 50}, Base: 45},
+			{Tombstone: model.Tombstone{ID: 6, DeletedAt: 60}, Base: 0},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 5}, rejected)
+	note, _ := alice.vault.note(1)
+	assert.Equal(t, "b64:a2", note.Content)
+	note, _ = alice.vault.note(2)
+	assert.Equal(t, "b64:b", note.Content)
+	note, ok := alice.vault.note(3)
+	require.True(t, ok)
+	assert.Equal(t, "b64:c", note.Content)
+	_, ok = alice.vault.note(4)
+	assert.True(t, ok)
+	tombstones, err := alice.vault.GetTombstones()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []model.Tombstone{{ID: 6, DeletedAt: 60}}, tombstones)
+
+	// invalid records are refused
+	_, err = client.Push(ctx, PushRequest{Notes: []PushedNote{{Note: model.Note{ID: 5}}}})
+	assert.Error(t, err)
+}
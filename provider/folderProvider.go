@@ -0,0 +1,388 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	log "github.com/sirupsen/logrus"
+)
+
+// FolderProviderName the name of the local folder provider
+const FolderProviderName = "folder"
+
+const (
+	// folderBatchSize how many outbox changes the worker writes in a row
+	folderBatchSize = 50
+	// folderSidecarExt the extension of the metadata files
+	folderSidecarExt = ".json"
+	// folderContentExt the extension of the encrypted content files
+	folderContentExt = ".note"
+	// gitCommandTimeout the timeout of a single git command
+	gitCommandTimeout = time.Minute
+)
+
+// folderSidecar the metadata of a note, stored next to its encrypted content, or the tombstone of a deleted note
+type folderSidecar struct {
+	ID         int    `json:"id"`
+	Title      string `json:"title,omitempty"`
+	Hidden     bool   `json:"hidden,omitempty"`
+	Encrypted  bool   `json:"encrypted,omitempty"`
+	EncKeyName string `json:"enc_key_name,omitempty"`
+	CreatedAt  int64  `json:"created_at,omitempty"`
+	UpdatedAt  int64  `json:"updated_at"`
+	DeletedAt  int64  `json:"deleted_at,omitempty"`
+	// ContentSHA256 tells whether the content file has been replicated together with the sidecar
+	ContentSHA256 string `json:"content_sha256,omitempty"`
+}
+
+// FolderProvider syncs the notes through a local folder replicated by other tools (eg. Syncthing, Dropbox or a git remote).
+// Each note is stored as its encrypted content (<id>.note) and a JSON sidecar with its metadata (<id>.json).
+// The folder is scanned at every sync to pick up the files changed by other devices.
+// In git mode every change is committed to the repository holding the folder. Commit messages only carry note IDs
+type FolderProvider struct {
+	fileIndexProvider
+	dir     string
+	gitMode bool
+	// gitArgs the arguments prepended to every git command
+	gitArgs []string
+	// writeMux one write (or commit) at a time
+	writeMux sync.Mutex
+}
+
+// NewFolderProvider creates a new folder provider storing the notes in dir
+func NewFolderProvider(
+	dir string,
+	gitMode bool,
+	logger *log.Logger,
+	observer observer.Observer,
+	outbox *Outbox,
+) (*FolderProvider, error) {
+	fp := &FolderProvider{
+		dir:     dir,
+		gitMode: gitMode,
+	}
+	fp.fileIndexProvider = newFileIndexProvider(fp, folderBatchSize, logger, observer, outbox)
+	if err := fp.Init(); err != nil {
+		return nil, err
+	}
+	return fp, nil
+}
+
+// newFolderProviderFromConfig creates the folder provider configured in the config file
+func newFolderProviderFromConfig(deps ProviderDeps) (SyncNoteProvider, error) {
+	dir, err := deps.Config.GetConfig(common.CONFIG_FOLDER_PATH)
+	if err != nil {
+		return nil, errors.New(common.ERR_INVALID_FOLDER_PROVIDER_CONFIG)
+	}
+	gitMode := false
+	if val, err := deps.Config.GetConfig(common.CONFIG_FOLDER_GIT); err == nil {
+		gitMode = common.StringToBool(val)
+	}
+	return NewFolderProvider(dir, gitMode, deps.Logger, deps.Observer, deps.Outbox)
+}
+
+// Init creates the folder when missing and, in git mode, the repository holding it
+func (fp *FolderProvider) Init() error {
+	if strings.TrimSpace(fp.dir) == "" {
+		return errors.New(common.ERR_INVALID_FOLDER_PROVIDER_CONFIG)
+	}
+	dir, err := filepath.Abs(fp.dir)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	fp.dir = dir
+	if !fp.gitMode {
+		return nil
+	}
+	if _, err = exec.LookPath("git"); err != nil {
+		return fmt.Errorf("%s: %w", common.ERR_INVALID_FOLDER_PROVIDER_CONFIG, err)
+	}
+	fp.gitArgs = []string{"-C", dir}
+	if _, err = fp.git("rev-parse", "--is-inside-work-tree"); err != nil {
+		if _, err = fp.git("init", "-q"); err != nil {
+			return err
+		}
+	}
+	// commits need an author: fall back to a local one when git has none configured
+	if email, err := fp.git("config", "user.email"); err != nil || email == "" {
+		fp.gitArgs = append(fp.gitArgs, "-c", "user.name=EcNotes", "-c", "user.email=ecnotes@localhost")
+	}
+	return nil
+}
+
+// Name returns the provider type
+func (fp *FolderProvider) Name() string {
+	return FolderProviderName
+}
+
+// list returns the stamp of the sidecar of each note in the folder
+func (fp *FolderProvider) list(ctx context.Context) (map[int]string, error) {
+	dirEntries, err := os.ReadDir(fp.dir)
+	if err != nil {
+		return nil, err
+	}
+	stamps := make(map[int]string, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		id, ok := noteIDFromFileName(dirEntry.Name(), folderSidecarExt)
+		if !ok || dirEntry.IsDir() {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stamps[id] = fileStamp(info)
+	}
+	return stamps, nil
+}
+
+// read reads the sidecar of a note and, unless the note has been deleted, its content, with the stamp of the sidecar.
+// Notes whose files haven't been fully replicated yet can't be read (errUnreadableFile)
+func (fp *FolderProvider) read(ctx context.Context, id int) (*remoteNoteFile, string, error) {
+	info, err := os.Stat(fp.sidecarPath(id))
+	if os.IsNotExist(err) {
+		return nil, "", errors.New(common.ERR_NOTE_NOT_FOUND)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	sidecar, err := fp.readSidecar(id)
+	if os.IsNotExist(err) {
+		return nil, "", errors.New(common.ERR_NOTE_NOT_FOUND)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errUnreadableFile, err)
+	}
+	file := &remoteNoteFile{ID: id, UpdatedAt: sidecar.UpdatedAt, DeletedAt: sidecar.DeletedAt}
+	if sidecar.DeletedAt > 0 {
+		return file, fileStamp(info), nil
+	}
+	content, err := os.ReadFile(fp.contentPath(id))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errUnreadableFile, err)
+	}
+	if contentHash(string(content)) != sidecar.ContentSHA256 {
+		return nil, "", fmt.Errorf("%w: %s: %d%s", errUnreadableFile, common.ERR_NOTE_CONTENT_MISMATCH, id, folderContentExt)
+	}
+	file.Note = sidecar.note(string(content))
+	return file, fileStamp(info), nil
+}
+
+// write writes the files of a note, if its sidecar still has the given stamp (or doesn't exist yet, when empty).
+// The content is written before the sidecar, so that a scan never pairs a sidecar with an older content
+func (fp *FolderProvider) write(ctx context.Context, file remoteNoteFile, stamp string) (string, error) {
+	fp.writeMux.Lock()
+	defer fp.writeMux.Unlock()
+	sidecar := fileSidecar(file)
+	info, err := os.Stat(fp.sidecarPath(file.ID))
+	switch {
+	case err == nil && fileStamp(info) != stamp, os.IsNotExist(err) && stamp != "":
+		return "", errVersionConflict
+	case err == nil:
+		// unchanged notes aren't written again
+		if current, err := fp.readSidecar(file.ID); err == nil && *current == sidecar {
+			return stamp, nil
+		}
+	case !os.IsNotExist(err):
+		return "", err
+	}
+	if sidecar.DeletedAt == 0 {
+		if err := writeFileAtomic(fp.contentPath(file.ID), []byte(file.Note.Content)); err != nil {
+			return "", err
+		}
+	}
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err = writeFileAtomic(fp.sidecarPath(file.ID), data); err != nil {
+		return "", err
+	}
+	if sidecar.DeletedAt > 0 {
+		if err = os.Remove(fp.contentPath(file.ID)); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	if info, err = os.Stat(fp.sidecarPath(file.ID)); err != nil {
+		return "", err
+	}
+	return fileStamp(info), nil
+}
+
+// purge deletes the sidecars of the given tombstones, unless the notes have been resurrected in the meantime
+func (fp *FolderProvider) purge(ctx context.Context, before int64, tombstones map[int]string) ([]int, error) {
+	fp.writeMux.Lock()
+	defer fp.writeMux.Unlock()
+	purged := make([]int, 0, len(tombstones))
+	for id := range tombstones {
+		current, err := fp.readSidecar(id)
+		if err != nil || current.DeletedAt == 0 || current.DeletedAt >= before {
+			continue
+		}
+		if err := os.Remove(fp.sidecarPath(id)); err != nil && !os.IsNotExist(err) {
+			return purged, err
+		}
+		purged = append(purged, id)
+	}
+	if len(purged) > 0 {
+		fp.gitCommit(fmt.Sprintf("Purge %d deleted notes", len(purged)))
+	}
+	return purged, nil
+}
+
+// commit commits the written files in git mode
+func (fp *FolderProvider) commit(ctx context.Context, written []remoteNoteFile) error {
+	fp.writeMux.Lock()
+	defer fp.writeMux.Unlock()
+	switch {
+	case len(written) == 1 && written[0].DeletedAt > 0:
+		fp.gitCommit(fmt.Sprintf("Delete note %d", written[0].ID))
+	case len(written) == 1:
+		fp.gitCommit(fmt.Sprintf("Update note %d", written[0].ID))
+	case len(written) > 1:
+		fp.gitCommit(fmt.Sprintf("Update %d notes", len(written)))
+	}
+	return nil
+}
+
+// readSidecar reads the sidecar of a note
+func (fp *FolderProvider) readSidecar(id int) (*folderSidecar, error) {
+	data, err := os.ReadFile(fp.sidecarPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var sidecar folderSidecar
+	if err := json.Unmarshal(data, &sidecar); err != nil || sidecar.ID != id {
+		return nil, fmt.Errorf("%s: %d%s", common.ERR_MALFORMED_NOTE_FILE, id, folderSidecarExt)
+	}
+	return &sidecar, nil
+}
+
+// gitCommit commits the changes to the folder in git mode. A failed commit is logged: its changes go with the next one.
+// The caller must hold writeMux
+func (fp *FolderProvider) gitCommit(message string) {
+	if !fp.gitMode {
+		return
+	}
+	if _, err := fp.git("add", "-A", "--", "."); err != nil {
+		fp.logger.Errorf("Error staging the notes in %s: %v", fp.dir, err)
+		return
+	}
+	// nothing staged: nothing to commit
+	if _, err := fp.git("diff", "--cached", "--quiet", "--", "."); err == nil {
+		return
+	}
+	if _, err := fp.git("commit", "-q", "-m", message, "--", "."); err != nil {
+		fp.logger.Errorf("Error committing the notes in %s: %v", fp.dir, err)
+	}
+}
+
+// git runs a git command in the folder, and returns its trimmed output
+func (fp *FolderProvider) git(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitCommandTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "git", append(append([]string{}, fp.gitArgs...), args...)...).CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	if err != nil {
+		return output, fmt.Errorf("git %s: %w: %s", args[0], err, output)
+	}
+	return output, nil
+}
+
+// sidecarPath returns the path of the sidecar of a note
+func (fp *FolderProvider) sidecarPath(id int) string {
+	return filepath.Join(fp.dir, strconv.Itoa(id)+folderSidecarExt)
+}
+
+// contentPath returns the path of the encrypted content of a note
+func (fp *FolderProvider) contentPath(id int) string {
+	return filepath.Join(fp.dir, strconv.Itoa(id)+folderContentExt)
+}
+
+// note returns the note described by the sidecar
+func (sidecar folderSidecar) note(content string) *model.Note {
+	return &model.Note{
+		ID:         sidecar.ID,
+		Title:      sidecar.Title,
+		Content:    content,
+		Hidden:     sidecar.Hidden,
+		Encrypted:  sidecar.Encrypted,
+		EncKeyName: sidecar.EncKeyName,
+		CreatedAt:  sidecar.CreatedAt,
+		UpdatedAt:  sidecar.UpdatedAt,
+	}
+}
+
+// noteSidecar returns the sidecar of a note
+func noteSidecar(note *model.Note) folderSidecar {
+	return folderSidecar{
+		ID:            note.ID,
+		Title:         note.Title,
+		Hidden:        note.Hidden,
+		Encrypted:     note.Encrypted,
+		EncKeyName:    note.EncKeyName,
+		CreatedAt:     note.CreatedAt,
+		UpdatedAt:     note.UpdatedAt,
+		ContentSHA256: contentHash(note.Content),
+	}
+}
+
+// fileSidecar returns the sidecar of a note file: the one of the note, or the tombstone replacing it
+func fileSidecar(file remoteNoteFile) folderSidecar {
+	if file.DeletedAt > 0 || file.Note == nil {
+		return folderSidecar{ID: file.ID, UpdatedAt: file.UpdatedAt, DeletedAt: file.DeletedAt}
+	}
+	return noteSidecar(file.Note)
+}
+
+// contentHash returns the hex SHA-256 of the (encrypted) content of a note
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// fileStamp tells whether a file changed since it was last read
+func fileStamp(info os.FileInfo) string {
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+}
+
+// writeFileAtomic writes a file through a temporary file in the same folder, so that it is never seen half-written
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,100 @@
+package provider
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/iltoga/ecnotes-go/service/observer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFolderProvider(t *testing.T, dir string, gitMode bool, outbox *Outbox) *FolderProvider {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	fp, err := NewFolderProvider(dir, gitMode, logger, &observer.ObserverImpl{}, outbox)
+	require.NoError(t, err)
+	return fp
+}
+
+func TestNewFolderProvider_InvalidConfig(t *testing.T) {
+	_, err := NewFolderProvider(" ", false, logrus.New(), &observer.ObserverImpl{}, nil)
+	assert.Error(t, err)
+
+	// the folder is created when missing
+	dir := filepath.Join(t.TempDir(), "notes", "ecnotes")
+	newTestFolderProvider(t, dir, false, nil)
+	assert.DirExists(t, dir)
+}
+
+func TestFolderProvider_PartialReplication(t *testing.T) {
+	dir := t.TempDir()
+	fp := newTestFolderProvider(t, dir, false, nil)
+	require.NoError(t, fp.PutNote(testNote(1, "b64:one", 100)))
+
+	// the sidecar of a new version arrived before its content: the previous version is kept until the content arrives
+	device := newTestFolderProvider(t, t.TempDir(), false, nil)
+	require.NoError(t, device.PutNote(testNote(1, "b64:one v2", 200)))
+	sidecar, err := os.ReadFile(filepath.Join(device.dir, "1.json"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "1.json"), sidecar, 0o600))
+	// and a note whose content hasn't arrived at all is skipped
+	require.NoError(t, device.PutNote(testNote(2, "b64:two", 200)))
+	sidecar, err = os.ReadFile(filepath.Join(device.dir, "2.json"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "2.json"), sidecar, 0o600))
+	// unrelated files are ignored
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "1.sync-conflict-20260101.json"), []byte("{}"), 0o600))
+
+	notes, err := fp.GetNotes()
+	require.NoError(t, err)
+	require.Len(t, notes, 1)
+	assert.Equal(t, "b64:one", notes[0].Content)
+
+	// the content arrives: the new version is picked up
+	content, err := os.ReadFile(filepath.Join(device.dir, "1.note"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "1.note"), content, 0o600))
+	notes, err = fp.GetNotes(1)
+	require.NoError(t, err)
+	require.Len(t, notes, 1)
+	assert.Equal(t, "b64:one v2", notes[0].Content)
+}
+
+func TestFolderProvider_GitMode(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := filepath.Join(t.TempDir(), "vault")
+	outbox := NewOutbox(newMemoryOutboxStore(), FolderProviderName, nil)
+	fp := newTestFolderProvider(t, dir, true, outbox)
+	assert.DirExists(t, filepath.Join(dir, ".git"))
+
+	require.NoError(t, fp.PutNote(testNote(1, "b64:one", 100)))
+	// unchanged notes don't make empty commits
+	require.NoError(t, fp.PutNote(testNote(1, "b64:one", 100)))
+	fp.UpdateNoteNotifier().OnNotify("title", nil, nil, testNote(2, "b64:two", 100))
+	fp.UpdateNoteNotifier().OnNotify("title", nil, nil, testNote(3, "b64:three", 100))
+	fp.flushOutbox(context.Background())
+	require.NoError(t, fp.DeleteNote(2))
+
+	log, err := fp.git("log", "--format=%s")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Delete note 2", "Update 2 notes", "Update note 1"}, strings.Split(log, "\n"))
+	status, err := fp.git("status", "--porcelain")
+	require.NoError(t, err)
+	assert.Empty(t, status)
+
+	// an existing repository is reused
+	newTestFolderProvider(t, dir, true, nil)
+	log, err = fp.git("log", "--format=%s")
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(log, "\n"), 3)
+}
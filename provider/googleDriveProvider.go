@@ -0,0 +1,622 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// GoogleDriveProviderName the name of the Google Drive provider
+const GoogleDriveProviderName = "google_drive"
+
+const (
+	// driveSpace the hidden folder of the app in the Drive of the user
+	driveSpace = "appDataFolder"
+	// driveSnapshotName the name of the snapshot of the vault
+	driveSnapshotName = "ecnotes-snapshot.json"
+	// driveChangePrefix the prefix of the names of the change files, followed by when they were written (ns)
+	driveChangePrefix = "ecnotes-change-"
+	// driveFileExt the extension of the change files
+	driveFileExt = ".json"
+	// driveFileFields the fields of the files the provider reads
+	driveFileFields = "id, name, headRevisionId, createdTime"
+	// driveBatchSize how many outbox changes the worker pushes in a change file
+	driveBatchSize = 50
+	// driveCompactThreshold how many change files trigger their compaction into the snapshot
+	driveCompactThreshold = 20
+	// driveListPageSize how many files are listed per request
+	driveListPageSize = 1000
+)
+
+// driveContent the content of the snapshot and of the change files: the encrypted notes and the tombstones
+type driveContent struct {
+	Files []remoteNoteFile `json:"files"`
+}
+
+// driveEntry a file of the app folder as last downloaded
+type driveEntry struct {
+	revision string
+	files    []remoteNoteFile
+}
+
+// GoogleDriveProvider syncs the notes with the hidden app folder of a Google Drive, which holds a snapshot of the
+// encrypted vault plus the change files written since. Each change is a new file, so that devices never overwrite
+// each other's changes, and the change files are compacted into the snapshot now and then. The snapshot is only
+// replaced at the revision it was read at, and the revisions written in the meantime by other devices are pushed
+// again before the change files are deleted
+type GoogleDriveProvider struct {
+	fileIndexProvider
+	client       *http.Client
+	endpoint     string
+	driveService *drive.Service
+	// limiter the rate limiter all the requests to the Google API go through
+	limiter *googleRateLimiter
+	// cache the files downloaded, by file ID
+	cache map[string]driveEntry
+	// merged the latest version of each note, merged from the snapshot and the change files
+	merged map[int]remoteNoteFile
+	// snapshots and changes the snapshots (oldest first) and the change files listed when they were last read
+	snapshots []*drive.File
+	changes   []*drive.File
+	mux       sync.RWMutex
+	// compactMux serializes the compactions
+	compactMux sync.Mutex
+}
+
+// NewGoogleDriveProvider creates a new Google Drive provider acting as the Google identity of client. endpoint is the
+// URL of the Drive API, empty for Google's
+func NewGoogleDriveProvider(
+	client *http.Client,
+	endpoint string,
+	logger *log.Logger,
+	observer observer.Observer,
+	outbox *Outbox,
+) (*GoogleDriveProvider, error) {
+	dp := &GoogleDriveProvider{
+		client:   client,
+		endpoint: endpoint,
+		limiter:  newGoogleRateLimiter(),
+		cache:    make(map[string]driveEntry),
+		merged:   make(map[int]remoteNoteFile),
+	}
+	dp.fileIndexProvider = newFileIndexProvider(dp, driveBatchSize, logger, observer, outbox)
+	if err := dp.Init(); err != nil {
+		return nil, err
+	}
+	return dp, nil
+}
+
+// newGoogleDriveProviderFromConfig creates the Google Drive provider configured in the config file, with the same
+// Google identity as the Google Sheets provider
+func newGoogleDriveProviderFromConfig(deps ProviderDeps) (SyncNoteProvider, error) {
+	client, err := googleClientFromConfig(context.Background(), deps, googleDriveAppDataScope)
+	if err != nil {
+		return nil, err
+	}
+	return NewGoogleDriveProvider(client, "", deps.Logger, deps.Observer, deps.Outbox)
+}
+
+// googleClientFromConfig returns the http client acting as the Google identity set in the config file: the Google
+// account connected with OAuth if an OAuth client is set, the service account otherwise. The key of the service
+// account is read from the cert store, or from the credentials file until it is moved there
+func googleClientFromConfig(ctx context.Context, deps ProviderDeps, scope string) (*http.Client, error) {
+	if clientFilePath, err := deps.Config.GetConfig(common.CONFIG_GOOGLE_OAUTH_CLIENT_FILE); err == nil && clientFilePath != "" {
+		if deps.Secrets == nil {
+			return nil, errors.New(common.ERR_INVALID_GOOGLE_PROVIDER_CONFIG)
+		}
+		config, err := NewGoogleOAuthConfig(clientFilePath)
+		if err != nil {
+			return nil, err
+		}
+		return oauth2.NewClient(ctx, newSecretTokenSource(ctx, config, deps.Secrets)), nil
+	}
+	var credentials []byte
+	if deps.Secrets != nil {
+		credentials, _ = deps.Secrets.GetSecret(GoogleServiceAccountSecretName)
+	}
+	if len(credentials) == 0 {
+		credFilePath, err := deps.Config.GetConfig(common.CONFIG_GOOGLE_CREDENTIALS_FILE_PATH)
+		if err != nil || credFilePath == "" {
+			return nil, errors.New(common.ERR_INVALID_GOOGLE_PROVIDER_CONFIG)
+		}
+		if credentials, err = os.ReadFile(credFilePath); err != nil {
+			return nil, fmt.Errorf("%s: %w", common.ERR_INVALID_GOOGLE_CREDENTIALS, err)
+		}
+	}
+	return getClientWithJWTToken(ctx, credentials, scope)
+}
+
+// Init initializes the provider
+func (dp *GoogleDriveProvider) Init() error {
+	if dp.client == nil {
+		return errors.New(common.ERR_INVALID_GOOGLE_PROVIDER_CONFIG)
+	}
+	opts := []option.ClientOption{option.WithHTTPClient(dp.client)}
+	if dp.endpoint != "" {
+		opts = append(opts, option.WithEndpoint(dp.endpoint))
+	}
+	var err error
+	dp.driveService, err = drive.NewService(dp.ctx, opts...)
+	return err
+}
+
+// Name returns the provider type
+func (dp *GoogleDriveProvider) Name() string {
+	return GoogleDriveProviderName
+}
+
+// list lists the files of the app folder, downloads the ones changed since they were last seen, and merges them.
+// It returns the version of each note: its UpdatedAt and DeletedAt
+func (dp *GoogleDriveProvider) list(ctx context.Context) (map[int]string, error) {
+	listed, err := dp.listFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]*drive.File, 0, 1)
+	changes := make([]*drive.File, 0, len(listed))
+	for _, file := range listed {
+		switch {
+		case file.Name == driveSnapshotName:
+			snapshots = append(snapshots, file)
+		case strings.HasPrefix(file.Name, driveChangePrefix) && strings.HasSuffix(file.Name, driveFileExt):
+			changes = append(changes, file)
+		}
+	}
+	// all devices take the same snapshot as the primary one, when several were created at once
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		if snapshots[i].CreatedTime != snapshots[j].CreatedTime {
+			return snapshots[i].CreatedTime < snapshots[j].CreatedTime
+		}
+		return snapshots[i].Id < snapshots[j].Id
+	})
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+
+	cache := make(map[string]driveEntry, len(listed))
+	merged := make(map[int]remoteNoteFile)
+	for _, file := range append(append([]*drive.File{}, snapshots...), changes...) {
+		dp.mux.RLock()
+		entry, ok := dp.cache[file.Id]
+		dp.mux.RUnlock()
+		if !ok || entry.revision != file.HeadRevisionId {
+			files, err := dp.download(ctx, file)
+			if err != nil {
+				if isDriveNotFound(err) {
+					// compacted in the meantime: its content is in the snapshot
+					continue
+				}
+				return nil, err
+			}
+			entry = driveEntry{revision: file.HeadRevisionId, files: files}
+		}
+		cache[file.Id] = entry
+		mergeDriveFiles(merged, entry.files)
+	}
+	versions := make(map[int]string, len(merged))
+	for id, file := range merged {
+		versions[id] = driveVersion(file)
+	}
+	dp.mux.Lock()
+	dp.cache = cache
+	dp.merged = merged
+	dp.snapshots = snapshots
+	dp.changes = changes
+	dp.mux.Unlock()
+	return versions, nil
+}
+
+// read returns the latest version of a note, as merged when the files were last listed
+func (dp *GoogleDriveProvider) read(_ context.Context, id int) (*remoteNoteFile, string, error) {
+	dp.mux.RLock()
+	defer dp.mux.RUnlock()
+	file, ok := dp.merged[id]
+	if !ok {
+		return nil, "", errors.New(common.ERR_NOTE_NOT_FOUND)
+	}
+	return &file, driveVersion(file), nil
+}
+
+// write only returns the version of a note: the notes written together go to a single change file, written by commit.
+// Change files are never overwritten, so there is no conflict to detect
+func (dp *GoogleDriveProvider) write(_ context.Context, file remoteNoteFile, _ string) (string, error) {
+	return driveVersion(file), nil
+}
+
+// commit writes the given files to a new change file, then compacts the change files when there are too many
+func (dp *GoogleDriveProvider) commit(ctx context.Context, written []remoteNoteFile) error {
+	return dp.pushFiles(ctx, written)
+}
+
+// purge compacts the change files into the snapshot, leaving out the tombstones of the notes deleted before the
+// given timestamp (ms)
+func (dp *GoogleDriveProvider) purge(ctx context.Context, before int64, _ map[int]string) ([]int, error) {
+	return dp.compact(ctx, before)
+}
+
+// listFiles lists the files of the app folder
+func (dp *GoogleDriveProvider) listFiles(ctx context.Context) ([]*drive.File, error) {
+	files := make([]*drive.File, 0)
+	pageToken := ""
+	for {
+		var list *drive.FileList
+		err := dp.limiter.do(ctx, func(ctx context.Context) error {
+			var err error
+			list, err = dp.driveService.Files.List().
+				Spaces(driveSpace).
+				Q("trashed = false").
+				PageSize(driveListPageSize).
+				PageToken(pageToken).
+				Fields(googleapi.Field("nextPageToken, files(" + driveFileFields + ")")).
+				Context(ctx).
+				Do()
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to list the google drive files: %w", err)
+		}
+		files = append(files, list.Files...)
+		if list.NextPageToken == "" {
+			return files, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+// download downloads the content of a file of the app folder, at its head revision
+func (dp *GoogleDriveProvider) download(ctx context.Context, file *drive.File) ([]remoteNoteFile, error) {
+	var data []byte
+	err := dp.limiter.do(ctx, func(ctx context.Context) error {
+		resp, err := dp.driveService.Files.Get(file.Id).Context(ctx).Download()
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		data, err = io.ReadAll(resp.Body)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseDriveContent(file.Name, data)
+}
+
+// downloadRevision downloads the content of a past revision of a file of the app folder
+func (dp *GoogleDriveProvider) downloadRevision(ctx context.Context, file *drive.File, revision string) ([]remoteNoteFile, error) {
+	var data []byte
+	err := dp.limiter.do(ctx, func(ctx context.Context) error {
+		resp, err := dp.driveService.Revisions.Get(file.Id, revision).Context(ctx).Download()
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		data, err = io.ReadAll(resp.Body)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseDriveContent(file.Name, data)
+}
+
+// pushFiles writes the given files to a new change file, then compacts the change files when there are too many
+func (dp *GoogleDriveProvider) pushFiles(ctx context.Context, files []remoteNoteFile) error {
+	if err := dp.writeChange(ctx, files); err != nil {
+		return err
+	}
+	dp.mux.RLock()
+	compact := len(dp.changes) >= driveCompactThreshold
+	dp.mux.RUnlock()
+	if compact {
+		// the changes are written: a compaction that fails is tried again after the next ones
+		if _, err := dp.compact(ctx, 0); err != nil {
+			dp.logger.Errorf("Error compacting the %s change files: %v", GoogleDriveProviderName, err)
+		}
+	}
+	return nil
+}
+
+// writeChange writes the given files to a new change file
+func (dp *GoogleDriveProvider) writeChange(ctx context.Context, files []remoteNoteFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(driveContent{Files: files})
+	if err != nil {
+		return err
+	}
+	name, err := driveChangeName()
+	if err != nil {
+		return err
+	}
+	created, err := dp.createFile(ctx, name, body)
+	if err != nil {
+		return fmt.Errorf("unable to write the google drive change file: %w", err)
+	}
+	dp.mux.Lock()
+	dp.cache[created.Id] = driveEntry{revision: created.HeadRevisionId, files: files}
+	dp.changes = append(dp.changes, created)
+	mergeDriveFiles(dp.merged, files)
+	dp.mux.Unlock()
+	return nil
+}
+
+// createFile writes a new file to the app folder
+func (dp *GoogleDriveProvider) createFile(ctx context.Context, name string, body []byte) (*drive.File, error) {
+	var created *drive.File
+	err := dp.limiter.do(ctx, func(ctx context.Context) error {
+		var err error
+		created, err = dp.driveService.Files.Create(&drive.File{
+			Name:     name,
+			Parents:  []string{driveSpace},
+			MimeType: "application/json",
+		}).
+			Media(bytes.NewReader(body), googleapi.ContentType("application/json")).
+			Fields(googleapi.Field(driveFileFields)).
+			Context(ctx).
+			Do()
+		return err
+	})
+	return created, err
+}
+
+// headRevision returns the ID of the head revision of a file
+func (dp *GoogleDriveProvider) headRevision(ctx context.Context, file *drive.File) (string, error) {
+	var current *drive.File
+	err := dp.limiter.do(ctx, func(ctx context.Context) error {
+		var err error
+		current, err = dp.driveService.Files.Get(file.Id).Fields("id, headRevisionId").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return current.HeadRevisionId, nil
+}
+
+// compact writes the merged notes (without the tombstones of the notes deleted before the given timestamp, in ms) to
+// the snapshot, then deletes the change files and the other snapshots it folds, and returns the IDs of the tombstones
+// left out. The snapshot is only replaced at the revision it was read at. When other devices replaced it at the same
+// time, the revisions they wrote are pushed again as a change file, and nothing is deleted if the revisions of the
+// snapshot can't be told
+func (dp *GoogleDriveProvider) compact(ctx context.Context, before int64) ([]int, error) {
+	dp.compactMux.Lock()
+	defer dp.compactMux.Unlock()
+
+	dp.mux.RLock()
+	files := make([]remoteNoteFile, 0, len(dp.merged))
+	for _, file := range dp.merged {
+		if file.DeletedAt > 0 && file.DeletedAt < before {
+			continue
+		}
+		files = append(files, file)
+	}
+	var primary *drive.File
+	folded := append([]*drive.File{}, dp.changes...)
+	if len(dp.snapshots) > 0 {
+		primary = dp.snapshots[0]
+		folded = append(folded, dp.snapshots[1:]...)
+	}
+	dp.mux.RUnlock()
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ID < files[j].ID
+	})
+	body, err := json.Marshal(driveContent{Files: files})
+	if err != nil {
+		return nil, err
+	}
+
+	var written *drive.File
+	if primary == nil {
+		written, err = dp.createFile(ctx, driveSnapshotName, body)
+		if err != nil {
+			return nil, fmt.Errorf("unable to write the google drive snapshot: %w", err)
+		}
+	} else {
+		written, err = dp.replaceSnapshot(ctx, primary, body)
+		if err != nil || written == nil {
+			return nil, err
+		}
+	}
+
+	deleted := make(map[string]bool, len(folded))
+	for _, file := range folded {
+		if file.Name == driveSnapshotName {
+			// another device that didn't see the primary snapshot may have replaced this one since it was read
+			if head, err := dp.headRevision(ctx, file); err != nil || head != file.HeadRevisionId {
+				continue
+			}
+		}
+		err := dp.limiter.do(ctx, func(ctx context.Context) error {
+			return dp.driveService.Files.Delete(file.Id).Context(ctx).Do()
+		})
+		if err != nil && !isDriveNotFound(err) {
+			return nil, fmt.Errorf("unable to delete the google drive file %s: %w", file.Name, err)
+		}
+		deleted[file.Id] = true
+	}
+
+	dp.mux.Lock()
+	defer dp.mux.Unlock()
+	for id := range deleted {
+		delete(dp.cache, id)
+	}
+	dp.cache[written.Id] = driveEntry{revision: written.HeadRevisionId, files: files}
+	changes := make([]*drive.File, 0, len(dp.changes))
+	for _, file := range dp.changes {
+		if !deleted[file.Id] {
+			changes = append(changes, file)
+		}
+	}
+	dp.changes = changes
+	snapshots := []*drive.File{written}
+	for _, file := range dp.snapshots {
+		if file.Id != written.Id && !deleted[file.Id] {
+			snapshots = append(snapshots, file)
+		}
+	}
+	dp.snapshots = snapshots
+	purged := make([]int, 0)
+	for id, file := range dp.merged {
+		if file.DeletedAt > 0 && file.DeletedAt < before {
+			delete(dp.merged, id)
+			purged = append(purged, id)
+		}
+	}
+	return purged, nil
+}
+
+// replaceSnapshot replaces the content of the snapshot, if it is still at the revision it was read at, and checks
+// that no other device replaced it at the same time. It returns nil when the change files must be kept
+func (dp *GoogleDriveProvider) replaceSnapshot(ctx context.Context, snapshot *drive.File, body []byte) (*drive.File, error) {
+	head, err := dp.headRevision(ctx, snapshot)
+	if err != nil {
+		if isDriveNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to read the google drive snapshot: %w", err)
+	}
+	if head != snapshot.HeadRevisionId {
+		// changed by another device since it was read: compacted again after the next refresh
+		return nil, nil
+	}
+	var updated *drive.File
+	err = dp.limiter.do(ctx, func(ctx context.Context) error {
+		var err error
+		updated, err = dp.driveService.Files.Update(snapshot.Id, &drive.File{}).
+			Media(bytes.NewReader(body), googleapi.ContentType("application/json")).
+			Fields(googleapi.Field(driveFileFields)).
+			Context(ctx).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to write the google drive snapshot: %w", err)
+	}
+	updated.Name = snapshot.Name
+	updated.CreatedTime = snapshot.CreatedTime
+
+	// the revisions written between the one read and this one hold changes that may be missing from this one
+	revisions, err := dp.listRevisions(ctx, snapshot)
+	if err != nil {
+		dp.logger.Errorf("Error listing the revisions of the %s snapshot: %v", GoogleDriveProviderName, err)
+		return nil, nil
+	}
+	read, wrote := -1, -1
+	for i, revision := range revisions {
+		switch revision.Id {
+		case snapshot.HeadRevisionId:
+			read = i
+		case updated.HeadRevisionId:
+			wrote = i
+		}
+	}
+	if read < 0 || wrote < read {
+		dp.logger.Errorf("Error checking the revisions of the %s snapshot: keeping the change files", GoogleDriveProviderName)
+		return nil, nil
+	}
+	for _, revision := range revisions[read+1 : wrote] {
+		files, err := dp.downloadRevision(ctx, snapshot, revision.Id)
+		if err != nil {
+			dp.logger.Errorf("Error reading a revision of the %s snapshot: %v", GoogleDriveProviderName, err)
+			return nil, nil
+		}
+		if err := dp.writeChange(ctx, files); err != nil {
+			return nil, err
+		}
+	}
+	return updated, nil
+}
+
+// listRevisions lists the revisions of a file, oldest first
+func (dp *GoogleDriveProvider) listRevisions(ctx context.Context, file *drive.File) ([]*drive.Revision, error) {
+	revisions := make([]*drive.Revision, 0)
+	pageToken := ""
+	for {
+		var list *drive.RevisionList
+		err := dp.limiter.do(ctx, func(ctx context.Context) error {
+			var err error
+			list, err = dp.driveService.Revisions.List(file.Id).
+				PageToken(pageToken).
+				Fields("nextPageToken, revisions(id)").
+				Context(ctx).
+				Do()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, list.Revisions...)
+		if list.NextPageToken == "" {
+			return revisions, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+// parseDriveContent parses the content of the snapshot or of a change file
+func parseDriveContent(name string, data []byte) ([]remoteNoteFile, error) {
+	var content driveContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, fmt.Errorf("unable to parse the google drive file %s: %w", name, err)
+	}
+	for _, file := range content.Files {
+		if file.ID == 0 || (file.Note == nil && file.DeletedAt == 0) || (file.Note != nil && file.Note.ID != file.ID) {
+			return nil, fmt.Errorf("%s: %s", common.ERR_MALFORMED_NOTE_FILE, name)
+		}
+	}
+	return content.Files, nil
+}
+
+// mergeDriveFiles keeps in index the latest version of each note: the most recently updated one, or the tombstone
+// when a note was deleted and updated at the same time
+func mergeDriveFiles(index map[int]remoteNoteFile, files []remoteNoteFile) {
+	for _, file := range files {
+		current, ok := index[file.ID]
+		if ok && (current.UpdatedAt > file.UpdatedAt || (current.UpdatedAt == file.UpdatedAt && current.DeletedAt > 0)) {
+			continue
+		}
+		index[file.ID] = file
+	}
+}
+
+// driveVersion returns the version of a note in the app folder
+func driveVersion(file remoteNoteFile) string {
+	return strconv.FormatInt(file.UpdatedAt, 10) + "-" + strconv.FormatInt(file.DeletedAt, 10)
+}
+
+// driveChangeName returns the name of a new change file: when it is written (ns), and a random suffix telling apart
+// the ones written at the same time by different devices
+func driveChangeName() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return driveChangePrefix + strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + hex.EncodeToString(suffix) + driveFileExt, nil
+}
+
+// isDriveNotFound reports whether a request failed because the file (or revision) doesn't exist
+func isDriveNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
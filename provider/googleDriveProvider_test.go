@@ -0,0 +1,444 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// driveTestFile a file of the fake app folder, with all its revisions
+type driveTestFile struct {
+	id        string
+	name      string
+	created   string
+	revisions []driveTestRevision
+}
+
+// driveTestRevision a revision of a file of the fake app folder
+type driveTestRevision struct {
+	id   string
+	data []byte
+}
+
+// driveTestServer an in-process fake of the Drive API over the app folder: listing, multipart uploads, downloads,
+// deletions and revisions
+type driveTestServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	files     map[string]*driveTestFile
+	lastID    int
+	downloads int
+	// beforeUpdate called (holding mu) before a file is replaced, to interleave the writes of other devices
+	beforeUpdate func(file *driveTestFile)
+	// failUploads makes the uploads fail
+	failUploads bool
+	// maxPageSize the most files listed per page, as Google may list fewer than asked
+	maxPageSize int
+}
+
+func newDriveTestServer(t *testing.T) *driveTestServer {
+	s := &driveTestServer{files: make(map[string]*driveTestFile)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *driveTestServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	query := r.URL.Query()
+	switch path := r.URL.Path; {
+	case strings.HasPrefix(path, "/upload/drive/v3/files"):
+		if s.failUploads {
+			driveTestError(w, http.StatusBadRequest, "badRequest")
+			return
+		}
+		name, data, err := driveTestUpload(r)
+		if err != nil {
+			driveTestError(w, http.StatusBadRequest, "badRequest")
+			return
+		}
+		if r.Method == http.MethodPost {
+			s.writeFile(w, s.create(name, data))
+			return
+		}
+		file, ok := s.files[strings.TrimPrefix(path, "/upload/drive/v3/files/")]
+		if !ok {
+			driveTestError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		if s.beforeUpdate != nil {
+			s.beforeUpdate(file)
+		}
+		s.addRevision(file, data)
+		s.writeFile(w, file)
+	case path == "/drive/v3/files":
+		if query.Get("spaces") != driveSpace {
+			driveTestError(w, http.StatusBadRequest, "badRequest")
+			return
+		}
+		s.list(w, query.Get("pageToken"), query.Get("pageSize"))
+	case strings.HasPrefix(path, "/drive/v3/files/"):
+		parts := strings.Split(strings.TrimPrefix(path, "/drive/v3/files/"), "/")
+		file, ok := s.files[parts[0]]
+		if !ok {
+			driveTestError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			delete(s.files, file.id)
+			w.WriteHeader(http.StatusNoContent)
+		case len(parts) == 1 && query.Get("alt") == "media":
+			s.downloads++
+			w.Write(file.revisions[len(file.revisions)-1].data)
+		case len(parts) == 1:
+			s.writeFile(w, file)
+		case len(parts) == 2 && parts[1] == "revisions":
+			revisions := make([]map[string]string, 0, len(file.revisions))
+			for _, revision := range file.revisions {
+				revisions = append(revisions, map[string]string{"id": revision.id})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"revisions": revisions})
+		case len(parts) == 3 && parts[1] == "revisions" && query.Get("alt") == "media":
+			for _, revision := range file.revisions {
+				if revision.id == parts[2] {
+					w.Write(revision.data)
+					return
+				}
+			}
+			driveTestError(w, http.StatusNotFound, "notFound")
+		default:
+			driveTestError(w, http.StatusBadRequest, "badRequest")
+		}
+	default:
+		driveTestError(w, http.StatusNotFound, "notFound")
+	}
+}
+
+// list writes a page of the files, pageToken being the offset of the page
+func (s *driveTestServer) list(w http.ResponseWriter, pageToken string, pageSize string) {
+	ids := make([]string, 0, len(s.files))
+	for id := range s.files {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	offset, _ := strconv.Atoi(pageToken)
+	size, err := strconv.Atoi(pageSize)
+	if err != nil || size <= 0 {
+		size = len(ids)
+	}
+	if s.maxPageSize > 0 {
+		size = min(size, s.maxPageSize)
+	}
+	end := min(offset+size, len(ids))
+	files := make([]map[string]string, 0, end-offset)
+	for _, id := range ids[offset:end] {
+		files = append(files, s.metadata(s.files[id]))
+	}
+	list := map[string]interface{}{"files": files}
+	if end < len(ids) {
+		list["nextPageToken"] = strconv.Itoa(end)
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// create adds a file to the app folder. The caller must hold mu
+func (s *driveTestServer) create(name string, data []byte) *driveTestFile {
+	s.lastID++
+	file := &driveTestFile{
+		id:      fmt.Sprintf("file%04d", s.lastID),
+		name:    name,
+		created: time.Date(2026, 1, 1, 0, 0, s.lastID, 0, time.UTC).Format(time.RFC3339),
+	}
+	s.files[file.id] = file
+	s.addRevision(file, data)
+	return file
+}
+
+// addRevision replaces the content of a file. The caller must hold mu
+func (s *driveTestServer) addRevision(file *driveTestFile, data []byte) {
+	s.lastID++
+	file.revisions = append(file.revisions, driveTestRevision{id: fmt.Sprintf("rev%04d", s.lastID), data: data})
+}
+
+func (s *driveTestServer) metadata(file *driveTestFile) map[string]string {
+	return map[string]string{
+		"id":             file.id,
+		"name":           file.name,
+		"createdTime":    file.created,
+		"headRevisionId": file.revisions[len(file.revisions)-1].id,
+	}
+}
+
+func (s *driveTestServer) writeFile(w http.ResponseWriter, file *driveTestFile) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.metadata(file))
+}
+
+// put writes a change file, as another device would
+func (s *driveTestServer) put(t *testing.T, files ...remoteNoteFile) {
+	t.Helper()
+	data, err := json.Marshal(driveContent{Files: files})
+	require.NoError(t, err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.create(fmt.Sprintf("%s%d-test%s", driveChangePrefix, time.Now().UnixNano(), driveFileExt), data)
+}
+
+// counts returns how many snapshots and change files the app folder holds
+func (s *driveTestServer) counts() (snapshots int, changes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, file := range s.files {
+		if file.name == driveSnapshotName {
+			snapshots++
+		} else {
+			changes++
+		}
+	}
+	return snapshots, changes
+}
+
+func (s *driveTestServer) downloaded() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downloads
+}
+
+// driveTestUpload reads the metadata and the content of a multipart upload
+func driveTestUpload(r *http.Request) (string, []byte, error) {
+	if r.URL.Query().Get("uploadType") != "multipart" {
+		return "", nil, fmt.Errorf("unexpected upload type %s", r.URL.Query().Get("uploadType"))
+	}
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return "", nil, err
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	part, err := reader.NextPart()
+	if err != nil {
+		return "", nil, err
+	}
+	var metadata struct {
+		Name    string   `json:"name"`
+		Parents []string `json:"parents"`
+	}
+	if err := json.NewDecoder(part).Decode(&metadata); err != nil {
+		return "", nil, err
+	}
+	if r.Method == http.MethodPost && (len(metadata.Parents) != 1 || metadata.Parents[0] != driveSpace) {
+		return "", nil, fmt.Errorf("not in the app folder")
+	}
+	part, err = reader.NextPart()
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := io.ReadAll(part)
+	return metadata.Name, data, err
+}
+
+func driveTestError(w http.ResponseWriter, status int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprint(w, googleErrorBody(status, reason))
+}
+
+func newTestGoogleDriveProvider(t *testing.T, s *driveTestServer, outbox *Outbox) *GoogleDriveProvider {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	dp, err := NewGoogleDriveProvider(s.Client(), s.URL+"/drive/v3/", logger, &observer.ObserverImpl{}, outbox)
+	require.NoError(t, err)
+	dp.limiter.baseDelay = time.Millisecond
+	return dp
+}
+
+func TestNewGoogleDriveProviderFromConfig(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	deps := ProviderDeps{
+		Config: mapConfig{},
+		Logger: logger,
+		Secrets: fakeSecrets{
+			GoogleServiceAccountSecretName: []byte(`{"type":"service_account",
+				"client_email":"notes@example.iam.gserviceaccount.com","private_key":"key",
+				"token_uri":"https://oauth2.googleapis.com/token"}`),
+		},
+	}
+	p, err := NewDefaultRegistry().Create(GoogleDriveProviderName, deps)
+	require.NoError(t, err)
+	assert.Equal(t, GoogleDriveProviderName, p.Name())
+	assert.True(t, p.Capabilities().Has(CapabilityTombstones|CapabilityMerge|CapabilityBackgroundPush))
+
+	// no Google identity
+	deps.Secrets = fakeSecrets{}
+	_, err = NewDefaultRegistry().Create(GoogleDriveProviderName, deps)
+	assert.EqualError(t, err, common.ERR_INVALID_GOOGLE_PROVIDER_CONFIG)
+	_, err = NewGoogleDriveProvider(nil, "", logger, nil, nil)
+	assert.EqualError(t, err, common.ERR_INVALID_GOOGLE_PROVIDER_CONFIG)
+}
+
+func TestGoogleDriveProvider_ChangeFiles(t *testing.T) {
+	s := newDriveTestServer(t)
+	outbox := NewOutbox(newMemoryOutboxStore(), GoogleDriveProviderName, nil)
+	dp := newTestGoogleDriveProvider(t, s, outbox)
+	ctx := context.Background()
+
+	// the local notes are pushed in a single change file
+	local := []model.Note{*testNote(1, "b64:one", 100), *testNote(2, "b64:two", 100)}
+	_, err := dp.SyncNotes(ctx, local, nil, nil)
+	require.NoError(t, err)
+	snapshots, changes := s.counts()
+	assert.Equal(t, [2]int{0, 1}, [2]int{snapshots, changes})
+
+	// only the new files are downloaded
+	s.put(t, noteFile(testNote(1, "b64:one v2", 200)), tombstoneFile(model.Tombstone{ID: 2, DeletedAt: 300}))
+	s.put(t, noteFile(testNote(3, "b64:three", 300)))
+	downloads := s.downloaded()
+	_, err = dp.SyncNotes(ctx, local, nil, map[int]int64{1: 100, 2: 100})
+	require.NoError(t, err)
+	assert.Equal(t, downloads+2, s.downloaded())
+
+	// nothing changed: nothing is downloaded nor written
+	downloads = s.downloaded()
+	local = []model.Note{*testNote(1, "b64:one v2", 200), *testNote(3, "b64:three", 300)}
+	_, err = dp.SyncNotes(ctx, local, nil, map[int]int64{1: 200, 3: 300})
+	require.NoError(t, err)
+	assert.Equal(t, downloads, s.downloaded())
+	_, changes = s.counts()
+	assert.Equal(t, 3, changes)
+
+	// an older change file never hides a newer version
+	s.put(t, noteFile(testNote(3, "b64:three stale", 250)))
+	_, err = dp.GetNoteIDs(true)
+	require.NoError(t, err)
+	note, err := dp.GetNote(3)
+	require.NoError(t, err)
+	assert.Equal(t, "b64:three", note.Content)
+
+	// the outbox changes go to a single change file
+	dp.UpdateNoteNotifier().OnNotify("title", nil, nil, testNote(4, "b64:four", 400))
+	dp.DeleteNoteNotifier().OnNotify(&model.Note{ID: 3}, nil, nil, model.Tombstone{ID: 3, DeletedAt: 400})
+	assert.Zero(t, dp.flushOutbox(ctx))
+	_, changes = s.counts()
+	assert.Equal(t, 5, changes)
+}
+
+func TestGoogleDriveProvider_Compact(t *testing.T) {
+	s := newDriveTestServer(t)
+	dp := newTestGoogleDriveProvider(t, s, nil)
+
+	// the change files are folded into the snapshot once there are too many
+	for i := 1; i < driveCompactThreshold; i++ {
+		require.NoError(t, dp.PutNote(testNote(i, "b64:note "+strconv.Itoa(i), 100)))
+	}
+	require.NoError(t, dp.DeleteNote(1))
+	snapshots, changes := s.counts()
+	assert.Equal(t, [2]int{1, 0}, [2]int{snapshots, changes})
+	require.NoError(t, dp.PutNote(testNote(2, "b64:note 2 v2", 200)))
+
+	other := newTestGoogleDriveProvider(t, s, nil)
+	notes, err := other.GetNotes()
+	require.NoError(t, err)
+	assert.Len(t, notes, driveCompactThreshold-2)
+	note, err := other.GetNote(2)
+	require.NoError(t, err)
+	assert.Equal(t, "b64:note 2 v2", note.Content)
+	_, err = other.GetNote(1)
+	assert.EqualError(t, err, common.ERR_NOTE_NOT_FOUND)
+
+	// the expired tombstones are left out of the snapshot
+	_, tombstones, err := other.RemoteVersions(context.Background())
+	require.NoError(t, err)
+	assert.Contains(t, tombstones, 1)
+	require.NoError(t, other.PurgeTombstones(common.GetCurrentTimestamp()+1))
+	snapshots, changes = s.counts()
+	assert.Equal(t, [2]int{1, 0}, [2]int{snapshots, changes})
+	_, tombstones, err = newTestGoogleDriveProvider(t, s, nil).RemoteVersions(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, tombstones)
+	notes, err = dp.GetNotes()
+	require.NoError(t, err)
+	assert.Len(t, notes, driveCompactThreshold-2)
+}
+
+func TestGoogleDriveProvider_Compact_Concurrent(t *testing.T) {
+	s := newDriveTestServer(t)
+	alice := newTestGoogleDriveProvider(t, s, nil)
+	bob := newTestGoogleDriveProvider(t, s, nil)
+	require.NoError(t, alice.PutNote(testNote(1, "b64:one", 100)))
+	require.NoError(t, alice.PurgeTombstones(0))
+	require.NoError(t, bob.PutNote(testNote(2, "b64:two", 100)))
+	_, err := bob.GetNoteIDs(true)
+	require.NoError(t, err)
+	require.NoError(t, alice.PutNote(testNote(3, "b64:three", 100)))
+
+	// bob compacts first: alice's snapshot is stale, and her change files are kept
+	_, err = bob.compact(context.Background(), 0)
+	require.NoError(t, err)
+	_, err = alice.compact(context.Background(), 0)
+	require.NoError(t, err)
+	_, changes := s.counts()
+	assert.Equal(t, 1, changes)
+	ids, err := newTestGoogleDriveProvider(t, s, nil).GetNoteIDs(true)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3}, ids)
+
+	// a device replaces the snapshot right between alice's check and her write: what it wrote is pushed again
+	_, err = alice.GetNoteIDs(true)
+	require.NoError(t, err)
+	s.beforeUpdate = func(file *driveTestFile) {
+		s.beforeUpdate = nil
+		data, _ := json.Marshal(driveContent{Files: []remoteNoteFile{noteFile(testNote(4, "b64:four", 100))}})
+		s.addRevision(file, data)
+	}
+	_, err = alice.compact(context.Background(), 0)
+	require.NoError(t, err)
+	snapshots, changes := s.counts()
+	assert.Equal(t, [2]int{1, 1}, [2]int{snapshots, changes})
+	ids, err = newTestGoogleDriveProvider(t, s, nil).GetNoteIDs(true)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4}, ids)
+}
+
+func TestGoogleDriveProvider_ListPages(t *testing.T) {
+	s := newDriveTestServer(t)
+	for i := 1; i <= 5; i++ {
+		s.put(t, noteFile(testNote(i, "b64:note", 100)))
+	}
+	s.maxPageSize = 2
+	dp := newTestGoogleDriveProvider(t, s, nil)
+	files, err := dp.listFiles(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, files, 5)
+	ids, err := dp.GetNoteIDs(true)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, ids)
+
+	// malformed files are reported
+	s.mu.Lock()
+	s.create(driveChangePrefix+"0-bad"+driveFileExt, []byte(`{"files":[{"id":6,"updated_at":100}]}`))
+	s.mu.Unlock()
+	_, err = dp.GetNoteIDs(true)
+	assert.ErrorContains(t, err, common.ERR_MALFORMED_NOTE_FILE)
+}
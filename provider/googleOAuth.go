@@ -0,0 +1,160 @@
+package provider
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// GoogleOAuthSecretName the name of the cert store entry holding the refresh token of the Google account
+	GoogleOAuthSecretName = "google_sheets_oauth"
+	// googleSheetsScope the scope the Google Sheets provider asks for
+	googleSheetsScope = "https://www.googleapis.com/auth/spreadsheets"
+	// googleDriveAppDataScope the scope the Google Drive provider asks for: its own hidden folder only
+	googleDriveAppDataScope = "https://www.googleapis.com/auth/drive.appdata"
+	// googleOAuthCallbackPath the path of the loopback redirect URI the browser is sent back to
+	googleOAuthCallbackPath = "/oauth2/callback"
+)
+
+// SecretReader reads the secrets kept encrypted in the cert store. They can't be read until the vault is unlocked
+type SecretReader interface {
+	GetSecret(name string) ([]byte, error)
+}
+
+// NewGoogleOAuthConfig reads the OAuth client of a desktop app, as downloaded from the Google console. The account
+// is connected once for both Google providers
+func NewGoogleOAuthConfig(clientFilePath string) (*oauth2.Config, error) {
+	data, err := os.ReadFile(clientFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", common.ERR_INVALID_GOOGLE_CREDENTIALS, err)
+	}
+	config, err := google.ConfigFromJSON(data, googleSheetsScope, googleDriveAppDataScope)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", common.ERR_INVALID_GOOGLE_CREDENTIALS, err)
+	}
+	return config, nil
+}
+
+// googleCallback what the browser was sent back with
+type googleCallback struct {
+	code string
+	err  error
+}
+
+// AuthorizeGoogle runs the OAuth flow of installed apps and returns the refresh token of the account the user
+// signs in with. The consent page is opened with openURL, and the browser is sent back to a one-off server on the
+// loopback interface. PKCE binds the code to this flow, so that another app catching it can't redeem it
+func AuthorizeGoogle(ctx context.Context, config *oauth2.Config, openURL func(authURL string) error) (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	flowConfig := *config
+	flowConfig.RedirectURL = "http://" + listener.Addr().String() + googleOAuthCallbackPath
+	state, err := randomState()
+	if err != nil {
+		_ = listener.Close()
+		return "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	callbacks := make(chan googleCallback, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc(googleOAuthCallbackPath, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		// requests not coming from this flow are ignored
+		if query.Get("state") != state {
+			http.Error(w, "invalid state", http.StatusBadRequest)
+			return
+		}
+		callback := googleCallback{code: query.Get("code")}
+		if reason := query.Get("error"); reason != "" || callback.code == "" {
+			callback.err = fmt.Errorf("%s: %s", common.ERR_GOOGLE_AUTHORIZATION_FAILED, reason)
+			fmt.Fprintln(w, "EcNotes could not connect your Google account. You can close this window.")
+		} else {
+			fmt.Fprintln(w, "EcNotes is connected to your Google account. You can close this window.")
+		}
+		select {
+		case callbacks <- callback:
+		default:
+		}
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	authURL := flowConfig.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce, oauth2.S256ChallengeOption(verifier))
+	if err = openURL(authURL); err != nil {
+		return "", err
+	}
+	var callback googleCallback
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case callback = <-callbacks:
+	}
+	if callback.err != nil {
+		return "", callback.err
+	}
+	token, err := flowConfig.Exchange(ctx, callback.code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", common.ERR_GOOGLE_AUTHORIZATION_FAILED, err)
+	}
+	if token.RefreshToken == "" {
+		return "", fmt.Errorf("%s: no refresh token", common.ERR_GOOGLE_AUTHORIZATION_FAILED)
+	}
+	return token.RefreshToken, nil
+}
+
+// randomState returns the random state tying the browser callback to the flow
+func randomState() (string, error) {
+	state := make([]byte, 16)
+	if _, err := rand.Read(state); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(state), nil
+}
+
+// secretTokenSource the access tokens of the Google account whose refresh token is in the cert store.
+// The refresh token is read when a token is needed: the vault is locked when the provider is created, and the
+// account can be connected again in the meantime
+type secretTokenSource struct {
+	ctx          context.Context
+	config       *oauth2.Config
+	secrets      SecretReader
+	refreshToken string
+	source       oauth2.TokenSource
+	mux          sync.Mutex
+}
+
+// newSecretTokenSource creates the token source of the Google account connected with AuthorizeGoogle
+func newSecretTokenSource(ctx context.Context, config *oauth2.Config, secrets SecretReader) oauth2.TokenSource {
+	return &secretTokenSource{ctx: ctx, config: config, secrets: secrets}
+}
+
+// Token returns a valid access token, refreshing it when it expires
+func (s *secretTokenSource) Token() (*oauth2.Token, error) {
+	secret, err := s.secrets.GetSecret(GoogleOAuthSecretName)
+	if err != nil || len(secret) == 0 {
+		return nil, errors.New(common.ERR_GOOGLE_NOT_CONNECTED)
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.source == nil || string(secret) != s.refreshToken {
+		s.refreshToken = string(secret)
+		s.source = s.config.TokenSource(s.ctx, &oauth2.Token{RefreshToken: s.refreshToken})
+	}
+	return s.source.Token()
+}
@@ -0,0 +1,260 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// fakeGoogleOAuth a Google token endpoint: it redeems the code it was told about, checking the PKCE verifier,
+// and refreshes the access tokens of its refresh token
+type fakeGoogleOAuth struct {
+	*httptest.Server
+	code         string
+	refreshToken string
+
+	mu        sync.Mutex
+	challenge string
+	refreshes int
+}
+
+func newFakeGoogleOAuth(t *testing.T) *fakeGoogleOAuth {
+	f := &fakeGoogleOAuth{code: "the-code", refreshToken: "the-refresh-token"}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/token" || r.ParseForm() != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			if r.PostForm.Get("code") != f.code || base64.RawURLEncoding.EncodeToString(sum[:]) != f.challenge {
+				writeOAuthError(w)
+				return
+			}
+			writeOAuthToken(w, "access-1", f.refreshToken)
+		case "refresh_token":
+			if r.PostForm.Get("refresh_token") != f.refreshToken {
+				writeOAuthError(w)
+				return
+			}
+			f.refreshes++
+			writeOAuthToken(w, fmt.Sprintf("access-refreshed-%d", f.refreshes), "")
+		default:
+			writeOAuthError(w)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func writeOAuthToken(w http.ResponseWriter, accessToken, refreshToken string) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+	})
+}
+
+func writeOAuthError(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = io.WriteString(w, `{"error":"invalid_grant"}`)
+}
+
+// config returns the OAuth client of a desktop app using the fake endpoint
+func (f *fakeGoogleOAuth) config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     "client-id",
+		ClientSecret: "client-secret",
+		Endpoint:     oauth2.Endpoint{AuthURL: f.URL + "/auth", TokenURL: f.URL + "/token"},
+		Scopes:       []string{googleSheetsScope},
+	}
+}
+
+// browser returns an openURL acting as the user consenting in the browser: Google sends the browser back to the
+// redirect URI with the given query
+func (f *fakeGoogleOAuth) browser(t *testing.T, query func(state string) url.Values) func(string) error {
+	return func(authURL string) error {
+		u, err := url.Parse(authURL)
+		require.NoError(t, err)
+		params := u.Query()
+		assert.Equal(t, "S256", params.Get("code_challenge_method"))
+		assert.Equal(t, "offline", params.Get("access_type"))
+		f.mu.Lock()
+		f.challenge = params.Get("code_challenge")
+		f.mu.Unlock()
+		redirect, err := url.Parse(params.Get("redirect_uri"))
+		require.NoError(t, err)
+		assert.Equal(t, "127.0.0.1", redirect.Hostname())
+		redirect.RawQuery = query(params.Get("state")).Encode()
+		go func() {
+			if resp, err := http.Get(redirect.String()); err == nil {
+				resp.Body.Close()
+			}
+		}()
+		return nil
+	}
+}
+
+// fakeSecrets a cert store holding secrets
+type fakeSecrets map[string][]byte
+
+func (s fakeSecrets) GetSecret(name string) ([]byte, error) {
+	if secret, ok := s[name]; ok {
+		return secret, nil
+	}
+	return nil, errors.New(common.ERR_CERT_NOT_FOUND)
+}
+
+// mapConfig provider settings held in memory
+type mapConfig map[string]string
+
+func (c mapConfig) GetConfig(key string) (string, error) {
+	if val, ok := c[key]; ok {
+		return val, nil
+	}
+	return "", errors.New("config not found")
+}
+
+func TestAuthorizeGoogle(t *testing.T) {
+	f := newFakeGoogleOAuth(t)
+	refreshToken, err := AuthorizeGoogle(context.Background(), f.config(), f.browser(t, func(state string) url.Values {
+		return url.Values{"code": {f.code}, "state": {state}}
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, f.refreshToken, refreshToken)
+}
+
+func TestAuthorizeGoogle_Denied(t *testing.T) {
+	f := newFakeGoogleOAuth(t)
+	_, err := AuthorizeGoogle(context.Background(), f.config(), f.browser(t, func(state string) url.Values {
+		return url.Values{"error": {"access_denied"}, "state": {state}}
+	}))
+	assert.EqualError(t, err, common.ERR_GOOGLE_AUTHORIZATION_FAILED+": access_denied")
+}
+
+func TestAuthorizeGoogle_WrongState(t *testing.T) {
+	f := newFakeGoogleOAuth(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := AuthorizeGoogle(ctx, f.config(), func(authURL string) error {
+		// a callback not coming from this flow is ignored: the flow waits until canceled
+		openURL := f.browser(t, func(string) url.Values {
+			return url.Values{"code": {f.code}, "state": {"forged"}}
+		})
+		require.NoError(t, openURL(authURL))
+		go cancel()
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestAuthorizeGoogle_WrongVerifier(t *testing.T) {
+	f := newFakeGoogleOAuth(t)
+	_, err := AuthorizeGoogle(context.Background(), f.config(), func(authURL string) error {
+		// the code is redeemed only with the verifier of the challenge
+		err := f.browser(t, func(state string) url.Values {
+			return url.Values{"code": {f.code}, "state": {state}}
+		})(authURL)
+		f.mu.Lock()
+		f.challenge = "another-challenge"
+		f.mu.Unlock()
+		return err
+	})
+	assert.ErrorContains(t, err, common.ERR_GOOGLE_AUTHORIZATION_FAILED)
+}
+
+func TestSecretTokenSource(t *testing.T) {
+	f := newFakeGoogleOAuth(t)
+	secrets := fakeSecrets{}
+	source := newSecretTokenSource(context.Background(), f.config(), secrets)
+
+	// the vault is locked, or the account not connected
+	_, err := source.Token()
+	assert.EqualError(t, err, common.ERR_GOOGLE_NOT_CONNECTED)
+
+	secrets[GoogleOAuthSecretName] = []byte(f.refreshToken)
+	token, err := source.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "access-refreshed-1", token.AccessToken)
+	// the access token is reused until it expires
+	token, err = source.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "access-refreshed-1", token.AccessToken)
+
+	// the account was connected again
+	secrets[GoogleOAuthSecretName] = []byte("revoked")
+	_, err = source.Token()
+	assert.Error(t, err)
+}
+
+func TestNewGoogleOAuthConfig(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewGoogleOAuthConfig(filepath.Join(dir, "missing.json"))
+	assert.ErrorContains(t, err, common.ERR_INVALID_GOOGLE_CREDENTIALS)
+
+	invalid := filepath.Join(dir, "invalid.json")
+	require.NoError(t, os.WriteFile(invalid, []byte(`{"type":"service_account"}`), 0o600))
+	_, err = NewGoogleOAuthConfig(invalid)
+	assert.ErrorContains(t, err, common.ERR_INVALID_GOOGLE_CREDENTIALS)
+
+	client := filepath.Join(dir, "client_secret.json")
+	require.NoError(t, os.WriteFile(client, []byte(`{"installed":{
+		"client_id":"client-id","client_secret":"client-secret",
+		"auth_uri":"https://accounts.google.com/o/oauth2/auth","token_uri":"https://oauth2.googleapis.com/token",
+		"redirect_uris":["http://localhost"]}}`), 0o600))
+	config, err := NewGoogleOAuthConfig(client)
+	require.NoError(t, err)
+	assert.Equal(t, "client-id", config.ClientID)
+	assert.Equal(t, []string{googleSheetsScope, googleDriveAppDataScope}, config.Scopes)
+
+	// the provider is created while the vault is still locked
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	deps := ProviderDeps{
+		Config: mapConfig{
+			common.CONFIG_GOOGLE_SHEET_ID:          "sheet-id",
+			common.CONFIG_GOOGLE_OAUTH_CLIENT_FILE: client,
+		},
+		Logger:  logger,
+		Secrets: fakeSecrets{},
+	}
+	p, err := newGoogleProviderFromConfig(deps)
+	require.NoError(t, err)
+	assert.NotNil(t, p.(*GoogleProvider).tokenSource)
+
+	deps.Secrets = nil
+	_, err = newGoogleProviderFromConfig(deps)
+	assert.EqualError(t, err, common.ERR_INVALID_GOOGLE_PROVIDER_CONFIG)
+}
+
+func TestGetClientWithJWTToken_InvalidCredentials(t *testing.T) {
+	_, err := getClientWithJWTToken(context.Background(), []byte("not json"), googleSheetsScope)
+	assert.ErrorContains(t, err, common.ERR_INVALID_GOOGLE_CREDENTIALS)
+
+	missing := filepath.Join(t.TempDir(), "cred_serviceaccount.json")
+	_, err = NewGoogleProvider("notes", "sheet-id", missing, logrus.New(), nil, nil)
+	assert.ErrorContains(t, err, common.ERR_INVALID_GOOGLE_CREDENTIALS)
+}
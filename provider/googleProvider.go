@@ -4,8 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"os"
+	"sort"
 	"sync"
 	"time"
 
@@ -14,11 +15,15 @@ import (
 	"github.com/iltoga/ecnotes-go/lib/common"
 	"github.com/iltoga/ecnotes-go/model"
 	"github.com/iltoga/ecnotes-go/service/observer"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
 	"google.golang.org/api/sheets/v4"
 )
 
+// GoogleProviderName the name of the Google Sheets provider
+const GoogleProviderName = "google_sheets"
+
 type GoogleProvider struct {
 	BaseSyncNoteProvider
 	sheetsService  *sheets.Service
@@ -28,40 +33,137 @@ type GoogleProvider struct {
 	credFilePath   string
 	noteIds        map[int]int
 	notesUpdatedAt map[int]int64
+	tombstones     map[int]int64
 	idsMux         *sync.RWMutex
 	updAtMux       *sync.RWMutex
-	updateQueue    chan *model.Note
-	deleteQueue    chan int
+	rowCount       int
+	rowsMux        sync.Mutex
+	layout         *sheetLayout
+	layoutMux      sync.Mutex
+	sheetGID       *int64
 	ctx            context.Context
-	logger         *log.Logger
 	observer       observer.Observer
+	// tokenSource the tokens of the Google account connected with OAuth, nil to use the service account
+	tokenSource oauth2.TokenSource
+	// credentials the key of the service account, read from credFilePath if nil
+	credentials []byte
+	// limiter the rate limiter all the requests to the Google API go through
+	limiter *googleRateLimiter
 }
 
-// NewGoogleProvider creates a new Google provider
+// NewGoogleProvider creates a new Google provider acting as the service account whose key is in credFilePath
 func NewGoogleProvider(
 	sheetName string,
 	sheetID string,
 	credFilePath string,
 	logger *log.Logger,
 	observer observer.Observer,
+	outbox *Outbox,
 ) (*GoogleProvider, error) {
-	gp := &GoogleProvider{
+	gp := newGoogleProvider(sheetName, sheetID, logger, observer, outbox)
+	gp.credFilePath = credFilePath
+	if err := gp.Init(); err != nil {
+		return nil, err
+	}
+	return gp, nil
+}
+
+// NewGoogleServiceAccountProvider creates a new Google provider acting as the service account whose key is
+// credentials (the JSON downloaded from the Google console)
+func NewGoogleServiceAccountProvider(
+	sheetName string,
+	sheetID string,
+	credentials []byte,
+	logger *log.Logger,
+	observer observer.Observer,
+	outbox *Outbox,
+) (*GoogleProvider, error) {
+	gp := newGoogleProvider(sheetName, sheetID, logger, observer, outbox)
+	gp.credentials = credentials
+	if err := gp.Init(); err != nil {
+		return nil, err
+	}
+	return gp, nil
+}
+
+// NewGoogleOAuthProvider creates a new Google provider acting as the Google account tokenSource gets the tokens of
+func NewGoogleOAuthProvider(
+	sheetName string,
+	sheetID string,
+	tokenSource oauth2.TokenSource,
+	logger *log.Logger,
+	observer observer.Observer,
+	outbox *Outbox,
+) (*GoogleProvider, error) {
+	gp := newGoogleProvider(sheetName, sheetID, logger, observer, outbox)
+	gp.tokenSource = tokenSource
+	if err := gp.Init(); err != nil {
+		return nil, err
+	}
+	return gp, nil
+}
+
+// newGoogleProvider creates a Google provider without credentials
+func newGoogleProvider(
+	sheetName string,
+	sheetID string,
+	logger *log.Logger,
+	observer observer.Observer,
+	outbox *Outbox,
+) *GoogleProvider {
+	return &GoogleProvider{
+		BaseSyncNoteProvider: BaseSyncNoteProvider{
+			outbox: outbox,
+			logger: logger,
+		},
 		sheetName:      sheetName,
 		sheetID:        sheetID,
-		credFilePath:   credFilePath,
 		noteIds:        make(map[int]int),
 		notesUpdatedAt: make(map[int]int64),
+		tombstones:     make(map[int]int64),
 		idsMux:         &sync.RWMutex{},
 		updAtMux:       &sync.RWMutex{},
-		updateQueue:    make(chan *model.Note, 100),
-		deleteQueue:    make(chan int, 100),
-		logger:         logger,
 		observer:       observer,
+		limiter:        newGoogleRateLimiter(),
 	}
-	if err := gp.Init(); err != nil {
-		return nil, err
+}
+
+// newGoogleProviderFromConfig creates the Google Sheets provider configured in the config file: with the Google
+// account connected with OAuth if an OAuth client is set, with the service account otherwise. The key of the
+// service account is read from the cert store, or from the credentials file until it is moved there
+func newGoogleProviderFromConfig(deps ProviderDeps) (SyncNoteProvider, error) {
+	sheetID, err := deps.Config.GetConfig(common.CONFIG_GOOGLE_SHEET_ID)
+	if err != nil {
+		return nil, errors.New(common.ERR_INVALID_GOOGLE_PROVIDER_CONFIG)
 	}
-	return gp, nil
+	if clientFilePath, err := deps.Config.GetConfig(common.CONFIG_GOOGLE_OAUTH_CLIENT_FILE); err == nil && clientFilePath != "" {
+		if deps.Secrets == nil {
+			return nil, errors.New(common.ERR_INVALID_GOOGLE_PROVIDER_CONFIG)
+		}
+		config, err := NewGoogleOAuthConfig(clientFilePath)
+		if err != nil {
+			return nil, err
+		}
+		tokenSource := newSecretTokenSource(context.Background(), config, deps.Secrets)
+		return NewGoogleOAuthProvider("notes", sheetID, tokenSource, deps.Logger, deps.Observer, deps.Outbox)
+	}
+	if deps.Secrets != nil {
+		if credentials, err := deps.Secrets.GetSecret(GoogleServiceAccountSecretName); err == nil && len(credentials) > 0 {
+			return NewGoogleServiceAccountProvider("notes", sheetID, credentials, deps.Logger, deps.Observer, deps.Outbox)
+		}
+	}
+	credFilePath, _ := deps.Config.GetConfig(common.CONFIG_GOOGLE_CREDENTIALS_FILE_PATH)
+	return NewGoogleProvider("notes", sheetID, credFilePath, deps.Logger, deps.Observer, deps.Outbox)
+}
+
+// Name returns the provider type
+func (gp *GoogleProvider) Name() string {
+	return GoogleProviderName
+}
+
+// Capabilities the sheet keeps the tombstones and the UpdatedAt of the notes, and changes are pushed in the background
+func (gp *GoogleProvider) Capabilities() Capability {
+	return CapabilityTombstones | CapabilityMerge | CapabilityBackgroundPush
 }
 
 // CacheIDSet update the note ID map
@@ -112,24 +214,45 @@ func (gp *GoogleProvider) CacheUpdAtUnset(noteID int) {
 	delete(gp.notesUpdatedAt, noteID)
 }
 
-// GetNotes fetch from the provider notes with given id or all if no ids is given
+// GetNotes fetch from the provider notes with given id or all if no ids is given.
+// Malformed rows are skipped with a warning, so that they don't hide the other notes
 func (gp *GoogleProvider) GetNotes(ids ...int) ([]model.Note, error) {
-	readRange := fmt.Sprintf("%s!A2:H", gp.sheetName)
-	ctx, cancel := context.WithTimeout(gp.ctx, 10*time.Second)
-	defer cancel()
-	resp, err := gp.sheetsService.Spreadsheets.Values.Get(gp.sheetID, readRange).Context(ctx).Do()
+	layout, err := gp.loadLayout()
+	if err != nil {
+		return nil, err
+	}
+	readRange := fmt.Sprintf("%s!A2:%s", gp.sheetName, layout.lastColumn())
+	var resp *sheets.ValueRange
+	err = gp.limiter.do(gp.ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = gp.sheetsService.Spreadsheets.Values.Get(gp.sheetID, readRange).
+			ValueRenderOption("UNFORMATTED_VALUE").
+			Context(ctx).
+			Do()
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("unable to retrieve data from sheet: %w", err)
 	}
 
 	notes := make([]model.Note, 0)
 	if len(resp.Values) == 0 {
-		log.Println("No data found in google sheet.")
+		gp.logger.Infof("No data found in google sheet")
 	} else {
-		for _, row := range resp.Values {
-			// map the sheet row to a Note object
-			note := gp.ParseSheetRow(row)
-			notes = append(notes, note)
+		for idx, row := range resp.Values {
+			// skip cleared rows
+			if isEmptyRow(row) {
+				continue
+			}
+			// map the sheet row to a Note object, skipping the tombstones of deleted notes
+			note, alive, err := layout.parseLiveRow(idx+2, row)
+			if err != nil {
+				gp.logger.Warnf("Skipping malformed google sheet row: %v", err)
+				continue
+			}
+			if alive {
+				notes = append(notes, note)
+			}
 		}
 	}
 	// if ids is not empty, filter the notes
@@ -153,27 +276,81 @@ func (*GoogleProvider) FilterNotes(notes []model.Note, ids []int) []model.Note {
 	return filteredNotes
 }
 
-// GetNoteIDs returns a map of the note IDs and their index in the sheet
-// Note: populates another map with the note IDs and their UpdatedAt field to be used for the sync
-// TODO: find a way to use a single api call to get both the note IDs and the UpdatedAt fields
-func (gp *GoogleProvider) GetNoteIDs(forceRemote bool) (map[int]int, error) {
-	// always return the map from the local cache, unless forceRemote is true
-	if len(gp.noteIds) > 0 && !forceRemote {
-		return gp.noteIds, nil
-	}
-	ctx, cancel := context.WithTimeout(gp.ctx, 10*time.Second)
-	defer cancel()
-	// range used to read note IDs and UpdatedAt fields from the sheet
-	readRangeID := fmt.Sprintf("%s!A2:A", gp.sheetName)
-	respGetIDs, err := gp.sheetsService.Spreadsheets.Values.Get(gp.sheetID, readRangeID).Context(ctx).Do()
+// GetNoteIDs returns the sorted IDs of the notes in the sheet (tombstones excluded)
+func (gp *GoogleProvider) GetNoteIDs(forceRemote bool) ([]int, error) {
+	noteIds, err := gp.getNoteIDs(gp.ctx, forceRemote)
 	if err != nil {
 		return nil, err
 	}
-	readRangeUpdAt := fmt.Sprintf("%s!G2:G", gp.sheetName)
-	respGetUpdAt, err := gp.sheetsService.Spreadsheets.Values.Get(gp.sheetID, readRangeUpdAt).Context(ctx).Do()
-	if err != nil {
+	gp.updAtMux.RLock()
+	defer gp.updAtMux.RUnlock()
+	ids := make([]int, 0, len(noteIds))
+	for id := range noteIds {
+		if _, deleted := gp.tombstones[id]; !deleted {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// getNoteIDs returns a map of the note IDs and their index in the sheet (tombstones included), with the requests
+// bound to ctx.
+// Note: populates other maps with the note IDs and their UpdatedAt and DeletedAt fields to be used for the sync.
+// The columns are read with a single batch request
+func (gp *GoogleProvider) getNoteIDs(ctx context.Context, forceRemote bool) (map[int]int, error) {
+	// always return the map from the local cache, unless forceRemote is true
+	if noteIds := gp.cachedNoteIDs(); len(noteIds) > 0 && !forceRemote {
+		return noteIds, nil
+	}
+	// rows must not be allocated or deleted while the indexes are reloaded
+	gp.rowsMux.Lock()
+	defer gp.rowsMux.Unlock()
+	if err := gp.loadRows(ctx); err != nil {
 		return nil, err
 	}
+	return gp.cachedNoteIDs(), nil
+}
+
+// cachedNoteIDs returns a copy of the note ID map: the outbox worker updates it while the callers range over it
+func (gp *GoogleProvider) cachedNoteIDs() map[int]int {
+	gp.idsMux.RLock()
+	defer gp.idsMux.RUnlock()
+	noteIds := make(map[int]int, len(gp.noteIds))
+	for id, idx := range gp.noteIds {
+		noteIds[id] = idx
+	}
+	return noteIds
+}
+
+// loadRows reloads the row indexes, UpdatedAt and DeletedAt of the notes from the sheet. The caller must hold rowsMux.
+// Other devices move the rows when they purge tombstones, so the indexes are reloaded before rows are written or deleted
+func (gp *GoogleProvider) loadRows(ctx context.Context) error {
+	layout, err := gp.loadLayout()
+	if err != nil {
+		return err
+	}
+	// ranges used to read note IDs and UpdatedAt fields from the sheet
+	ranges := make([]string, 0, 3)
+	for _, col := range []string{sheetColID, sheetColUpdatedAt, sheetColDeletedAt} {
+		colName := layout.column(col)
+		ranges = append(ranges, fmt.Sprintf("%s!%s2:%s", gp.sheetName, colName, colName))
+	}
+	var resp *sheets.BatchGetValuesResponse
+	err = gp.limiter.do(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = gp.sheetsService.Spreadsheets.Values.BatchGet(gp.sheetID).
+			Ranges(ranges...).
+			ValueRenderOption("UNFORMATTED_VALUE").
+			Context(ctx).
+			Do()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	idRows, updAtRows := valueRangeRows(resp.ValueRanges, 0), valueRangeRows(resp.ValueRanges, 1)
+	deletedAtRows := valueRangeRows(resp.ValueRanges, 2)
 	// add all IDs to a slice (make it a thread-safe map)
 	gp.updAtMux.Lock()
 	defer gp.updAtMux.Unlock()
@@ -181,24 +358,38 @@ func (gp *GoogleProvider) GetNoteIDs(forceRemote bool) (map[int]int, error) {
 	defer gp.idsMux.Unlock()
 	gp.noteIds = make(map[int]int)
 	gp.notesUpdatedAt = make(map[int]int64)
-	for idx, row := range respGetIDs.Values {
-		if len(row) < 1 {
+	gp.tombstones = make(map[int]int64)
+	// rows without a valid ID still take space: new notes are appended after the last row
+	gp.rowCount = max(len(idRows), len(updAtRows), len(deletedAtRows))
+	for idx, row := range idRows {
+		// the columns are read as single-column rows
+		noteID, updAt, deletedAt, err := parseIDRow(idx+2, row, rowAt(updAtRows, idx), rowAt(deletedAtRows, idx))
+		if err != nil {
+			// a malformed row must not block the sync of the other notes
+			gp.logger.Warnf("Skipping malformed google sheet row: %v", err)
+			continue
+		}
+		if noteID == 0 {
 			continue
 		}
 		// populate the note ID map with the note ID and its index in the slice
-		noteID := common.StringToInt(row[0].(string))
 		gp.CacheIDSet(noteID, idx, true)
 		// populate the note updated at map with the note ID and its updated at field
-		updAtVal := common.StringToInt64(respGetUpdAt.Values[idx][0].(string))
-		gp.CacheUpdAtSet(noteID, updAtVal, true)
+		gp.CacheUpdAtSet(noteID, updAt, true)
+		if deletedAt > 0 {
+			gp.tombstones[noteID] = deletedAt
+		}
 	}
-	return gp.noteIds, nil
+	return nil
 }
 
 // GetNote returns the note with the given id
 func (gp *GoogleProvider) GetNote(id int) (*model.Note, error) {
 	// if noteIds map is empty, populate it
-	if len(gp.noteIds) == 0 {
+	gp.idsMux.RLock()
+	empty := len(gp.noteIds) == 0
+	gp.idsMux.RUnlock()
+	if empty {
 		_, err := gp.GetNoteIDs(true)
 		if err != nil {
 			return nil, err
@@ -210,295 +401,565 @@ func (gp *GoogleProvider) GetNote(id int) (*model.Note, error) {
 		return nil, errors.New(common.ERR_NOTE_NOT_FOUND)
 	}
 	noteIDx += 2 // add 2 to the index to get the correct row
-	ctx, cancel := context.WithTimeout(gp.ctx, 10*time.Second)
-	defer cancel()
-	readRangeRow := fmt.Sprintf("%s!A%d:H%d", gp.sheetName, noteIDx, noteIDx)
+	layout, err := gp.loadLayout()
+	if err != nil {
+		return nil, err
+	}
+	readRangeRow := fmt.Sprintf("%s!A%d:%s%d", gp.sheetName, noteIDx, layout.lastColumn(), noteIDx)
 	// read the note from sheet in readRangeRow
-	respGetNote, err := gp.sheetsService.Spreadsheets.Values.Get(gp.sheetID, readRangeRow).Context(ctx).Do()
+	var respGetNote *sheets.ValueRange
+	err = gp.limiter.do(gp.ctx, func(ctx context.Context) error {
+		var err error
+		respGetNote, err = gp.sheetsService.Spreadsheets.Values.Get(gp.sheetID, readRangeRow).
+			ValueRenderOption("UNFORMATTED_VALUE").
+			Context(ctx).
+			Do()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	// parse the note from the sheet
-	if len(respGetNote.Values) == 0 {
+	if len(respGetNote.Values) == 0 || isEmptyRow(respGetNote.Values[0]) {
 		return nil, errors.New(common.ERR_NOTE_NOT_FOUND)
 	}
 	row := respGetNote.Values[0]
-	note := gp.ParseSheetRow(row)
+	note, alive, err := layout.parseLiveRow(noteIDx, row)
+	if err != nil {
+		return nil, err
+	}
+	if !alive {
+		return nil, errors.New(common.ERR_NOTE_NOT_FOUND)
+	}
 	return &note, nil
 }
 
-// PutNote pushes a note to the provider
-// if the note does not exist, it will be created
-func (gp *GoogleProvider) PutNote(note *model.Note) error {
-	// if noteIds map is empty, populate it
-	if len(gp.noteIds) == 0 {
-		_, err := gp.GetNoteIDs(true)
-		if err != nil {
+// fetchNotes reads the notes with the given ids with batch requests of up to sheetBatchSize rows.
+// Notes missing from the sheet or stored in malformed rows are skipped
+func (gp *GoogleProvider) fetchNotes(ctx context.Context, ids []int) ([]model.Note, error) {
+	if len(ids) == 0 {
+		return []model.Note{}, nil
+	}
+	layout, err := gp.loadLayout()
+	if err != nil {
+		return nil, err
+	}
+	rowNums := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if idx, ok := gp.CacheIDGet(id); ok {
+			rowNums = append(rowNums, idx+2)
+		}
+	}
+	notes := make([]model.Note, 0, len(rowNums))
+	for start := 0; start < len(rowNums); start += sheetBatchSize {
+		end := min(start+sheetBatchSize, len(rowNums))
+		ranges := make([]string, 0, end-start)
+		for _, rowNum := range rowNums[start:end] {
+			ranges = append(ranges, fmt.Sprintf("%s!A%d:%s%d", gp.sheetName, rowNum, layout.lastColumn(), rowNum))
+		}
+		var resp *sheets.BatchGetValuesResponse
+		err := gp.limiter.do(ctx, func(ctx context.Context) error {
+			var err error
+			resp, err = gp.sheetsService.Spreadsheets.Values.BatchGet(gp.sheetID).
+				Ranges(ranges...).
+				ValueRenderOption("UNFORMATTED_VALUE").
+				Context(ctx).
+				Do()
 			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i, rowNum := range rowNums[start:end] {
+			rows := valueRangeRows(resp.ValueRanges, i)
+			if len(rows) == 0 || isEmptyRow(rows[0]) {
+				gp.logger.Warnf("Skipping empty google sheet row %d", rowNum)
+				continue
+			}
+			note, alive, err := layout.parseLiveRow(rowNum, rows[0])
+			if err != nil {
+				gp.logger.Warnf("Skipping malformed google sheet row: %v", err)
+				continue
+			}
+			if alive {
+				notes = append(notes, note)
+			}
 		}
 	}
-	// check if the note ID is in the map
-	noteIDx, ok := gp.CacheIDGet(note.ID)
-	if !ok {
-		// if not, create a new row at the end of the sheet
-		cacheIdx := len(gp.noteIds)
-		noteIDx = cacheIdx + 2 // add 2 to the index to get the correct row
-		// add the note to the map
-		gp.CacheIDSet(note.ID, cacheIdx, false)
-	} else {
-		// if yes, update the row
-		noteIDx += 2 // add 2 to the index to get the correct row
-	}
-	// create/update a new row in the sheet
-	writeRange := fmt.Sprintf("%s!A%d:H%d", gp.sheetName, noteIDx, noteIDx)
-	values := [][]interface{}{
-		{note.ID, note.Title, note.Content, note.Hidden, note.Encrypted, note.EncKeyName, note.CreatedAt, note.UpdatedAt},
-	}
-	ctx, cancel := context.WithTimeout(gp.ctx, 10*time.Second)
-	defer cancel()
-	_, err := gp.sheetsService.Spreadsheets.Values.Update(gp.sheetID, writeRange, &sheets.ValueRange{
-		Values: values,
-	}).Context(ctx).ValueInputOption("USER_ENTERED").Do()
+	return notes, nil
+}
+
+// PutNote pushes a note to the provider
+// if the note does not exist, it will be created
+func (gp *GoogleProvider) PutNote(note *model.Note) error {
+	return gp.PutNotes([]*model.Note{note})
+}
+
+// PutNotes pushes notes to the provider with batch requests of up to sheetBatchSize rows.
+// Notes that do not exist are appended to the sheet
+func (gp *GoogleProvider) PutNotes(notes []*model.Note) error {
+	entries, err := gp.noteEntries(notes)
 	if err != nil {
 		return err
 	}
-	return nil
+	return gp.writeRows(gp.ctx, entries)
 }
 
-// DeleteNote deletes the note with the given id
+// DeleteNote deletes the note with the given id, replacing it with a tombstone
 func (gp *GoogleProvider) DeleteNote(id int) error {
-	// if noteIds map is empty, populate it
-	if len(gp.noteIds) == 0 {
-		_, err := gp.GetNoteIDs(true)
+	return gp.PutTombstones([]model.Tombstone{{ID: id, DeletedAt: common.GetCurrentTimestamp()}})
+}
+
+// PutTombstones pushes the tombstones of deleted notes, replacing their rows (or appending new ones),
+// so that the other devices delete them at their next sync
+func (gp *GoogleProvider) PutTombstones(tombstones []model.Tombstone) error {
+	entries, err := gp.tombstoneEntries(tombstones)
+	if err != nil {
+		return err
+	}
+	return gp.writeRows(gp.ctx, entries)
+}
+
+// pushEntries writes notes and tombstones with the same batch request
+func (gp *GoogleProvider) pushEntries(ctx context.Context, notes []*model.Note, tombstones []model.Tombstone) error {
+	entries, err := gp.noteEntries(notes)
+	if err != nil {
+		return err
+	}
+	tombstoneEntries, err := gp.tombstoneEntries(tombstones)
+	if err != nil {
+		return err
+	}
+	return gp.writeRows(ctx, append(entries, tombstoneEntries...))
+}
+
+// sheetEntry a row to be written to the sheet
+type sheetEntry struct {
+	id        int
+	updatedAt int64
+	deletedAt int64
+	row       []interface{}
+}
+
+// noteEntries maps notes to the rows to be written
+func (gp *GoogleProvider) noteEntries(notes []*model.Note) ([]sheetEntry, error) {
+	entries := make([]sheetEntry, len(notes))
+	for i, note := range notes {
+		row, err := gp.NoteToSheetRow(note)
 		if err != nil {
+			return nil, err
+		}
+		entries[i] = sheetEntry{id: note.ID, updatedAt: note.UpdatedAt, row: row}
+	}
+	return entries, nil
+}
+
+// tombstoneEntries maps tombstones to the rows to be written
+func (gp *GoogleProvider) tombstoneEntries(tombstones []model.Tombstone) ([]sheetEntry, error) {
+	if len(tombstones) == 0 {
+		return nil, nil
+	}
+	layout, err := gp.loadLayout()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]sheetEntry, len(tombstones))
+	for i, tombstone := range tombstones {
+		entries[i] = sheetEntry{
+			id:        tombstone.ID,
+			updatedAt: tombstone.DeletedAt,
+			deletedAt: tombstone.DeletedAt,
+			row:       layout.buildTombstoneRow(tombstone),
+		}
+	}
+	return entries, nil
+}
+
+// writeRows writes rows with batch requests of up to sheetBatchSize rows.
+// The row indexes are reloaded before each batch, and the rows of unknown notes are appended to the sheet
+func (gp *GoogleProvider) writeRows(ctx context.Context, entries []sheetEntry) error {
+	for start := 0; start < len(entries); start += sheetBatchSize {
+		end := min(start+sheetBatchSize, len(entries))
+		if err := gp.writeBatch(ctx, entries[start:end]); err != nil {
 			return err
 		}
 	}
-	// check if the note ID is in the map
-	noteIDx, ok := gp.CacheIDGet(id)
-	if !ok {
-		return errors.New(common.ERR_NOTE_NOT_FOUND)
+	return nil
+}
+
+// writeBatch writes rows with one batch request, at the indexes read from the sheet right before
+func (gp *GoogleProvider) writeBatch(ctx context.Context, entries []sheetEntry) error {
+	// row indexes must not shift while they are allocated and written
+	gp.rowsMux.Lock()
+	defer gp.rowsMux.Unlock()
+	if err := gp.loadRows(ctx); err != nil {
+		return err
 	}
-	noteIDx += 2 // add 2 to the index to get the correct row
-	// delete the row from the sheet
-	ctx, cancel := context.WithTimeout(gp.ctx, 10*time.Second)
-	defer cancel()
-	deleteRange := fmt.Sprintf("%s!A%d:H%d", gp.sheetName, noteIDx, noteIDx)
-	_, err := gp.sheetsService.Spreadsheets.Values.Clear(gp.sheetID, deleteRange, &sheets.ClearValuesRequest{}).
-		Context(ctx).
-		Do()
+	data := make([]*sheets.ValueRange, len(entries))
+	for i, entry := range entries {
+		noteIDx := gp.rowIndex(entry.id) + 2 // add 2 to the index to get the correct row
+		data[i] = &sheets.ValueRange{
+			Range:  fmt.Sprintf("%s!A%d:%s%d", gp.sheetName, noteIDx, columnName(len(entry.row)-1), noteIDx),
+			Values: [][]interface{}{entry.row},
+		}
+	}
+	// RAW: content chunks and checksums must not be parsed as formulas, numbers or times
+	err := gp.limiter.do(ctx, func(ctx context.Context) error {
+		_, err := gp.sheetsService.Spreadsheets.Values.BatchUpdate(gp.sheetID, &sheets.BatchUpdateValuesRequest{
+			ValueInputOption: "RAW",
+			Data:             data,
+		}).Context(ctx).Do()
+		return err
+	})
 	if err != nil {
+		// the rows allocated to new notes may not exist: reload the indexes on the next request
+		gp.resetCache()
 		return err
 	}
-	// delete the note from the map
-	gp.CacheIDUnset(id)
+	gp.updAtMux.Lock()
+	defer gp.updAtMux.Unlock()
+	for _, entry := range entries {
+		gp.CacheUpdAtSet(entry.id, entry.updatedAt, true)
+		if entry.deletedAt > 0 {
+			gp.tombstones[entry.id] = entry.deletedAt
+		} else {
+			delete(gp.tombstones, entry.id)
+		}
+	}
 	return nil
 }
 
-// SyncNotes syncs the notes from the provider to the local database and vice versa
-// to correctly sync, we need to get all note ID (columb A of the sheet) and UpdatedAt fields (column G of the sheet) from the provider, then we need to get all notes from the local database, then we need to compare the two lists and sync the notes
-// return the notes to be added to the local database
-func (gp *GoogleProvider) SyncNotes(syncCtx context.Context, dbNotes []model.Note) (downloaded []model.Note, err error) {
-	// get ids and updated at from the provider
-	noteIds, err := gp.GetNoteIDs(true)
-	if err != nil {
-		return nil, err
+// PurgeTombstones garbage-collects the tombstones of notes deleted before the given timestamp (ms).
+// Their rows are removed from the sheet, which stays compact
+func (gp *GoogleProvider) PurgeTombstones(before int64) error {
+	gp.rowsMux.Lock()
+	defer gp.rowsMux.Unlock()
+	if err := gp.loadRows(gp.ctx); err != nil {
+		return err
 	}
 	gp.updAtMux.RLock()
-	noteUpdAt := gp.notesUpdatedAt
-	gp.updAtMux.RUnlock()
-
-	// loop through the local notes and check if they exist in the provider.
-	// if they do not exist, put them in the provider
-	// if they do exist, check if they have been updated since the last sync and update them in the provider if they have
-	for idx, dbNote := range dbNotes {
-		// check if the note exists in the provider
-		_, ok := noteIds[dbNote.ID]
-		if !ok {
-			// if not, create it
-			err := gp.PutNote(&dbNote)
-			if err != nil {
-				return nil, err
-			}
+	rows := make(map[int]int)
+	expired := make([]int, 0)
+	for id, deletedAt := range gp.tombstones {
+		if deletedAt >= before {
 			continue
 		}
-		// if yes, check if it has been updated since the last sync
-		if dbNote.UpdatedAt > noteUpdAt[dbNote.ID] {
-			// if yes, update it in the provider
-			err := gp.PutNote(&dbNote)
-			if err != nil {
-				return nil, err
-			}
+		// a tombstone without a row must not delete the row of another note
+		idx, ok := gp.CacheIDGet(id)
+		if !ok {
 			continue
 		}
-		// if the the note from the provider has been updated since the last sync, update the local note with the new data
-		if dbNote.UpdatedAt < noteUpdAt[dbNote.ID] {
-			// get the note from the provider
-			note, err := gp.GetNote(dbNote.ID)
-			if err != nil {
-				return nil, err
-			}
-			// update the local note with the new data
-			dbNotes[idx] = *note
-		}
+		rows[id] = idx
+		expired = append(expired, id)
 	}
-	// loop through the provider notes and check if they exist in the local database.
-	// if they do not exist, get them from the provider and put them in the local database
-	toAdd := make([]model.Note, 0)
-	for noteID, _ := range noteIds {
-		// check if the noteID exists dbNotes
-		if len(dbNotes) == 0 {
-			// if dbNotes is empty, get the note from the provider
-			note, err := gp.GetNote(noteID)
-			if err != nil {
-				return nil, err
-			}
-			// add the note to the local database
-			toAdd = append(toAdd, *note)
-			continue
-		}
-		// if the noteID does not exist in dbNotes, get it from the provider
-		found := false
-		for _, dbNote := range dbNotes {
-			if dbNote.ID == noteID {
-				found = true
-				break
-			}
+	gp.updAtMux.RUnlock()
+	if len(expired) == 0 {
+		return nil
+	}
+	gid, err := gp.loadSheetGID()
+	if err != nil {
+		return err
+	}
+	// rows are deleted bottom-up, so that the indexes of the following requests stay valid
+	sort.Slice(expired, func(i, j int) bool { return rows[expired[i]] > rows[expired[j]] })
+	requests := make([]*sheets.Request, 0, len(expired))
+	for _, id := range expired {
+		// dimension indexes are 0-based and the header is row 0
+		requests = append(requests, &sheets.Request{
+			DeleteDimension: &sheets.DeleteDimensionRequest{
+				Range: &sheets.DimensionRange{
+					SheetId:    gid,
+					Dimension:  "ROWS",
+					StartIndex: int64(rows[id] + 1),
+					EndIndex:   int64(rows[id] + 2),
+					// the first sheet of a spreadsheet has id 0
+					ForceSendFields: []string{"SheetId"},
+				},
+			},
+		})
+	}
+	err = gp.limiter.do(gp.ctx, func(ctx context.Context) error {
+		_, err := gp.sheetsService.Spreadsheets.BatchUpdate(gp.sheetID, &sheets.BatchUpdateSpreadsheetRequest{
+			Requests: requests,
+		}).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		gp.resetCache()
+		return err
+	}
+	for _, id := range expired {
+		gp.removeRow(id, rows[id])
+	}
+	return nil
+}
+
+// rowIndex returns the cached row index of a note, allocating a new row at the end of the sheet for new notes
+func (gp *GoogleProvider) rowIndex(noteID int) int {
+	gp.idsMux.Lock()
+	defer gp.idsMux.Unlock()
+	if idx, ok := gp.noteIds[noteID]; ok {
+		return idx
+	}
+	idx := gp.rowCount
+	gp.noteIds[noteID] = idx
+	gp.rowCount++
+	return idx
+}
+
+// removeRow removes a deleted note from the caches and shifts up the rows below it
+func (gp *GoogleProvider) removeRow(noteID int, noteIDx int) {
+	gp.idsMux.Lock()
+	delete(gp.noteIds, noteID)
+	for id, idx := range gp.noteIds {
+		if idx > noteIDx {
+			gp.noteIds[id] = idx - 1
 		}
-		if !found {
-			// get the note from the provider
-			note, err := gp.GetNote(noteID)
-			if err != nil {
-				return nil, err
-			}
-			// add the note to the local database
-			toAdd = append(toAdd, *note)
+	}
+	if gp.rowCount > 0 {
+		gp.rowCount--
+	}
+	gp.idsMux.Unlock()
+	gp.updAtMux.Lock()
+	delete(gp.notesUpdatedAt, noteID)
+	delete(gp.tombstones, noteID)
+	gp.updAtMux.Unlock()
+}
+
+// resetCache empties the caches, so that they are reloaded from the sheet
+func (gp *GoogleProvider) resetCache() {
+	gp.updAtMux.Lock()
+	defer gp.updAtMux.Unlock()
+	gp.idsMux.Lock()
+	defer gp.idsMux.Unlock()
+	gp.noteIds = make(map[int]int)
+	gp.notesUpdatedAt = make(map[int]int64)
+	gp.tombstones = make(map[int]int64)
+	gp.rowCount = 0
+}
+
+// loadSheetGID returns the numeric id of the notes sheet, needed by the structural requests (eg. deleting rows)
+func (gp *GoogleProvider) loadSheetGID() (int64, error) {
+	if gp.sheetGID != nil {
+		return *gp.sheetGID, nil
+	}
+	var resp *sheets.Spreadsheet
+	err := gp.limiter.do(gp.ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = gp.sheetsService.Spreadsheets.Get(gp.sheetID).
+			Fields("sheets.properties(sheetId,title)").
+			Context(ctx).
+			Do()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, sheet := range resp.Sheets {
+		if sheet.Properties != nil && sheet.Properties.Title == gp.sheetName {
+			gid := sheet.Properties.SheetId
+			gp.sheetGID = &gid
+			return gid, nil
 		}
+	}
+	return 0, errors.New(common.ERR_SHEET_NOT_FOUND)
+}
 
+// RemoteVersions returns the UpdatedAt and DeletedAt of the notes in the sheet, reading them again
+func (gp *GoogleProvider) RemoteVersions(ctx context.Context) (map[int]int64, map[int]int64, error) {
+	// get ids, updated at and deleted at from the provider
+	if _, err := gp.getNoteIDs(ctx, true); err != nil {
+		return nil, nil, err
+	}
+	gp.updAtMux.RLock()
+	defer gp.updAtMux.RUnlock()
+	noteUpdAt := make(map[int]int64, len(gp.notesUpdatedAt))
+	for id, updAt := range gp.notesUpdatedAt {
+		noteUpdAt[id] = updAt
+	}
+	remoteTombstones := make(map[int]int64, len(gp.tombstones))
+	for id, deletedAt := range gp.tombstones {
+		remoteTombstones[id] = deletedAt
 	}
+	return noteUpdAt, remoteTombstones, nil
+}
 
-	// build the note titles array
-	noteTitles := make([]string, len(dbNotes))
-	for idx, note := range dbNotes {
-		noteTitles[idx] = note.Title
+// SyncNotes syncs the notes from the provider to the local database and vice versa
+// to correctly sync, we need to get all note ID, UpdatedAt and DeletedAt fields from the provider, then we need to compare
+// them with the local notes and tombstones (see planSync) and sync the notes.
+// Notes and tombstones are pushed and fetched with batch requests
+func (gp *GoogleProvider) SyncNotes(syncCtx context.Context, dbNotes []model.Note, dbTombstones []model.Tombstone, bases map[int]int64) (*SyncResult, error) {
+	noteUpdAt, remoteTombstones, err := gp.RemoteVersions(syncCtx)
+	if err != nil {
+		return nil, err
 	}
+	plan := planSync(dbNotes, dbTombstones, bases, noteUpdAt, remoteTombstones)
+	if err := gp.pushEntries(syncCtx, plan.toPush, plan.toBury); err != nil {
+		return nil, err
+	}
+	fetched, err := gp.fetchNotes(syncCtx, plan.toFetch)
+	if err != nil {
+		return nil, err
+	}
+	result, noteTitles := plan.result(fetched)
 	gp.observer.Notify(observer.EVENT_UPDATE_NOTE_TITLES, noteTitles)
-	return toAdd, nil
+	return result, nil
 }
 
 // Init initializes the provider
 func (gp *GoogleProvider) Init() error {
-	if gp.sheetID == "" || gp.sheetName == "" || gp.credFilePath == "" {
+	if gp.sheetID == "" || gp.sheetName == "" || (gp.credFilePath == "" && gp.credentials == nil && gp.tokenSource == nil) {
 		return errors.New(common.ERR_INVALID_GOOGLE_PROVIDER_CONFIG)
 	}
 	gp.ctx = context.Background()
-	client, err := getClientWithJWTToken(gp.ctx, gp.credFilePath)
-	if err != nil {
-		return err
+	var client *http.Client
+	var err error
+	if gp.tokenSource != nil {
+		client = oauth2.NewClient(gp.ctx, gp.tokenSource)
+	} else {
+		credentials := gp.credentials
+		if credentials == nil {
+			if credentials, err = os.ReadFile(gp.credFilePath); err != nil {
+				return fmt.Errorf("%s: %w", common.ERR_INVALID_GOOGLE_CREDENTIALS, err)
+			}
+		}
+		if client, err = getClientWithJWTToken(gp.ctx, credentials, googleSheetsScope); err != nil {
+			return err
+		}
 	}
 	gp.client = client
 	gp.sheetsService, err = sheets.NewService(gp.ctx, option.WithHTTPClient(client))
 	return err
 }
 
-// getClientWithJWTToken gets a http client with jwt token from service account
-func getClientWithJWTToken(ctx context.Context, credFilePath string) (*http.Client, error) {
-	c, err := ioutil.ReadFile(credFilePath)
+// getClientWithJWTToken gets a http client with jwt token from the key of the service account, granted the given scopes
+func getClientWithJWTToken(ctx context.Context, credentials []byte, scopes ...string) (*http.Client, error) {
+	config, err := google.JWTConfigFromJSON(credentials, scopes...)
 	if err != nil {
-		return nil, err
-	}
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.JWTConfigFromJSON(c, "https://www.googleapis.com/auth/spreadsheets")
-	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+		return nil, fmt.Errorf("%s: %w", common.ERR_INVALID_GOOGLE_CREDENTIALS, err)
 	}
 	return config.Client(ctx), nil
 }
 
-// ParseSheetRow maps the sheet row to a Note object
-func (*GoogleProvider) ParseSheetRow(row []interface{}) model.Note {
-	note := model.Note{
-		ID:         common.StringToInt(row[0].(string)),
-		Title:      row[1].(string),
-		Content:    row[2].(string),
-		Hidden:     common.StringToBool(row[3].(string)),
-		Encrypted:  common.StringToBool(row[4].(string)),
-		EncKeyName: row[5].(string),
-		CreatedAt:  common.StringToInt64(row[6].(string)),
-		UpdatedAt:  common.StringToInt64(row[7].(string)),
+// ParseSheetRow maps the sheet row with the given row number to a Note object, reassembling chunked contents.
+// Malformed rows are reported as *RowError
+func (gp *GoogleProvider) ParseSheetRow(rowNum int, row []interface{}) (model.Note, error) {
+	layout, err := gp.loadLayout()
+	if err != nil {
+		return model.Note{}, err
 	}
-	return note
+	return layout.parseRow(rowNum, row)
 }
 
-// UpdateNoteNotifier creates a new note observer to notify the provider when a note is created or updated
-func (gp *GoogleProvider) UpdateNoteNotifier() observer.Listener {
-	return observer.Listener{
-		OnNotify: func(note interface{}, args ...interface{}) {
-			if note == nil {
-				return
-			}
-			// the encrypted note is args[2]. Check if exists and if it is encrypted
-			if len(args) < 3 {
-				gp.logger.Error("The note is not encrypted. Cannot push it to google sheets")
-				return
-			}
-			n, ok := args[2].(*model.Note)
-			if !ok {
-				gp.logger.Errorf("Error cannot cast note struct: %v", note)
-				return
-			}
-
-			// Add note to update queue instead of pulling synchronously
-			select {
-			case gp.updateQueue <- n:
-			default:
-				gp.logger.Warn("Update queue full, dropping Google Sheet sync for note ID", n.ID)
-			}
-		},
+// NoteToSheetRow maps a Note object to a sheet row, following the sheet header
+func (gp *GoogleProvider) NoteToSheetRow(note *model.Note) ([]interface{}, error) {
+	layout, err := gp.loadLayout()
+	if err != nil {
+		return nil, err
 	}
+	return layout.buildRow(note)
 }
 
-// DeleteNoteNotifier creates a new note observer to notify the provider when a note is deleted
-func (gp *GoogleProvider) DeleteNoteNotifier() observer.Listener {
-	return observer.Listener{
-		OnNotify: func(note interface{}, args ...interface{}) {
-			if note == nil {
-				return
-			}
-			n, ok := note.(*model.Note)
-			if !ok {
-				gp.logger.Errorf("Error cannot cast note struct: %v", note)
-				return
-			}
-
-			// add the note ID to the delete queue
-			select {
-			case gp.deleteQueue <- n.ID:
-			default:
-				gp.logger.Warn("Delete queue full, dropping Google Sheet sync for note ID", n.ID)
-			}
-		},
+// loadLayout reads the header row of the sheet, to map the note fields to their columns.
+// Columns missing from the header (eg. all of them in a new sheet) are appended to it
+func (gp *GoogleProvider) loadLayout() (*sheetLayout, error) {
+	gp.layoutMux.Lock()
+	defer gp.layoutMux.Unlock()
+	if gp.layout != nil {
+		return gp.layout, nil
+	}
+	var resp *sheets.ValueRange
+	err := gp.limiter.do(gp.ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = gp.sheetsService.Spreadsheets.Values.Get(gp.sheetID, fmt.Sprintf("%s!1:1", gp.sheetName)).
+			Context(ctx).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the sheet header: %w", err)
+	}
+	header := make([]interface{}, 0)
+	if len(resp.Values) > 0 {
+		header = resp.Values[0]
+	}
+	layout := newSheetLayout(header)
+	missing := layout.missing()
+	if len(missing) > 0 {
+		first := layout.width
+		cells := make([]interface{}, len(missing))
+		for i, col := range missing {
+			cells[i] = col
+			layout.add(col)
+		}
+		writeRange := fmt.Sprintf("%s!%s1:%s1", gp.sheetName, columnName(first), layout.lastColumn())
+		err = gp.limiter.do(gp.ctx, func(ctx context.Context) error {
+			_, err := gp.sheetsService.Spreadsheets.Values.Update(gp.sheetID, writeRange, &sheets.ValueRange{
+				Values: [][]interface{}{cells},
+			}).Context(ctx).ValueInputOption("RAW").Do()
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to write the sheet header: %w", err)
+		}
 	}
+	gp.layout = layout
+	return layout, nil
 }
 
-// InitWorker starts a background worker that processes sync queues
+// InitWorker starts a background worker that pushes the outbox changes
 func (gp *GoogleProvider) InitWorker(ctx context.Context) {
-	go func() {
-		gp.logger.Info("Starting Google Sheets sync worker")
-		for {
-			select {
-			case <-ctx.Done():
-				gp.logger.Info("Shutting down Google Sheets sync worker")
-				return
-			case note := <-gp.updateQueue:
-				if err := gp.PutNote(note); err != nil {
-					gp.logger.Errorf("Worker error pushing note to google sheets (ID %d): %v", note.ID, err)
-				}
-			case id := <-gp.deleteQueue:
-				if err := gp.DeleteNote(id); err != nil {
-					gp.logger.Errorf("Worker error deleting from google sheets (ID %d): %v", id, err)
-				}
+	gp.runWorker(ctx, gp.flushOutbox)
+}
+
+// flushOutbox pushes the outbox changes that are due with one batch request, and returns how long to wait for the next ones.
+// Failed changes are rescheduled with a backoff
+func (gp *GoogleProvider) flushOutbox(ctx context.Context) time.Duration {
+	pending, wait, err := gp.outbox.Due(sheetBatchSize)
+	if err != nil {
+		gp.logger.Errorf("Worker error reading the google sheets outbox: %v", err)
+		return outboxBaseDelay
+	}
+	if len(pending) == 0 {
+		return wait
+	}
+	rows := make([]sheetEntry, 0, len(pending))
+	batch := make([]model.OutboxEntry, 0, len(pending))
+	for _, entry := range pending {
+		var entries []sheetEntry
+		switch {
+		case entry.Tombstone != nil:
+			entries, err = gp.tombstoneEntries([]model.Tombstone{*entry.Tombstone})
+		case entry.Note != nil:
+			entries, err = gp.noteEntries([]*model.Note{entry.Note})
+		default:
+			// nothing to push: drop it
+			batch = append(batch, entry)
+			continue
+		}
+		// a change that can't be written (eg. a note too large) must not hold back the others
+		if err != nil {
+			gp.logger.Errorf("Worker error pushing note ID %d to google sheets: %v", entry.ID, err)
+			if err := gp.outbox.Retry([]model.OutboxEntry{entry}, err); err != nil {
+				gp.logger.Errorf("Worker error rescheduling the google sheets outbox: %v", err)
+				return outboxBaseDelay
 			}
+			continue
+		}
+		rows = append(rows, entries...)
+		batch = append(batch, entry)
+	}
+	if err := gp.writeRows(ctx, rows); err != nil {
+		gp.logger.Errorf("Worker error pushing %d changes to google sheets: %v", len(batch), err)
+		if err := gp.outbox.Retry(batch, err); err != nil {
+			gp.logger.Errorf("Worker error rescheduling the google sheets outbox: %v", err)
+			return outboxBaseDelay
 		}
-	}()
+		return 0
+	}
+	if err := gp.outbox.Done(batch); err != nil {
+		gp.logger.Errorf("Worker error updating the google sheets outbox: %v", err)
+		return outboxBaseDelay
+	}
+	return 0
 }
@@ -3,6 +3,7 @@ package provider
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"path/filepath"
@@ -30,6 +31,9 @@ type requestRecord struct {
 type responseStep struct {
 	body    string
 	validate func(*testing.T, requestRecord)
+	// status and header of the response, if not the default ones
+	status int
+	header http.Header
 }
 
 type scriptedTransport struct {
@@ -37,6 +41,7 @@ type scriptedTransport struct {
 	responses  []responseStep
 	mu         sync.Mutex
 	requests   []requestRecord
+	statusCode int
 }
 
 func (s *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -71,9 +76,20 @@ func (s *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error)
 		respBody = "{}"
 	}
 
+	statusCode := s.statusCode
+	if step.status != 0 {
+		statusCode = step.status
+	}
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	header := step.header
+	if header == nil {
+		header = make(http.Header)
+	}
 	return &http.Response{
-		StatusCode: 200,
-		Header:     make(http.Header),
+		StatusCode: statusCode,
+		Header:     header,
 		Body:       io.NopCloser(strings.NewReader(respBody)),
 		Request:    req,
 	}, nil
@@ -94,19 +110,24 @@ func newTestGoogleProvider(t *testing.T, responses ...responseStep) (*GoogleProv
 	logger.SetOutput(io.Discard)
 
 	gp := &GoogleProvider{
+		BaseSyncNoteProvider: BaseSyncNoteProvider{
+			outbox: NewOutbox(newMemoryOutboxStore(), GoogleProviderName, nil),
+			logger: logger,
+		},
 		sheetsService:  svc,
 		client:         client,
 		sheetName:      "notes",
 		sheetID:        "sheet-id",
 		noteIds:        map[int]int{},
 		notesUpdatedAt: map[int]int64{},
+		tombstones:     map[int]int64{},
 		idsMux:         &sync.RWMutex{},
 		updAtMux:       &sync.RWMutex{},
-		updateQueue:    make(chan *model.Note, 10),
-		deleteQueue:    make(chan int, 10),
+		layout:         defaultSheetLayout(),
 		ctx:            context.Background(),
-		logger:         logger,
 		observer:       &observer.ObserverImpl{},
+		// requests are not retried, unless a test asks for it
+		limiter: &googleRateLimiter{maxAttempts: 1, baseDelay: time.Millisecond},
 	}
 	return gp, transport
 }
@@ -147,7 +168,7 @@ func TestGoogleProvider_InitAndConstructorErrors(t *testing.T) {
 	logger.SetOutput(io.Discard)
 	obs := &observer.ObserverImpl{}
 
-	gp, err := NewGoogleProvider("", "", "", logger, obs)
+	gp, err := NewGoogleProvider("", "", "", logger, obs, nil)
 	require.Error(t, err)
 	assert.Nil(t, gp)
 
@@ -164,13 +185,42 @@ func TestGoogleProvider_GetNoteIDs_UsesCacheWhenAllowed(t *testing.T) {
 	t.Parallel()
 
 	gp := &GoogleProvider{
-		noteIds: map[int]int{1: 0},
+		noteIds:    map[int]int{1: 0, 2: 1},
+		tombstones: map[int]int64{2: 100},
+		updAtMux:   &sync.RWMutex{},
+		idsMux:     &sync.RWMutex{},
 	}
 
 	ids, err := gp.GetNoteIDs(false)
 	require.NoError(t, err)
-	require.Len(t, ids, 1)
-	assert.Equal(t, 0, ids[1])
+	assert.Equal(t, []int{1}, ids)
+}
+
+func TestGoogleProvider_GetNoteIDs_ConcurrentCacheWrites(t *testing.T) {
+	t.Parallel()
+
+	gp := &GoogleProvider{
+		noteIds:    map[int]int{1: 0},
+		tombstones: map[int]int64{},
+		updAtMux:   &sync.RWMutex{},
+		idsMux:     &sync.RWMutex{},
+	}
+	// the outbox worker caches the rows it appends while the IDs are read
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 2; i < 2000; i++ {
+			gp.CacheIDSet(i, i-1, false)
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		_, err := gp.GetNoteIDs(false)
+		require.NoError(t, err)
+	}
+	<-done
+	ids, err := gp.GetNoteIDs(false)
+	require.NoError(t, err)
+	assert.Len(t, ids, 1999)
 }
 
 func TestGoogleProvider_GetNote_NotFound(t *testing.T) {
@@ -210,20 +260,11 @@ func TestGoogleProvider_GetNotes_FilterAndParse(t *testing.T) {
 func TestGoogleProvider_PutGetDeleteRoundTrip(t *testing.T) {
 	gp, transport := newTestGoogleProvider(t,
 		responseStep{
-			body: `{"values":[["1"],["2"]]}`,
-		},
-		responseStep{
-			body: `{"values":[["100"],["200"]]}`,
+			body: `{"valueRanges":[{"values":[["1"],["2"]]},{"values":[["100"],["200"]]},{}]}`,
 		},
 		responseStep{
 			validate: func(t *testing.T, rec requestRecord) {
-				var payload struct {
-					Values [][]interface{} `json:"values"`
-				}
-				require.NoError(t, json.Unmarshal(rec.Body, &payload))
-				require.Len(t, payload.Values, 1)
-				row := payload.Values[0]
-				require.Len(t, row, 8)
+				row := batchUpdateRow(t, rec, "notes!A4:AA4")
 				assert.EqualValues(t, 7, row[0])
 				assert.Equal(t, "Alpha", row[1])
 				assert.Equal(t, "Body", row[2])
@@ -237,15 +278,10 @@ func TestGoogleProvider_PutGetDeleteRoundTrip(t *testing.T) {
 		responseStep{
 			body: `{"values":[["7","Alpha","Body","true","false","alpha-key","111","222"]]}`,
 		},
+		sheetRowsStep(`{"valueRanges":[{"values":[["1"],["2"],["7"]]},{"values":[["100"],["200"],["222"]]},{}]}`),
 		responseStep{
 			validate: func(t *testing.T, rec requestRecord) {
-				var payload struct {
-					Values [][]interface{} `json:"values"`
-				}
-				require.NoError(t, json.Unmarshal(rec.Body, &payload))
-				require.Len(t, payload.Values, 1)
-				row := payload.Values[0]
-				require.Len(t, row, 8)
+				row := batchUpdateRow(t, rec, "notes!A4:AA4")
 				assert.EqualValues(t, 7, row[0])
 				assert.Equal(t, "Alpha", row[1])
 				assert.Equal(t, "Body updated", row[2])
@@ -256,7 +292,22 @@ func TestGoogleProvider_PutGetDeleteRoundTrip(t *testing.T) {
 				assert.EqualValues(t, 333, row[7])
 			},
 		},
-		responseStep{},
+		sheetRowsStep(`{"valueRanges":[{"values":[["1"],["2"],["7"]]},{"values":[["100"],["200"],["333"]]},{}]}`),
+		responseStep{
+			validate: func(t *testing.T, rec requestRecord) {
+				// the row is replaced by a tombstone
+				row := batchUpdateRow(t, rec, "notes!A4:AA4")
+				deletedAtIdx, _ := defaultSheetLayout().index(sheetColDeletedAt)
+				assert.EqualValues(t, 7, row[0])
+				assert.Equal(t, "", row[1])
+				assert.Equal(t, "", row[2])
+				assert.Greater(t, row[deletedAtIdx], float64(333))
+				assert.Equal(t, row[deletedAtIdx], row[7])
+			},
+		},
+		responseStep{
+			body: `{"values":[["7","","","","","","1000","1000","","","","","","","","","","","","","","","","","","","1000"]]}`,
+		},
 	)
 
 	newNote := &model.Note{
@@ -288,32 +339,254 @@ func TestGoogleProvider_PutGetDeleteRoundTrip(t *testing.T) {
 	newNote.Content = "Body updated"
 	newNote.UpdatedAt = 333
 	require.NoError(t, gp.PutNote(newNote))
+	updAt, ok := gp.CacheUpdAtGet(newNote.ID)
+	require.True(t, ok)
+	assert.Equal(t, int64(333), updAt)
 
 	require.NoError(t, gp.DeleteNote(newNote.ID))
 	_, ok = gp.CacheIDGet(newNote.ID)
-	assert.False(t, ok)
+	assert.True(t, ok)
+	assert.Contains(t, gp.tombstones, newNote.ID)
+	assert.Equal(t, 3, gp.rowCount)
+	_, err = gp.GetNote(newNote.ID)
+	require.Error(t, err)
+	assert.Equal(t, common.ERR_NOTE_NOT_FOUND, err.Error())
 
-	require.Len(t, transport.requests, 6)
+	require.Len(t, transport.requests, 8)
+	assert.Contains(t, transport.requests[0].URL, "values:batchGet")
+	assert.Contains(t, transport.requests[1].URL, "values:batchUpdate")
 	assert.Contains(t, transport.requests[2].URL, "/values/")
-	assert.Contains(t, transport.requests[3].URL, "/values/")
+	assert.Contains(t, transport.requests[4].URL, "values:batchUpdate")
 }
 
-func TestGoogleProvider_SyncNotes(t *testing.T) {
-	gp, _ := newTestGoogleProvider(t,
+func TestGoogleProvider_PurgeTombstones_ShiftsCachedRows(t *testing.T) {
+	purged := `{"valueRanges":[{"values":[["1"],["3"]]},{"values":[["10"],["900"]]},{"values":[[],["900"]]}]}`
+	gp, transport := newTestGoogleProvider(t,
+		sheetRowsStep(`{"valueRanges":[
+			{"values":[["1"],["2"],["3"],["4"]]},
+			{"values":[["10"],["100"],["900"],["200"]]},
+			{"values":[[],["100"],["900"],["200"]]}
+		]}`),
+		responseStep{
+			body: `{"sheets":[{"properties":{"sheetId":42,"title":"notes"}}]}`,
+		},
+		responseStep{
+			validate: func(t *testing.T, rec requestRecord) {
+				var payload sheets.BatchUpdateSpreadsheetRequest
+				require.NoError(t, json.Unmarshal(rec.Body, &payload))
+				require.Len(t, payload.Requests, 2)
+				// bottom-up, so that the indexes stay valid
+				for i, start := range []int64{4, 2} {
+					rng := payload.Requests[i].DeleteDimension.Range
+					assert.Equal(t, int64(42), rng.SheetId)
+					assert.Equal(t, "ROWS", rng.Dimension)
+					assert.Equal(t, start, rng.StartIndex)
+					assert.Equal(t, start+1, rng.EndIndex)
+				}
+			},
+		},
+		sheetRowsStep(purged),
+		sheetRowsStep(purged),
+		responseStep{
+			validate: func(t *testing.T, rec requestRecord) {
+				// the sheet is compact: the new note goes right after the remaining rows
+				batchUpdateRow(t, rec, "notes!A4:AA4")
+			},
+		},
+	)
+	// stale cache: the tombstone of note 9 was already purged by another device, so it has no row to delete
+	gp.noteIds = map[int]int{1: 0, 2: 1, 3: 2, 4: 3}
+	gp.tombstones = map[int]int64{2: 100, 4: 200, 3: 900, 9: 50}
+	gp.rowCount = 4
+
+	require.NoError(t, gp.PurgeTombstones(500))
+	assert.Equal(t, map[int]int{1: 0, 3: 1}, gp.noteIds)
+	assert.Equal(t, map[int]int64{3: 900}, gp.tombstones)
+	assert.Equal(t, 2, gp.rowCount)
+
+	// nothing left to purge
+	require.NoError(t, gp.PurgeTombstones(500))
+	require.NoError(t, gp.PutNotes([]*model.Note{{ID: 5}}))
+	assert.Equal(t, map[int]int{1: 0, 3: 1, 5: 2}, gp.noteIds)
+	assert.Len(t, transport.requests, 6)
+}
+
+func TestGoogleProvider_PutNotes_RowsMovedByAnotherDevice(t *testing.T) {
+	gp, transport := newTestGoogleProvider(t,
+		// another device purged the tombstone of note 2: note 3 moved up a row
+		sheetRowsStep(`{"valueRanges":[{"values":[["1"],["3"]]},{"values":[["10"],["30"]]},{}]}`),
+		responseStep{
+			validate: func(t *testing.T, rec requestRecord) {
+				row := batchUpdateRow(t, rec, "notes!A3:AA3")
+				assert.EqualValues(t, 3, row[0])
+			},
+		},
+	)
+	gp.noteIds = map[int]int{1: 0, 2: 1, 3: 2}
+	gp.tombstones = map[int]int64{2: 20}
+	gp.rowCount = 3
+
+	require.NoError(t, gp.PutNotes([]*model.Note{{ID: 3, UpdatedAt: 40}}))
+	assert.Len(t, transport.requests, 2)
+	assert.Equal(t, map[int]int{1: 0, 3: 1}, gp.noteIds)
+	assert.Empty(t, gp.tombstones)
+}
+
+func TestGoogleProvider_SyncNotes_Tombstones(t *testing.T) {
+	gp, transport := newTestGoogleProvider(t,
+		responseStep{
+			// 1: deleted remotely, 2: deleted remotely then edited locally, 3: deleted locally,
+			// 4: deleted locally then edited remotely, 5: deleted remotely and unknown locally
+			body: `{"valueRanges":[
+				{"values":[["1"],["2"],["3"],["4"],["5"]]},
+				{"values":[["500"],["500"],["100"],["900"],["500"]]},
+				{"values":[["500"],["500"],[],[],["500"]]}
+			]}`,
+		},
+		sheetRowsStep(`{"valueRanges":[
+			{"values":[["1"],["2"],["3"],["4"],["5"]]},
+			{"values":[["500"],["500"],["100"],["900"],["500"]]},
+			{"values":[["500"],["500"],[],[],["500"]]}
+		]}`),
+		responseStep{
+			validate: func(t *testing.T, rec requestRecord) {
+				var payload sheets.BatchUpdateValuesRequest
+				require.NoError(t, json.Unmarshal(rec.Body, &payload))
+				require.Len(t, payload.Data, 2)
+				deletedAtIdx, _ := defaultSheetLayout().index(sheetColDeletedAt)
+				// note 2 is resurrected
+				assert.Equal(t, "notes!A3:AA3", payload.Data[0].Range)
+				assert.Equal(t, "", payload.Data[0].Values[0][deletedAtIdx])
+				// note 3 is buried
+				assert.Equal(t, "notes!A4:AA4", payload.Data[1].Range)
+				assert.EqualValues(t, 300, payload.Data[1].Values[0][deletedAtIdx])
+			},
+		},
+		responseStep{
+			validate: func(t *testing.T, rec requestRecord) {
+				assert.Contains(t, rec.URL, "ranges=notes%21A5%3AAA5")
+			},
+			body: `{"valueRanges":[{"values":[["4","Remote Four","Body","false","false","","50","900"]]}]}`,
+		},
+	)
+
+	dbNotes := []model.Note{
+		{ID: 1, Title: "One", UpdatedAt: 400},
+		{ID: 2, Title: "Two", UpdatedAt: 600},
+	}
+	dbTombstones := []model.Tombstone{
+		{ID: 3, DeletedAt: 300},
+		{ID: 4, DeletedAt: 300},
+	}
+
+	result, err := gp.SyncNotes(context.Background(), dbNotes, dbTombstones, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []model.Tombstone{{ID: 1, DeletedAt: 500}}, result.Deleted)
+	require.Len(t, result.Downloaded, 1)
+	assert.Equal(t, 4, result.Downloaded[0].ID)
+	assert.Len(t, transport.requests, 4)
+	assert.Equal(t, map[int]int64{1: 500, 3: 300, 5: 500}, gp.tombstones)
+}
+
+func TestGoogleProvider_PutNotes_BatchesAndResetsCacheOnError(t *testing.T) {
+	notes := make([]*model.Note, sheetBatchSize+1)
+	ids := make([]string, sheetBatchSize)
+	for i := range notes {
+		notes[i] = &model.Note{ID: i + 1, UpdatedAt: int64(i)}
+		if i < sheetBatchSize {
+			ids[i] = fmt.Sprintf(`["%d"]`, i+1)
+		}
+	}
+	gp, transport := newTestGoogleProvider(t,
+		// the first note is already in the sheet
+		sheetRowsStep(`{"valueRanges":[{"values":[["1"]]},{"values":[["0"]]},{}]}`),
 		responseStep{
-			body: `{"values":[["1"],["2"]]}`,
+			validate: func(t *testing.T, rec requestRecord) {
+				var payload sheets.BatchUpdateValuesRequest
+				require.NoError(t, json.Unmarshal(rec.Body, &payload))
+				assert.Len(t, payload.Data, sheetBatchSize)
+				assert.Equal(t, "notes!A2:AA2", payload.Data[0].Range)
+			},
 		},
+		// the indexes are read again before the next batch
+		sheetRowsStep(`{"valueRanges":[{"values":[`+strings.Join(ids, ",")+`]},{},{}]}`),
 		responseStep{
-			body: `{"values":[["100"],["200"]]}`,
+			validate: func(t *testing.T, rec requestRecord) {
+				var payload sheets.BatchUpdateValuesRequest
+				require.NoError(t, json.Unmarshal(rec.Body, &payload))
+				require.Len(t, payload.Data, 1)
+				assert.Equal(t, "notes!A102:AA102", payload.Data[0].Range)
+			},
+		},
+	)
+
+	require.NoError(t, gp.PutNotes(notes))
+	assert.Len(t, transport.requests, 4)
+	assert.Len(t, gp.noteIds, sheetBatchSize+1)
+	assert.Equal(t, sheetBatchSize+1, gp.rowCount)
+
+	// a failed write resets the cache, so that the indexes are reloaded
+	transport.responses = append(transport.responses,
+		sheetRowsStep(`{"valueRanges":[{"values":[["1"]]},{},{}]}`),
+		responseStep{status: http.StatusInternalServerError},
+	)
+	require.Error(t, gp.PutNotes(notes[:1]))
+	assert.Empty(t, gp.noteIds)
+	assert.Zero(t, gp.rowCount)
+}
+
+// sheetRowsStep answers the read of the ID, UpdatedAt and DeletedAt columns, which precedes every write
+func sheetRowsStep(body string) responseStep {
+	return responseStep{
+		body: body,
+		validate: func(t *testing.T, rec requestRecord) {
+			assert.Contains(t, rec.URL, "values:batchGet")
 		},
+	}
+}
+
+// batchUpdateRow returns the single row written by a values batch update request
+func batchUpdateRow(t *testing.T, rec requestRecord, writeRange string) []interface{} {
+	t.Helper()
+	assert.Contains(t, rec.URL, "values:batchUpdate")
+	var payload struct {
+		ValueInputOption string `json:"valueInputOption"`
+		Data             []struct {
+			Range  string          `json:"range"`
+			Values [][]interface{} `json:"values"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body, &payload))
+	assert.Equal(t, "RAW", payload.ValueInputOption)
+	require.Len(t, payload.Data, 1)
+	assert.Equal(t, writeRange, payload.Data[0].Range)
+	require.Len(t, payload.Data[0].Values, 1)
+	row := payload.Data[0].Values[0]
+	require.Len(t, row, len(sheetColumns))
+	return row
+}
+
+func TestGoogleProvider_SyncNotes(t *testing.T) {
+	gp, _ := newTestGoogleProvider(t,
 		responseStep{
-			body: `{"values":[["1","Remote One","Remote Body","false","false","","100","100"]]}`,
+			body: `{"valueRanges":[{"values":[["1"],["2"]]},{"values":[["100"],["200"]]},{}]}`,
 		},
+		sheetRowsStep(`{"valueRanges":[{"values":[["1"],["2"]]},{"values":[["100"],["200"]]},{}]}`),
 		responseStep{
-			body: `{}`,
+			validate: func(t *testing.T, rec requestRecord) {
+				row := batchUpdateRow(t, rec, "notes!A4:AA4")
+				assert.EqualValues(t, 3, row[0])
+			},
 		},
 		responseStep{
-			body: `{"values":[["2","Remote Two","Other Body","true","false","","200","200"]]}`,
+			validate: func(t *testing.T, rec requestRecord) {
+				assert.Contains(t, rec.URL, "values:batchGet")
+				assert.Contains(t, rec.URL, "ranges=notes%21A2%3AAA2&ranges=notes%21A3%3AAA3")
+			},
+			body: `{"valueRanges":[
+				{"values":[["1","Remote One","Remote Body","false","false","","100","100"]]},
+				{"values":[["2","Remote Two","Other Body","true","false","","200","200"]]}
+			]}`,
 		},
 	)
 
@@ -346,11 +619,16 @@ func TestGoogleProvider_SyncNotes(t *testing.T) {
 		},
 	}
 
-	downloaded, err := gp.SyncNotes(context.Background(), dbNotes)
+	result, err := gp.SyncNotes(context.Background(), dbNotes, nil, nil)
 	require.NoError(t, err)
-	require.Len(t, downloaded, 1)
-	assert.Equal(t, 2, downloaded[0].ID)
-	assert.Equal(t, "Remote Two", downloaded[0].Title)
+	// note 1 changed remotely: it replaces the local one
+	require.Len(t, result.Downloaded, 2)
+	assert.Equal(t, 1, result.Downloaded[0].ID)
+	assert.Equal(t, "Remote One", result.Downloaded[0].Title)
+	assert.Equal(t, 2, result.Downloaded[1].ID)
+	assert.Equal(t, "Remote Two", result.Downloaded[1].Title)
+	assert.Empty(t, result.Deleted)
+	assert.Empty(t, result.Conflicts)
 
 	select {
 	case titles := <-titlesCh:
@@ -359,3 +637,151 @@ func TestGoogleProvider_SyncNotes(t *testing.T) {
 		t.Fatal("timed out waiting for note titles update")
 	}
 }
+
+func TestGoogleProvider_SyncNotes_ThreeWay(t *testing.T) {
+	gp, transport := newTestGoogleProvider(t,
+		responseStep{
+			body: `{"valueRanges":[{"values":[["1"],["2"],["3"]]},{"values":[["100"],["150"],["300"]]},{}]}`,
+		},
+		sheetRowsStep(`{"valueRanges":[{"values":[["1"],["2"],["3"]]},{"values":[["100"],["150"],["300"]]},{}]}`),
+		responseStep{
+			validate: func(t *testing.T, rec requestRecord) {
+				row := batchUpdateRow(t, rec, "notes!A3:AA3")
+				assert.EqualValues(t, 2, row[0])
+			},
+		},
+		responseStep{
+			validate: func(t *testing.T, rec requestRecord) {
+				assert.Contains(t, rec.URL, "ranges=notes%21A2%3AAA2&ranges=notes%21A4%3AAA4")
+			},
+			body: `{"valueRanges":[
+				{"values":[["1","One","Remote One","false","false","","1","100"]]},
+				{"values":[["3","Three","Remote Three","false","false","","1","300"]]}
+			]}`,
+		},
+	)
+
+	dbNotes := []model.Note{
+		// changed on both sides since the last sync
+		{ID: 1, Title: "One", Content: "Local One", UpdatedAt: 120},
+		// changed only locally
+		{ID: 2, Title: "Two", Content: "Local Two", UpdatedAt: 200},
+		// changed only remotely
+		{ID: 3, Title: "Three", Content: "Local Three", UpdatedAt: 250},
+	}
+	bases := map[int]int64{1: 90, 2: 150, 3: 250}
+
+	result, err := gp.SyncNotes(context.Background(), dbNotes, nil, bases)
+	require.NoError(t, err)
+	require.Len(t, transport.requests, 4)
+	require.Len(t, result.Conflicts, 1)
+	assert.Equal(t, "Remote One", result.Conflicts[0].Content)
+	require.Len(t, result.Downloaded, 1)
+	assert.Equal(t, "Remote Three", result.Downloaded[0].Content)
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		name                string
+		local, remote, base int64
+		want                noteVersion
+	}{
+		{"in sync", 10, 10, 5, versionSynced},
+		{"no base, local newer", 20, 10, 0, versionLocal},
+		{"no base, remote newer", 10, 20, 0, versionRemote},
+		{"remote changed", 10, 20, 10, versionRemote},
+		{"remote behind", 10, 5, 10, versionLocal},
+		{"local changed", 20, 10, 10, versionLocal},
+		{"both changed", 20, 30, 10, versionConflict},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, compareVersions(tt.local, tt.remote, tt.base), tt.name)
+	}
+}
+
+func TestGoogleProvider_FlushOutbox(t *testing.T) {
+	gp, transport := newTestGoogleProvider(t,
+		responseStep{
+			body: `{"valueRanges":[{"values":[["1"]]},{"values":[["100"]]}]}`,
+		},
+		responseStep{
+			validate: func(t *testing.T, rec requestRecord) {
+				assert.Contains(t, rec.URL, "values:batchUpdate")
+				// both changes are written with one request
+				assert.Contains(t, string(rec.Body), "notes!A2:AA2")
+				assert.Contains(t, string(rec.Body), "notes!A3:AA3")
+			},
+		},
+		responseStep{},
+	)
+	require.NoError(t, gp.outbox.PushNote(&model.Note{ID: 7, Title: "New", Content: "body", UpdatedAt: 200}))
+	require.NoError(t, gp.outbox.PushTombstone(model.Tombstone{ID: 1, DeletedAt: 300}))
+
+	assert.Equal(t, outboxIdleWait, gp.flushOutbox(context.Background())+gp.flushOutbox(context.Background()))
+	require.Len(t, transport.requests, 2)
+	pending, err := gp.outbox.Pending()
+	require.NoError(t, err)
+	assert.Zero(t, pending)
+
+	// a failed push stays in the outbox, to be retried later
+	transport.statusCode = http.StatusInternalServerError
+	require.NoError(t, gp.outbox.PushNote(&model.Note{ID: 7, Title: "New", Content: "changed", UpdatedAt: 400}))
+	assert.Zero(t, gp.flushOutbox(context.Background()))
+	wait := gp.flushOutbox(context.Background())
+	assert.Greater(t, wait, time.Duration(0))
+	assert.LessOrEqual(t, wait, outboxBaseDelay)
+	pending, err = gp.outbox.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, 1, pending)
+}
+
+func TestGoogleProvider_ChunkedContentRoundTrip(t *testing.T) {
+	gp, transport := newTestGoogleProvider(t,
+		responseStep{
+			body: `{"valueRanges":[{"values":[["1"]]},{"values":[["100"]]}]}`,
+		},
+		responseStep{},
+	)
+	chunksCol, _ := gp.layout.index(sheetColContentChunks)
+	lastChunkCol, _ := gp.layout.index(contentChunkColumn(3))
+
+	content := strings.Repeat("0123456789", 2*sheetChunkSize/10) + "tail"
+	note := &model.Note{ID: 7, Title: "Big", Content: content, CreatedAt: 1, UpdatedAt: 2}
+	require.NoError(t, gp.PutNote(note))
+
+	require.Len(t, transport.requests, 2)
+	row := batchUpdateRow(t, transport.requests[1], "notes!A3:AA3")
+	assert.Len(t, row[2], sheetChunkSize)
+	assert.Equal(t, "3:"+contentChecksum(content), row[chunksCol])
+	assert.Equal(t, "tail", row[lastChunkCol])
+	assert.Equal(t, "", row[lastChunkCol+1])
+
+	// the sheets api trims trailing empty cells
+	cells := append([]interface{}{}, row[:lastChunkCol+1]...)
+	parsed, err := gp.ParseSheetRow(2, cells)
+	require.NoError(t, err)
+	assert.Equal(t, content, parsed.Content)
+	assert.Equal(t, 7, parsed.ID)
+
+	// a tampered or missing chunk fails the integrity check
+	var rowErr *RowError
+	tampered := append([]interface{}{}, cells...)
+	tampered[lastChunkCol] = "tall"
+	_, err = gp.ParseSheetRow(2, tampered)
+	require.ErrorAs(t, err, &rowErr)
+	assert.Equal(t, sheetColContentChunks, rowErr.Column)
+	assert.Equal(t, common.ERR_NOTE_CHUNKS_CORRUPTED, rowErr.Err.Error())
+	_, err = gp.ParseSheetRow(2, cells[:lastChunkCol])
+	require.ErrorAs(t, err, &rowErr)
+	assert.Equal(t, common.ERR_NOTE_CHUNKS_CORRUPTED, rowErr.Err.Error())
+}
+
+func TestGoogleProvider_PutNote_TooLarge(t *testing.T) {
+	gp, transport := newTestGoogleProvider(t)
+
+	note := &model.Note{ID: 1, Content: strings.Repeat("x", sheetMaxChunks*sheetChunkSize+1)}
+	err := gp.PutNote(note)
+	require.Error(t, err)
+	assert.Equal(t, common.ERR_NOTE_TOO_LARGE, err.Error())
+	assert.Empty(t, transport.requests)
+}
@@ -11,10 +11,12 @@ import (
 
 func TestUpdateNoteNotifier_EnqueuesNote(t *testing.T) {
 	logger := logrus.New()
+	store := newMemoryOutboxStore()
 	gp := &GoogleProvider{
-		updateQueue: make(chan *model.Note, 10),
-		deleteQueue: make(chan int, 10),
-		logger:      logger,
+		BaseSyncNoteProvider: BaseSyncNoteProvider{
+			outbox: NewOutbox(store, GoogleProviderName, nil),
+			logger: logger,
+		},
 	}
 
 	listener := gp.UpdateNoteNotifier()
@@ -26,24 +28,34 @@ func TestUpdateNoteNotifier_EnqueuesNote(t *testing.T) {
 
 	// The listener expects the encrypted note as args[2] currently, according to implementation
 	// listener.OnNotify(note, nil, nil, note)
-	listener.OnNotify("dummy", nil, nil, note) 
+	listener.OnNotify("dummy", nil, nil, note)
 
-	// Verify the note is in the queue
+	// Verify the note is in the outbox
+	entries, _ := store.GetOutboxEntries(GoogleProviderName)
+	if len(entries) != 1 || entries[0].Note == nil || entries[0].Note.ID != 123 {
+		t.Errorf("Expected note ID 123 in outbox, got %+v", entries)
+	}
 	select {
-	case queuedNote := <-gp.updateQueue:
-		if queuedNote.ID != 123 {
-			t.Errorf("Expected note ID 123 in queue, got %v", queuedNote.ID)
-		}
+	case <-gp.outbox.Wake():
 	case <-time.After(1 * time.Second):
-		t.Error("Note was not enqueued in time")
+		t.Error("Worker was not woken up in time")
+	}
+
+	// local-only changes don't carry the encrypted note
+	listener.OnNotify("dummy", nil, nil)
+	if pending, _ := gp.outbox.Pending(); pending != 1 {
+		t.Errorf("Expected 1 pending change, got %d", pending)
 	}
 }
 
 func TestDeleteNoteNotifier_EnqueuesDelete(t *testing.T) {
 	logger := logrus.New()
+	store := newMemoryOutboxStore()
 	gp := &GoogleProvider{
-		deleteQueue: make(chan int, 10),
-		logger:      logger,
+		BaseSyncNoteProvider: BaseSyncNoteProvider{
+			outbox: NewOutbox(store, GoogleProviderName, nil),
+			logger: logger,
+		},
 	}
 
 	listener := gp.DeleteNoteNotifier()
@@ -51,33 +63,37 @@ func TestDeleteNoteNotifier_EnqueuesDelete(t *testing.T) {
 
 	listener.OnNotify(note)
 
-	// Verify the delete ID is in the queue
-	select {
-	case queuedID := <-gp.deleteQueue:
-		if queuedID != 456 {
-			t.Errorf("Expected note ID 456 in delete queue, got %v", queuedID)
-		}
-	case <-time.After(1 * time.Second):
-		t.Error("Delete ID was not enqueued in time")
+	// Verify the tombstone is in the outbox
+	entries, _ := store.GetOutboxEntries(GoogleProviderName)
+	if len(entries) != 1 || entries[0].Tombstone == nil || entries[0].Tombstone.ID != 456 || entries[0].Tombstone.DeletedAt == 0 {
+		t.Errorf("Expected a tombstone for note ID 456 in outbox, got %+v", entries)
+	}
+
+	// the tombstone recorded by the note service is used as it is, and replaces the pending one
+	listener.OnNotify(note, nil, nil, model.Tombstone{ID: 456, DeletedAt: 789})
+	entries, _ = store.GetOutboxEntries(GoogleProviderName)
+	if len(entries) != 1 || entries[0].Tombstone.DeletedAt != 789 {
+		t.Errorf("Expected the recorded tombstone in outbox, got %+v", entries)
 	}
 }
 
 func TestInitWorker_ContextCancellation(t *testing.T) {
 	logger := logrus.New()
 	gp := &GoogleProvider{
-		updateQueue: make(chan *model.Note, 10),
-		deleteQueue: make(chan int, 10),
-		logger:      logger,
+		BaseSyncNoteProvider: BaseSyncNoteProvider{
+			outbox: NewOutbox(newMemoryOutboxStore(), GoogleProviderName, nil),
+			logger: logger,
+		},
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
-	
+
 	// Start worker, then immediately cancel to make sure it doesn't panic and exits cleanly
 	gp.InitWorker(ctx)
 	cancel()
-	
+
 	// Small delay to allow goroutine to print shutdown log
 	time.Sleep(100 * time.Millisecond)
-	
+
 	// If it hasn't crashed, test passes.
 }
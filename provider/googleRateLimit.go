@@ -0,0 +1,197 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// googleRequestTimeout the timeout of each attempt at a request to the Google API
+	googleRequestTimeout = 10 * time.Second
+	// googleMaxAttempts how many times a request is sent before giving up
+	googleMaxAttempts = 4
+	// googleRetryBaseDelay the delay before the first retry of a request, when the response doesn't tell how long
+	// to wait. It doubles at each attempt
+	googleRetryBaseDelay = time.Second
+	// googleMaxRetryWait the longest wait before retrying a request: the changes waiting longer are left to the outbox
+	googleMaxRetryWait = 30 * time.Second
+	// googleMinInterval the spacing between requests after a rate limit error. It doubles at each error
+	googleMinInterval = 500 * time.Millisecond
+	// googleMaxInterval the longest spacing between requests
+	googleMaxInterval = 10 * time.Second
+)
+
+// googleRateLimitReasons the reasons of the 403 errors telling that a quota is exhausted
+var googleRateLimitReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+	"quotaExceeded":         true,
+}
+
+// retryAfterError an error telling how long to wait before trying again (eg. a rate limit)
+type retryAfterError struct {
+	err  error
+	wait time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// googleRateLimiter spaces out the requests to the Google API of a provider. The spacing grows when a quota is
+// exhausted and shrinks back as requests succeed, and all requests are held while Google asks to wait
+type googleRateLimiter struct {
+	// maxAttempts how many times a request is sent before giving up
+	maxAttempts int
+	// baseDelay the delay before the first retry of a request, when the response doesn't tell how long to wait
+	baseDelay time.Duration
+	// interval the spacing between requests
+	interval time.Duration
+	// next when the next request can be sent
+	next time.Time
+	mux  sync.Mutex
+}
+
+// newGoogleRateLimiter creates a rate limiter not spacing out the requests until a quota is exhausted
+func newGoogleRateLimiter() *googleRateLimiter {
+	return &googleRateLimiter{maxAttempts: googleMaxAttempts, baseDelay: googleRetryBaseDelay}
+}
+
+// wait blocks until a request can be sent, or ctx is done. Requests held longer than googleMaxRetryWait fail right
+// away with a retryAfterError
+func (l *googleRateLimiter) wait(ctx context.Context) error {
+	l.mux.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	delay := at.Sub(now)
+	if delay > googleMaxRetryWait {
+		l.mux.Unlock()
+		return &retryAfterError{err: errors.New(common.ERR_GOOGLE_RATE_LIMITED), wait: delay}
+	}
+	l.next = at.Add(l.interval)
+	l.mux.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttle slows down the requests after a rate limit error, and holds them for wait
+func (l *googleRateLimiter) throttle(wait time.Duration) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.interval = min(max(2*l.interval, googleMinInterval), googleMaxInterval)
+	if until := time.Now().Add(wait); until.After(l.next) {
+		l.next = until
+	}
+}
+
+// relax speeds up the requests after a successful one
+func (l *googleRateLimiter) relax() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.interval -= l.interval / 4
+	if l.interval < googleMinInterval {
+		l.interval = 0
+	}
+}
+
+// backoff returns the delay before the given attempt: it doubles at each attempt, and is randomized (between half
+// and all of it) so that devices don't retry in lockstep
+func (l *googleRateLimiter) backoff(attempt int) time.Duration {
+	delay := googleMaxRetryWait
+	if attempt < 20 {
+		delay = min(l.baseDelay<<(attempt-1), googleMaxRetryWait)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// do sends a request with googleRequestTimeout, once the limiter lets it through. Rate limit, quota and server errors
+// are retried with a backoff, waiting at least what the Retry-After header of the response asks for.
+// When the request can't be retried soon enough, the error is a retryAfterError telling how long to wait
+func (l *googleRateLimiter) do(ctx context.Context, request func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		if err := l.wait(ctx); err != nil {
+			return err
+		}
+		reqCtx, cancel := context.WithTimeout(ctx, googleRequestTimeout)
+		err := request(reqCtx)
+		cancel()
+		retryAfter, retryable := googleRetryAfter(err)
+		if !retryable {
+			if err == nil {
+				l.relax()
+			}
+			return err
+		}
+		wait := max(retryAfter, l.backoff(attempt))
+		l.throttle(wait)
+		if attempt >= l.maxAttempts || wait > googleMaxRetryWait {
+			return &retryAfterError{err: err, wait: wait}
+		}
+	}
+}
+
+// googleRetryAfter reports whether a request failing with err can be retried, and how long the response asks to
+// wait before (0 if it doesn't tell)
+func googleRetryAfter(err error) (time.Duration, bool) {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return 0, false
+	}
+	switch {
+	case apiErr.Code == http.StatusTooManyRequests, apiErr.Code >= http.StatusInternalServerError:
+	case apiErr.Code == http.StatusForbidden && isGoogleRateLimit(apiErr):
+	default:
+		return 0, false
+	}
+	return parseRetryAfter(apiErr.Header.Get("Retry-After"), time.Now()), true
+}
+
+// isGoogleRateLimit reports whether a 403 error is due to an exhausted quota, rather than to missing permissions
+func isGoogleRateLimit(apiErr *googleapi.Error) bool {
+	for _, item := range apiErr.Errors {
+		if googleRateLimitReasons[item.Reason] {
+			return true
+		}
+	}
+	return strings.Contains(apiErr.Body, "RESOURCE_EXHAUSTED")
+}
+
+// parseRetryAfter returns the wait asked by a Retry-After header, in seconds or as a date: 0 if missing or invalid
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0)
+	}
+	return 0
+}
@@ -0,0 +1,152 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+)
+
+// googleErrorBody the body of a Google API error response
+func googleErrorBody(code int, reason string) string {
+	return fmt.Sprintf(`{"error":{"code":%d,"message":"%s","errors":[{"reason":"%s","message":"%s"}]}}`,
+		code, reason, reason, reason)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	assert.Zero(t, parseRetryAfter("", now))
+	assert.Zero(t, parseRetryAfter("soon", now))
+	assert.Zero(t, parseRetryAfter("-3", now))
+	assert.Equal(t, 7*time.Second, parseRetryAfter(" 7 ", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter(now.Add(90*time.Second).Format(http.TimeFormat), now))
+	assert.Zero(t, parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now))
+}
+
+func TestGoogleRetryAfter(t *testing.T) {
+	header := http.Header{"Retry-After": {"12"}}
+	tests := []struct {
+		name      string
+		err       error
+		wait      time.Duration
+		retryable bool
+	}{
+		{"success", nil, 0, false},
+		{"network error", errors.New("connection reset"), 0, false},
+		{"too many requests", &googleapi.Error{Code: http.StatusTooManyRequests, Header: header}, 12 * time.Second, true},
+		{"server error", &googleapi.Error{Code: http.StatusServiceUnavailable}, 0, true},
+		{"quota", &googleapi.Error{
+			Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}},
+		}, 0, true},
+		{"permission denied", &googleapi.Error{
+			Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "forbidden"}},
+		}, 0, false},
+		{"bad request", &googleapi.Error{Code: http.StatusBadRequest}, 0, false},
+	}
+	for _, tt := range tests {
+		wait, retryable := googleRetryAfter(tt.err)
+		assert.Equal(t, tt.retryable, retryable, tt.name)
+		assert.Equal(t, tt.wait, wait, tt.name)
+	}
+}
+
+func TestGoogleRateLimiter(t *testing.T) {
+	l := newGoogleRateLimiter()
+	require.NoError(t, l.wait(context.Background()))
+
+	// each rate limit error doubles the spacing between requests, up to googleMaxInterval
+	l.throttle(0)
+	assert.Equal(t, googleMinInterval, l.interval)
+	for i := 0; i < 10; i++ {
+		l.throttle(0)
+	}
+	assert.Equal(t, googleMaxInterval, l.interval)
+	// and successful requests shrink it back
+	l.relax()
+	assert.Equal(t, googleMaxInterval*3/4, l.interval)
+	for i := 0; i < 20; i++ {
+		l.relax()
+	}
+	assert.Zero(t, l.interval)
+
+	// the requests are held while Google asks to wait
+	l.throttle(time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, l.wait(ctx), context.DeadlineExceeded)
+	// and fail right away when that is too long
+	l.throttle(time.Hour)
+	err := l.wait(context.Background())
+	var retryAfter *retryAfterError
+	require.ErrorAs(t, err, &retryAfter)
+	assert.EqualError(t, err, common.ERR_GOOGLE_RATE_LIMITED)
+	assert.Greater(t, retryAfter.wait, googleMaxRetryWait)
+}
+
+func TestGoogleProvider_RetriesRateLimitedRequests(t *testing.T) {
+	gp, transport := newTestGoogleProvider(t,
+		responseStep{
+			status: http.StatusTooManyRequests,
+			header: http.Header{"Retry-After": {"0"}},
+			body:   googleErrorBody(http.StatusTooManyRequests, "rateLimitExceeded"),
+		},
+		responseStep{
+			status: http.StatusForbidden,
+			body:   googleErrorBody(http.StatusForbidden, "userRateLimitExceeded"),
+		},
+		responseStep{body: `{"values":[[1,"Title","Content",false,true,"key",100,200]]}`},
+	)
+	gp.limiter.maxAttempts = 3
+
+	notes, err := gp.GetNotes()
+	require.NoError(t, err)
+	assert.Len(t, notes, 1)
+	assert.Len(t, transport.requests, 3)
+
+	// missing permissions are not retried
+	transport.responses = append(transport.responses, responseStep{
+		status: http.StatusForbidden,
+		body:   googleErrorBody(http.StatusForbidden, "forbidden"),
+	})
+	gp.limiter = &googleRateLimiter{maxAttempts: 3, baseDelay: time.Millisecond}
+	_, err = gp.GetNotes()
+	assert.Error(t, err)
+	assert.Len(t, transport.requests, 4)
+}
+
+func TestGoogleProvider_FlushOutbox_RateLimited(t *testing.T) {
+	gp, transport := newTestGoogleProvider(t, responseStep{
+		status: http.StatusTooManyRequests,
+		header: http.Header{"Retry-After": {"120"}},
+		body:   googleErrorBody(http.StatusTooManyRequests, "rateLimitExceeded"),
+	})
+	gp.limiter.maxAttempts = 3
+	// the note is already in the sheet, which skips the initial load of the indexes
+	gp.noteIds = map[int]int{1: 0}
+	gp.rowCount = 1
+	require.NoError(t, gp.outbox.PushNote(&model.Note{ID: 1, Title: "Title", Content: "body", UpdatedAt: 200}))
+
+	// Google asks to wait longer than a request can be held: the change is left to the outbox
+	gp.flushOutbox(context.Background())
+	assert.Len(t, transport.requests, 1)
+	due, wait, err := gp.outbox.Due(sheetBatchSize)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+	assert.Greater(t, wait, 119*time.Second)
+	pending, err := gp.outbox.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, 1, pending)
+
+	// the other requests are held too
+	_, err = gp.GetNote(1)
+	assert.EqualError(t, err, common.ERR_GOOGLE_RATE_LIMITED)
+	assert.Len(t, transport.requests, 1)
+}
@@ -0,0 +1,389 @@
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"google.golang.org/api/sheets/v4"
+)
+
+const (
+	// sheetChunkSize max number of characters stored in a single cell.
+	// Google Sheets rejects cells longer than 50000 characters, so bigger contents are split in chunks
+	sheetChunkSize = 45000
+	// sheetMaxChunks the content cell plus the continuation cells (Content2..Content18)
+	sheetMaxChunks = 18
+	// sheetBatchSize max number of rows read or written by a single batch request
+	sheetBatchSize = 100
+)
+
+// header names of the notes sheet columns
+const (
+	sheetColID            = "ID"
+	sheetColTitle         = "Title"
+	sheetColContent       = "Content"
+	sheetColHidden        = "Hidden"
+	sheetColEncrypted     = "Encrypted"
+	sheetColEncKeyName    = "EncKeyName"
+	sheetColCreatedAt     = "CreatedAt"
+	sheetColUpdatedAt     = "UpdatedAt"
+	sheetColContentChunks = "ContentChunks"
+	sheetColDeletedAt     = "DeletedAt"
+)
+
+// sheetColumns the columns of the notes sheet, in the order used to create a new header.
+// ContentChunks holds "<chunks>:<sha256 of the content>" for contents split in continuation columns.
+// DeletedAt is set on the tombstone rows of deleted notes
+var sheetColumns = func() []string {
+	cols := []string{
+		sheetColID, sheetColTitle, sheetColContent, sheetColHidden, sheetColEncrypted,
+		sheetColEncKeyName, sheetColCreatedAt, sheetColUpdatedAt, sheetColContentChunks,
+	}
+	for i := 2; i <= sheetMaxChunks; i++ {
+		cols = append(cols, contentChunkColumn(i))
+	}
+	return append(cols, sheetColDeletedAt)
+}()
+
+// RowError reports a malformed row of the notes sheet
+type RowError struct {
+	// Row the sheet row number (the header is row 1)
+	Row int
+	// Column the header name of the malformed cell
+	Column string
+	Err    error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("sheet row %d, column %s: %v", e.Row, e.Column, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// sheetLayout maps the header names of the notes sheet to their column index
+type sheetLayout struct {
+	columns map[string]int
+	width   int
+}
+
+// newSheetLayout maps the header row of the sheet. Header names are matched case insensitively
+// and unknown columns are left alone
+func newSheetLayout(header []interface{}) *sheetLayout {
+	layout := &sheetLayout{columns: make(map[string]int), width: len(header)}
+	for idx, cell := range header {
+		name := strings.ToLower(strings.TrimSpace(cellString(cell)))
+		if _, ok := layout.columns[name]; name != "" && !ok {
+			layout.columns[name] = idx
+		}
+	}
+	return layout
+}
+
+// defaultSheetLayout the layout of a sheet with the header written by the provider
+func defaultSheetLayout() *sheetLayout {
+	header := make([]interface{}, len(sheetColumns))
+	for i, col := range sheetColumns {
+		header[i] = col
+	}
+	return newSheetLayout(header)
+}
+
+// missing returns the known columns not present in the header
+func (l *sheetLayout) missing() []string {
+	missing := make([]string, 0)
+	for _, col := range sheetColumns {
+		if _, ok := l.index(col); !ok {
+			missing = append(missing, col)
+		}
+	}
+	return missing
+}
+
+// add appends a column to the layout
+func (l *sheetLayout) add(col string) {
+	l.columns[strings.ToLower(col)] = l.width
+	l.width++
+}
+
+// index returns the index of a column
+func (l *sheetLayout) index(col string) (int, bool) {
+	idx, ok := l.columns[strings.ToLower(col)]
+	return idx, ok
+}
+
+// column returns the A1 name of a column
+func (l *sheetLayout) column(col string) string {
+	idx, _ := l.index(col)
+	return columnName(idx)
+}
+
+// lastColumn returns the A1 name of the last column of the sheet
+func (l *sheetLayout) lastColumn() string {
+	return columnName(l.width - 1)
+}
+
+// cell returns the value of a column of a row as a string. Missing cells are empty
+func (l *sheetLayout) cell(row []interface{}, col string) string {
+	idx, ok := l.index(col)
+	if !ok || idx >= len(row) {
+		return ""
+	}
+	return cellString(row[idx])
+}
+
+// parseRow maps a sheet row to a Note object, reassembling chunked contents.
+// Missing cells are zero values, malformed ones are reported as *RowError
+func (l *sheetLayout) parseRow(rowNum int, row []interface{}) (model.Note, error) {
+	var err error
+	note := model.Note{
+		Title:      l.cell(row, sheetColTitle),
+		EncKeyName: l.cell(row, sheetColEncKeyName),
+	}
+	id := strings.TrimSpace(l.cell(row, sheetColID))
+	if id == "" {
+		return model.Note{}, &RowError{Row: rowNum, Column: sheetColID, Err: errors.New(common.ERR_NOTE_ID_MISSING)}
+	}
+	if note.ID, err = strconv.Atoi(id); err != nil {
+		return model.Note{}, &RowError{Row: rowNum, Column: sheetColID, Err: err}
+	}
+	for col, dst := range map[string]*bool{sheetColHidden: &note.Hidden, sheetColEncrypted: &note.Encrypted} {
+		if val := strings.TrimSpace(l.cell(row, col)); val != "" {
+			if *dst, err = strconv.ParseBool(val); err != nil {
+				return model.Note{}, &RowError{Row: rowNum, Column: col, Err: err}
+			}
+		}
+	}
+	if note.CreatedAt, err = l.int64Cell(rowNum, row, sheetColCreatedAt); err != nil {
+		return model.Note{}, err
+	}
+	if note.UpdatedAt, err = l.int64Cell(rowNum, row, sheetColUpdatedAt); err != nil {
+		return model.Note{}, err
+	}
+	if note.Content, err = l.joinContentChunks(row); err != nil {
+		return model.Note{}, &RowError{Row: rowNum, Column: sheetColContentChunks, Err: err}
+	}
+	return note, nil
+}
+
+// int64Cell parses an integer cell. Empty cells are 0
+func (l *sheetLayout) int64Cell(rowNum int, row []interface{}, col string) (int64, error) {
+	val := strings.TrimSpace(l.cell(row, col))
+	if val == "" {
+		return 0, nil
+	}
+	i, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, &RowError{Row: rowNum, Column: col, Err: err}
+	}
+	return i, nil
+}
+
+// deletedAt returns the deletion timestamp of a tombstone row, 0 for the rows of live notes
+func (l *sheetLayout) deletedAt(rowNum int, row []interface{}) (int64, error) {
+	return l.int64Cell(rowNum, row, sheetColDeletedAt)
+}
+
+// parseLiveRow parses the row of a note, reporting false for the tombstones of deleted notes
+func (l *sheetLayout) parseLiveRow(rowNum int, row []interface{}) (model.Note, bool, error) {
+	deletedAt, err := l.deletedAt(rowNum, row)
+	if err != nil || deletedAt > 0 {
+		return model.Note{}, false, err
+	}
+	note, err := l.parseRow(rowNum, row)
+	return note, err == nil, err
+}
+
+// parseIDRow parses the ID, UpdatedAt and DeletedAt cells of a row, read as single-column ranges.
+// Cleared rows return a zero ID
+func parseIDRow(rowNum int, idRow, updAtRow, deletedAtRow []interface{}) (id int, updAt int64, deletedAt int64, err error) {
+	layout := newSheetLayout([]interface{}{sheetColID, sheetColUpdatedAt, sheetColDeletedAt})
+	row := []interface{}{nil, nil, nil}
+	for i, cells := range [][]interface{}{idRow, updAtRow, deletedAtRow} {
+		if len(cells) > 0 {
+			row[i] = cells[0]
+		}
+	}
+	if isEmptyRow(row[:1]) {
+		return 0, 0, 0, nil
+	}
+	note, err := layout.parseRow(rowNum, row)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if deletedAt, err = layout.deletedAt(rowNum, row); err != nil {
+		return 0, 0, 0, err
+	}
+	return note.ID, note.UpdatedAt, deletedAt, nil
+}
+
+// valueRangeRows returns the rows of the i-th range of a batch response
+func valueRangeRows(ranges []*sheets.ValueRange, i int) [][]interface{} {
+	if i >= len(ranges) || ranges[i] == nil {
+		return nil
+	}
+	return ranges[i].Values
+}
+
+// rowAt returns the i-th row of a range, empty when the range is shorter
+func rowAt(rows [][]interface{}, i int) []interface{} {
+	if i < len(rows) {
+		return rows[i]
+	}
+	return []interface{}{}
+}
+
+// buildRow maps a Note object to a sheet row spanning the whole header.
+// Contents longer than sheetChunkSize are split: the first chunk goes in the Content column,
+// the chunk count and checksum in ContentChunks and the remaining chunks in the continuation columns.
+// Cells of unknown columns are nil, so that the sheets api leaves them untouched
+func (l *sheetLayout) buildRow(note *model.Note) ([]interface{}, error) {
+	chunks := splitContent(note.Content)
+	if len(chunks) > sheetMaxChunks {
+		return nil, errors.New(common.ERR_NOTE_TOO_LARGE)
+	}
+	chunkInfo := ""
+	if len(chunks) > 1 {
+		chunkInfo = fmt.Sprintf("%d:%s", len(chunks), contentChecksum(note.Content))
+	}
+	values := map[string]interface{}{
+		sheetColID:            note.ID,
+		sheetColTitle:         note.Title,
+		sheetColContent:       chunks[0],
+		sheetColHidden:        note.Hidden,
+		sheetColEncrypted:     note.Encrypted,
+		sheetColEncKeyName:    note.EncKeyName,
+		sheetColCreatedAt:     note.CreatedAt,
+		sheetColUpdatedAt:     note.UpdatedAt,
+		sheetColContentChunks: chunkInfo,
+		sheetColDeletedAt:     "",
+	}
+	// continuation cells left by a previous, longer content are cleared
+	for i := 2; i <= sheetMaxChunks; i++ {
+		values[contentChunkColumn(i)] = ""
+		if i <= len(chunks) {
+			values[contentChunkColumn(i)] = chunks[i-1]
+		}
+	}
+	row := make([]interface{}, l.width)
+	for col, val := range values {
+		if idx, ok := l.index(col); ok {
+			row[idx] = val
+		}
+	}
+	return row, nil
+}
+
+// buildTombstoneRow maps a tombstone to a sheet row: the title and content of the deleted note are cleared
+func (l *sheetLayout) buildTombstoneRow(tombstone model.Tombstone) []interface{} {
+	row := make([]interface{}, l.width)
+	for _, col := range sheetColumns {
+		if idx, ok := l.index(col); ok {
+			row[idx] = ""
+		}
+	}
+	for col, val := range map[string]interface{}{
+		sheetColID:        tombstone.ID,
+		sheetColUpdatedAt: tombstone.DeletedAt,
+		sheetColDeletedAt: tombstone.DeletedAt,
+	} {
+		if idx, ok := l.index(col); ok {
+			row[idx] = val
+		}
+	}
+	return row
+}
+
+// joinContentChunks returns the content stored in a sheet row, checking the integrity of chunked contents
+func (l *sheetLayout) joinContentChunks(row []interface{}) (string, error) {
+	content := l.cell(row, sheetColContent)
+	info := l.cell(row, sheetColContentChunks)
+	if info == "" {
+		return content, nil
+	}
+	countStr, checksum, ok := strings.Cut(info, ":")
+	count, err := strconv.Atoi(countStr)
+	if !ok || err != nil || count < 2 || count > sheetMaxChunks {
+		return "", errors.New(common.ERR_NOTE_CHUNKS_CORRUPTED)
+	}
+	var sb strings.Builder
+	sb.WriteString(content)
+	for i := 2; i <= count; i++ {
+		sb.WriteString(l.cell(row, contentChunkColumn(i)))
+	}
+	content = sb.String()
+	if contentChecksum(content) != checksum {
+		return "", errors.New(common.ERR_NOTE_CHUNKS_CORRUPTED)
+	}
+	return content, nil
+}
+
+// splitContent splits a content in chunks of at most sheetChunkSize characters
+func splitContent(content string) []string {
+	runes := []rune(content)
+	if len(runes) <= sheetChunkSize {
+		return []string{content}
+	}
+	chunks := make([]string, 0, len(runes)/sheetChunkSize+1)
+	for start := 0; start < len(runes); start += sheetChunkSize {
+		end := start + sheetChunkSize
+		if end > len(runes) {
+			end = len(runes)
+		}
+		chunks = append(chunks, string(runes[start:end]))
+	}
+	return chunks
+}
+
+// contentChecksum returns the hex sha256 of a content
+func contentChecksum(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// contentChunkColumn returns the header name of the continuation column of the n-th chunk
+func contentChunkColumn(n int) string {
+	return sheetColContent + strconv.Itoa(n)
+}
+
+// cellString returns the value of a cell as a string, whatever type the sheets api decoded it to
+func cellString(cell interface{}) string {
+	switch v := cell.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// isEmptyRow returns true for rows without values (eg. cleared rows)
+func isEmptyRow(row []interface{}) bool {
+	for _, cell := range row {
+		if strings.TrimSpace(cellString(cell)) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// columnName returns the A1 name of a 0-based column index (0 -> A, 26 -> AA)
+func columnName(idx int) string {
+	name := ""
+	for ; idx >= 0; idx = idx/26 - 1 {
+		name = string(rune('A'+idx%26)) + name
+	}
+	return name
+}
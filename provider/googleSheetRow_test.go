@@ -0,0 +1,164 @@
+package provider
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSheetLayout_ParseRowTolerant(t *testing.T) {
+	t.Parallel()
+
+	// reordered, differently cased and extra columns; no chunk columns
+	layout := newSheetLayout([]interface{}{"Notes", " updatedat ", "id", "TITLE", "Content", "Hidden", "Encrypted", "EncKeyName", "CreatedAt"})
+
+	note, err := layout.parseRow(2, []interface{}{"comment", float64(1645435461544), float64(42), "Alpha", "Body", true, "FALSE", "key", "1645412392244"})
+	require.NoError(t, err)
+	assert.Equal(t, model.Note{
+		ID:         42,
+		Title:      "Alpha",
+		Content:    "Body",
+		Hidden:     true,
+		EncKeyName: "key",
+		CreatedAt:  1645412392244,
+		UpdatedAt:  1645435461544,
+	}, note)
+
+	// short rows leave the missing fields empty
+	note, err = layout.parseRow(3, []interface{}{"", "", "7", "Short"})
+	require.NoError(t, err)
+	assert.Equal(t, model.Note{ID: 7, Title: "Short"}, note)
+}
+
+func TestSheetLayout_ParseRowErrors(t *testing.T) {
+	t.Parallel()
+
+	layout := defaultSheetLayout()
+	tests := []struct {
+		name   string
+		row    []interface{}
+		column string
+	}{
+		{"missing id", []interface{}{"", "Title"}, sheetColID},
+		{"invalid id", []interface{}{"abc", "Title"}, sheetColID},
+		{"invalid bool", []interface{}{"1", "Title", "", "maybe"}, sheetColHidden},
+		{"invalid timestamp", []interface{}{"1", "Title", "", "", "", "", "", "yesterday"}, sheetColUpdatedAt},
+		{"invalid chunks", []interface{}{"1", "Title", "", "", "", "", "", "", "x:y"}, sheetColContentChunks},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := layout.parseRow(5, tt.row)
+			var rowErr *RowError
+			require.ErrorAs(t, err, &rowErr)
+			assert.Equal(t, 5, rowErr.Row)
+			assert.Equal(t, tt.column, rowErr.Column)
+			assert.Contains(t, err.Error(), "sheet row 5")
+		})
+	}
+}
+
+func TestSheetLayout_BuildRowSkipsUnknownColumns(t *testing.T) {
+	t.Parallel()
+
+	layout := newSheetLayout([]interface{}{"Comment", "ID", "Title"})
+	for _, col := range layout.missing() {
+		layout.add(col)
+	}
+	row, err := layout.buildRow(&model.Note{ID: 3, Title: "Alpha", Content: "Body"})
+	require.NoError(t, err)
+	require.Len(t, row, 3+len(sheetColumns)-2)
+	assert.Nil(t, row[0])
+	assert.Equal(t, 3, row[1])
+	assert.Equal(t, "Alpha", row[2])
+	contentIdx, _ := layout.index(sheetColContent)
+	assert.Equal(t, "Body", row[contentIdx])
+	assert.Equal(t, "AB", layout.lastColumn())
+}
+
+func TestColumnName(t *testing.T) {
+	t.Parallel()
+
+	for idx, name := range map[int]string{0: "A", 7: "H", 25: "Z", 26: "AA", 27: "AB", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA"} {
+		assert.Equal(t, name, columnName(idx), strconv.Itoa(idx))
+	}
+}
+
+func TestGoogleProvider_LoadLayoutAppendsMissingColumns(t *testing.T) {
+	gp, transport := newTestGoogleProvider(t,
+		responseStep{
+			body: `{"values":[["ID","Title","Content","Hidden","Encrypted","EncKeyName","CreatedAt","UpdatedAt","Comments"]]}`,
+		},
+		responseStep{
+			validate: func(t *testing.T, rec requestRecord) {
+				assert.Contains(t, rec.URL, "notes%21J1%3AAB1")
+				var payload struct {
+					Values [][]interface{} `json:"values"`
+				}
+				require.NoError(t, json.Unmarshal(rec.Body, &payload))
+				require.Len(t, payload.Values, 1)
+				assert.Equal(t, []interface{}{sheetColContentChunks, "Content2"}, payload.Values[0][:2])
+				assert.Len(t, payload.Values[0], len(sheetColumns)-8)
+			},
+		},
+		responseStep{
+			body: `{"values":[["1","Alpha","Body","false","false","","100","200","a comment"]]}`,
+		},
+	)
+	gp.layout = nil
+
+	notes, err := gp.GetNotes()
+	require.NoError(t, err)
+	require.Len(t, notes, 1)
+	assert.Equal(t, "Body", notes[0].Content)
+	assert.Equal(t, int64(200), notes[0].UpdatedAt)
+	require.Len(t, transport.requests, 3)
+	assert.Contains(t, transport.requests[2].URL, "notes%21A2%3AAB")
+
+	// the layout is cached
+	_, err = gp.loadLayout()
+	require.NoError(t, err)
+	assert.Len(t, transport.requests, 3)
+}
+
+func TestGoogleProvider_GetNotes_SkipsMalformedRows(t *testing.T) {
+	gp, _ := newTestGoogleProvider(t, responseStep{
+		body: `{"values":[["1","Alpha","Body"],[],["oops","Beta"],["3","Gamma","Body"]]}`,
+	})
+
+	notes, err := gp.GetNotes()
+	require.NoError(t, err)
+	require.Len(t, notes, 2)
+	assert.Equal(t, 1, notes[0].ID)
+	assert.Equal(t, 3, notes[1].ID)
+}
+
+func TestGoogleProvider_GetNoteIDs_SkipsMalformedRows(t *testing.T) {
+	gp, transport := newTestGoogleProvider(t,
+		responseStep{
+			body: `{"valueRanges":[{"values":[[1],[],["oops"],["4"]]},{"values":[[100],[],["300"],["not a time"]]},{}]}`,
+		},
+	)
+
+	ids, err := gp.GetNoteIDs(true)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1}, ids)
+	idx, ok := gp.CacheIDGet(1)
+	require.True(t, ok)
+	assert.Equal(t, 0, idx)
+	updAt, ok := gp.CacheUpdAtGet(1)
+	require.True(t, ok)
+	assert.Equal(t, int64(100), updAt)
+	// IDs and UpdatedAt are read from the columns named in the header
+	require.Len(t, transport.requests, 1)
+	assert.Contains(t, transport.requests[0].URL, "ranges=notes%21A2%3AA&ranges=notes%21H2%3AH&ranges=notes%21AA2%3AAA")
+	// malformed rows still take space in the sheet
+	assert.Equal(t, 4, gp.rowCount)
+	_, err = gp.GetNote(4)
+	require.Error(t, err)
+	assert.Equal(t, common.ERR_NOTE_NOT_FOUND, err.Error())
+}
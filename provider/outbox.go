@@ -0,0 +1,218 @@
+package provider
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/service/observer"
+)
+
+const (
+	// outboxBaseDelay the delay before the first retry of a failed push. It doubles at each attempt
+	outboxBaseDelay = 2 * time.Second
+	// outboxMaxDelay the longest delay between two retries
+	outboxMaxDelay = 10 * time.Minute
+	// outboxIdleWait how long the worker sleeps when the outbox is empty (new changes wake it up)
+	outboxIdleWait = time.Hour
+)
+
+// OutboxStore persists the outbox entries of the sync providers (queues)
+type OutboxStore interface {
+	SaveOutboxEntry(queue string, entry model.OutboxEntry) error
+	GetOutboxEntries(queue string) ([]model.OutboxEntry, error)
+	DeleteOutboxEntries(queue string, ids ...int) error
+}
+
+// Outbox a durable queue of the changes waiting to be pushed to a sync provider.
+// Changes are stored as soon as they are made, so they survive restarts and network outages, and only the latest
+// change of each note is kept. Failed pushes are retried with exponential backoff
+type Outbox struct {
+	store    OutboxStore
+	queue    string
+	observer observer.Observer
+	wake     chan struct{}
+	mux      sync.Mutex
+}
+
+// NewOutbox creates the outbox of a sync provider. The observer is notified of the number of pending changes
+func NewOutbox(store OutboxStore, queue string, observer observer.Observer) *Outbox {
+	return &Outbox{
+		store:    store,
+		queue:    queue,
+		observer: observer,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// PushNote queues a created or updated (encrypted) note
+func (o *Outbox) PushNote(note *model.Note) error {
+	return o.enqueue(model.OutboxEntry{ID: note.ID, Note: note})
+}
+
+// PushTombstone queues the deletion of a note
+func (o *Outbox) PushTombstone(tombstone model.Tombstone) error {
+	return o.enqueue(model.OutboxEntry{ID: tombstone.ID, Tombstone: &tombstone})
+}
+
+// enqueue stores a change, replacing the pending one of the same note, and wakes up the worker
+func (o *Outbox) enqueue(entry model.OutboxEntry) error {
+	o.mux.Lock()
+	entry.Seq = time.Now().UnixNano()
+	err := o.store.SaveOutboxEntry(o.queue, entry)
+	o.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	o.notifyPending()
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Wake returns the channel signalled when a change is queued
+func (o *Outbox) Wake() <-chan struct{} {
+	return o.wake
+}
+
+// Due returns the oldest changes (up to limit) ready to be pushed, and how long to wait for the next ones
+func (o *Outbox) Due(limit int) ([]model.OutboxEntry, time.Duration, error) {
+	o.mux.Lock()
+	entries, err := o.store.GetOutboxEntries(o.queue)
+	o.mux.Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	now := common.GetCurrentTimestamp()
+	due := make([]model.OutboxEntry, 0)
+	wait := outboxIdleWait
+	for _, entry := range entries {
+		if entry.NextAttemptAt <= now {
+			if len(due) < limit {
+				due = append(due, entry)
+			}
+			continue
+		}
+		if next := time.Duration(entry.NextAttemptAt-now) * time.Millisecond; next < wait {
+			wait = next
+		}
+	}
+	if len(due) == limit {
+		wait = 0
+	}
+	return due, wait, nil
+}
+
+// Done removes the pushed changes. The changes queued again in the meantime are kept
+func (o *Outbox) Done(pushed []model.OutboxEntry) error {
+	o.mux.Lock()
+	ids, err := o.unchanged(pushed)
+	if err == nil {
+		err = o.store.DeleteOutboxEntries(o.queue, ids...)
+	}
+	o.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	o.notifyPending()
+	if len(pushed) > 0 && o.observer != nil {
+		o.observer.Notify(observer.EVENT_SYNC_COMPLETED, &model.SyncEvent{Provider: o.queue, At: common.GetCurrentTimestamp()})
+	}
+	return nil
+}
+
+// Retry schedules another attempt at pushing the changes that failed, after an exponential backoff with jitter, or
+// after the wait asked by the provider (eg. when a quota is exhausted) if longer. The observer is told why they failed
+func (o *Outbox) Retry(failed []model.OutboxEntry, cause error) error {
+	if o.observer != nil {
+		o.observer.Notify(observer.EVENT_SYNC_FAILED, &model.SyncEvent{
+			Provider: o.queue, At: common.GetCurrentTimestamp(), Err: cause,
+		})
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	ids, err := o.unchanged(failed)
+	if err != nil {
+		return err
+	}
+	retry := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		retry[id] = true
+	}
+	var retryAfter *retryAfterError
+	minDelay := time.Duration(0)
+	if errors.As(cause, &retryAfter) {
+		minDelay = retryAfter.wait
+	}
+	for _, entry := range failed {
+		if !retry[entry.ID] {
+			continue
+		}
+		entry.Attempts++
+		entry.NextAttemptAt = common.GetCurrentTimestamp() + max(retryDelay(entry.Attempts), minDelay).Milliseconds()
+		entry.LastError = cause.Error()
+		if err := o.store.SaveOutboxEntry(o.queue, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pending returns the number of changes waiting to be pushed
+func (o *Outbox) Pending() (int, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	entries, err := o.store.GetOutboxEntries(o.queue)
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// unchanged returns the IDs of the given entries still stored as they are (not replaced by a newer change)
+func (o *Outbox) unchanged(entries []model.OutboxEntry) ([]int, error) {
+	stored, err := o.store.GetOutboxEntries(o.queue)
+	if err != nil {
+		return nil, err
+	}
+	seqs := make(map[int]int64, len(stored))
+	for _, entry := range stored {
+		seqs[entry.ID] = entry.Seq
+	}
+	ids := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		if seq, ok := seqs[entry.ID]; ok && seq == entry.Seq {
+			ids = append(ids, entry.ID)
+		}
+	}
+	return ids, nil
+}
+
+// notifyPending tells the observer how many changes are waiting to be pushed
+func (o *Outbox) notifyPending() {
+	if o.observer == nil {
+		return
+	}
+	if pending, err := o.Pending(); err == nil {
+		o.observer.Notify(observer.EVENT_SYNC_PENDING, pending, o.queue)
+	}
+}
+
+// retryDelay returns the delay before the given attempt: it doubles at each attempt, up to outboxMaxDelay,
+// and is randomized (between half and all of it) so that devices don't retry in lockstep
+func retryDelay(attempts int) time.Duration {
+	delay := outboxMaxDelay
+	if attempts < 20 {
+		if d := outboxBaseDelay << (attempts - 1); d < outboxMaxDelay {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,192 @@
+package provider
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryOutboxStore an in-memory OutboxStore
+type memoryOutboxStore struct {
+	mu      sync.Mutex
+	entries map[string]map[int]model.OutboxEntry
+}
+
+func newMemoryOutboxStore() *memoryOutboxStore {
+	return &memoryOutboxStore{entries: map[string]map[int]model.OutboxEntry{}}
+}
+
+func (m *memoryOutboxStore) SaveOutboxEntry(queue string, entry model.OutboxEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.entries[queue] == nil {
+		m.entries[queue] = map[int]model.OutboxEntry{}
+	}
+	m.entries[queue][entry.ID] = entry
+	return nil
+}
+
+func (m *memoryOutboxStore) GetOutboxEntries(queue string) ([]model.OutboxEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := make([]model.OutboxEntry, 0, len(m.entries[queue]))
+	for _, entry := range m.entries[queue] {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (m *memoryOutboxStore) DeleteOutboxEntries(queue string, ids ...int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		delete(m.entries[queue], id)
+	}
+	return nil
+}
+
+func TestOutbox_CoalescesAndKeepsRequeuedChanges(t *testing.T) {
+	outbox := NewOutbox(newMemoryOutboxStore(), "test", nil)
+	require.NoError(t, outbox.PushNote(&model.Note{ID: 2, UpdatedAt: 1}))
+	require.NoError(t, outbox.PushNote(&model.Note{ID: 1, UpdatedAt: 2}))
+	require.NoError(t, outbox.PushNote(&model.Note{ID: 2, UpdatedAt: 3}))
+
+	due, _, err := outbox.Due(10)
+	require.NoError(t, err)
+	require.Len(t, due, 2)
+	// oldest change first, latest version of each note
+	assert.Equal(t, 1, due[0].ID)
+	assert.Equal(t, 2, due[1].ID)
+	assert.EqualValues(t, 3, due[1].Note.UpdatedAt)
+
+	// a change queued while the previous one is being pushed is kept
+	require.NoError(t, outbox.PushTombstone(model.Tombstone{ID: 1, DeletedAt: 4}))
+	require.NoError(t, outbox.Done(due))
+	due, wait, err := outbox.Due(10)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	assert.Equal(t, model.Tombstone{ID: 1, DeletedAt: 4}, *due[0].Tombstone)
+	assert.Equal(t, outboxIdleWait, wait)
+
+	require.NoError(t, outbox.Done(due))
+	pending, err := outbox.Pending()
+	require.NoError(t, err)
+	assert.Zero(t, pending)
+}
+
+func TestOutbox_RetryBacksOff(t *testing.T) {
+	store := newMemoryOutboxStore()
+	outbox := NewOutbox(store, "test", nil)
+	require.NoError(t, outbox.PushNote(&model.Note{ID: 1}))
+	due, _, err := outbox.Due(10)
+	require.NoError(t, err)
+
+	require.NoError(t, outbox.Retry(due, errors.New("offline")))
+	entries, _ := store.GetOutboxEntries("test")
+	require.Len(t, entries, 1)
+	assert.Equal(t, 1, entries[0].Attempts)
+	assert.Equal(t, "offline", entries[0].LastError)
+	assert.Greater(t, entries[0].NextAttemptAt, common.GetCurrentTimestamp())
+
+	// nothing is due until the backoff expires
+	due, wait, err := outbox.Due(10)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+	assert.LessOrEqual(t, wait, outboxBaseDelay)
+	assert.Greater(t, wait, time.Duration(0))
+
+	// a new change of the note is pushed right away
+	require.NoError(t, outbox.PushNote(&model.Note{ID: 1, UpdatedAt: 5}))
+	due, _, err = outbox.Due(10)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	assert.Zero(t, due[0].Attempts)
+}
+
+func TestOutbox_NotifiesPendingCount(t *testing.T) {
+	obs := &observer.ObserverImpl{}
+	counts := make(chan int, 4)
+	obs.AddListener(observer.EVENT_SYNC_PENDING, observer.Listener{
+		OnNotify: func(data interface{}, args ...interface{}) {
+			if len(args) == 1 && args[0] == "test" {
+				counts <- data.(int)
+			}
+		},
+	})
+	outbox := NewOutbox(newMemoryOutboxStore(), "test", obs)
+	require.NoError(t, outbox.PushNote(&model.Note{ID: 1}))
+	select {
+	case count := <-counts:
+		assert.Equal(t, 1, count)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the pending count")
+	}
+	due, _, _ := outbox.Due(10)
+	require.NoError(t, outbox.Done(due))
+	select {
+	case count := <-counts:
+		assert.Equal(t, 0, count)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the pending count")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts := 1; attempts < 30; attempts++ {
+		delay := retryDelay(attempts)
+		expected := outboxMaxDelay
+		if attempts < 10 && outboxBaseDelay<<(attempts-1) < outboxMaxDelay {
+			expected = outboxBaseDelay << (attempts - 1)
+		}
+		assert.GreaterOrEqual(t, delay, expected/2, "attempt %d", attempts)
+		assert.LessOrEqual(t, delay, expected, "attempt %d", attempts)
+	}
+}
+
+func TestOutbox_NotifiesPushResults(t *testing.T) {
+	obs := &observer.ObserverImpl{}
+	failed := make(chan *model.SyncEvent, 1)
+	completed := make(chan *model.SyncEvent, 1)
+	obs.AddListener(observer.EVENT_SYNC_FAILED, observer.Listener{
+		OnNotify: func(data interface{}, args ...interface{}) { failed <- data.(*model.SyncEvent) },
+	})
+	obs.AddListener(observer.EVENT_SYNC_COMPLETED, observer.Listener{
+		OnNotify: func(data interface{}, args ...interface{}) { completed <- data.(*model.SyncEvent) },
+	})
+	outbox := NewOutbox(newMemoryOutboxStore(), "test", obs)
+	require.NoError(t, outbox.PushNote(&model.Note{ID: 1}))
+	due, _, _ := outbox.Due(10)
+
+	require.NoError(t, outbox.Retry(due, errors.New("offline")))
+	select {
+	case e := <-failed:
+		assert.Equal(t, "test", e.Provider)
+		assert.EqualError(t, e.Err, "offline")
+		assert.NotZero(t, e.At)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the failure")
+	}
+
+	// nothing was pushed
+	require.NoError(t, outbox.Done(nil))
+	require.NoError(t, outbox.Done(due))
+	select {
+	case e := <-completed:
+		assert.Equal(t, "test", e.Provider)
+		assert.NoError(t, e.Err)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the completion")
+	}
+	select {
+	case <-completed:
+		t.Fatal("an empty push is not a sync")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
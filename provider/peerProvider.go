@@ -0,0 +1,266 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/p2p"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	log "github.com/sirupsen/logrus"
+)
+
+// PeerProviderPrefix the prefix of the name of the providers syncing with a paired device, followed by the beginning
+// of its fingerprint: each device has its own sync bases
+const PeerProviderPrefix = "p2p:"
+
+// peerNameLength how many characters of the fingerprint of the device end up in the provider name
+const peerNameLength = 16
+
+// PeerProvider syncs the notes with a paired device on the local network (see package p2p), reached at the address
+// it was last seen at. The notes never leave the devices, and are exchanged encrypted.
+// Nothing is pushed in the background: the devices sync with each other periodically and on request
+type PeerProvider struct {
+	identity    *p2p.Identity
+	peers       *p2p.Peers
+	fingerprint string
+	logger      *log.Logger
+	observer    observer.Observer
+	// client the client of the device, for the address it was created for
+	client    *p2p.Client
+	clientMux sync.Mutex
+	ctx       context.Context
+}
+
+// NewPeerProvider creates a new provider syncing the notes with the paired device with the given fingerprint
+func NewPeerProvider(
+	identity *p2p.Identity,
+	peers *p2p.Peers,
+	fingerprint string,
+	logger *log.Logger,
+	observer observer.Observer,
+) *PeerProvider {
+	return &PeerProvider{
+		identity:    identity,
+		peers:       peers,
+		fingerprint: fingerprint,
+		logger:      logger,
+		observer:    observer,
+	}
+}
+
+// Init initializes the provider
+func (pp *PeerProvider) Init() error {
+	if _, ok := pp.peers.Get(pp.fingerprint); !ok {
+		return errors.New(common.ERR_PEER_NOT_PAIRED)
+	}
+	pp.ctx = context.Background()
+	return nil
+}
+
+// Name returns the provider name of the device
+func (pp *PeerProvider) Name() string {
+	fingerprint := pp.fingerprint
+	if len(fingerprint) > peerNameLength {
+		fingerprint = fingerprint[:peerNameLength]
+	}
+	return PeerProviderPrefix + fingerprint
+}
+
+// Capabilities the device keeps the tombstones and the UpdatedAt of the notes. Changes are only exchanged by syncs
+func (pp *PeerProvider) Capabilities() Capability {
+	return CapabilityTombstones | CapabilityMerge
+}
+
+// GetNotes fetch from the device notes with given id or all if no ids is given
+func (pp *PeerProvider) GetNotes(ids ...int) ([]model.Note, error) {
+	client, err := pp.getClient()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		index, err := client.Index(pp.ctx)
+		if err != nil {
+			return nil, err
+		}
+		ids = indexNoteIDs(index)
+	}
+	return client.Fetch(pp.ctx, ids)
+}
+
+// GetNoteIDs returns the sorted IDs of the notes of the device (tombstones excluded)
+func (pp *PeerProvider) GetNoteIDs(forceRemote bool) ([]int, error) {
+	client, err := pp.getClient()
+	if err != nil {
+		return nil, err
+	}
+	index, err := client.Index(pp.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return indexNoteIDs(index), nil
+}
+
+// GetNote returns the note with the given id
+func (pp *PeerProvider) GetNote(id int) (*model.Note, error) {
+	notes, err := pp.GetNotes(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(notes) == 0 {
+		return nil, errors.New(common.ERR_NOTE_NOT_FOUND)
+	}
+	return &notes[0], nil
+}
+
+// PutNote writes a note to the device, unless it changed there since it was read
+func (pp *PeerProvider) PutNote(note *model.Note) error {
+	return pp.push(pp.ctx, func(index *p2p.Index) p2p.PushRequest {
+		return p2p.PushRequest{Notes: []p2p.PushedNote{{Note: *note, Base: index.Version(note.ID)}}}
+	})
+}
+
+// DeleteNote deletes the note with the given id from the device
+func (pp *PeerProvider) DeleteNote(id int) error {
+	tombstone := model.Tombstone{ID: id, DeletedAt: common.GetCurrentTimestamp()}
+	return pp.push(pp.ctx, func(index *p2p.Index) p2p.PushRequest {
+		return p2p.PushRequest{Tombstones: []p2p.PushedTombstone{{Tombstone: tombstone, Base: index.Version(id)}}}
+	})
+}
+
+// RemoteVersions returns the UpdatedAt and DeletedAt of the notes on the device, reading its index
+func (pp *PeerProvider) RemoteVersions(ctx context.Context) (map[int]int64, map[int]int64, error) {
+	client, err := pp.getClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	index, err := client.Index(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return indexVersions(index), index.Tombstones, nil
+}
+
+// SyncNotes syncs the notes of the device with the local database and vice versa (see planSync).
+// The notes are written to the device only if they didn't change there since its index was read: otherwise the sync
+// fails, and the next one merges them
+func (pp *PeerProvider) SyncNotes(
+	ctx context.Context,
+	dbNotes []model.Note,
+	dbTombstones []model.Tombstone,
+	bases map[int]int64,
+) (*SyncResult, error) {
+	client, err := pp.getClient()
+	if err != nil {
+		return nil, err
+	}
+	index, err := client.Index(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plan := planSync(dbNotes, dbTombstones, bases, indexVersions(index), index.Tombstones)
+	req := p2p.PushRequest{}
+	for _, note := range plan.toPush {
+		req.Notes = append(req.Notes, p2p.PushedNote{Note: *note, Base: index.Version(note.ID)})
+	}
+	for _, tombstone := range plan.toBury {
+		req.Tombstones = append(req.Tombstones, p2p.PushedTombstone{Tombstone: tombstone, Base: index.Version(tombstone.ID)})
+	}
+	rejected, err := client.Push(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(rejected) > 0 {
+		return nil, fmt.Errorf("%w: %d", errRemoteNewer, rejected[0])
+	}
+	fetched, err := client.Fetch(ctx, plan.toFetch)
+	if err != nil {
+		return nil, err
+	}
+	result, noteTitles := plan.result(fetched)
+	pp.observer.Notify(observer.EVENT_UPDATE_NOTE_TITLES, noteTitles)
+	return result, nil
+}
+
+// PurgeTombstones does nothing: each device purges its own tombstones
+func (pp *PeerProvider) PurgeTombstones(before int64) error {
+	return nil
+}
+
+// InitWorker does nothing: the changes are only exchanged by syncs
+func (pp *PeerProvider) InitWorker(ctx context.Context) {}
+
+// UpdateNoteNotifier returns a listener ignoring the changes: they are exchanged by the next sync
+func (pp *PeerProvider) UpdateNoteNotifier() observer.Listener {
+	return observer.Listener{OnNotify: func(data interface{}, args ...interface{}) {}}
+}
+
+// DeleteNoteNotifier returns a listener ignoring the deletions: they are exchanged by the next sync
+func (pp *PeerProvider) DeleteNoteNotifier() observer.Listener {
+	return observer.Listener{OnNotify: func(data interface{}, args ...interface{}) {}}
+}
+
+// push writes the notes and tombstones of the request built from the index of the device
+func (pp *PeerProvider) push(ctx context.Context, request func(index *p2p.Index) p2p.PushRequest) error {
+	client, err := pp.getClient()
+	if err != nil {
+		return err
+	}
+	index, err := client.Index(ctx)
+	if err != nil {
+		return err
+	}
+	rejected, err := client.Push(ctx, request(index))
+	if err != nil {
+		return err
+	}
+	if len(rejected) > 0 {
+		return fmt.Errorf("%w: %d", errRemoteNewer, rejected[0])
+	}
+	return nil
+}
+
+// getClient returns the client of the device, for the address it was last seen at
+func (pp *PeerProvider) getClient() (*p2p.Client, error) {
+	peer, ok := pp.peers.Get(pp.fingerprint)
+	if !ok {
+		return nil, errors.New(common.ERR_PEER_NOT_PAIRED)
+	}
+	pp.clientMux.Lock()
+	defer pp.clientMux.Unlock()
+	if pp.client != nil && pp.client.Peer().Address == peer.Address {
+		return pp.client, nil
+	}
+	client, err := p2p.NewClient(pp.identity, peer, peer.Address)
+	if err != nil {
+		return nil, err
+	}
+	pp.client = client
+	return client, nil
+}
+
+// indexNoteIDs returns the sorted IDs of the notes of an index (tombstones excluded)
+func indexNoteIDs(index *p2p.Index) []int {
+	ids := make([]int, 0, len(index.Notes))
+	for id := range index.Notes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// indexVersions returns the UpdatedAt of the notes of an index, and the DeletedAt of its tombstones
+func indexVersions(index *p2p.Index) map[int]int64 {
+	versions := make(map[int]int64, len(index.Notes)+len(index.Tombstones))
+	for id, updatedAt := range index.Notes {
+		versions[id] = updatedAt
+	}
+	for id, deletedAt := range index.Tombstones {
+		versions[id] = deletedAt
+	}
+	return versions
+}
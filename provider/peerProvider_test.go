@@ -0,0 +1,192 @@
+package provider
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/p2p"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeVault an in-memory vault served to the paired devices
+type fakeVault struct {
+	notes      map[int]model.Note
+	tombstones map[int]model.Tombstone
+	mux        sync.Mutex
+}
+
+func (v *fakeVault) CanSync() bool     { return true }
+func (v *fakeVault) IsLocalOnly() bool { return false }
+
+func (v *fakeVault) GetStoredNotes() ([]model.Note, error) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	notes := make([]model.Note, 0, len(v.notes))
+	for _, note := range v.notes {
+		notes = append(notes, note)
+	}
+	return notes, nil
+}
+
+func (v *fakeVault) GetTombstones() ([]model.Tombstone, error) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	tombstones := make([]model.Tombstone, 0, len(v.tombstones))
+	for _, tombstone := range v.tombstones {
+		tombstones = append(tombstones, tombstone)
+	}
+	return tombstones, nil
+}
+
+func (v *fakeVault) SaveEncryptedNotes(notes []model.Note) error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	for _, note := range notes {
+		v.notes[note.ID] = note
+		delete(v.tombstones, note.ID)
+	}
+	return nil
+}
+
+func (v *fakeVault) ApplyRemoteDeletes(tombstones []model.Tombstone) error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	for _, tombstone := range tombstones {
+		delete(v.notes, tombstone.ID)
+		v.tombstones[tombstone.ID] = tombstone
+	}
+	return nil
+}
+
+// newTestPeerProvider serves vault on loopback, and returns a provider of another device paired with it
+func newTestPeerProvider(t *testing.T, vault *fakeVault) *PeerProvider {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	serverDir := t.TempDir()
+	serverIdentity, err := p2p.LoadIdentity(serverDir)
+	require.NoError(t, err)
+	serverPeers, err := p2p.LoadPeers(filepath.Join(serverDir, "peers.json"))
+	require.NoError(t, err)
+	server := p2p.NewServer(serverIdentity, serverPeers, vault, "server", logger)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, server.Serve(ctx, listener))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	clientDir := t.TempDir()
+	clientIdentity, err := p2p.LoadIdentity(clientDir)
+	require.NoError(t, err)
+	clientPeers, err := p2p.LoadPeers(filepath.Join(clientDir, "peers.json"))
+	require.NoError(t, err)
+	code, err := server.StartPairing(time.Minute)
+	require.NoError(t, err)
+	peer, err := p2p.Pair(context.Background(), clientIdentity, listener.Addr().String(), code, "client", 0)
+	require.NoError(t, err)
+	require.NoError(t, clientPeers.Add(*peer))
+
+	pp := NewPeerProvider(clientIdentity, clientPeers, peer.Fingerprint, logger, &observer.ObserverImpl{})
+	require.NoError(t, pp.Init())
+	return pp
+}
+
+func TestPeerProvider_NotPaired(t *testing.T) {
+	identity, err := p2p.LoadIdentity(t.TempDir())
+	require.NoError(t, err)
+	peers, err := p2p.LoadPeers(filepath.Join(t.TempDir(), "peers.json"))
+	require.NoError(t, err)
+	pp := NewPeerProvider(identity, peers, "0123456789abcdef0123", logrus.New(), &observer.ObserverImpl{})
+	assert.Error(t, pp.Init())
+	assert.Equal(t, "p2p:0123456789abcdef", pp.Name())
+	assert.False(t, pp.Capabilities().Has(CapabilityBackgroundPush))
+}
+
+func TestPeerProvider_SyncNotes(t *testing.T) {
+	vault := &fakeVault{
+		notes: map[int]model.Note{
+			// changed on the device only
+			2: {ID: 2, Title: "enc:2", Content: "b64:2-remote", UpdatedAt: 25},
+			// deleted here
+			3: {ID: 3, Title: "enc:3", Content: "b64:3", UpdatedAt: 30},
+			// changed on both sides
+			5: {ID: 5, Title: "enc:5", Content: "b64:5-remote", UpdatedAt: 56},
+			// new on the device
+			6: {ID: 6, Title: "enc:6", Content: "b64:6", UpdatedAt: 60},
+		},
+		tombstones: map[int]model.Tombstone{
+			// deleted on the device
+			4: {ID: 4, DeletedAt: 45},
+		},
+	}
+	pp := newTestPeerProvider(t, vault)
+
+	dbNotes := []model.Note{
+		{ID: 1, Title: "enc:1", Content: "b64:1", UpdatedAt: 10},
+		{ID: 2, Title: "enc:2", Content: "b64:2", UpdatedAt: 20},
+		{ID: 4, Title: "enc:4", Content: "b64:4", UpdatedAt: 40},
+		{ID: 5, Title: "enc:5", Content: "b64:5-local", UpdatedAt: 55},
+	}
+	dbTombstones := []model.Tombstone{{ID: 3, DeletedAt: 35}}
+	bases := map[int]int64{2: 20, 4: 40, 5: 50}
+	result, err := pp.SyncNotes(context.Background(), dbNotes, dbTombstones, bases)
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, []int{2, 6}, noteIDs(result.Downloaded))
+	require.Len(t, result.Conflicts, 1)
+	assert.Equal(t, "b64:5-remote", result.Conflicts[0].Content)
+	assert.Equal(t, []model.Tombstone{{ID: 4, DeletedAt: 45}}, result.Deleted)
+
+	// the new note and the deletion reached the device
+	assert.Equal(t, "b64:1", vault.notes[1].Content)
+	assert.NotContains(t, vault.notes, 3)
+	assert.Equal(t, model.Tombstone{ID: 3, DeletedAt: 35}, vault.tombstones[3])
+	// the conflicting note is left to the merge
+	assert.Equal(t, "b64:5-remote", vault.notes[5].Content)
+
+	ids, err := pp.GetNoteIDs(true)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 5, 6}, ids)
+}
+
+func TestPeerProvider_PutAndDeleteNote(t *testing.T) {
+	vault := &fakeVault{notes: map[int]model.Note{}, tombstones: map[int]model.Tombstone{}}
+	pp := newTestPeerProvider(t, vault)
+
+	require.NoError(t, pp.PutNote(&model.Note{ID: 1, Title: "enc:1", Content: "b64:1", UpdatedAt: 10}))
+	note, err := pp.GetNote(1)
+	require.NoError(t, err)
+	assert.Equal(t, "b64:1", note.Content)
+
+	require.NoError(t, pp.DeleteNote(1))
+	_, err = pp.GetNote(1)
+	assert.Error(t, err)
+	notes, err := pp.GetNotes()
+	require.NoError(t, err)
+	assert.Empty(t, notes)
+}
+
+func noteIDs(notes []model.Note) []int {
+	ids := make([]int, 0, len(notes))
+	for _, note := range notes {
+		ids = append(ids, note.ID)
+	}
+	return ids
+}
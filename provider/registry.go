@@ -0,0 +1,87 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfigReader reads the provider settings from the config file
+type ConfigReader interface {
+	GetConfig(key string) (string, error)
+}
+
+// ProviderDeps the dependencies handed over to the provider factories
+type ProviderDeps struct {
+	Config ConfigReader
+	// Outbox the outbox of the provider, holding the changes waiting to be pushed
+	Outbox *Outbox
+	Logger *log.Logger
+	// Observer the observer the provider notifies. Note titles must reach the UI only through NoteService
+	Observer observer.Observer
+	// Secrets the secrets kept in the cert store, such as the OAuth tokens and the credentials of the provider
+	Secrets SecretReader
+}
+
+// ProviderFactory creates a provider from its settings
+type ProviderFactory func(deps ProviderDeps) (SyncNoteProvider, error)
+
+// Registry the sync providers that can be activated, by provider type
+type Registry struct {
+	factories map[string]ProviderFactory
+	mux       sync.RWMutex
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{factories: make(map[string]ProviderFactory)}
+}
+
+// NewDefaultRegistry creates a registry holding all the built-in providers
+func NewDefaultRegistry() *Registry {
+	r := NewRegistry()
+	r.Register(GoogleProviderName, newGoogleProviderFromConfig)
+	r.Register(GoogleDriveProviderName, newGoogleDriveProviderFromConfig)
+	r.Register(WebDAVProviderName, newWebDAVProviderFromConfig)
+	r.Register(FolderProviderName, newFolderProviderFromConfig)
+	r.Register(ServerProviderName, newServerProviderFromConfig)
+	r.Register(S3ProviderName, newS3ProviderFromConfig)
+	return r
+}
+
+// Register adds a provider type, replacing the one with the same name
+func (r *Registry) Register(name string, factory ProviderFactory) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.factories[name] = factory
+}
+
+// Names returns the sorted provider types
+func (r *Registry) Names() []string {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	names := make([]string, 0, len(r.factories))
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Create creates a provider of the given type. The secret settings are read from the cert store, if given
+func (r *Registry) Create(name string, deps ProviderDeps) (SyncNoteProvider, error) {
+	r.mux.RLock()
+	factory, ok := r.factories[name]
+	r.mux.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", common.ERR_UNKNOWN_SYNC_PROVIDER, name)
+	}
+	if deps.Secrets != nil {
+		deps.Config = newSecretConfig(deps.Config, deps.Secrets)
+	}
+	return factory(deps)
+}
@@ -0,0 +1,431 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	log "github.com/sirupsen/logrus"
+)
+
+// S3ProviderName the name of the S3 provider
+const S3ProviderName = "s3"
+
+const (
+	// s3RequestTimeout the timeout of a single S3 request
+	s3RequestTimeout = 30 * time.Second
+	// s3BatchSize how many outbox changes the worker pushes in a row
+	s3BatchSize = 50
+	// s3NotesFolder the folder of the note objects, under the prefix
+	s3NotesFolder = "notes/"
+	// s3NoteExt the extension of the note objects
+	s3NoteExt = ".json"
+	// s3ManifestKey the key of the manifest, under the prefix
+	s3ManifestKey = "manifest.json"
+	// s3ManifestAttempts how many times the manifest is read again and rewritten when other devices update it
+	s3ManifestAttempts = 5
+)
+
+// s3Manifest the object listing the note objects with their ETag, so that a sync downloads the changed ones only
+type s3Manifest struct {
+	Notes map[int]s3ManifestEntry `json:"notes"`
+}
+
+// s3ManifestEntry a note object listed in the manifest
+type s3ManifestEntry struct {
+	ETag      string `json:"etag"`
+	UpdatedAt int64  `json:"updated_at"`
+	DeletedAt int64  `json:"deleted_at,omitempty"`
+}
+
+// S3Provider syncs the notes with a bucket of an S3-compatible object storage (AWS S3, MinIO, Backblaze B2),
+// one object per note plus a manifest listing them. The objects are written with conditional requests, so that
+// a newer version written by another device is never overwritten, and the manifest is updated with
+// compare-and-swap on its ETag
+type S3Provider struct {
+	fileIndexProvider
+	endpoint  string
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	baseURL   *url.URL
+	client    *http.Client
+	signer    *s3Signer
+	// manifest the notes listed in the manifest when it was last read or written, with its ETag
+	manifest     map[int]s3ManifestEntry
+	manifestETag string
+	// objects the note objects read or written since the manifest was last read, to be listed by commit
+	objects     map[int]s3ManifestEntry
+	manifestMux sync.RWMutex
+}
+
+// NewS3Provider creates a new S3 provider storing the notes in bucket, under prefix. endpoint is the URL of the
+// S3 service (eg. https://s3.eu-west-1.amazonaws.com or http://localhost:9000), the bucket is addressed path-style
+func NewS3Provider(
+	endpoint string,
+	region string,
+	bucket string,
+	prefix string,
+	accessKey string,
+	secretKey string,
+	logger *log.Logger,
+	observer observer.Observer,
+	outbox *Outbox,
+) (*S3Provider, error) {
+	sp := &S3Provider{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    bucket,
+		prefix:    prefix,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		manifest:  make(map[int]s3ManifestEntry),
+		objects:   make(map[int]s3ManifestEntry),
+	}
+	sp.fileIndexProvider = newFileIndexProvider(sp, s3BatchSize, logger, observer, outbox)
+	if err := sp.Init(); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+// newS3ProviderFromConfig creates the S3 provider configured in the config file
+func newS3ProviderFromConfig(deps ProviderDeps) (SyncNoteProvider, error) {
+	settings := make(map[string]string)
+	for _, key := range []string{
+		common.CONFIG_S3_ENDPOINT,
+		common.CONFIG_S3_BUCKET,
+		common.CONFIG_S3_ACCESS_KEY,
+		common.CONFIG_S3_SECRET_KEY,
+	} {
+		value, err := deps.Config.GetConfig(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: missing %s", common.ERR_INVALID_S3_PROVIDER_CONFIG, key)
+		}
+		settings[key] = value
+	}
+	region, _ := deps.Config.GetConfig(common.CONFIG_S3_REGION)
+	prefix, _ := deps.Config.GetConfig(common.CONFIG_S3_PREFIX)
+	return NewS3Provider(
+		settings[common.CONFIG_S3_ENDPOINT],
+		region,
+		settings[common.CONFIG_S3_BUCKET],
+		prefix,
+		settings[common.CONFIG_S3_ACCESS_KEY],
+		settings[common.CONFIG_S3_SECRET_KEY],
+		deps.Logger,
+		deps.Observer,
+		deps.Outbox,
+	)
+}
+
+// Init initializes the provider
+func (sp *S3Provider) Init() error {
+	baseURL, err := url.Parse(sp.endpoint)
+	if err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+		return errors.New(common.ERR_INVALID_S3_PROVIDER_CONFIG)
+	}
+	if sp.bucket == "" || strings.Contains(sp.bucket, "/") || sp.accessKey == "" || sp.secretKey == "" {
+		return errors.New(common.ERR_INVALID_S3_PROVIDER_CONFIG)
+	}
+	if sp.region == "" {
+		sp.region = common.DEFAULT_S3_REGION
+	}
+	// the prefix is a folder of the bucket
+	sp.prefix = strings.Trim(sp.prefix, "/")
+	if sp.prefix != "" {
+		sp.prefix += "/"
+	}
+	baseURL.Path = strings.TrimSuffix(baseURL.Path, "/")
+	baseURL.RawPath = ""
+	sp.baseURL = baseURL
+	sp.client = &http.Client{Timeout: s3RequestTimeout}
+	sp.signer = &s3Signer{accessKey: sp.accessKey, secretKey: sp.secretKey, region: sp.region, now: time.Now}
+	return nil
+}
+
+// Name returns the provider type
+func (sp *S3Provider) Name() string {
+	return S3ProviderName
+}
+
+// list reads the manifest, and returns the ETag of the note objects it lists
+func (sp *S3Provider) list(ctx context.Context) (map[int]string, error) {
+	if err := sp.readManifest(ctx); err != nil {
+		return nil, err
+	}
+	sp.manifestMux.Lock()
+	defer sp.manifestMux.Unlock()
+	etags := make(map[int]string, len(sp.manifest))
+	for id, listed := range sp.manifest {
+		etags[id] = listed.ETag
+	}
+	// the objects purged by other devices are no longer listed
+	for id := range sp.objects {
+		if _, ok := sp.manifest[id]; !ok {
+			delete(sp.objects, id)
+		}
+	}
+	return etags, nil
+}
+
+// purge deletes the objects of the given tombstones, unless they changed since they were seen, and removes them
+// from the manifest
+func (sp *S3Provider) purge(ctx context.Context, _ int64, tombstones map[int]string) ([]int, error) {
+	purged := make(map[int]string, len(tombstones))
+	ids := make([]int, 0, len(tombstones))
+	for id, etag := range tombstones {
+		key := sp.noteKey(id)
+		resp, err := sp.do(ctx, http.MethodDelete, key, nil, map[string]string{"If-Match": etag})
+		if err != nil {
+			return ids, err
+		}
+		// an object changed in the meantime (eg. the note was resurrected) is kept
+		if resp.StatusCode == http.StatusPreconditionFailed {
+			resp.Body.Close()
+			continue
+		}
+		if resp.StatusCode != http.StatusNotFound && !isSuccess(resp.StatusCode) {
+			err := s3StatusError(http.MethodDelete, key, resp)
+			resp.Body.Close()
+			return ids, err
+		}
+		resp.Body.Close()
+		purged[id] = etag
+		ids = append(ids, id)
+		sp.manifestMux.Lock()
+		delete(sp.objects, id)
+		sp.manifestMux.Unlock()
+	}
+	return ids, sp.updateManifest(ctx, func(notes map[int]s3ManifestEntry) bool {
+		changed := false
+		for id, etag := range purged {
+			if entry, ok := notes[id]; ok && entry.ETag == etag {
+				delete(notes, id)
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+// readManifest downloads the manifest. A missing manifest lists no notes
+func (sp *S3Provider) readManifest(ctx context.Context) error {
+	key := sp.prefix + s3ManifestKey
+	resp, err := sp.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	manifest := s3Manifest{Notes: make(map[int]s3ManifestEntry)}
+	etag := ""
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+	case isSuccess(resp.StatusCode):
+		if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+			return fmt.Errorf("unable to parse the s3 manifest: %w", err)
+		}
+		if manifest.Notes == nil {
+			manifest.Notes = make(map[int]s3ManifestEntry)
+		}
+		etag = resp.Header.Get("ETag")
+	default:
+		return s3StatusError(http.MethodGet, key, resp)
+	}
+	sp.manifestMux.Lock()
+	sp.manifest = manifest.Notes
+	sp.manifestETag = etag
+	sp.manifestMux.Unlock()
+	return nil
+}
+
+// commit lists in the manifest the note objects written or seen since it was last read, not only the written ones:
+// this also repairs the entries left behind by a device that didn't complete its last write. An entry is never
+// replaced by an older version of the note
+func (sp *S3Provider) commit(ctx context.Context, _ []remoteNoteFile) error {
+	return sp.updateManifest(ctx, func(notes map[int]s3ManifestEntry) bool {
+		changed := false
+		for id, object := range sp.objects {
+			if listed, ok := notes[id]; ok && (listed.ETag == object.ETag || listed.UpdatedAt > object.UpdatedAt) {
+				continue
+			}
+			notes[id] = object
+			changed = true
+		}
+		return changed
+	})
+}
+
+// updateManifest applies change (called holding manifestMux for reading) to a copy of the manifest, and writes it if
+// anything changed. When another device wrote the manifest in the meantime, it is read again and change reapplied
+func (sp *S3Provider) updateManifest(ctx context.Context, change func(notes map[int]s3ManifestEntry) bool) error {
+	key := sp.prefix + s3ManifestKey
+	for attempt := 0; attempt < s3ManifestAttempts; attempt++ {
+		sp.manifestMux.RLock()
+		notes := make(map[int]s3ManifestEntry, len(sp.manifest))
+		for id, entry := range sp.manifest {
+			notes[id] = entry
+		}
+		etag := sp.manifestETag
+		changed := change(notes)
+		sp.manifestMux.RUnlock()
+		if !changed {
+			return nil
+		}
+		body, err := json.Marshal(s3Manifest{Notes: notes})
+		if err != nil {
+			return err
+		}
+		condition := map[string]string{"If-None-Match": "*"}
+		if etag != "" {
+			condition = map[string]string{"If-Match": etag}
+		}
+		resp, err := sp.do(ctx, http.MethodPut, key, body, condition)
+		if err != nil {
+			return err
+		}
+		if isSuccess(resp.StatusCode) {
+			resp.Body.Close()
+			sp.manifestMux.Lock()
+			sp.manifest = notes
+			sp.manifestETag = resp.Header.Get("ETag")
+			sp.manifestMux.Unlock()
+			return nil
+		}
+		// 409: a concurrent conditional write is still in progress
+		if resp.StatusCode != http.StatusPreconditionFailed && resp.StatusCode != http.StatusConflict {
+			err := s3StatusError(http.MethodPut, key, resp)
+			resp.Body.Close()
+			return err
+		}
+		resp.Body.Close()
+		if err := sp.readManifest(ctx); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("s3 PUT %s: too many concurrent updates", key)
+}
+
+// read downloads the object of a note, with its ETag
+func (sp *S3Provider) read(ctx context.Context, id int) (*remoteNoteFile, string, error) {
+	key := sp.noteKey(id)
+	resp, err := sp.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", errors.New(common.ERR_NOTE_NOT_FOUND)
+	}
+	if !isSuccess(resp.StatusCode) {
+		return nil, "", s3StatusError(http.MethodGet, key, resp)
+	}
+	var file remoteNoteFile
+	if err := json.NewDecoder(resp.Body).Decode(&file); err != nil {
+		return nil, "", fmt.Errorf("unable to parse the s3 object of note %d: %w", id, err)
+	}
+	if file.ID != id || (file.Note == nil && file.DeletedAt == 0) {
+		return nil, "", fmt.Errorf("%s: %s", common.ERR_MALFORMED_NOTE_FILE, key)
+	}
+	etag := resp.Header.Get("ETag")
+	sp.seen(file, etag)
+	return &file, etag, nil
+}
+
+// write writes the object of a note, if it still has the given ETag (or doesn't exist yet, when empty).
+// The object is listed in the manifest by commit
+func (sp *S3Provider) write(ctx context.Context, file remoteNoteFile, etag string) (string, error) {
+	key := sp.noteKey(file.ID)
+	body, err := json.Marshal(file)
+	if err != nil {
+		return "", err
+	}
+	condition := map[string]string{"If-None-Match": "*"}
+	if etag != "" {
+		condition = map[string]string{"If-Match": etag}
+	}
+	resp, err := sp.do(ctx, http.MethodPut, key, body, condition)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch {
+	case isSuccess(resp.StatusCode):
+		etag = resp.Header.Get("ETag")
+		sp.seen(file, etag)
+		return etag, nil
+	// 409: a concurrent conditional write is still in progress
+	case resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict:
+		return "", errVersionConflict
+	}
+	return "", s3StatusError(http.MethodPut, key, resp)
+}
+
+// seen records a note object read or written, to be listed in the manifest by commit
+func (sp *S3Provider) seen(file remoteNoteFile, etag string) {
+	sp.manifestMux.Lock()
+	sp.objects[file.ID] = s3ManifestEntry{ETag: etag, UpdatedAt: file.UpdatedAt, DeletedAt: file.DeletedAt}
+	sp.manifestMux.Unlock()
+}
+
+// do sends a signed request for the object at key
+func (sp *S3Provider) do(
+	ctx context.Context,
+	method string,
+	key string,
+	body []byte,
+	headers map[string]string,
+) (*http.Response, error) {
+	var reader io.Reader
+	payloadHash := s3EmptyPayloadHash
+	if body != nil {
+		reader = bytes.NewReader(body)
+		payloadHash = sha256Hex(body)
+	}
+	target := *sp.baseURL
+	target.Path = sp.baseURL.Path + "/" + sp.bucket + "/" + key
+	// the path is sent encoded as it is signed
+	target.RawPath = s3URIEncode(target.Path, false)
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	sp.signer.sign(req, payloadHash)
+	return sp.client.Do(req)
+}
+
+// noteKey returns the key of the object of a note
+func (sp *S3Provider) noteKey(id int) string {
+	return sp.prefix + s3NotesFolder + strconv.Itoa(id) + s3NoteExt
+}
+
+// s3StatusError the error returned when the service rejects a request, with the S3 error code when there is one
+func s3StatusError(method string, key string, resp *http.Response) error {
+	var s3Err struct {
+		Code string `xml:"Code"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&s3Err); err == nil && s3Err.Code != "" {
+		return fmt.Errorf("s3 %s %s: %s (%s)", method, key, resp.Status, s3Err.Code)
+	}
+	return fmt.Errorf("s3 %s %s: %s", method, key, resp.Status)
+}
@@ -0,0 +1,276 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// s3TestServer an in-process fake of the S3 object API: path-style GET, PUT and DELETE of objects, with conditional
+// requests and signature checks
+type s3TestServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	gets    map[string]int
+	// failPath the object path whose writes fail
+	failPath string
+}
+
+func newS3TestServer(t *testing.T) *s3TestServer {
+	s := &s3TestServer{objects: make(map[string][]byte), gets: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *s3TestServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s3TestError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	if !s.verifySignature(r, body) {
+		s3TestError(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, exists := s.objects[r.URL.Path]
+	etag := ""
+	if exists {
+		etag = s3TestETag(data)
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.gets[r.URL.Path]++
+		if !exists {
+			s3TestError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write(data)
+	case http.MethodPut, http.MethodDelete:
+		if r.URL.Path == s.failPath {
+			s3TestError(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+		if (ifMatch != "" && ifMatch != etag) || (ifNoneMatch == "*" && exists) {
+			s3TestError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(s.objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		s.objects[r.URL.Path] = body
+		w.Header().Set("ETag", s3TestETag(body))
+	default:
+		s3TestError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// verifySignature signs again the headers listed in the Authorization header, and checks the payload hash
+func (s *s3TestServer) verifySignature(r *http.Request, body []byte) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, s3SignAlgorithm+" Credential=access/") {
+		return false
+	}
+	signedAt, err := time.Parse(s3DateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil || r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+		return false
+	}
+	signed := strings.TrimPrefix(auth[strings.Index(auth, "SignedHeaders="):], "SignedHeaders=")
+	signed = signed[:strings.Index(signed, ",")]
+	req, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return false
+	}
+	for _, name := range strings.Split(signed, ";") {
+		if name != "host" {
+			req.Header.Set(name, r.Header.Get(name))
+		}
+	}
+	signer := &s3Signer{accessKey: "access", secretKey: "secret", region: "eu-central-1", now: func() time.Time { return signedAt }}
+	signer.sign(req, r.Header.Get("X-Amz-Content-Sha256"))
+	return req.Header.Get("Authorization") == auth
+}
+
+// manifest returns the notes listed in the manifest
+func (s *s3TestServer) manifest(t *testing.T) map[int]s3ManifestEntry {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var manifest s3Manifest
+	require.NoError(t, json.Unmarshal(s.objects["/vault/team/"+s3ManifestKey], &manifest))
+	return manifest.Notes
+}
+
+// object returns the object at key, nil if it doesn't exist
+func (s *s3TestServer) object(key string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.objects["/vault/team/"+key]
+}
+
+// noteGets returns how many times the note objects were downloaded
+func (s *s3TestServer) noteGets() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gets := 0
+	for path, count := range s.gets {
+		if strings.Contains(path, "/"+s3NotesFolder) {
+			gets += count
+		}
+	}
+	return gets
+}
+
+func (s *s3TestServer) setFailPath(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failPath = path
+}
+
+func s3TestETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func s3TestError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code></Error>", code)
+}
+
+func newTestS3Provider(t *testing.T, s *s3TestServer, outbox *Outbox) *S3Provider {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	sp, err := NewS3Provider(s.URL, "eu-central-1", "vault", "/team/", "access", "secret", logger, &observer.ObserverImpl{}, outbox)
+	require.NoError(t, err)
+	return sp
+}
+
+func TestNewS3Provider_InvalidConfig(t *testing.T) {
+	for _, settings := range [][4]string{
+		{"", "vault", "access", "secret"},
+		{"s3.amazonaws.com", "vault", "access", "secret"},
+		{"ftp://s3.amazonaws.com", "vault", "access", "secret"},
+		{"https://s3.amazonaws.com", "", "access", "secret"},
+		{"https://s3.amazonaws.com", "vault/notes", "access", "secret"},
+		{"https://s3.amazonaws.com", "vault", "", "secret"},
+		{"https://s3.amazonaws.com", "vault", "access", ""},
+	} {
+		_, err := NewS3Provider(settings[0], "", settings[1], "", settings[2], settings[3], logrus.New(), &observer.ObserverImpl{}, nil)
+		assert.Error(t, err, settings)
+	}
+	sp, err := NewS3Provider("https://s3.amazonaws.com", "", "vault", "", "access", "secret", logrus.New(), &observer.ObserverImpl{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "us-east-1", sp.region)
+}
+
+func TestS3Provider_ETags(t *testing.T) {
+	s := newS3TestServer(t)
+	sp := newTestS3Provider(t, s, nil)
+	device := newTestS3Provider(t, s, nil)
+	ctx := context.Background()
+
+	_, err := sp.SyncNotes(ctx, []model.Note{*testNote(1, "b64:one", 100), *testNote(2, "b64:two", 100)}, nil, nil)
+	require.NoError(t, err)
+	_, err = device.GetNoteIDs(true)
+	require.NoError(t, err)
+	require.NoError(t, device.PutNote(testNote(1, "b64:one v2", 200)))
+
+	// only the changed objects are downloaded
+	gets := s.noteGets()
+	notes, err := sp.GetNotes()
+	require.NoError(t, err)
+	require.Len(t, notes, 2)
+	assert.Equal(t, "b64:one v2", notes[0].Content)
+	assert.Equal(t, gets+1, s.noteGets())
+
+	// nothing changed: nothing is downloaded
+	gets = s.noteGets()
+	_, err = sp.GetNotes()
+	require.NoError(t, err)
+	assert.Equal(t, gets, s.noteGets())
+}
+
+func TestS3Provider_Manifest(t *testing.T) {
+	s := newS3TestServer(t)
+	alice := newTestS3Provider(t, s, nil)
+	bob := newTestS3Provider(t, s, nil)
+	ctx := context.Background()
+
+	// the devices update the manifest concurrently: no entry is lost
+	require.NoError(t, alice.PutNote(testNote(1, "b64:one", 100)))
+	require.NoError(t, bob.PutNote(testNote(2, "b64:two", 100)))
+	assert.Len(t, s.manifest(t), 2)
+
+	// a stale device never lists an older version of a note
+	require.NoError(t, alice.PutNote(testNote(2, "b64:two v2", 200)))
+	require.NoError(t, bob.commit(ctx, nil))
+	assert.EqualValues(t, 200, s.manifest(t)[2].UpdatedAt)
+
+	// a note written without updating the manifest (eg. the device went offline) is listed by its next sync
+	require.NoError(t, bob.putFile(ctx, noteFile(testNote(3, "b64:three", 300))))
+	ids, err := alice.GetNoteIDs(true)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, ids)
+	bob = newTestS3Provider(t, s, nil)
+	_, err = bob.SyncNotes(ctx, []model.Note{*testNote(3, "b64:three", 300)}, nil, nil)
+	require.NoError(t, err)
+	ids, err = alice.GetNoteIDs(true)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3}, ids)
+
+	// the tombstones are listed, and the purged ones removed
+	require.NoError(t, alice.DeleteNote(1))
+	assert.NotZero(t, s.manifest(t)[1].DeletedAt)
+	require.NoError(t, alice.PurgeTombstones(common.GetCurrentTimestamp()+1))
+	assert.Nil(t, s.object(s3NotesFolder+"1.json"))
+	assert.NotContains(t, s.manifest(t), 1)
+}
+
+func TestS3Provider_ManifestFailure(t *testing.T) {
+	s := newS3TestServer(t)
+	outbox := NewOutbox(newMemoryOutboxStore(), S3ProviderName, nil)
+	sp := newTestS3Provider(t, s, outbox)
+	ctx := context.Background()
+
+	// the manifest can't be written: the changes are kept and retried
+	s.setFailPath("/vault/team/" + s3ManifestKey)
+	sp.UpdateNoteNotifier().OnNotify("title", nil, nil, testNote(1, "b64:one", 100))
+	assert.NotZero(t, sp.flushOutbox(ctx))
+	pending, err := outbox.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, 1, pending)
+	assert.True(t, bytes.Contains(s.object(s3NotesFolder+"1.json"), []byte("b64:one")), "only the manifest update failed")
+
+	// a wrong secret is an error as well
+	s.setFailPath("")
+	sp.signer.secretKey = "wrong"
+	_, err = sp.GetNoteIDs(true)
+	assert.ErrorContains(t, err, "SignatureDoesNotMatch")
+}
@@ -0,0 +1,59 @@
+package provider
+
+import (
+	"github.com/iltoga/ecnotes-go/lib/common"
+)
+
+const (
+	// GoogleServiceAccountSecretName the name of the cert store entry holding the key of the Google service account
+	GoogleServiceAccountSecretName = "google_sheets_service_account"
+	// configSecretPrefix the prefix of the cert store entries holding a provider setting
+	configSecretPrefix = "config:"
+)
+
+// SecretConfigKeys the provider settings granting access to the synced notes. They are kept encrypted in the cert
+// store rather than in the config file
+var SecretConfigKeys = []string{
+	common.CONFIG_GOOGLE_SHEET_ID,
+	common.CONFIG_WEBDAV_PASSWORD,
+	common.CONFIG_SERVER_TOKEN,
+	common.CONFIG_S3_ACCESS_KEY,
+	common.CONFIG_S3_SECRET_KEY,
+}
+
+// ConfigSecretName returns the name of the cert store entry holding the given provider setting
+func ConfigSecretName(key string) string {
+	return configSecretPrefix + key
+}
+
+// isSecretConfigKey reports whether the given provider setting is kept in the cert store
+func isSecretConfigKey(key string) bool {
+	for _, secretKey := range SecretConfigKeys {
+		if key == secretKey {
+			return true
+		}
+	}
+	return false
+}
+
+// secretConfig the provider settings, reading the secret ones from the cert store first. The config file still
+// holds them until the vault they are moved into is unlocked for the first time
+type secretConfig struct {
+	config  ConfigReader
+	secrets SecretReader
+}
+
+// newSecretConfig creates the settings of the providers, with the secrets of the given cert store
+func newSecretConfig(config ConfigReader, secrets SecretReader) ConfigReader {
+	return &secretConfig{config: config, secrets: secrets}
+}
+
+// GetConfig returns the value of the given setting
+func (c *secretConfig) GetConfig(key string) (string, error) {
+	if isSecretConfigKey(key) {
+		if secret, err := c.secrets.GetSecret(ConfigSecretName(key)); err == nil && len(secret) > 0 {
+			return string(secret), nil
+		}
+	}
+	return c.config.GetConfig(key)
+}
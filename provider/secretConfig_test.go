@@ -0,0 +1,77 @@
+package provider
+
+import (
+	"io"
+	"testing"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_Create_SecretConfig(t *testing.T) {
+	var seen ConfigReader
+	r := NewRegistry()
+	r.Register("recorder", func(deps ProviderDeps) (SyncNoteProvider, error) {
+		seen = deps.Config
+		return nil, nil
+	})
+	config := mapConfig{
+		common.CONFIG_WEBDAV_URL:      "https://dav.example.com",
+		common.CONFIG_WEBDAV_PASSWORD: "plaintext",
+		common.CONFIG_S3_ACCESS_KEY:   "plaintext-access-key",
+	}
+	secrets := fakeSecrets{
+		ConfigSecretName(common.CONFIG_WEBDAV_PASSWORD): []byte("encrypted"),
+		// only the secret settings are read from the cert store
+		ConfigSecretName(common.CONFIG_WEBDAV_URL): []byte("https://evil.example.com"),
+	}
+
+	_, err := r.Create("recorder", ProviderDeps{Config: config, Secrets: secrets})
+	require.NoError(t, err)
+	val, err := seen.GetConfig(common.CONFIG_WEBDAV_PASSWORD)
+	require.NoError(t, err)
+	assert.Equal(t, "encrypted", val)
+	val, err = seen.GetConfig(common.CONFIG_WEBDAV_URL)
+	require.NoError(t, err)
+	assert.Equal(t, "https://dav.example.com", val)
+	// not moved to the cert store yet
+	val, err = seen.GetConfig(common.CONFIG_S3_ACCESS_KEY)
+	require.NoError(t, err)
+	assert.Equal(t, "plaintext-access-key", val)
+	_, err = seen.GetConfig(common.CONFIG_S3_SECRET_KEY)
+	assert.Error(t, err)
+
+	// without a cert store the config file is read as is
+	_, err = r.Create("recorder", ProviderDeps{Config: config})
+	require.NoError(t, err)
+	val, err = seen.GetConfig(common.CONFIG_WEBDAV_PASSWORD)
+	require.NoError(t, err)
+	assert.Equal(t, "plaintext", val)
+}
+
+func TestNewGoogleProviderFromConfig_ServiceAccountSecret(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	deps := ProviderDeps{
+		Config: mapConfig{common.CONFIG_GOOGLE_CREDENTIALS_FILE_PATH: "/nonexistent/cred_serviceaccount.json"},
+		Logger: logger,
+		Secrets: fakeSecrets{
+			ConfigSecretName(common.CONFIG_GOOGLE_SHEET_ID): []byte("sheet-id"),
+			GoogleServiceAccountSecretName: []byte(`{"type":"service_account",
+				"client_email":"notes@example.iam.gserviceaccount.com","private_key":"key",
+				"token_uri":"https://oauth2.googleapis.com/token"}`),
+		},
+	}
+	p, err := NewDefaultRegistry().Create(GoogleProviderName, deps)
+	require.NoError(t, err)
+	gp := p.(*GoogleProvider)
+	assert.Equal(t, "sheet-id", gp.sheetID)
+	assert.NotNil(t, gp.credentials)
+
+	// the credentials file is read until the key is moved to the cert store
+	delete(deps.Secrets.(fakeSecrets), GoogleServiceAccountSecretName)
+	_, err = NewDefaultRegistry().Create(GoogleProviderName, deps)
+	assert.ErrorContains(t, err, common.ERR_INVALID_GOOGLE_CREDENTIALS)
+}
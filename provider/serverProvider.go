@@ -0,0 +1,289 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServerProviderName the name of the ecnotes sync server provider
+const ServerProviderName = "ecnotes_server"
+
+const (
+	// serverRequestTimeout the timeout of a single request to the server
+	serverRequestTimeout = 30 * time.Second
+	// serverBatchSize how many outbox changes the worker pushes in a row
+	serverBatchSize = 50
+	// serverChangesLimit how many records a page of the changes feed holds
+	serverChangesLimit = 500
+)
+
+// ServerProvider syncs the notes with a vault of an ecnotes sync server (see cmd/ecnotes-server).
+// The server stores each note as an opaque blob (the encrypted note) with its revision: the provider follows the
+// changes feed of the vault, and writes the notes only if they are still at the revision it last saw
+type ServerProvider struct {
+	fileIndexProvider
+	serverURL string
+	vault     string
+	token     string
+	vaultURL  *url.URL
+	client    *http.Client
+	// revisions the revision of each note, as last seen on the server
+	revisions map[int]int64
+	// fetched the records received with the changes feed (or a conflict) that haven't been read yet
+	fetched map[int]model.SyncRecord
+	// cursor where the next page of the changes feed starts
+	cursor  int64
+	feedMux sync.Mutex
+}
+
+// NewServerProvider creates a new provider syncing the notes with a vault of the server at serverURL
+func NewServerProvider(
+	serverURL string,
+	vault string,
+	token string,
+	logger *log.Logger,
+	observer observer.Observer,
+	outbox *Outbox,
+) (*ServerProvider, error) {
+	sp := &ServerProvider{
+		serverURL: serverURL,
+		vault:     vault,
+		token:     token,
+		revisions: make(map[int]int64),
+		fetched:   make(map[int]model.SyncRecord),
+	}
+	sp.fileIndexProvider = newFileIndexProvider(sp, serverBatchSize, logger, observer, outbox)
+	if err := sp.Init(); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+// newServerProviderFromConfig creates the ecnotes server provider configured in the config file
+func newServerProviderFromConfig(deps ProviderDeps) (SyncNoteProvider, error) {
+	settings := make(map[string]string)
+	for _, key := range []string{common.CONFIG_SERVER_URL, common.CONFIG_SERVER_VAULT, common.CONFIG_SERVER_TOKEN} {
+		val, err := deps.Config.GetConfig(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s is missing", common.ERR_INVALID_SERVER_PROVIDER_CONFIG, key)
+		}
+		settings[key] = val
+	}
+	return NewServerProvider(
+		settings[common.CONFIG_SERVER_URL],
+		settings[common.CONFIG_SERVER_VAULT],
+		settings[common.CONFIG_SERVER_TOKEN],
+		deps.Logger,
+		deps.Observer,
+		deps.Outbox,
+	)
+}
+
+// Init initializes the provider
+func (sp *ServerProvider) Init() error {
+	serverURL, err := url.Parse(sp.serverURL)
+	if err != nil || (serverURL.Scheme != "http" && serverURL.Scheme != "https") || serverURL.Host == "" {
+		return errors.New(common.ERR_INVALID_SERVER_PROVIDER_CONFIG)
+	}
+	if sp.vault == "" || sp.token == "" {
+		return errors.New(common.ERR_INVALID_SERVER_PROVIDER_CONFIG)
+	}
+	sp.vaultURL = serverURL.JoinPath("v1", "vaults", sp.vault)
+	sp.client = &http.Client{Timeout: serverRequestTimeout}
+	return nil
+}
+
+// Name returns the provider type
+func (sp *ServerProvider) Name() string {
+	return ServerProviderName
+}
+
+// list reads the changes feed of the vault since it was last read, and returns the revision of each note
+func (sp *ServerProvider) list(ctx context.Context) (map[int]string, error) {
+	sp.feedMux.Lock()
+	defer sp.feedMux.Unlock()
+	for {
+		target := sp.vaultURL.JoinPath("changes")
+		target.RawQuery = url.Values{
+			"since": {strconv.FormatInt(sp.cursor, 10)},
+			"limit": {strconv.Itoa(serverChangesLimit)},
+		}.Encode()
+		var changes model.SyncChanges
+		if _, err := sp.do(ctx, http.MethodGet, target, nil, nil, &changes); err != nil {
+			return nil, err
+		}
+		for _, record := range changes.Records {
+			sp.revisions[record.ID] = record.Revision
+			sp.fetched[record.ID] = record
+		}
+		if changes.Cursor > sp.cursor {
+			sp.cursor = changes.Cursor
+		}
+		if !changes.More {
+			break
+		}
+	}
+	revisions := make(map[int]string, len(sp.revisions))
+	for id, revision := range sp.revisions {
+		revisions[id] = strconv.FormatInt(revision, 10)
+	}
+	return revisions, nil
+}
+
+// read returns the record of a note received with the changes feed, or downloads it, with its revision
+func (sp *ServerProvider) read(ctx context.Context, id int) (*remoteNoteFile, string, error) {
+	sp.feedMux.Lock()
+	record, ok := sp.fetched[id]
+	delete(sp.fetched, id)
+	sp.feedMux.Unlock()
+	if !ok {
+		status, err := sp.do(ctx, http.MethodGet, sp.vaultURL.JoinPath("notes", strconv.Itoa(id)), nil, nil, &record)
+		if status == http.StatusNotFound {
+			return nil, "", errors.New(common.ERR_NOTE_NOT_FOUND)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	// a record without a revision is not on the server (eg. the answer to a conflicting creation)
+	if record.Revision == 0 {
+		return nil, "", errors.New(common.ERR_NOTE_NOT_FOUND)
+	}
+	note, err := decodeRecord(record)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errUnreadableFile, err)
+	}
+	return &remoteNoteFile{ID: id, UpdatedAt: record.UpdatedAt, DeletedAt: record.DeletedAt, Note: note},
+		strconv.FormatInt(record.Revision, 10), nil
+}
+
+// write writes the record of a note at the given revision (empty: if it doesn't exist yet). On a conflict the
+// server answers with the stored record, read next
+func (sp *ServerProvider) write(ctx context.Context, file remoteNoteFile, revision string) (string, error) {
+	record := model.SyncRecord{ID: file.ID, UpdatedAt: file.UpdatedAt, DeletedAt: file.DeletedAt}
+	if file.DeletedAt == 0 && file.Note != nil {
+		blob, err := json.Marshal(file.Note)
+		if err != nil {
+			return "", err
+		}
+		record.Blob = blob
+	}
+	if revision != "" {
+		var err error
+		if record.Revision, err = strconv.ParseInt(revision, 10, 64); err != nil {
+			return "", err
+		}
+	}
+	var stored model.SyncRecord
+	status, err := sp.do(ctx, http.MethodPut, sp.vaultURL.JoinPath("notes", strconv.Itoa(file.ID)), record, &stored, &stored)
+	sp.feedMux.Lock()
+	defer sp.feedMux.Unlock()
+	if status == http.StatusConflict && err != nil && err.Error() == common.ERR_REVISION_CONFLICT {
+		sp.fetched[file.ID] = stored
+		return "", errVersionConflict
+	}
+	if err != nil {
+		return "", err
+	}
+	sp.revisions[file.ID] = stored.Revision
+	delete(sp.fetched, file.ID)
+	return strconv.FormatInt(stored.Revision, 10), nil
+}
+
+// purge deletes the tombstones of the notes deleted before the given timestamp (ms): the server purges them all
+func (sp *ServerProvider) purge(ctx context.Context, before int64, tombstones map[int]string) ([]int, error) {
+	target := sp.vaultURL.JoinPath("purge")
+	target.RawQuery = url.Values{"before": {strconv.FormatInt(before, 10)}}.Encode()
+	if _, err := sp.do(ctx, http.MethodPost, target, nil, nil, nil); err != nil {
+		return nil, err
+	}
+	sp.feedMux.Lock()
+	defer sp.feedMux.Unlock()
+	purged := make([]int, 0, len(tombstones))
+	for id := range tombstones {
+		delete(sp.revisions, id)
+		delete(sp.fetched, id)
+		purged = append(purged, id)
+	}
+	return purged, nil
+}
+
+// do sends a request to the server, with body (if not nil) as JSON, and decodes the JSON response into result
+// (or, on a 409, into conflict). It returns the status code of the response
+func (sp *ServerProvider) do(
+	ctx context.Context,
+	method string,
+	target *url.URL,
+	body interface{},
+	conflict interface{},
+	result interface{},
+) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+sp.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := sp.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case isSuccess(resp.StatusCode):
+		if result != nil {
+			return resp.StatusCode, json.NewDecoder(resp.Body).Decode(result)
+		}
+		return resp.StatusCode, nil
+	case resp.StatusCode == http.StatusConflict && conflict != nil:
+		if err := json.NewDecoder(resp.Body).Decode(conflict); err != nil {
+			return resp.StatusCode, err
+		}
+		return resp.StatusCode, errors.New(common.ERR_REVISION_CONFLICT)
+	}
+	var serverErr struct {
+		Error string `json:"error"`
+	}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&serverErr)
+	if serverErr.Error == "" {
+		serverErr.Error = resp.Status
+	}
+	return resp.StatusCode, fmt.Errorf("ecnotes server %s %s: %s", method, strings.TrimPrefix(target.Path, sp.vaultURL.Path), serverErr.Error)
+}
+
+// decodeRecord returns the note of a record, nil for tombstones
+func decodeRecord(record model.SyncRecord) (*model.Note, error) {
+	if record.DeletedAt > 0 || len(record.Blob) == 0 {
+		return nil, nil
+	}
+	var note model.Note
+	if err := json.Unmarshal(record.Blob, &note); err != nil || note.ID != record.ID {
+		return nil, fmt.Errorf("%s: %d", common.ERR_INVALID_SYNC_RECORD, record.ID)
+	}
+	return &note, nil
+}
@@ -0,0 +1,79 @@
+package provider
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/server"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSyncServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	store, err := server.NewStore(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	tokens := server.NewTokens()
+	require.NoError(t, tokens.Add("team", "secret"))
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	ts := httptest.NewServer(server.NewServer(store, tokens, logger).Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func newTestServerProvider(t *testing.T, serverURL string, outbox *Outbox) *ServerProvider {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	sp, err := NewServerProvider(serverURL, "team", "secret", logger, &observer.ObserverImpl{}, outbox)
+	require.NoError(t, err)
+	return sp
+}
+
+func TestNewServerProvider_InvalidConfig(t *testing.T) {
+	for _, settings := range [][3]string{
+		{"", "team", "secret"},
+		{"ftp://example.com", "team", "secret"},
+		{"https://example.com", "", "secret"},
+		{"https://example.com", "team", ""},
+	} {
+		_, err := NewServerProvider(settings[0], settings[1], settings[2], logrus.New(), &observer.ObserverImpl{}, nil)
+		assert.Error(t, err, settings)
+	}
+}
+
+func TestServerProvider_Changes(t *testing.T) {
+	ts := newTestSyncServer(t)
+	sp := newTestServerProvider(t, ts.URL, nil)
+	ctx := context.Background()
+	local := []model.Note{*testNote(1, "b64:one", 100), *testNote(2, "b64:two", 100)}
+	_, err := sp.SyncNotes(ctx, local, nil, nil)
+	require.NoError(t, err)
+
+	// only the changes since the last sync are read
+	result, err := sp.SyncNotes(ctx, local, nil, map[int]int64{1: 100, 2: 100})
+	require.NoError(t, err)
+	assert.Empty(t, result.Downloaded)
+	cursor := sp.cursor
+	_, err = sp.SyncNotes(ctx, local, nil, map[int]int64{1: 100, 2: 100})
+	require.NoError(t, err)
+	assert.Equal(t, cursor, sp.cursor)
+
+	require.NoError(t, newTestServerProvider(t, ts.URL, nil).PutNote(testNote(1, "b64:one v2", 200)))
+	result, err = sp.SyncNotes(ctx, local, nil, map[int]int64{1: 100, 2: 100})
+	require.NoError(t, err)
+	require.Len(t, result.Downloaded, 1)
+	assert.Greater(t, sp.cursor, cursor)
+
+	// a wrong token is an error
+	sp.token = "wrong"
+	_, err = sp.GetNoteIDs(true)
+	assert.Error(t, err)
+}
@@ -1,11 +1,46 @@
 // Interfaces to be implemented by different providers
 package provider
 
-import "github.com/iltoga/ecnotes-go/model"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	log "github.com/sirupsen/logrus"
+)
+
+// Capability a feature a sync provider may support. Capabilities are combined as bit flags
+type Capability uint
+
+const (
+	// CapabilityTombstones the provider stores the deletions, so that they reach the other devices
+	CapabilityTombstones Capability = 1 << iota
+	// CapabilityMerge the provider tells apart the notes changed on both sides since their last sync, to be merged
+	CapabilityMerge
+	// CapabilityBackgroundPush the provider pushes the local changes as they are made, through its outbox
+	CapabilityBackgroundPush
+)
+
+// Has reports whether all the given capabilities are supported
+func (c Capability) Has(capability Capability) bool {
+	return c&capability == capability
+}
 
 // SyncNoteProvider is the interface that must be implemented by a sync-note provider implementation
 // Note: the relative service must be able to get/put/delete/find notes from the provider
 type SyncNoteProvider interface {
+	// Name returns the provider type, as written in the config
+	Name() string
+	// Capabilities returns the features supported by the provider
+	Capabilities() Capability
 	// GetNotes returns a list of notes from the provider
 	GetNotes(ids ...int) ([]model.Note, error)
 	// GetNoteIDs returns the list of note IDs from the provider
@@ -16,16 +51,616 @@ type SyncNoteProvider interface {
 	PutNote(note *model.Note) error
 	// DeleteNote deletes the note with the given id
 	DeleteNote(id int) error
-	// SyncNotes syncs the notes from the provider with the local database
-	SyncNotes(dbNotes []model.Note) error
+	// RemoteVersions returns two maps keyed by note ID, as compared by SyncNotes: the UpdatedAt of every note in the
+	// provider (a tombstone's UpdatedAt is its DeletedAt), and the DeletedAt of the tombstones only
+	RemoteVersions(ctx context.Context) (map[int]int64, map[int]int64, error)
+	// SyncNotes syncs the notes from the provider with the local database. bases holds the UpdatedAt of the version
+	// of each note last synced with the provider
+	SyncNotes(ctx context.Context, dbNotes []model.Note, dbTombstones []model.Tombstone, bases map[int]int64) (*SyncResult, error)
+	// PurgeTombstones removes the tombstones of the notes deleted before the given timestamp (ms)
+	PurgeTombstones(before int64) error
+	// InitWorker starts pushing the local changes in the background, until ctx is done
+	InitWorker(ctx context.Context)
+	// UpdateNoteNotifier returns the listener to notify the provider when a note is created or updated
+	UpdateNoteNotifier() observer.Listener
+	// DeleteNoteNotifier returns the listener to notify the provider when a note is deleted
+	DeleteNoteNotifier() observer.Listener
 	// Init initializes the provider
 	Init() error
 }
 
-// BaseSyncNoteProvider ....
+// SyncResult the changes a sync brings to the local database
+type SyncResult struct {
+	// Downloaded the notes to be added to (or replaced in) the local database
+	Downloaded []model.Note
+	// Deleted the tombstones of the local notes deleted on other devices
+	Deleted []model.Tombstone
+	// Conflicts the remote version of the local notes changed on both sides since their last sync, to be merged
+	Conflicts []model.Note
+}
+
+// noteVersion tells which version of a note a sync keeps
+type noteVersion int
+
+const (
+	versionSynced noteVersion = iota
+	versionLocal
+	versionRemote
+	versionConflict
+)
+
+// compareVersions compares the UpdatedAt of the local and remote versions of a note with the one of their
+// last synced version (0 if unknown)
+func compareVersions(local, remote, base int64) noteVersion {
+	switch {
+	case local == remote:
+		return versionSynced
+	case base == 0:
+		// never synced: the most recent version wins
+		if local > remote {
+			return versionLocal
+		}
+		return versionRemote
+	case local == base:
+		// only the remote note changed, unless the provider is behind (eg. a push that didn't complete)
+		if remote > base {
+			return versionRemote
+		}
+		return versionLocal
+	case remote == base:
+		return versionLocal
+	}
+	return versionConflict
+}
+
+// remoteNoteFile the file (or object) stored for each note by the providers keeping one per note: the encrypted note
+// and its metadata, or the tombstone of a deleted note
+type remoteNoteFile struct {
+	ID        int         `json:"id"`
+	UpdatedAt int64       `json:"updated_at"`
+	DeletedAt int64       `json:"deleted_at,omitempty"`
+	Note      *model.Note `json:"note,omitempty"`
+}
+
+// noteFile returns the file of a note
+func noteFile(note *model.Note) remoteNoteFile {
+	return remoteNoteFile{ID: note.ID, UpdatedAt: note.UpdatedAt, Note: note}
+}
+
+// tombstoneFile returns the file replacing a deleted note
+func tombstoneFile(tombstone model.Tombstone) remoteNoteFile {
+	return remoteNoteFile{ID: tombstone.ID, UpdatedAt: tombstone.DeletedAt, DeletedAt: tombstone.DeletedAt}
+}
+
+var (
+	// errRemoteNewer the provider holds a newer version of the note than the one being written
+	errRemoteNewer = errors.New(common.ERR_REMOTE_NOTE_CHANGED)
+	// errVersionConflict the file of a note changed since the version it is written at
+	errVersionConflict = errors.New(common.ERR_REVISION_CONFLICT)
+	// errUnreadableFile the file of a note can't be read yet (eg. not fully replicated): the version last read is kept
+	errUnreadableFile = errors.New(common.ERR_NOTE_FILE_UNREADABLE)
+)
+
+// BaseSyncNoteProvider the parts shared by the providers that push the local changes through an outbox
 type BaseSyncNoteProvider struct {
-	// NoteIDs is the list of note IDs from the provider
-	NoteIDs []int
-	// Notes is the list of notes from the provider
-	Notes []model.Note
+	outbox *Outbox
+	logger *log.Logger
+}
+
+// UpdateNoteNotifier creates a new note observer to notify the provider when a note is created or updated
+func (bp *BaseSyncNoteProvider) UpdateNoteNotifier() observer.Listener {
+	return observer.Listener{
+		OnNotify: func(note interface{}, args ...interface{}) {
+			if note == nil {
+				return
+			}
+			// the encrypted note is args[2]. Local-only changes don't carry it and must not be pushed
+			if len(args) < 3 {
+				return
+			}
+			n, ok := args[2].(*model.Note)
+			if !ok {
+				bp.logger.Errorf("Error cannot cast note struct: %v", note)
+				return
+			}
+
+			// queue the note in the outbox: the worker pushes it in the background
+			if err := bp.outbox.PushNote(n); err != nil {
+				bp.logger.Errorf("Error queueing note ID %d for %s: %v", n.ID, bp.outbox.queue, err)
+			}
+		},
+	}
+}
+
+// DeleteNoteNotifier creates a new note observer to notify the provider when a note is deleted
+func (bp *BaseSyncNoteProvider) DeleteNoteNotifier() observer.Listener {
+	return observer.Listener{
+		OnNotify: func(note interface{}, args ...interface{}) {
+			if note == nil {
+				return
+			}
+			n, ok := note.(*model.Note)
+			if !ok {
+				bp.logger.Errorf("Error cannot cast note struct: %v", note)
+				return
+			}
+			// the tombstone recorded locally is args[2]
+			tombstone := model.Tombstone{ID: n.ID, DeletedAt: common.GetCurrentTimestamp()}
+			if len(args) > 2 {
+				if t, ok := args[2].(model.Tombstone); ok {
+					tombstone = t
+				}
+			}
+
+			// queue the tombstone in the outbox
+			if err := bp.outbox.PushTombstone(tombstone); err != nil {
+				bp.logger.Errorf("Error queueing the deletion of note ID %d for %s: %v", n.ID, bp.outbox.queue, err)
+			}
+		},
+	}
+}
+
+// runWorker pushes the outbox changes with flush, which returns how long to wait for the next ones, until ctx is done.
+// New changes wake the worker up
+func (bp *BaseSyncNoteProvider) runWorker(ctx context.Context, flush func(ctx context.Context) time.Duration) {
+	go func() {
+		bp.logger.Infof("Starting %s sync worker", bp.outbox.queue)
+		// the changes left over by the previous run are pushed right away
+		bp.outbox.notifyPending()
+		for {
+			wait := flush(ctx)
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				bp.logger.Infof("Shutting down %s sync worker", bp.outbox.queue)
+				return
+			case <-bp.outbox.Wake():
+				timer.Stop()
+			case <-timer.C:
+			}
+		}
+	}()
+}
+
+// pushEach pushes the outbox changes that are due one at a time with push, then hands the pushed ones over to commit
+// (if not nil), and returns them with how long to wait for the next ones. Failed changes are rescheduled with a backoff
+// (all of them, if commit fails), the ones superseded by a newer remote version are dropped (the next sync merges them)
+func (bp *BaseSyncNoteProvider) pushEach(
+	ctx context.Context,
+	batchSize int,
+	push func(ctx context.Context, entry model.OutboxEntry) error,
+	commit func(ctx context.Context, pushed []model.OutboxEntry) error,
+) ([]model.OutboxEntry, time.Duration) {
+	queue := bp.outbox.queue
+	pending, wait, err := bp.outbox.Due(batchSize)
+	if err != nil {
+		bp.logger.Errorf("Worker error reading the %s outbox: %v", queue, err)
+		return nil, outboxBaseDelay
+	}
+	if len(pending) == 0 {
+		return nil, wait
+	}
+	pushed := make([]model.OutboxEntry, 0, len(pending))
+	for _, entry := range pending {
+		if entry.Note != nil || entry.Tombstone != nil {
+			err = push(ctx, entry)
+		} else {
+			// nothing to push: drop it
+			err = nil
+		}
+		if errors.Is(err, errRemoteNewer) {
+			bp.logger.Infof("Note ID %d changed on %s in the meantime: it will be merged at the next sync", entry.ID, queue)
+			err = nil
+		}
+		if err != nil {
+			bp.logger.Errorf("Worker error pushing note ID %d to %s: %v", entry.ID, queue, err)
+			if err := bp.outbox.Retry([]model.OutboxEntry{entry}, err); err != nil {
+				bp.logger.Errorf("Worker error rescheduling the %s outbox: %v", queue, err)
+				return pushed, outboxBaseDelay
+			}
+			continue
+		}
+		pushed = append(pushed, entry)
+	}
+	if commit != nil && len(pushed) > 0 {
+		if err := commit(ctx, pushed); err != nil {
+			bp.logger.Errorf("Worker error committing the changes pushed to %s: %v", queue, err)
+			if err := bp.outbox.Retry(pushed, err); err != nil {
+				bp.logger.Errorf("Worker error rescheduling the %s outbox: %v", queue, err)
+			}
+			return nil, outboxBaseDelay
+		}
+	}
+	if err := bp.outbox.Done(pushed); err != nil {
+		bp.logger.Errorf("Worker error updating the %s outbox: %v", queue, err)
+		return pushed, outboxBaseDelay
+	}
+	return pushed, 0
+}
+
+// noteFileStore the transport of the providers storing a file (or object, or record) per note, as a remoteNoteFile.
+// Versions (eg. ETags) tell whether a file changed since it was last read: an empty version is always read again
+type noteFileStore interface {
+	// list returns the version of the file of each note
+	list(ctx context.Context) (map[int]string, error)
+	// read returns the file of a note with its version, or ERR_NOTE_NOT_FOUND
+	read(ctx context.Context, id int) (*remoteNoteFile, string, error)
+	// write writes the file of a note if it is still at version (empty: if it doesn't exist yet), and returns its new
+	// version, or errVersionConflict when it changed in the meantime
+	write(ctx context.Context, file remoteNoteFile, version string) (string, error)
+	// purge deletes the tombstones of the notes deleted before the given timestamp (ms), listed with the version they
+	// were read at, unless they changed since. It returns the IDs of the deleted ones
+	purge(ctx context.Context, before int64, tombstones map[int]string) ([]int, error)
+}
+
+// noteFileCommitter implemented by the stores that complete the writes of a sync, of a note or of an outbox batch
+// in a single step (eg. updating a manifest or committing them)
+type noteFileCommitter interface {
+	// commit completes the writes of the given files
+	commit(ctx context.Context, written []remoteNoteFile) error
+}
+
+// noteFileEntry a note file as last read or written
+type noteFileEntry struct {
+	version string
+	file    remoteNoteFile
+}
+
+// fileIndexProvider the parts shared by the providers storing a file per note: the files are indexed with their
+// version, so that a sync reads the changed ones only, and are written only at the version last seen, so that a
+// newer version written by another device is never overwritten
+type fileIndexProvider struct {
+	BaseSyncNoteProvider
+	store noteFileStore
+	// batchSize how many outbox changes the worker pushes in a row
+	batchSize int
+	index     map[int]noteFileEntry
+	indexMux  sync.RWMutex
+	ctx       context.Context
+	observer  observer.Observer
+}
+
+// newFileIndexProvider creates the file index of a provider, storing the files through store
+func newFileIndexProvider(
+	store noteFileStore,
+	batchSize int,
+	logger *log.Logger,
+	observer observer.Observer,
+	outbox *Outbox,
+) fileIndexProvider {
+	return fileIndexProvider{
+		BaseSyncNoteProvider: BaseSyncNoteProvider{
+			outbox: outbox,
+			logger: logger,
+		},
+		store:     store,
+		batchSize: batchSize,
+		index:     make(map[int]noteFileEntry),
+		ctx:       context.Background(),
+		observer:  observer,
+	}
+}
+
+// Capabilities the files keep the tombstones and the UpdatedAt of the notes, and changes are pushed in the background
+func (fp *fileIndexProvider) Capabilities() Capability {
+	return CapabilityTombstones | CapabilityMerge | CapabilityBackgroundPush
+}
+
+// GetNotes fetch from the provider notes with given id or all if no ids is given
+func (fp *fileIndexProvider) GetNotes(ids ...int) ([]model.Note, error) {
+	if err := fp.refreshIndex(fp.ctx); err != nil {
+		return nil, err
+	}
+	fp.indexMux.RLock()
+	defer fp.indexMux.RUnlock()
+	notes := make([]model.Note, 0, len(fp.index))
+	for _, id := range fp.liveIDs() {
+		notes = append(notes, *fp.index[id].file.Note)
+	}
+	if len(ids) > 0 {
+		notes = filterNotes(notes, ids)
+	}
+	return notes, nil
+}
+
+// GetNoteIDs returns the sorted IDs of the notes in the provider (tombstones excluded)
+func (fp *fileIndexProvider) GetNoteIDs(forceRemote bool) ([]int, error) {
+	fp.indexMux.RLock()
+	empty := len(fp.index) == 0
+	fp.indexMux.RUnlock()
+	if forceRemote || empty {
+		if err := fp.refreshIndex(fp.ctx); err != nil {
+			return nil, err
+		}
+	}
+	fp.indexMux.RLock()
+	defer fp.indexMux.RUnlock()
+	return fp.liveIDs(), nil
+}
+
+// GetNote returns the note with the given id
+func (fp *fileIndexProvider) GetNote(id int) (*model.Note, error) {
+	file, _, err := fp.store.read(fp.ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if file.Note == nil || file.DeletedAt > 0 {
+		return nil, errors.New(common.ERR_NOTE_NOT_FOUND)
+	}
+	return file.Note, nil
+}
+
+// PutNote writes a note to its file
+func (fp *fileIndexProvider) PutNote(note *model.Note) error {
+	return fp.writeFiles(fp.ctx, []remoteNoteFile{noteFile(note)})
+}
+
+// DeleteNote replaces the file of the note with its tombstone
+func (fp *fileIndexProvider) DeleteNote(id int) error {
+	return fp.writeFiles(fp.ctx, []remoteNoteFile{tombstoneFile(model.Tombstone{ID: id, DeletedAt: common.GetCurrentTimestamp()})})
+}
+
+// RemoteVersions returns the UpdatedAt and DeletedAt of the note files, refreshing the index
+func (fp *fileIndexProvider) RemoteVersions(ctx context.Context) (map[int]int64, map[int]int64, error) {
+	if err := fp.refreshIndex(ctx); err != nil {
+		return nil, nil, err
+	}
+	fp.indexMux.RLock()
+	defer fp.indexMux.RUnlock()
+	noteUpdAt := make(map[int]int64, len(fp.index))
+	remoteTombstones := make(map[int]int64)
+	for id, entry := range fp.index {
+		noteUpdAt[id] = entry.file.UpdatedAt
+		if entry.file.DeletedAt > 0 {
+			remoteTombstones[id] = entry.file.DeletedAt
+		}
+	}
+	return noteUpdAt, remoteTombstones, nil
+}
+
+// SyncNotes syncs the notes from the provider to the local database and vice versa (see planSync).
+// Only the files changed since they were last read are downloaded
+func (fp *fileIndexProvider) SyncNotes(
+	ctx context.Context,
+	dbNotes []model.Note,
+	dbTombstones []model.Tombstone,
+	bases map[int]int64,
+) (*SyncResult, error) {
+	noteUpdAt, remoteTombstones, err := fp.RemoteVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plan := planSync(dbNotes, dbTombstones, bases, noteUpdAt, remoteTombstones)
+	files := make([]remoteNoteFile, 0, len(plan.toPush)+len(plan.toBury))
+	for _, note := range plan.toPush {
+		files = append(files, noteFile(note))
+	}
+	for _, tombstone := range plan.toBury {
+		files = append(files, tombstoneFile(tombstone))
+	}
+	if err := fp.writeFiles(ctx, files); err != nil {
+		return nil, err
+	}
+	// the changed files have been downloaded with the index
+	fetched := make([]model.Note, 0, len(plan.toFetch))
+	fp.indexMux.RLock()
+	for _, id := range plan.toFetch {
+		if entry, ok := fp.index[id]; ok && entry.file.Note != nil {
+			fetched = append(fetched, *entry.file.Note)
+		}
+	}
+	fp.indexMux.RUnlock()
+	result, noteTitles := plan.result(fetched)
+	fp.observer.Notify(observer.EVENT_UPDATE_NOTE_TITLES, noteTitles)
+	return result, nil
+}
+
+// PurgeTombstones deletes the tombstones of the notes deleted before the given timestamp (ms)
+func (fp *fileIndexProvider) PurgeTombstones(before int64) error {
+	if err := fp.refreshIndex(fp.ctx); err != nil {
+		return err
+	}
+	fp.indexMux.RLock()
+	expired := make(map[int]string)
+	for id, entry := range fp.index {
+		if entry.file.DeletedAt > 0 && entry.file.DeletedAt < before {
+			expired[id] = entry.version
+		}
+	}
+	fp.indexMux.RUnlock()
+	purged, err := fp.store.purge(fp.ctx, before, expired)
+	fp.indexMux.Lock()
+	for _, id := range purged {
+		delete(fp.index, id)
+	}
+	fp.indexMux.Unlock()
+	return err
+}
+
+// InitWorker starts a background worker that pushes the outbox changes
+func (fp *fileIndexProvider) InitWorker(ctx context.Context) {
+	fp.runWorker(ctx, fp.flushOutbox)
+}
+
+// flushOutbox pushes the outbox changes that are due, one file at a time, then commits them, and returns how long to
+// wait for the next ones
+func (fp *fileIndexProvider) flushOutbox(ctx context.Context) time.Duration {
+	var commit func(ctx context.Context, pushed []model.OutboxEntry) error
+	if committer, ok := fp.store.(noteFileCommitter); ok {
+		commit = func(ctx context.Context, pushed []model.OutboxEntry) error {
+			files := make([]remoteNoteFile, 0, len(pushed))
+			for _, entry := range pushed {
+				if file, ok := outboxFile(entry); ok {
+					files = append(files, file)
+				}
+			}
+			return committer.commit(ctx, files)
+		}
+	}
+	_, wait := fp.pushEach(ctx, fp.batchSize, func(ctx context.Context, entry model.OutboxEntry) error {
+		file, _ := outboxFile(entry)
+		return fp.putFile(ctx, file)
+	}, commit)
+	return wait
+}
+
+// refreshIndex lists the note files, and reads the ones changed since they were last read.
+// Files that can't be read yet keep the version last read, and are read again by a later refresh
+func (fp *fileIndexProvider) refreshIndex(ctx context.Context) error {
+	versions, err := fp.store.list(ctx)
+	if err != nil {
+		return err
+	}
+	fp.indexMux.RLock()
+	index := make(map[int]noteFileEntry, len(versions))
+	changed := make([]int, 0)
+	for id, version := range versions {
+		if entry, ok := fp.index[id]; ok && version != "" && entry.version == version {
+			index[id] = entry
+			continue
+		}
+		changed = append(changed, id)
+	}
+	fp.indexMux.RUnlock()
+	for _, id := range changed {
+		file, version, err := fp.store.read(ctx, id)
+		switch {
+		case err == nil:
+		case err.Error() == common.ERR_NOTE_NOT_FOUND:
+			// deleted in the meantime
+			continue
+		case errors.Is(err, errUnreadableFile):
+			fp.logger.Warnf("Skipping note ID %d: %v", id, err)
+			fp.indexMux.RLock()
+			if entry, ok := fp.index[id]; ok {
+				index[id] = entry
+			}
+			fp.indexMux.RUnlock()
+			continue
+		default:
+			return err
+		}
+		if version == "" {
+			version = versions[id]
+		}
+		index[id] = noteFileEntry{version: version, file: *file}
+	}
+	fp.indexMux.Lock()
+	fp.index = index
+	fp.indexMux.Unlock()
+	return nil
+}
+
+// writeFiles writes the given files, then commits them
+func (fp *fileIndexProvider) writeFiles(ctx context.Context, files []remoteNoteFile) error {
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fp.putFile(ctx, file); err != nil {
+			return err
+		}
+	}
+	if committer, ok := fp.store.(noteFileCommitter); ok {
+		return committer.commit(ctx, files)
+	}
+	return nil
+}
+
+// putFile writes the file of a note, only if it hasn't changed since it was last read (or doesn't exist yet).
+// When another device wrote it in the meantime, an older version is overwritten and a newer one is left untouched
+// (errRemoteNewer)
+func (fp *fileIndexProvider) putFile(ctx context.Context, file remoteNoteFile) error {
+	for attempt := 0; attempt < 2; attempt++ {
+		fp.indexMux.RLock()
+		entry := fp.index[file.ID]
+		fp.indexMux.RUnlock()
+		if entry.file.UpdatedAt > file.UpdatedAt {
+			return errRemoteNewer
+		}
+		version, err := fp.store.write(ctx, file, entry.version)
+		if err == nil {
+			fp.indexMux.Lock()
+			fp.index[file.ID] = noteFileEntry{version: version, file: file}
+			fp.indexMux.Unlock()
+			return nil
+		}
+		if !errors.Is(err, errVersionConflict) {
+			return err
+		}
+		// the file changed in the meantime: see which version is newer
+		current, version, err := fp.store.read(ctx, file.ID)
+		if err != nil {
+			if err.Error() != common.ERR_NOTE_NOT_FOUND {
+				return err
+			}
+			// deleted in the meantime
+			fp.indexMux.Lock()
+			delete(fp.index, file.ID)
+			fp.indexMux.Unlock()
+			continue
+		}
+		fp.indexMux.Lock()
+		fp.index[file.ID] = noteFileEntry{version: version, file: *current}
+		fp.indexMux.Unlock()
+		switch {
+		case current.UpdatedAt == file.UpdatedAt:
+			// already written (eg. a write retried after it could not be committed)
+			return nil
+		case current.UpdatedAt > file.UpdatedAt:
+			return errRemoteNewer
+		}
+	}
+	return fmt.Errorf("%w: %d", errRemoteNewer, file.ID)
+}
+
+// liveIDs returns the sorted IDs of the notes not deleted. The caller must hold indexMux
+func (fp *fileIndexProvider) liveIDs() []int {
+	ids := make([]int, 0, len(fp.index))
+	for id, entry := range fp.index {
+		if entry.file.DeletedAt == 0 && entry.file.Note != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// outboxFile returns the file of an outbox change, false when there is nothing to push
+func outboxFile(entry model.OutboxEntry) (remoteNoteFile, bool) {
+	switch {
+	case entry.Tombstone != nil:
+		return tombstoneFile(*entry.Tombstone), true
+	case entry.Note != nil:
+		return noteFile(entry.Note), true
+	}
+	return remoteNoteFile{}, false
+}
+
+// filterNotes filters the notes by the given ids
+func filterNotes(notes []model.Note, ids []int) []model.Note {
+	wanted := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	filtered := make([]model.Note, 0, len(ids))
+	for _, note := range notes {
+		if wanted[note.ID] {
+			filtered = append(filtered, note)
+		}
+	}
+	return filtered
+}
+
+// noteIDFromFileName returns the ID of the note stored in the file <id><ext>
+func noteIDFromFileName(name string, ext string) (int, bool) {
+	if !strings.HasSuffix(name, ext) {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimSuffix(name, ext))
+	if err != nil || id == 0 {
+		return 0, false
+	}
+	return id, true
 }
@@ -0,0 +1,287 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fileIndexRemote the remote shared by the devices of a test
+type fileIndexRemote struct {
+	// open returns a new device of the remote, pushing the changes of outbox
+	open func(outbox *Outbox) *fileIndexProvider
+	// fail makes the writes to the remote fail
+	fail func()
+}
+
+// put writes files as another device would
+func (r fileIndexRemote) put(t *testing.T, files ...remoteNoteFile) {
+	t.Helper()
+	device := r.open(nil)
+	require.NoError(t, device.refreshIndex(context.Background()))
+	require.NoError(t, device.writeFiles(context.Background(), files))
+}
+
+// content returns the content of a note, as read by another device
+func (r fileIndexRemote) content(t *testing.T, id int) string {
+	t.Helper()
+	notes, err := r.open(nil).GetNotes(id)
+	require.NoError(t, err)
+	require.Len(t, notes, 1)
+	return notes[0].Content
+}
+
+// fileIndexStores the noteFileStore implementations, each starting an empty remote
+var fileIndexStores = []struct {
+	name string
+	// versioned whether the writes over a version not seen yet are rejected. Drive appends change files instead, and
+	// the newest version wins when they are merged
+	versioned bool
+	newRemote func(t *testing.T) fileIndexRemote
+}{
+	{
+		name:      FolderProviderName,
+		versioned: true,
+		newRemote: func(t *testing.T) fileIndexRemote {
+			dir := t.TempDir()
+			return fileIndexRemote{
+				open: func(outbox *Outbox) *fileIndexProvider {
+					return &newTestFolderProvider(t, dir, false, outbox).fileIndexProvider
+				},
+				fail: func() {
+					require.NoError(t, os.RemoveAll(dir))
+					require.NoError(t, os.WriteFile(dir, nil, 0o600))
+				},
+			}
+		},
+	},
+	{
+		name:      WebDAVProviderName,
+		versioned: true,
+		newRemote: func(t *testing.T) fileIndexRemote {
+			s := newWebDAVTestServer(t)
+			return fileIndexRemote{
+				open: func(outbox *Outbox) *fileIndexProvider {
+					return &newTestWebDAVProvider(t, s, outbox).fileIndexProvider
+				},
+				fail: s.Close,
+			}
+		},
+	},
+	{
+		name:      S3ProviderName,
+		versioned: true,
+		newRemote: func(t *testing.T) fileIndexRemote {
+			s := newS3TestServer(t)
+			return fileIndexRemote{
+				open: func(outbox *Outbox) *fileIndexProvider {
+					return &newTestS3Provider(t, s, outbox).fileIndexProvider
+				},
+				fail: s.Close,
+			}
+		},
+	},
+	{
+		name:      ServerProviderName,
+		versioned: true,
+		newRemote: func(t *testing.T) fileIndexRemote {
+			ts := newTestSyncServer(t)
+			return fileIndexRemote{
+				open: func(outbox *Outbox) *fileIndexProvider {
+					return &newTestServerProvider(t, ts.URL, outbox).fileIndexProvider
+				},
+				fail: ts.Close,
+			}
+		},
+	},
+	{
+		name: GoogleDriveProviderName,
+		newRemote: func(t *testing.T) fileIndexRemote {
+			s := newDriveTestServer(t)
+			return fileIndexRemote{
+				open: func(outbox *Outbox) *fileIndexProvider {
+					return &newTestGoogleDriveProvider(t, s, outbox).fileIndexProvider
+				},
+				fail: func() {
+					s.mu.Lock()
+					s.failUploads = true
+					s.mu.Unlock()
+				},
+			}
+		},
+	},
+}
+
+func testNote(id int, content string, updatedAt int64) *model.Note {
+	return &model.Note{ID: id, Title: "enc:" + strconv.Itoa(id), Content: content, Encrypted: true, UpdatedAt: updatedAt}
+}
+
+func TestFileIndexProvider_SyncNotes(t *testing.T) {
+	for _, store := range fileIndexStores {
+		t.Run(store.name, func(t *testing.T) {
+			remote := store.newRemote(t)
+			fp := remote.open(nil)
+			ctx := context.Background()
+
+			local := []model.Note{*testNote(1, "b64:one", 100), *testNote(2, "b64:two", 100)}
+			result, err := fp.SyncNotes(ctx, local, nil, nil)
+			require.NoError(t, err)
+			assert.Empty(t, result.Downloaded)
+			ids, err := remote.open(nil).GetNoteIDs(true)
+			require.NoError(t, err)
+			assert.Equal(t, []int{1, 2}, ids)
+
+			// another device updates a note, deletes one and adds a new one
+			remote.put(t, noteFile(testNote(1, "b64:one v2", 200)), tombstoneFile(model.Tombstone{ID: 2, DeletedAt: 300}))
+			remote.put(t, noteFile(testNote(3, "b64:three", 300)))
+
+			result, err = fp.SyncNotes(ctx, local, nil, map[int]int64{1: 100, 2: 100})
+			require.NoError(t, err)
+			downloaded := map[int]string{}
+			for _, note := range result.Downloaded {
+				downloaded[note.ID] = note.Content
+				assert.True(t, note.Encrypted)
+			}
+			assert.Equal(t, map[int]string{1: "b64:one v2", 3: "b64:three"}, downloaded)
+			assert.Equal(t, []model.Tombstone{{ID: 2, DeletedAt: 300}}, result.Deleted)
+			assert.Empty(t, result.Conflicts)
+
+			// nothing changed: nothing is downloaded
+			local = []model.Note{*testNote(1, "b64:one v2", 200), *testNote(3, "b64:three", 300)}
+			result, err = fp.SyncNotes(ctx, local, nil, map[int]int64{1: 200, 3: 300})
+			require.NoError(t, err)
+			assert.Empty(t, result.Downloaded)
+			assert.Empty(t, result.Deleted)
+
+			// a note changed on both sides is a conflict
+			remote.put(t, noteFile(testNote(1, "b64:one remote", 400)))
+			local[0] = *testNote(1, "b64:one local", 500)
+			result, err = fp.SyncNotes(ctx, local, nil, map[int]int64{1: 200, 3: 300})
+			require.NoError(t, err)
+			require.Len(t, result.Conflicts, 1)
+			assert.Equal(t, "b64:one remote", result.Conflicts[0].Content)
+
+			// a newer version written by another device is never overwritten
+			assert.True(t, errors.Is(fp.PutNote(testNote(1, "b64:one old", 300)), errRemoteNewer))
+			note, err := fp.GetNote(1)
+			require.NoError(t, err)
+			assert.Equal(t, "b64:one remote", note.Content)
+		})
+	}
+}
+
+func TestFileIndexProvider_PutNote(t *testing.T) {
+	for _, store := range fileIndexStores {
+		t.Run(store.name, func(t *testing.T) {
+			remote := store.newRemote(t)
+			fp := remote.open(nil)
+			require.NoError(t, fp.PutNote(testNote(1, "b64:v1", 100)))
+
+			// another device wrote a newer version after this one was last seen: it is kept
+			remote.put(t, noteFile(testNote(1, "b64:v3", 300)))
+			err := fp.PutNote(testNote(1, "b64:v2", 200))
+			if store.versioned {
+				assert.True(t, errors.Is(err, errRemoteNewer))
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, "b64:v3", remote.content(t, 1))
+
+			// an older version written by another device is overwritten
+			remote.put(t, noteFile(testNote(1, "b64:v4", 400)))
+			require.NoError(t, fp.PutNote(testNote(1, "b64:v5", 500)))
+			assert.Equal(t, "b64:v5", remote.content(t, 1))
+
+			// a note created by another device in the meantime is never blindly replaced
+			remote.put(t, noteFile(testNote(2, "b64:other", 300)))
+			err = fp.PutNote(testNote(2, "b64:mine", 200))
+			if store.versioned {
+				assert.True(t, errors.Is(err, errRemoteNewer))
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, "b64:other", remote.content(t, 2))
+
+			// deleted notes are not found
+			require.NoError(t, fp.DeleteNote(1))
+			ids, err := remote.open(nil).GetNoteIDs(true)
+			require.NoError(t, err)
+			assert.Equal(t, []int{2}, ids)
+		})
+	}
+}
+
+func TestFileIndexProvider_Tombstones(t *testing.T) {
+	for _, store := range fileIndexStores {
+		t.Run(store.name, func(t *testing.T) {
+			remote := store.newRemote(t)
+			fp := remote.open(nil)
+			ctx := context.Background()
+			_, err := fp.SyncNotes(ctx, []model.Note{*testNote(1, "b64:one", 100), *testNote(2, "b64:two", 100)}, nil, nil)
+			require.NoError(t, err)
+
+			// the local deletions are pushed as tombstones
+			_, err = fp.SyncNotes(ctx, []model.Note{*testNote(2, "b64:two", 100)}, []model.Tombstone{{ID: 1, DeletedAt: 200}}, nil)
+			require.NoError(t, err)
+			_, err = fp.GetNote(1)
+			assert.Error(t, err)
+			ids, err := remote.open(nil).GetNoteIDs(true)
+			require.NoError(t, err)
+			assert.Equal(t, []int{2}, ids)
+
+			// only the expired tombstones are purged
+			require.NoError(t, fp.DeleteNote(2))
+			require.NoError(t, fp.PurgeTombstones(300))
+			_, tombstones, err := remote.open(nil).RemoteVersions(ctx)
+			require.NoError(t, err)
+			assert.NotContains(t, tombstones, 1)
+			assert.Contains(t, tombstones, 2)
+		})
+	}
+}
+
+func TestFileIndexProvider_FlushOutbox(t *testing.T) {
+	for _, store := range fileIndexStores {
+		t.Run(store.name, func(t *testing.T) {
+			remote := store.newRemote(t)
+			outbox := NewOutbox(newMemoryOutboxStore(), store.name, nil)
+			fp := remote.open(outbox)
+			ctx := context.Background()
+
+			fp.UpdateNoteNotifier().OnNotify("title", nil, nil, testNote(1, "b64:one", 100))
+			fp.UpdateNoteNotifier().OnNotify("title", nil, nil, testNote(2, "b64:two", 100))
+			fp.DeleteNoteNotifier().OnNotify(&model.Note{ID: 2}, nil, nil, model.Tombstone{ID: 2, DeletedAt: 200})
+			// a newer version written by another device is left for the next sync to merge
+			remote.put(t, noteFile(testNote(3, "b64:remote", 300)))
+			fp.UpdateNoteNotifier().OnNotify("title", nil, nil, testNote(3, "b64:local", 200))
+
+			assert.Zero(t, fp.flushOutbox(ctx))
+			pending, err := outbox.Pending()
+			require.NoError(t, err)
+			assert.Zero(t, pending)
+
+			notes, err := remote.open(nil).GetNotes()
+			require.NoError(t, err)
+			require.Len(t, notes, 2)
+			assert.Equal(t, "b64:one", notes[0].Content)
+			assert.Equal(t, "b64:remote", notes[1].Content)
+			_, tombstones, err := remote.open(nil).RemoteVersions(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, map[int]int64{2: 200}, tombstones, "the deleted note is replaced by its tombstone")
+
+			// the remote can't be written: the changes are kept and retried
+			remote.fail()
+			fp.UpdateNoteNotifier().OnNotify("title", nil, nil, testNote(1, "b64:one v2", 400))
+			fp.flushOutbox(ctx)
+			pending, err = outbox.Pending()
+			require.NoError(t, err)
+			assert.Equal(t, 1, pending)
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+)
+
+// syncPlan what a sync has to push to and fetch from a provider, given the local notes and the provider index
+type syncPlan struct {
+	// toPush the local notes newer than (or missing from) the provider
+	toPush []*model.Note
+	// toBury the local deletions the provider doesn't know yet
+	toBury []model.Tombstone
+	// toFetch the IDs of the remote notes newer than (or missing from) the local database, conflicts included
+	toFetch []int
+	// conflicts the IDs of the notes changed on both sides since their last sync
+	conflicts map[int]bool
+	// updatedRemotely the index in liveNotes of the local notes to be replaced by their remote version
+	updatedRemotely map[int]int
+	// liveNotes the local notes left after the sync
+	liveNotes []model.Note
+	// deleted the tombstones of the local notes deleted on other devices
+	deleted []model.Tombstone
+}
+
+// planSync compares the local notes and tombstones with the UpdatedAt (remoteUpdAt, tombstones included) and
+// DeletedAt (remoteTombstones) of the notes in a provider.
+// bases holds the UpdatedAt of the last synced version of each note: a note changed only on one side since then is pushed
+// or downloaded, a note changed on both sides is a conflict. Notes without a base fall back to the most recent version.
+// A deletion wins over the versions of a note older than it, and loses against the newer ones (the note is resurrected)
+func planSync(
+	dbNotes []model.Note,
+	dbTombstones []model.Tombstone,
+	bases map[int]int64,
+	remoteUpdAt map[int]int64,
+	remoteTombstones map[int]int64,
+) *syncPlan {
+	plan := &syncPlan{
+		toPush:          make([]*model.Note, 0),
+		toBury:          make([]model.Tombstone, 0),
+		toFetch:         make([]int, 0),
+		conflicts:       make(map[int]bool),
+		updatedRemotely: make(map[int]int),
+		liveNotes:       make([]model.Note, 0, len(dbNotes)),
+		deleted:         make([]model.Tombstone, 0),
+	}
+	// loop through the local notes and check if they exist in the provider.
+	// if they do not exist, put them in the provider
+	// if they do exist, compare both versions with the last synced one: push the local note if only it changed,
+	// download the remote one if only it changed, and merge them if both changed
+	// if they have been deleted in the provider after their last update, delete them locally
+	localIDs := make(map[int]bool, len(dbNotes))
+	for _, dbNote := range dbNotes {
+		localIDs[dbNote.ID] = true
+		if deletedAt, deleted := remoteTombstones[dbNote.ID]; deleted {
+			if dbNote.UpdatedAt > deletedAt {
+				plan.toPush = append(plan.toPush, &dbNote)
+				plan.liveNotes = append(plan.liveNotes, dbNote)
+			} else {
+				plan.deleted = append(plan.deleted, model.Tombstone{ID: dbNote.ID, DeletedAt: deletedAt})
+			}
+			continue
+		}
+		plan.liveNotes = append(plan.liveNotes, dbNote)
+		remote, ok := remoteUpdAt[dbNote.ID]
+		if !ok {
+			plan.toPush = append(plan.toPush, &dbNote)
+			continue
+		}
+		switch compareVersions(dbNote.UpdatedAt, remote, bases[dbNote.ID]) {
+		case versionLocal:
+			plan.toPush = append(plan.toPush, &dbNote)
+		case versionRemote:
+			plan.toFetch = append(plan.toFetch, dbNote.ID)
+			plan.updatedRemotely[dbNote.ID] = len(plan.liveNotes) - 1
+		case versionConflict:
+			plan.toFetch = append(plan.toFetch, dbNote.ID)
+			plan.conflicts[dbNote.ID] = true
+		}
+	}
+	// loop through the local tombstones: push the deletions the provider doesn't know yet,
+	// unless the note has been updated in the provider after the deletion
+	buried := make(map[int]bool)
+	for _, tombstone := range dbTombstones {
+		if localIDs[tombstone.ID] {
+			continue
+		}
+		if _, deleted := remoteTombstones[tombstone.ID]; deleted {
+			continue
+		}
+		if remote, ok := remoteUpdAt[tombstone.ID]; ok && remote > tombstone.DeletedAt {
+			continue
+		}
+		plan.toBury = append(plan.toBury, tombstone)
+		buried[tombstone.ID] = true
+	}
+	// loop through the provider notes and check if they exist in the local database.
+	// if they do not exist, get them from the provider and put them in the local database
+	for noteID := range remoteUpdAt {
+		_, deleted := remoteTombstones[noteID]
+		if !localIDs[noteID] && !deleted && !buried[noteID] {
+			plan.toFetch = append(plan.toFetch, noteID)
+		}
+	}
+	return plan
+}
+
+// result sorts the fetched notes into the SyncResult, and returns the titles of the notes left after the sync
+func (plan *syncPlan) result(fetched []model.Note) (*SyncResult, []string) {
+	result := &SyncResult{Downloaded: make([]model.Note, 0), Deleted: plan.deleted, Conflicts: make([]model.Note, 0)}
+	for _, note := range fetched {
+		if plan.conflicts[note.ID] {
+			result.Conflicts = append(result.Conflicts, note)
+			continue
+		}
+		if idx, ok := plan.updatedRemotely[note.ID]; ok {
+			// update the local note with the new data
+			plan.liveNotes[idx] = note
+		}
+		// add the note to the local database
+		result.Downloaded = append(result.Downloaded, note)
+	}
+	// build the note titles array
+	noteTitles := make([]string, len(plan.liveNotes))
+	for idx, note := range plan.liveNotes {
+		noteTitles[idx] = note.Title
+	}
+	return result, noteTitles
+}
+
+// PlannedNote a note a sync would change, with its versions on each side (UpdatedAt and DeletedAt in ms, 0 if none)
+type PlannedNote struct {
+	ID int `json:"id"`
+	// Title the (decrypted) title of the local note, if known
+	Title           string `json:"title,omitempty"`
+	LocalUpdatedAt  int64  `json:"local_updated_at,omitempty"`
+	LocalDeletedAt  int64  `json:"local_deleted_at,omitempty"`
+	RemoteUpdatedAt int64  `json:"remote_updated_at,omitempty"`
+	RemoteDeletedAt int64  `json:"remote_deleted_at,omitempty"`
+	// BaseUpdatedAt the UpdatedAt of the version last synced with the provider
+	BaseUpdatedAt int64 `json:"base_updated_at,omitempty"`
+}
+
+// SyncPlan what a sync with a provider would do, computed without changing anything on either side (dry run).
+// Each list is sorted by note ID
+type SyncPlan struct {
+	Provider string `json:"provider"`
+	// PlannedAt when the plan was computed (ms)
+	PlannedAt int64 `json:"planned_at"`
+	// Upload the local notes the provider would receive
+	Upload []PlannedNote `json:"upload"`
+	// Download the remote notes that would be saved locally
+	Download []PlannedNote `json:"download"`
+	// Conflicts the notes changed on both sides since their last sync, that would be merged
+	Conflicts []PlannedNote `json:"conflicts"`
+	// DeleteRemote the local deletions the provider would receive
+	DeleteRemote []PlannedNote `json:"delete_remote"`
+	// DeleteLocal the local notes that would be deleted, as deleted on other devices
+	DeleteLocal []PlannedNote `json:"delete_local"`
+	// LocalOnly the uploaded notes missing from the provider
+	LocalOnly []PlannedNote `json:"local_only"`
+	// RemoteOnly the downloaded notes missing from the local database
+	RemoteOnly []PlannedNote `json:"remote_only"`
+}
+
+// PlanSync returns what SyncNotes would do with a provider, without changing anything on either side
+func PlanSync(
+	ctx context.Context,
+	p SyncNoteProvider,
+	dbNotes []model.Note,
+	dbTombstones []model.Tombstone,
+	bases map[int]int64,
+) (*SyncPlan, error) {
+	remoteUpdAt, remoteTombstones, err := p.RemoteVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plan := planSync(dbNotes, dbTombstones, bases, remoteUpdAt, remoteTombstones)
+
+	localUpdAt := make(map[int]int64, len(dbNotes))
+	for _, note := range dbNotes {
+		localUpdAt[note.ID] = note.UpdatedAt
+	}
+	localDeletedAt := make(map[int]int64, len(dbTombstones))
+	for _, tombstone := range dbTombstones {
+		localDeletedAt[tombstone.ID] = tombstone.DeletedAt
+	}
+	planned := func(id int) PlannedNote {
+		note := PlannedNote{
+			ID:             id,
+			LocalUpdatedAt: localUpdAt[id],
+			BaseUpdatedAt:  bases[id],
+		}
+		if _, ok := localUpdAt[id]; !ok {
+			note.LocalDeletedAt = localDeletedAt[id]
+		}
+		if deletedAt, ok := remoteTombstones[id]; ok {
+			note.RemoteDeletedAt = deletedAt
+		} else {
+			note.RemoteUpdatedAt = remoteUpdAt[id]
+		}
+		return note
+	}
+
+	report := &SyncPlan{
+		Provider:     p.Name(),
+		PlannedAt:    common.GetCurrentTimestamp(),
+		Upload:       make([]PlannedNote, 0, len(plan.toPush)),
+		Download:     make([]PlannedNote, 0, len(plan.toFetch)),
+		Conflicts:    make([]PlannedNote, 0, len(plan.conflicts)),
+		DeleteRemote: make([]PlannedNote, 0, len(plan.toBury)),
+		DeleteLocal:  make([]PlannedNote, 0, len(plan.deleted)),
+		LocalOnly:    make([]PlannedNote, 0),
+		RemoteOnly:   make([]PlannedNote, 0),
+	}
+	for _, note := range plan.toPush {
+		report.Upload = append(report.Upload, planned(note.ID))
+		if _, ok := remoteUpdAt[note.ID]; !ok {
+			report.LocalOnly = append(report.LocalOnly, planned(note.ID))
+		}
+	}
+	for _, id := range plan.toFetch {
+		if plan.conflicts[id] {
+			report.Conflicts = append(report.Conflicts, planned(id))
+			continue
+		}
+		report.Download = append(report.Download, planned(id))
+		if _, ok := localUpdAt[id]; !ok {
+			report.RemoteOnly = append(report.RemoteOnly, planned(id))
+		}
+	}
+	for _, tombstone := range plan.toBury {
+		report.DeleteRemote = append(report.DeleteRemote, planned(tombstone.ID))
+	}
+	for _, tombstone := range plan.deleted {
+		report.DeleteLocal = append(report.DeleteLocal, planned(tombstone.ID))
+	}
+	for _, notes := range report.lists() {
+		sort.Slice(*notes, func(i, j int) bool { return (*notes)[i].ID < (*notes)[j].ID })
+	}
+	return report, nil
+}
+
+// Empty tells whether the sync would change nothing
+func (sp *SyncPlan) Empty() bool {
+	for _, notes := range sp.lists() {
+		if len(*notes) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SetTitles sets the titles of the planned notes, by note ID
+func (sp *SyncPlan) SetTitles(titles map[int]string) {
+	for _, notes := range sp.lists() {
+		for i := range *notes {
+			(*notes)[i].Title = titles[(*notes)[i].ID]
+		}
+	}
+}
+
+// Matches tells whether two plans of the same provider would make the same changes (when and titles aside)
+func (sp *SyncPlan) Matches(other *SyncPlan) bool {
+	if other == nil || sp.Provider != other.Provider {
+		return false
+	}
+	lists, otherLists := sp.lists(), other.lists()
+	for i, notes := range lists {
+		if len(*notes) != len(*otherLists[i]) {
+			return false
+		}
+		for j, note := range *notes {
+			otherNote := (*otherLists[i])[j]
+			note.Title, otherNote.Title = "", ""
+			if note != otherNote {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// WriteText writes the plan in a human-readable form
+func (sp *SyncPlan) WriteText(w io.Writer) error {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Sync plan for %s (%s)\n", sp.Provider, formatPlanTime(sp.PlannedAt))
+	if sp.Empty() {
+		b.WriteString("  nothing to sync\n")
+	}
+	sections := []struct {
+		name  string
+		notes []PlannedNote
+	}{
+		{"Upload", sp.Upload},
+		{"Download", sp.Download},
+		{"Conflicts (merged)", sp.Conflicts},
+		{"Delete on the provider", sp.DeleteRemote},
+		{"Delete locally", sp.DeleteLocal},
+		{"Local only", sp.LocalOnly},
+		{"Remote only", sp.RemoteOnly},
+	}
+	for _, section := range sections {
+		if len(section.notes) == 0 {
+			continue
+		}
+		fmt.Fprintf(b, "  %s (%d):\n", section.name, len(section.notes))
+		for _, note := range section.notes {
+			title := note.Title
+			if title == "" {
+				title = "-"
+			}
+			fmt.Fprintf(b, "    #%-6d %-30s local %s  remote %s  last synced %s\n",
+				note.ID, title,
+				formatPlanVersion(note.LocalUpdatedAt, note.LocalDeletedAt),
+				formatPlanVersion(note.RemoteUpdatedAt, note.RemoteDeletedAt),
+				formatPlanTime(note.BaseUpdatedAt),
+			)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// lists returns the lists of planned notes, in a fixed order
+func (sp *SyncPlan) lists() []*[]PlannedNote {
+	return []*[]PlannedNote{
+		&sp.Upload, &sp.Download, &sp.Conflicts, &sp.DeleteRemote, &sp.DeleteLocal, &sp.LocalOnly, &sp.RemoteOnly,
+	}
+}
+
+// formatPlanVersion formats the version of a note on one side: when it was updated, or deleted
+func formatPlanVersion(updatedAt, deletedAt int64) string {
+	if deletedAt > 0 {
+		return "deleted " + formatPlanTime(deletedAt)
+	}
+	return formatPlanTime(updatedAt)
+}
+
+// formatPlanTime formats a timestamp (ms) of a plan, "-" if unknown
+func formatPlanTime(ms int64) string {
+	if ms == 0 {
+		return "-"
+	}
+	return time.UnixMilli(ms).Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,105 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// planIDs returns the IDs of planned notes
+func planIDs(notes []PlannedNote) []int {
+	ids := make([]int, 0, len(notes))
+	for _, note := range notes {
+		ids = append(ids, note.ID)
+	}
+	return ids
+}
+
+func TestPlanSync(t *testing.T) {
+	fp := newTestFolderProvider(t, t.TempDir(), false, nil)
+	for _, note := range []*model.Note{
+		// changed on the provider only
+		testNote(2, "b64:2-remote", 25),
+		// deleted here
+		testNote(3, "b64:3", 30),
+		// changed on both sides
+		testNote(5, "b64:5-remote", 56),
+		// new on the provider
+		testNote(6, "b64:6", 60),
+	} {
+		require.NoError(t, fp.PutNote(note))
+	}
+	// deleted on the provider
+	require.NoError(t, fp.putFile(context.Background(), tombstoneFile(model.Tombstone{ID: 4, DeletedAt: 45})))
+
+	dbNotes := []model.Note{
+		*testNote(1, "b64:1", 10),
+		*testNote(2, "b64:2", 20),
+		*testNote(4, "b64:4", 40),
+		*testNote(5, "b64:5-local", 55),
+	}
+	dbTombstones := []model.Tombstone{{ID: 3, DeletedAt: 35}}
+	bases := map[int]int64{2: 20, 4: 40, 5: 50}
+	plan, err := PlanSync(context.Background(), fp, dbNotes, dbTombstones, bases)
+	require.NoError(t, err)
+
+	assert.Equal(t, FolderProviderName, plan.Provider)
+	assert.NotZero(t, plan.PlannedAt)
+	assert.Equal(t, []PlannedNote{{ID: 1, LocalUpdatedAt: 10}}, plan.Upload)
+	assert.Equal(t, []int{1}, planIDs(plan.LocalOnly))
+	assert.Equal(t, []PlannedNote{
+		{ID: 2, LocalUpdatedAt: 20, RemoteUpdatedAt: 25, BaseUpdatedAt: 20},
+		{ID: 6, RemoteUpdatedAt: 60},
+	}, plan.Download)
+	assert.Equal(t, []int{6}, planIDs(plan.RemoteOnly))
+	assert.Equal(t, []PlannedNote{{ID: 5, LocalUpdatedAt: 55, RemoteUpdatedAt: 56, BaseUpdatedAt: 50}}, plan.Conflicts)
+	assert.Equal(t, []PlannedNote{{ID: 3, LocalDeletedAt: 35, RemoteUpdatedAt: 30}}, plan.DeleteRemote)
+	assert.Equal(t, []PlannedNote{{ID: 4, LocalUpdatedAt: 40, RemoteDeletedAt: 45, BaseUpdatedAt: 40}}, plan.DeleteLocal)
+	assert.False(t, plan.Empty())
+
+	// nothing changed on the provider
+	_, err = fp.GetNote(1)
+	assert.Error(t, err)
+	note, err := fp.GetNote(3)
+	require.NoError(t, err)
+	assert.Equal(t, "b64:3", note.Content)
+
+	// the same state gives the same plan, titles aside
+	again, err := PlanSync(context.Background(), fp, dbNotes, dbTombstones, bases)
+	require.NoError(t, err)
+	again.SetTitles(map[int]string{1: "Groceries"})
+	assert.Equal(t, "Groceries", again.Upload[0].Title)
+	assert.True(t, plan.Matches(again))
+
+	// a change made since makes the plan outdated
+	require.NoError(t, fp.PutNote(testNote(2, "b64:2-remote-again", 26)))
+	changed, err := PlanSync(context.Background(), fp, dbNotes, dbTombstones, bases)
+	require.NoError(t, err)
+	assert.False(t, plan.Matches(changed))
+	assert.False(t, plan.Matches(nil))
+}
+
+func TestSyncPlan_WriteText(t *testing.T) {
+	plan := &SyncPlan{Provider: "webdav", PlannedAt: 1700000000000}
+	b := &strings.Builder{}
+	require.NoError(t, plan.WriteText(b))
+	assert.True(t, plan.Empty())
+	assert.Contains(t, b.String(), "Sync plan for webdav")
+	assert.Contains(t, b.String(), "nothing to sync")
+
+	plan.Upload = []PlannedNote{{ID: 1, Title: "Groceries", LocalUpdatedAt: 1700000000000}}
+	plan.DeleteLocal = []PlannedNote{{ID: 2, LocalUpdatedAt: 1700000000000, RemoteDeletedAt: 1700000001000}}
+	b.Reset()
+	require.NoError(t, plan.WriteText(b))
+	text := b.String()
+	assert.NotContains(t, text, "nothing to sync")
+	assert.Contains(t, text, "Upload (1):")
+	assert.Contains(t, text, "Groceries")
+	assert.Contains(t, text, "Delete locally (1):")
+	assert.Contains(t, text, "remote deleted ")
+	assert.NotContains(t, text, "Download")
+}
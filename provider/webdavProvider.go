@@ -0,0 +1,292 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	log "github.com/sirupsen/logrus"
+)
+
+// WebDAVProviderName the name of the WebDAV provider
+const WebDAVProviderName = "webdav"
+
+const (
+	// webdavRequestTimeout the timeout of a single WebDAV request
+	webdavRequestTimeout = 30 * time.Second
+	// webdavBatchSize how many outbox changes the worker pushes in a row
+	webdavBatchSize = 50
+	// webdavNoteExt the extension of the note files
+	webdavNoteExt = ".json"
+	// webdavPropfindBody asks for the ETag of the files of a folder
+	webdavPropfindBody = `<?xml version="1.0" encoding="utf-8"?>` +
+		`<d:propfind xmlns:d="DAV:"><d:prop><d:getetag/></d:prop></d:propfind>`
+)
+
+// WebDAVProvider syncs the notes with a folder of a WebDAV server (eg. Nextcloud), one file per note.
+// The ETags of the files tell which ones changed since they were last downloaded, and the files are written
+// with conditional requests, so that a newer version written by another device is never overwritten
+type WebDAVProvider struct {
+	fileIndexProvider
+	folderURL string
+	username  string
+	password  string
+	baseURL   *url.URL
+	client    *http.Client
+}
+
+// NewWebDAVProvider creates a new WebDAV provider storing the notes in the folder at folderURL
+func NewWebDAVProvider(
+	folderURL string,
+	username string,
+	password string,
+	logger *log.Logger,
+	observer observer.Observer,
+	outbox *Outbox,
+) (*WebDAVProvider, error) {
+	wp := &WebDAVProvider{
+		folderURL: folderURL,
+		username:  username,
+		password:  password,
+	}
+	wp.fileIndexProvider = newFileIndexProvider(wp, webdavBatchSize, logger, observer, outbox)
+	if err := wp.Init(); err != nil {
+		return nil, err
+	}
+	return wp, nil
+}
+
+// newWebDAVProviderFromConfig creates the WebDAV provider configured in the config file
+func newWebDAVProviderFromConfig(deps ProviderDeps) (SyncNoteProvider, error) {
+	folderURL, err := deps.Config.GetConfig(common.CONFIG_WEBDAV_URL)
+	if err != nil {
+		return nil, errors.New(common.ERR_INVALID_WEBDAV_PROVIDER_CONFIG)
+	}
+	username, _ := deps.Config.GetConfig(common.CONFIG_WEBDAV_USERNAME)
+	password, _ := deps.Config.GetConfig(common.CONFIG_WEBDAV_PASSWORD)
+	return NewWebDAVProvider(folderURL, username, password, deps.Logger, deps.Observer, deps.Outbox)
+}
+
+// Init initializes the provider
+func (wp *WebDAVProvider) Init() error {
+	baseURL, err := url.Parse(wp.folderURL)
+	if err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+		return errors.New(common.ERR_INVALID_WEBDAV_PROVIDER_CONFIG)
+	}
+	// the note files are resolved relative to the folder
+	if !strings.HasSuffix(baseURL.Path, "/") {
+		baseURL.Path += "/"
+	}
+	wp.baseURL = baseURL
+	wp.client = &http.Client{Timeout: webdavRequestTimeout}
+	return nil
+}
+
+// Name returns the provider type
+func (wp *WebDAVProvider) Name() string {
+	return WebDAVProviderName
+}
+
+// davMultistatus the body of a PROPFIND response
+type davMultistatus struct {
+	Responses []struct {
+		Href      string `xml:"href"`
+		Propstats []struct {
+			ETag   string `xml:"prop>getetag"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// list returns the ETag of the note files in the folder, by note ID. The folder is created when missing
+func (wp *WebDAVProvider) list(ctx context.Context) (map[int]string, error) {
+	resp, err := wp.do(ctx, "PROPFIND", wp.baseURL.String(), []byte(webdavPropfindBody), map[string]string{
+		"Depth":        "1",
+		"Content-Type": "application/xml; charset=utf-8",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return map[int]string{}, wp.createFolder(ctx)
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("webdav PROPFIND %s: %s", wp.baseURL.Path, resp.Status)
+	}
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("unable to parse the webdav folder listing: %w", err)
+	}
+	etags := make(map[int]string, len(ms.Responses))
+	for _, r := range ms.Responses {
+		id, ok := noteIDFromHref(r.Href)
+		if !ok {
+			continue
+		}
+		etag := ""
+		for _, ps := range r.Propstats {
+			if strings.Contains(ps.Status, " 200 ") && ps.ETag != "" {
+				etag = ps.ETag
+			}
+		}
+		etags[id] = etag
+	}
+	return etags, nil
+}
+
+// createFolder creates the folder holding the note files
+func (wp *WebDAVProvider) createFolder(ctx context.Context) error {
+	resp, err := wp.do(ctx, "MKCOL", wp.baseURL.String(), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	// 405: the folder has been created in the meantime
+	if !isSuccess(resp.StatusCode) && resp.StatusCode != http.StatusMethodNotAllowed {
+		return fmt.Errorf("webdav MKCOL %s: %s", wp.baseURL.Path, resp.Status)
+	}
+	return nil
+}
+
+// read downloads the file of a note, with its ETag
+func (wp *WebDAVProvider) read(ctx context.Context, id int) (*remoteNoteFile, string, error) {
+	resp, err := wp.do(ctx, http.MethodGet, wp.fileURL(id), nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", errors.New(common.ERR_NOTE_NOT_FOUND)
+	}
+	if !isSuccess(resp.StatusCode) {
+		return nil, "", statusError(http.MethodGet, id, resp)
+	}
+	var file remoteNoteFile
+	if err := json.NewDecoder(resp.Body).Decode(&file); err != nil {
+		return nil, "", fmt.Errorf("unable to parse the webdav file of note %d: %w", id, err)
+	}
+	if file.ID != id || (file.Note == nil && file.DeletedAt == 0) {
+		return nil, "", fmt.Errorf("%s: %d%s", common.ERR_MALFORMED_NOTE_FILE, id, webdavNoteExt)
+	}
+	return &file, resp.Header.Get("ETag"), nil
+}
+
+// write writes the file of a note, if it still has the given ETag (or doesn't exist yet, when empty)
+func (wp *WebDAVProvider) write(ctx context.Context, file remoteNoteFile, etag string) (string, error) {
+	body, err := json.Marshal(file)
+	if err != nil {
+		return "", err
+	}
+	condition := map[string]string{"If-None-Match": "*"}
+	if etag != "" {
+		condition = map[string]string{"If-Match": etag}
+	}
+	resp, err := wp.do(ctx, http.MethodPut, wp.fileURL(file.ID), body, condition)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	// 409: the folder doesn't exist yet (nothing has been synced)
+	if resp.StatusCode == http.StatusConflict {
+		if err := wp.createFolder(ctx); err != nil {
+			return "", err
+		}
+		if resp, err = wp.do(ctx, http.MethodPut, wp.fileURL(file.ID), body, condition); err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+	}
+	switch {
+	case isSuccess(resp.StatusCode):
+		return resp.Header.Get("ETag"), nil
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return "", errVersionConflict
+	}
+	return "", statusError(http.MethodPut, file.ID, resp)
+}
+
+// purge deletes the files of the given tombstones, unless they changed since they were read
+func (wp *WebDAVProvider) purge(ctx context.Context, _ int64, tombstones map[int]string) ([]int, error) {
+	purged := make([]int, 0, len(tombstones))
+	for id, etag := range tombstones {
+		var condition map[string]string
+		if etag != "" {
+			condition = map[string]string{"If-Match": etag}
+		}
+		resp, err := wp.do(ctx, http.MethodDelete, wp.fileURL(id), nil, condition)
+		if err != nil {
+			return purged, err
+		}
+		resp.Body.Close()
+		// a file changed in the meantime (eg. the note was resurrected) is kept
+		if resp.StatusCode == http.StatusPreconditionFailed {
+			continue
+		}
+		if resp.StatusCode != http.StatusNotFound && !isSuccess(resp.StatusCode) {
+			return purged, statusError(http.MethodDelete, id, resp)
+		}
+		purged = append(purged, id)
+	}
+	return purged, nil
+}
+
+// do sends a request to the server
+func (wp *WebDAVProvider) do(
+	ctx context.Context,
+	method string,
+	target string,
+	body []byte,
+	headers map[string]string,
+) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	if wp.username != "" || wp.password != "" {
+		req.SetBasicAuth(wp.username, wp.password)
+	}
+	return wp.client.Do(req)
+}
+
+// fileURL returns the URL of the file of a note
+func (wp *WebDAVProvider) fileURL(id int) string {
+	return wp.baseURL.ResolveReference(&url.URL{Path: strconv.Itoa(id) + webdavNoteExt}).String()
+}
+
+// noteIDFromHref returns the ID of the note stored at href, if it is a note file
+func noteIDFromHref(href string) (int, bool) {
+	if u, err := url.Parse(href); err == nil {
+		href = u.Path
+	}
+	return noteIDFromFileName(path.Base(href), webdavNoteExt)
+}
+
+// isSuccess reports whether a status code is a 2xx
+func isSuccess(status int) bool {
+	return status >= 200 && status < 300
+}
+
+// statusError the error returned when the server rejects a request on a note file
+func statusError(method string, id int, resp *http.Response) error {
+	return fmt.Errorf("webdav %s %d%s: %s", method, id, webdavNoteExt, resp.Status)
+}
@@ -0,0 +1,114 @@
+package provider
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// webdavTestServer a local WebDAV server. The x/net handler ignores If-Match and If-None-Match, so they are enforced here
+type webdavTestServer struct {
+	*httptest.Server
+	handler *webdav.Handler
+
+	mu   sync.Mutex
+	gets int
+}
+
+func newWebDAVTestServer(t *testing.T) *webdavTestServer {
+	s := &webdavTestServer{
+		handler: &webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s.mu.Lock()
+			s.gets++
+			s.mu.Unlock()
+		case http.MethodPut, http.MethodDelete:
+			etag := s.etag(r.URL.Path)
+			ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+			if (ifMatch != "" && ifMatch != etag) || (ifNoneMatch == "*" && etag != "") {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+		}
+		s.handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// etag returns the ETag of a file, or "" when it doesn't exist
+func (s *webdavTestServer) etag(path string) string {
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, path, nil))
+	if rec.Code != http.StatusOK {
+		return ""
+	}
+	return rec.Header().Get("ETag")
+}
+
+func (s *webdavTestServer) getCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets
+}
+
+func newTestWebDAVProvider(t *testing.T, s *webdavTestServer, outbox *Outbox) *WebDAVProvider {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	wp, err := NewWebDAVProvider(s.URL+"/notes", "user", "secret", logger, &observer.ObserverImpl{}, outbox)
+	require.NoError(t, err)
+	return wp
+}
+
+func TestNewWebDAVProvider_InvalidURL(t *testing.T) {
+	for _, folderURL := range []string{"", "notes", "ftp://example.com/notes", "http://"} {
+		_, err := NewWebDAVProvider(folderURL, "", "", logrus.New(), &observer.ObserverImpl{}, nil)
+		assert.Error(t, err, folderURL)
+	}
+}
+
+func TestWebDAVProvider_ETags(t *testing.T) {
+	s := newWebDAVTestServer(t)
+	wp := newTestWebDAVProvider(t, s, nil)
+	device := newTestWebDAVProvider(t, s, nil)
+	ctx := context.Background()
+
+	// the folder is created on the first sync
+	_, err := wp.SyncNotes(ctx, []model.Note{*testNote(1, "b64:one", 100), *testNote(2, "b64:two", 100)}, nil, nil)
+	require.NoError(t, err)
+	_, err = device.GetNoteIDs(true)
+	require.NoError(t, err)
+	require.NoError(t, device.PutNote(testNote(1, "b64:one v2", 200)))
+
+	// only the changed files are downloaded
+	gets := s.getCount()
+	notes, err := wp.GetNotes()
+	require.NoError(t, err)
+	require.Len(t, notes, 2)
+	assert.Equal(t, "b64:one v2", notes[0].Content)
+	assert.Equal(t, gets+1, s.getCount())
+
+	// nothing changed: nothing is downloaded
+	gets = s.getCount()
+	_, err = wp.GetNotes()
+	require.NoError(t, err)
+	assert.Equal(t, gets, s.getCount())
+}
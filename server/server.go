@@ -0,0 +1,208 @@
+// Package server implements the ecnotes sync server: a zero-knowledge backend storing the encrypted notes of each vault
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxRecordSize the maximum size of a write request
+	maxRecordSize = 4 * 1024 * 1024
+	// defaultChangesLimit how many records a page of the changes feed holds by default
+	defaultChangesLimit = 500
+	// maxChangesLimit the maximum number of records in a page of the changes feed
+	maxChangesLimit = 5000
+)
+
+// Server the ecnotes sync server. It only ever sees the encrypted notes (opaque blobs), their IDs (blind indexes of
+// their titles) and their timestamps. Every request carries the token of its vault (Authorization: Bearer <token>)
+type Server struct {
+	store  Store
+	tokens *Tokens
+	logger *log.Logger
+}
+
+// NewServer creates a new server
+func NewServer(store Store, tokens *Tokens, logger *log.Logger) *Server {
+	return &Server{
+		store:  store,
+		tokens: tokens,
+		logger: logger,
+	}
+}
+
+// Handler returns the HTTP handler of the server API:
+//
+//	GET  /v1/vaults/{vault}/changes?since=<cursor>&limit=<n>  the records written after a cursor
+//	GET  /v1/vaults/{vault}/notes/{id}                        a record
+//	PUT  /v1/vaults/{vault}/notes/{id}                        writes a record, if still at its revision (409 otherwise)
+//	POST /v1/vaults/{vault}/purge?before=<ms>                 deletes the tombstones older than a timestamp
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/vaults/{vault}/changes", s.authorized(s.getChanges))
+	mux.HandleFunc("GET /v1/vaults/{vault}/notes/{id}", s.authorized(s.getRecord))
+	mux.HandleFunc("PUT /v1/vaults/{vault}/notes/{id}", s.authorized(s.putRecord))
+	mux.HandleFunc("POST /v1/vaults/{vault}/purge", s.authorized(s.purgeTombstones))
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+// authorized lets a request through only if its token grants access to the vault
+func (s *Server) authorized(next func(w http.ResponseWriter, r *http.Request, vault string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vault := r.PathValue("vault")
+		if !ValidVaultName(vault) {
+			writeError(w, http.StatusBadRequest, common.ERR_INVALID_VAULT_NAME)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !s.tokens.Allowed(vault, token) {
+			writeError(w, http.StatusUnauthorized, common.ERR_UNAUTHORIZED)
+			return
+		}
+		next(w, r, vault)
+	}
+}
+
+// getChanges returns a page of the changes feed
+func (s *Server) getChanges(w http.ResponseWriter, r *http.Request, vault string) {
+	since, err := queryInt(r, "since", 0)
+	if err != nil || since < 0 {
+		writeError(w, http.StatusBadRequest, "invalid since")
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultChangesLimit)
+	if err != nil || limit <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid limit")
+		return
+	}
+	if limit > maxChangesLimit {
+		limit = maxChangesLimit
+	}
+	changes, err := s.store.GetChanges(vault, since, int(limit))
+	if err != nil {
+		s.internalError(w, "reading the changes", vault, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, changes)
+}
+
+// getRecord returns a record
+func (s *Server) getRecord(w http.ResponseWriter, r *http.Request, vault string) {
+	id, ok := noteID(w, r)
+	if !ok {
+		return
+	}
+	record, err := s.store.GetRecord(vault, id)
+	if err != nil {
+		if err.Error() == common.ERR_NOTE_NOT_FOUND {
+			writeError(w, http.StatusNotFound, common.ERR_NOTE_NOT_FOUND)
+			return
+		}
+		s.internalError(w, "reading a note", vault, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, record)
+}
+
+// putRecord writes a record, if it is still at the revision the client last saw. On a conflict the stored record is
+// returned with a 409, so that the client can tell which version is newer
+func (s *Server) putRecord(w http.ResponseWriter, r *http.Request, vault string) {
+	id, ok := noteID(w, r)
+	if !ok {
+		return
+	}
+	var record model.SyncRecord
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRecordSize)).Decode(&record); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, http.StatusRequestEntityTooLarge, common.ERR_NOTE_TOO_LARGE)
+			return
+		}
+		writeError(w, http.StatusBadRequest, common.ERR_INVALID_SYNC_RECORD)
+		return
+	}
+	// a record is either a note or a tombstone
+	deleted := record.DeletedAt > 0
+	if record.ID != id || record.UpdatedAt <= 0 || record.Revision < 0 || deleted == (len(record.Blob) > 0) {
+		writeError(w, http.StatusBadRequest, common.ERR_INVALID_SYNC_RECORD)
+		return
+	}
+	stored, err := s.store.PutRecord(vault, record)
+	if err != nil {
+		if err.Error() == common.ERR_REVISION_CONFLICT {
+			if stored == nil {
+				stored = &model.SyncRecord{ID: id}
+			}
+			writeJSON(w, http.StatusConflict, stored)
+			return
+		}
+		s.internalError(w, "writing a note", vault, err)
+		return
+	}
+	// the client already has the blob
+	stored.Blob = nil
+	writeJSON(w, http.StatusOK, stored)
+}
+
+// purgeTombstones deletes the tombstones older than a timestamp (ms)
+func (s *Server) purgeTombstones(w http.ResponseWriter, r *http.Request, vault string) {
+	before, err := queryInt(r, "before", 0)
+	if err != nil || before <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid before")
+		return
+	}
+	purged, err := s.store.PurgeTombstones(vault, before)
+	if err != nil {
+		s.internalError(w, "purging the tombstones", vault, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
+
+// internalError logs an unexpected error, without telling the client the details
+func (s *Server) internalError(w http.ResponseWriter, action string, vault string, err error) {
+	s.logger.Errorf("Error %s of vault %s: %v", action, vault, err)
+	writeError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+}
+
+// noteID returns the note ID of the request path, or replies with a 400
+func noteID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id == 0 {
+		writeError(w, http.StatusBadRequest, common.ERR_NOTE_ID_MISSING)
+		return 0, false
+	}
+	return id, true
+}
+
+// queryInt returns an integer query parameter, or def when missing
+func queryInt(r *http.Request, name string, def int64) (int64, error) {
+	val := r.URL.Query().Get(name)
+	if val == "" {
+		return def, nil
+	}
+	return strconv.ParseInt(val, 10, 64)
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStore(t *testing.T) Store {
+	t.Helper()
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+	return store
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	tokens, err := ParseTokens(strings.NewReader("# team vault\nteam: alice-token\nteam:bob-token\n\nsolo:solo-token\n"))
+	require.NoError(t, err)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	ts := httptest.NewServer(NewServer(newTestStore(t), tokens, logger).Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func request(t *testing.T, method string, target string, token string, body interface{}, result interface{}) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, target, reader)
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	if result != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(result))
+	}
+	return resp.StatusCode
+}
+
+func TestParseTokens(t *testing.T) {
+	tokens, err := ParseTokens(strings.NewReader("team:a\nteam:b\n"))
+	require.NoError(t, err)
+	assert.True(t, tokens.Allowed("team", "a"))
+	assert.True(t, tokens.Allowed("team", "b"))
+	assert.False(t, tokens.Allowed("team", "c"))
+	assert.False(t, tokens.Allowed("other", "a"))
+	assert.False(t, tokens.Allowed("team", ""))
+
+	for _, invalid := range []string{"no-separator", "bad vault:token", "team:", ":token"} {
+		_, err := ParseTokens(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestStoreImpl_PutRecord(t *testing.T) {
+	store := newTestStore(t)
+
+	_, err := store.GetRecord("team", 1)
+	assert.EqualError(t, err, common.ERR_NOTE_NOT_FOUND)
+
+	stored, err := store.PutRecord("team", model.SyncRecord{ID: 1, UpdatedAt: 100, Blob: []byte("v1")})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, stored.Revision)
+	stored, err = store.PutRecord("team", model.SyncRecord{ID: 2, UpdatedAt: 100, Blob: []byte("two")})
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, stored.Revision)
+
+	// a write based on an old revision fails, and returns the stored record
+	current, err := store.PutRecord("team", model.SyncRecord{ID: 1, UpdatedAt: 200, Blob: []byte("v2")})
+	assert.EqualError(t, err, common.ERR_REVISION_CONFLICT)
+	assert.Equal(t, []byte("v1"), current.Blob)
+	stored, err = store.PutRecord("team", model.SyncRecord{ID: 1, Revision: 1, UpdatedAt: 200, Blob: []byte("v2")})
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, stored.Revision)
+
+	// vaults are independent
+	stored, err = store.PutRecord("solo", model.SyncRecord{ID: 1, UpdatedAt: 100, Blob: []byte("solo")})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, stored.Revision)
+	record, err := store.GetRecord("team", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v2"), record.Blob)
+}
+
+func TestStoreImpl_PutRecord_RevisionsVault(t *testing.T) {
+	store := newTestStore(t)
+
+	// the records of a vault named "revisions" don't overwrite the revisions of the other vaults
+	for id := 1; id <= 3; id++ {
+		_, err := store.PutRecord("team", model.SyncRecord{ID: id, UpdatedAt: 100, Blob: []byte("team")})
+		require.NoError(t, err)
+	}
+	stored, err := store.PutRecord("revisions", model.SyncRecord{ID: 1, UpdatedAt: 100, Blob: []byte("revisions")})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, stored.Revision)
+	stored, err = store.PutRecord("team", model.SyncRecord{ID: 4, UpdatedAt: 100, Blob: []byte("team")})
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, stored.Revision)
+	changes, err := store.GetChanges("revisions", 0, 10)
+	require.NoError(t, err)
+	require.Len(t, changes.Records, 1)
+	assert.Equal(t, []byte("revisions"), changes.Records[0].Blob)
+	assert.EqualValues(t, 1, changes.Cursor)
+}
+
+func TestStoreImpl_GetChanges(t *testing.T) {
+	store := newTestStore(t)
+
+	changes, err := store.GetChanges("team", 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, changes.Records)
+	assert.Zero(t, changes.Cursor)
+
+	for id := 1; id <= 3; id++ {
+		_, err := store.PutRecord("team", model.SyncRecord{ID: id, UpdatedAt: 100, Blob: []byte("blob")})
+		require.NoError(t, err)
+	}
+	_, err = store.PutRecord("team", model.SyncRecord{ID: 1, Revision: 1, UpdatedAt: 200, DeletedAt: 200})
+	require.NoError(t, err)
+
+	// oldest first, paginated
+	changes, err = store.GetChanges("team", 0, 2)
+	require.NoError(t, err)
+	require.Len(t, changes.Records, 2)
+	assert.Equal(t, []int{2, 3}, []int{changes.Records[0].ID, changes.Records[1].ID})
+	assert.True(t, changes.More)
+	changes, err = store.GetChanges("team", changes.Cursor, 2)
+	require.NoError(t, err)
+	require.Len(t, changes.Records, 1)
+	assert.EqualValues(t, 200, changes.Records[0].DeletedAt)
+	assert.False(t, changes.More)
+	assert.EqualValues(t, 4, changes.Cursor)
+
+	// the tombstones older than the horizon are purged
+	purged, err := store.PurgeTombstones("team", 300)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	changes, err = store.GetChanges("team", 0, 10)
+	require.NoError(t, err)
+	assert.Len(t, changes.Records, 2)
+	assert.EqualValues(t, 4, changes.Cursor)
+}
+
+func TestServer_Auth(t *testing.T) {
+	ts := newTestServer(t)
+	changesURL := ts.URL + "/v1/vaults/team/changes"
+
+	assert.Equal(t, http.StatusUnauthorized, request(t, http.MethodGet, changesURL, "", nil, nil))
+	assert.Equal(t, http.StatusUnauthorized, request(t, http.MethodGet, changesURL, "solo-token", nil, nil))
+	assert.Equal(t, http.StatusUnauthorized, request(t, http.MethodGet, ts.URL+"/v1/vaults/unknown/changes", "alice-token", nil, nil))
+	assert.Equal(t, http.StatusBadRequest, request(t, http.MethodGet, ts.URL+"/v1/vaults/bad.vault/changes", "alice-token", nil, nil))
+	assert.Equal(t, http.StatusOK, request(t, http.MethodGet, changesURL, "alice-token", nil, nil))
+	assert.Equal(t, http.StatusOK, request(t, http.MethodGet, changesURL, "bob-token", nil, nil))
+}
+
+func TestServer_Notes(t *testing.T) {
+	ts := newTestServer(t)
+	noteURL := ts.URL + "/v1/vaults/team/notes/7"
+
+	var stored model.SyncRecord
+	status := request(t, http.MethodPut, noteURL, "alice-token", model.SyncRecord{ID: 7, UpdatedAt: 100, Blob: []byte("v1")}, &stored)
+	require.Equal(t, http.StatusOK, status)
+	assert.EqualValues(t, 1, stored.Revision)
+	assert.Empty(t, stored.Blob)
+
+	// another client writing without the latest revision gets the stored record back
+	var current model.SyncRecord
+	status = request(t, http.MethodPut, noteURL, "bob-token", model.SyncRecord{ID: 7, UpdatedAt: 200, Blob: []byte("v2")}, &current)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, model.SyncRecord{ID: 7, Revision: 1, UpdatedAt: 100, Blob: []byte("v1")}, current)
+
+	// a tombstone
+	status = request(t, http.MethodPut, noteURL, "bob-token", model.SyncRecord{ID: 7, Revision: 1, UpdatedAt: 300, DeletedAt: 300}, &stored)
+	require.Equal(t, http.StatusOK, status)
+	status = request(t, http.MethodGet, noteURL, "alice-token", nil, &current)
+	require.Equal(t, http.StatusOK, status)
+	assert.EqualValues(t, 300, current.DeletedAt)
+	assert.Equal(t, http.StatusNotFound, request(t, http.MethodGet, ts.URL+"/v1/vaults/team/notes/8", "alice-token", nil, nil))
+
+	// invalid records are rejected
+	for _, invalid := range []model.SyncRecord{
+		{ID: 8, UpdatedAt: 100, Blob: []byte("x")},
+		{ID: 7, Revision: 2, Blob: []byte("x")},
+		{ID: 7, Revision: 2, UpdatedAt: 100},
+		{ID: 7, Revision: 2, UpdatedAt: 100, DeletedAt: 100, Blob: []byte("x")},
+	} {
+		assert.Equal(t, http.StatusBadRequest, request(t, http.MethodPut, noteURL, "alice-token", invalid, nil), invalid)
+	}
+	tooLarge := model.SyncRecord{ID: 7, Revision: 2, UpdatedAt: 400, Blob: make([]byte, maxRecordSize)}
+	assert.Equal(t, http.StatusRequestEntityTooLarge, request(t, http.MethodPut, noteURL, "alice-token", tooLarge, nil))
+
+	var changes model.SyncChanges
+	require.Equal(t, http.StatusOK, request(t, http.MethodGet, ts.URL+"/v1/vaults/team/changes?since=0", "alice-token", nil, &changes))
+	require.Len(t, changes.Records, 1)
+	assert.EqualValues(t, 2, changes.Cursor)
+
+	var purged map[string]int
+	require.Equal(t, http.StatusOK, request(t, http.MethodPost, ts.URL+"/v1/vaults/team/purge?before=400", "alice-token", nil, &purged))
+	assert.Equal(t, 1, purged["purged"])
+	assert.Equal(t, http.StatusBadRequest, request(t, http.MethodPost, ts.URL+"/v1/vaults/team/purge", "alice-token", nil, nil))
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/xujiajun/nutsdb"
+)
+
+const (
+	// vaultBucketPrefix the records of each vault are stored in the bucket vaultBucketPrefix + vault
+	vaultBucketPrefix = "vault_"
+	// revisionsBucket the latest revision of each vault. It doesn't start with vaultBucketPrefix, so that no vault
+	// name maps to it
+	revisionsBucket = "revisions"
+)
+
+// Store stores the sync records of the vaults
+type Store interface {
+	// GetRecord returns a record, or ERR_NOTE_NOT_FOUND
+	GetRecord(vault string, id int) (*model.SyncRecord, error)
+	// PutRecord writes a record at the next revision of the vault, if the stored one is still at record.Revision
+	// (0: none). On a revision conflict, it returns the stored record and ERR_REVISION_CONFLICT
+	PutRecord(vault string, record model.SyncRecord) (*model.SyncRecord, error)
+	// GetChanges returns up to limit records written after the revision since, oldest first
+	GetChanges(vault string, since int64, limit int) (*model.SyncChanges, error)
+	// PurgeTombstones deletes the records of the notes deleted before the given timestamp (ms), and returns how many
+	PurgeTombstones(vault string, before int64) (int, error)
+	Close() error
+}
+
+// StoreImpl implementation of Store that uses nutsdb
+type StoreImpl struct {
+	db *nutsdb.DB
+}
+
+// NewStore opens (or creates) the store in dir
+func NewStore(dir string) (Store, error) {
+	opt := nutsdb.DefaultOptions
+	opt.Dir = dir
+	opt.SegmentSize = 8 * 1024 * 1024 // 8MB
+	db, err := nutsdb.Open(opt)
+	if err != nil {
+		return nil, err
+	}
+	return &StoreImpl{db: db}, nil
+}
+
+// GetRecord returns a record, or ERR_NOTE_NOT_FOUND
+func (s *StoreImpl) GetRecord(vault string, id int) (*model.SyncRecord, error) {
+	var record *model.SyncRecord
+	if err := s.db.View(
+		func(tx *nutsdb.Tx) (err error) {
+			record, err = getRecord(tx, vault, id)
+			return err
+		}); err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, errors.New(common.ERR_NOTE_NOT_FOUND)
+	}
+	return record, nil
+}
+
+// PutRecord writes a record at the next revision of the vault, if the stored one is still at record.Revision
+func (s *StoreImpl) PutRecord(vault string, record model.SyncRecord) (*model.SyncRecord, error) {
+	var current *model.SyncRecord
+	err := s.db.Update(
+		func(tx *nutsdb.Tx) error {
+			var err error
+			if current, err = getRecord(tx, vault, record.ID); err != nil {
+				return err
+			}
+			currentRevision := int64(0)
+			if current != nil {
+				currentRevision = current.Revision
+			}
+			if currentRevision != record.Revision {
+				return errors.New(common.ERR_REVISION_CONFLICT)
+			}
+			revision, err := getRevision(tx, vault)
+			if err != nil {
+				return err
+			}
+			record.Revision = revision + 1
+			value, err := common.MarshalJSON(record)
+			if err != nil {
+				return err
+			}
+			if err = tx.Put(vaultBucketPrefix+vault, recordKey(record.ID), value, 0); err != nil {
+				return err
+			}
+			return tx.Put(revisionsBucket, []byte(vault), []byte(strconv.FormatInt(record.Revision, 10)), 0)
+		})
+	if err != nil {
+		if err.Error() == common.ERR_REVISION_CONFLICT {
+			return current, err
+		}
+		return nil, err
+	}
+	return &record, nil
+}
+
+// GetChanges returns up to limit records written after the revision since, oldest first
+func (s *StoreImpl) GetChanges(vault string, since int64, limit int) (*model.SyncChanges, error) {
+	changes := &model.SyncChanges{Records: make([]model.SyncRecord, 0), Cursor: since}
+	err := s.db.View(
+		func(tx *nutsdb.Tx) error {
+			records, err := getRecords(tx, vault)
+			if err != nil {
+				return err
+			}
+			for _, record := range records {
+				if record.Revision > since {
+					changes.Records = append(changes.Records, record)
+				}
+			}
+			if changes.Cursor, err = getRevision(tx, vault); err != nil {
+				return err
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(changes.Records, func(i, j int) bool {
+		return changes.Records[i].Revision < changes.Records[j].Revision
+	})
+	if limit > 0 && len(changes.Records) > limit {
+		changes.Records = changes.Records[:limit]
+		changes.Cursor = changes.Records[limit-1].Revision
+		changes.More = true
+	}
+	if changes.Cursor < since {
+		changes.Cursor = since
+	}
+	return changes, nil
+}
+
+// PurgeTombstones deletes the records of the notes deleted before the given timestamp (ms), and returns how many
+func (s *StoreImpl) PurgeTombstones(vault string, before int64) (int, error) {
+	purged := 0
+	err := s.db.Update(
+		func(tx *nutsdb.Tx) error {
+			records, err := getRecords(tx, vault)
+			if err != nil {
+				return err
+			}
+			for _, record := range records {
+				if record.DeletedAt > 0 && record.DeletedAt < before {
+					if err := tx.Delete(vaultBucketPrefix+vault, recordKey(record.ID)); err != nil {
+						return err
+					}
+					purged++
+				}
+			}
+			return nil
+		})
+	return purged, err
+}
+
+// Close closes the store
+func (s *StoreImpl) Close() error {
+	return s.db.Close()
+}
+
+// getRecord returns a record, or nil when the vault doesn't have it
+func getRecord(tx *nutsdb.Tx, vault string, id int) (*model.SyncRecord, error) {
+	entry, err := tx.Get(vaultBucketPrefix+vault, recordKey(id))
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var record model.SyncRecord
+	if err := common.UnmarshalJSON(entry.Value, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// getRecords returns all the records of a vault
+func getRecords(tx *nutsdb.Tx, vault string) ([]model.SyncRecord, error) {
+	entries, err := tx.GetAll(vaultBucketPrefix + vault)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	records := make([]model.SyncRecord, 0, len(entries))
+	for _, entry := range entries {
+		var record model.SyncRecord
+		if err := common.UnmarshalJSON(entry.Value, &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// getRevision returns the latest revision of a vault (0 for a new vault)
+func getRevision(tx *nutsdb.Tx, vault string) (int64, error) {
+	entry, err := tx.Get(revisionsBucket, []byte(vault))
+	if err != nil {
+		if isNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseInt(string(entry.Value), 10, 64)
+}
+
+// isNotFound tells whether a nutsdb error means that the key (or its whole bucket) doesn't exist
+func isNotFound(err error) bool {
+	return errors.Is(err, nutsdb.ErrKeyNotFound) ||
+		errors.Is(err, nutsdb.ErrNotFoundKey) ||
+		errors.Is(err, nutsdb.ErrBucketEmpty) ||
+		errors.Is(err, nutsdb.ErrBucketNotFound)
+}
+
+// recordKey returns the key of a record
+func recordKey(id int) []byte {
+	return []byte(strconv.Itoa(id))
+}
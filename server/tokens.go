@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+)
+
+// vaultNameRegexp the valid vault names
+var vaultNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Tokens the access tokens of each vault. Only their SHA-256 is kept in memory
+type Tokens struct {
+	hashes map[string][][sha256.Size]byte
+}
+
+// NewTokens creates an empty token set
+func NewTokens() *Tokens {
+	return &Tokens{hashes: make(map[string][][sha256.Size]byte)}
+}
+
+// LoadTokens reads the tokens file: one "<vault>:<token>" per line. Empty lines and lines starting with # are skipped.
+// A vault can have several tokens (eg. one per team member)
+func LoadTokens(path string) (*Tokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseTokens(f)
+}
+
+// ParseTokens parses a tokens file (see LoadTokens)
+func ParseTokens(r io.Reader) (*Tokens, error) {
+	tokens := NewTokens()
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		vault, token, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s: line %d", common.ERR_INVALID_TOKENS_FILE, lineNo)
+		}
+		if err := tokens.Add(strings.TrimSpace(vault), strings.TrimSpace(token)); err != nil {
+			return nil, fmt.Errorf("%s: line %d: %w", common.ERR_INVALID_TOKENS_FILE, lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Add grants a token access to a vault
+func (t *Tokens) Add(vault string, token string) error {
+	if !ValidVaultName(vault) {
+		return fmt.Errorf("%s: %q", common.ERR_INVALID_VAULT_NAME, vault)
+	}
+	if token == "" {
+		return fmt.Errorf("%s: empty token for vault %s", common.ERR_INVALID_TOKENS_FILE, vault)
+	}
+	t.hashes[vault] = append(t.hashes[vault], sha256.Sum256([]byte(token)))
+	return nil
+}
+
+// Allowed tells whether a token grants access to a vault
+func (t *Tokens) Allowed(vault string, token string) bool {
+	if token == "" {
+		return false
+	}
+	hash := sha256.Sum256([]byte(token))
+	allowed := 0
+	for _, h := range t.hashes[vault] {
+		allowed |= subtle.ConstantTimeCompare(h[:], hash[:])
+	}
+	return allowed == 1
+}
+
+// ValidVaultName tells whether a vault name is valid: 1 to 64 letters, digits, '-' or '_'
+func ValidVaultName(vault string) bool {
+	return vaultNameRegexp.MatchString(vault)
+}
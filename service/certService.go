@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"os"
+	"sort"
 	"sync"
 
 	"github.com/iltoga/ecnotes-go/lib/common"
@@ -17,8 +18,10 @@ type CertService interface {
 	LoadCerts(pwd string) error
 	SaveCerts(pwd string) error
 	GetCert(name string) (*model.EncKey, error)
+	GetCerts() ([]model.EncKey, error)
 	AddCert(cert model.EncKey) error
 	RemoveCert(name string) error
+	DestroyCerts() error
 }
 
 type CertServiceImpl struct {
@@ -62,7 +65,8 @@ func (cs *CertServiceImpl) CountCerts() (int, error) {
 // SaveCerts saves certs to file, encrypts them and writes them to file
 func (cs *CertServiceImpl) SaveCerts(pwd string) error {
 	if len(cs.Keys) > 0 {
-		keysFile, err := os.OpenFile(cs.KeysFilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		// truncate the file: the store is always rewritten as a whole
+		keysFile, err := os.OpenFile(cs.KeysFilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 		if err != nil {
 			return err
 		}
@@ -130,6 +134,18 @@ func (cs *CertServiceImpl) GetCert(name string) (*model.EncKey, error) {
 	return nil, errors.New(common.ERR_CERT_NOT_FOUND)
 }
 
+// GetCerts returns the loaded certs, sorted by name
+func (cs *CertServiceImpl) GetCerts() ([]model.EncKey, error) {
+	cs.KeysMutex.Lock()
+	defer cs.KeysMutex.Unlock()
+	if !cs.Loaded || len(cs.Keys) == 0 {
+		return nil, errors.New(common.ERR_CERT_NOT_FOUND)
+	}
+	keys := keysToArray(cs.Keys)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys, nil
+}
+
 // AddCert adds cert to map
 func (cs *CertServiceImpl) AddCert(cert model.EncKey) error {
 	cs.KeysMutex.Lock()
@@ -157,6 +173,18 @@ func (cs *CertServiceImpl) RemoveCert(name string) error {
 	return errors.New(common.ERR_CERT_NOT_FOUND)
 }
 
+// DestroyCerts securely deletes the certificate file and forgets all keys loaded in memory
+func (cs *CertServiceImpl) DestroyCerts() error {
+	cs.KeysMutex.Lock()
+	defer cs.KeysMutex.Unlock()
+	cs.Keys = make(map[string]model.EncKey)
+	cs.Loaded = false
+	if cs.KeysFilePath == "" {
+		return nil
+	}
+	return common.SecureDeleteFile(cs.KeysFilePath)
+}
+
 // keysToArray converts map to array
 func keysToArray(keys map[string]model.EncKey) []model.EncKey {
 	var keysArray []model.EncKey
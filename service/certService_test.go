@@ -1,6 +1,7 @@
 package service_test
 
 import (
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -46,6 +47,15 @@ func TestCertService_RoundTripAndMutations(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, betaKey, []byte(betaCert.Key))
 
+	// the certs are only listed once loaded
+	_, err = certService.GetCerts()
+	assert.EqualError(t, err, common.ERR_CERT_NOT_FOUND)
+	certs, err := loaded.GetCerts()
+	require.NoError(t, err)
+	require.Len(t, certs, 2)
+	assert.Equal(t, "alpha", certs[0].Name)
+	assert.Equal(t, "beta", certs[1].Name)
+
 	require.NoError(t, loaded.AddCert(model.EncKey{
 		Name: "gamma",
 		Algo: common.ENCRYPTION_ALGORITHM_AES_256_CBC,
@@ -60,3 +70,26 @@ func TestCertService_RoundTripAndMutations(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestCertService_SaveOverwritesAndDestroy(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key_store.json")
+
+	certService := service.NewCertService(keyFile)
+	require.NoError(t, certService.AddCert(model.EncKey{
+		Name: "alpha",
+		Algo: common.ENCRYPTION_ALGORITHM_AES_256_CBC,
+		Key:  []byte("alpha-key-32-bytes-alpha-key-32-by"),
+	}))
+	require.NoError(t, certService.SaveCerts("first"))
+
+	// saving again with another password must replace the store, not append to it
+	require.NoError(t, certService.SaveCerts("second"))
+	reloaded := service.NewCertService(keyFile)
+	assert.Error(t, reloaded.LoadCerts("first"))
+	require.NoError(t, reloaded.LoadCerts("second"))
+
+	require.NoError(t, reloaded.DestroyCerts())
+	_, err := reloaded.GetCert("alpha")
+	assert.Error(t, err)
+	_, err = os.Stat(keyFile)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 
 	"github.com/iltoga/ecnotes-go/lib/common"
@@ -24,6 +25,7 @@ type ConfigService interface {
 	GetConfigBytes(key string) ([]byte, error)
 	SetConfig(key string, value string) error
 	SetConfigBytes(key string, value []byte) error
+	DeleteConfig(key string) error
 	LoadConfig() error
 	ParseConfigTree(configTree *toml.Tree)
 	SaveConfig() error
@@ -67,9 +69,35 @@ func (c *ConfigServiceImpl) setDefaultConfig() {
 	if _, ok := c.Config[common.CONFIG_KEY_FILE_PATH]; !ok {
 		c.Config[common.CONFIG_KEY_FILE_PATH] = filepath.Join(c.ResourcePath, common.DEFAULT_KEY_FILE_PATH)
 	}
+	// the duress key store path is always set, so its presence reveals nothing
+	if _, ok := c.Config[common.CONFIG_DURESS_KEY_FILE_PATH]; !ok {
+		c.Config[common.CONFIG_DURESS_KEY_FILE_PATH] = filepath.Join(c.ResourcePath, common.DEFAULT_DURESS_KEY_FILE_PATH)
+	}
 	if _, ok := c.Config[common.CONFIG_LOG_LEVEL]; !ok {
 		c.Config[common.CONFIG_LOG_LEVEL] = common.DEFAULT_LOG_LEVEL
 	}
+	// set default config for the padding of the note content
+	if _, ok := c.Config[common.CONFIG_NOTE_PADDING]; !ok {
+		c.Config[common.CONFIG_NOTE_PADDING] = common.DEFAULT_NOTE_PADDING
+	}
+	if _, ok := c.Config[common.CONFIG_NOTE_PADDING_BLOCK_SIZE]; !ok {
+		c.Config[common.CONFIG_NOTE_PADDING_BLOCK_SIZE] = strconv.Itoa(common.DEFAULT_NOTE_PADDING_BLOCK_SIZE)
+	}
+	if _, ok := c.Config[common.CONFIG_NOTE_COMPRESSION]; !ok {
+		c.Config[common.CONFIG_NOTE_COMPRESSION] = common.DEFAULT_NOTE_COMPRESSION
+	}
+	// set default config for how long deletions are remembered, to propagate them to the sync providers
+	if _, ok := c.Config[common.CONFIG_TOMBSTONE_TTL_DAYS]; !ok {
+		c.Config[common.CONFIG_TOMBSTONE_TTL_DAYS] = strconv.Itoa(common.DEFAULT_TOMBSTONE_TTL_DAYS)
+	}
+	// set default config for how often the remote changes are pulled from the sync providers
+	if _, ok := c.Config[common.CONFIG_SYNC_INTERVAL_MINUTES]; !ok {
+		c.Config[common.CONFIG_SYNC_INTERVAL_MINUTES] = strconv.Itoa(common.DEFAULT_SYNC_INTERVAL_MINUTES)
+	}
+	// set default config for the directory holding the device certificate and the paired devices
+	if _, ok := c.Config[common.CONFIG_P2P_PATH]; !ok {
+		c.Config[common.CONFIG_P2P_PATH] = filepath.Join(c.ResourcePath, common.DEFAULT_P2P_PATH)
+	}
 	// STEF delete this
 	// // set default config for encryption algorithm
 	// if _, ok := c.Config[common.CONFIG_ENCRYPTION_ALGORITHM]; !ok {
@@ -203,6 +231,17 @@ func (c *ConfigServiceImpl) SetConfigBytes(key string, value []byte) error {
 	return nil
 }
 
+// DeleteConfig removes the given key from the config map
+func (c *ConfigServiceImpl) DeleteConfig(key string) error {
+	if err := c.checkAndLoad(); err != nil {
+		return err
+	}
+	c.ConfigMux.Lock()
+	defer c.ConfigMux.Unlock()
+	delete(c.Config, key)
+	return nil
+}
+
 // GetGlobal ....
 func (c *ConfigServiceImpl) GetGlobal(key string) (string, error) {
 	c.GlobalsMux.RLock()
@@ -14,20 +14,32 @@
 //   - loading / saving keys (with or without password)
 //   - recovery-payload creation and verification
 //   - key rotation / re-encryption of notes
+//   - the duress password and its decoy vault
+//   - the transfer of the cert store to a new device
+//   - the secrets kept in the cert store, such as the OAuth tokens and the credentials
+//     of the sync providers
 //
 // All methods return plain Go errors; the UI layer is responsible for deciding
 // how to surface them (notification, dialog, log, etc.).
 package service
 
 import (
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/iltoga/ecnotes-go/lib/common"
 	"github.com/iltoga/ecnotes-go/lib/cryptoUtil"
 	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/p2p"
+	"github.com/iltoga/ecnotes-go/provider"
 )
 
 // RecoverySetupResult holds everything returned from CreateRecoveryPayload so the
@@ -40,6 +52,22 @@ type RecoverySetupResult struct {
 	Salt string
 }
 
+// KeyTransfer is a transfer of the cert store to a new device, started with SendKeys.
+type KeyTransfer struct {
+	// Code is the one-time code to enter on the new device.
+	Code string
+	// Addresses are the addresses the new device can reach this one at.
+	Addresses []string
+	// Done receives the outcome of the transfer, once.
+	Done <-chan error
+}
+
+// keyTransferPayload is the cert store sent to a new device.
+type keyTransferPayload struct {
+	CurrentKey string         `json:"current_key"`
+	Keys       []model.EncKey `json:"keys"`
+}
+
 // KeyService manages the full lifecycle of encryption keys.
 // Implementations must be safe for concurrent use.
 type KeyService interface {
@@ -50,6 +78,8 @@ type KeyService interface {
 
 	// LoadKey validates password and activates the named cert in the crypto service.
 	// Corresponds to the "Confirm" action in the Decrypt Encryption Key dialog.
+	// The credentials of the sync providers still in the config dir are moved into
+	// the cert store (TryAutoLoad does the same).
 	LoadKey(keyName, password string) error
 
 	// GenerateKey creates a new encryption key for the given algorithm, saves it
@@ -84,31 +114,72 @@ type KeyService interface {
 	// The raw key is encrypted with password before export.
 	ExportKeyForClipboard(password string) (string, error)
 
+	// SendKeys serves the loaded cert store, once, to the new device entering the
+	// returned one-time code, until ctx is done. The code is only used through
+	// SPAKE2: the keys travel encrypted with the key agreed on, and a device in the
+	// middle can only try one guess of the code. With withSecrets, the secrets of
+	// the cert store (the credentials of the sync providers) are sent too, so that
+	// the new device can sync right away; otherwise only the encryption keys are.
+	SendKeys(ctx context.Context, withSecrets bool) (*KeyTransfer, error)
+
+	// ReceiveKeys receives the cert store served by another device at address,
+	// saves it with password and activates its default key. Like ImportKey, it
+	// replaces the cert store of this device.
+	ReceiveKeys(ctx context.Context, address, code, password string) (model.EncKey, error)
+
 	// HasRecovery reports whether a recovery payload exists for the given key name.
 	// The UI uses this to decide whether to show the "Forgot Password?" button.
 	HasRecovery(keyName string) bool
+
+	// GetSecret returns a secret saved with SaveSecret. It fails until the vault is
+	// unlocked, and from inside the decoy vault, which is never synced.
+	GetSecret(name string) ([]byte, error)
+
+	// SaveSecret saves (or replaces) a secret in the cert store, encrypted with
+	// password like the keys. The password is checked first.
+	SaveSecret(name string, secret []byte, password string) error
+
+	// ConnectGoogleAccount lets the user sign in to the Google account the notes are
+	// synced with, in the browser opened with openURL (OAuth flow of installed apps),
+	// and saves its refresh token in the cert store with password.
+	ConnectGoogleAccount(ctx context.Context, password string, openURL func(authURL string) error) error
+
+	// ConfigureDuress creates (or replaces) a decoy key protected by duressPassword.
+	// Entering the duress password in the Decrypt Encryption Key dialog unlocks the
+	// decoy key and opens a separate, never-synced decoy vault; the unlock looks
+	// exactly like a normal one. When wipeRealKey is true, using the duress password
+	// also destroys the real key material.
+	// Requires the real (password-protected) key to be active.
+	ConfigureDuress(duressPassword string, wipeRealKey bool) error
 }
 
 // KeyServiceImpl is the production implementation of KeyService.
 type KeyServiceImpl struct {
-	certService   CertService
-	confService   ConfigService
-	cryptoService CryptoServiceFactory
-	noteService   NoteService
+	certService       CertService
+	duressCertService CertService
+	confService       ConfigService
+	cryptoService     CryptoServiceFactory
+	noteService       NoteService
+	// decoyActive is set once the duress password has opened the decoy vault. It is
+	// written on the UI goroutine and read by the provider goroutines
+	decoyActive atomic.Bool
 }
 
 // NewKeyService constructs a ready-to-use KeyService.
+// duressCertService holds the decoy key and may be nil to disable the duress feature.
 func NewKeyService(
 	certService CertService,
+	duressCertService CertService,
 	confService ConfigService,
 	cryptoService CryptoServiceFactory,
 	noteService NoteService,
 ) KeyService {
 	return &KeyServiceImpl{
-		certService:   certService,
-		confService:   confService,
-		cryptoService: cryptoService,
-		noteService:   noteService,
+		certService:       certService,
+		duressCertService: duressCertService,
+		confService:       confService,
+		cryptoService:     cryptoService,
+		noteService:       noteService,
 	}
 }
 
@@ -133,17 +204,30 @@ func (ks *KeyServiceImpl) TryAutoLoad() (bool, error) {
 	if !common.IsSupportedEncryptionAlgorithm(cert.Algo) {
 		return false, fmt.Errorf("unsupported encryption algorithm for key %q: %s", keyName, cert.Algo)
 	}
+	// the credentials are moved before the key is loaded: the providers wait for the key
+	migrateErr := ks.migrateProviderCredentials("")
 	ks.cryptoService.SetSrv(NewCryptoServiceFactory(cert.Algo))
 	if err = ks.cryptoService.GetSrv().GetKeyManager().ImportKey(cert.Key, cert.Name); err != nil {
 		return false, err
 	}
+	if err = ks.noteService.MigrateTitles(); err != nil {
+		return true, fmt.Errorf("error migrating note titles: %w", err)
+	}
+	if migrateErr != nil {
+		return true, fmt.Errorf("error moving provider credentials to cert store: %w", migrateErr)
+	}
 	return true, nil
 }
 
 // LoadKey validates the password and activates the named cert.
+// When the password doesn't open the cert store but opens the duress store, the
+// decoy key and vault are activated instead and no error is returned.
 func (ks *KeyServiceImpl) LoadKey(keyName, password string) error {
 	if err := ks.certService.LoadCerts(password); err != nil {
 		if strings.Contains(err.Error(), "message authentication failed") {
+			if ks.openDecoyVault(keyName, password) {
+				return nil
+			}
 			return fmt.Errorf("invalid password: %w", err)
 		}
 		return fmt.Errorf("error loading cert store: %w", err)
@@ -155,10 +239,20 @@ func (ks *KeyServiceImpl) LoadKey(keyName, password string) error {
 	if !common.IsSupportedEncryptionAlgorithm(cert.Algo) {
 		return fmt.Errorf("unsupported encryption algorithm for key %q: %s", keyName, cert.Algo)
 	}
+	// the credentials of the sync providers can only be encrypted now that the cert store is open. They are moved
+	// before the key is loaded: the providers wait for the key
+	migrateErr := ks.migrateProviderCredentials(password)
 	ks.cryptoService.SetSrv(NewCryptoServiceFactory(cert.Algo))
 	if err = ks.cryptoService.GetSrv().GetKeyManager().ImportKey(cert.Key, cert.Name); err != nil {
 		return fmt.Errorf("error importing key: %w", err)
 	}
+	// the titles can only be decrypted (and the legacy ones encrypted) now that the key is loaded
+	if err = ks.noteService.MigrateTitles(); err != nil {
+		return fmt.Errorf("error migrating note titles: %w", err)
+	}
+	if migrateErr != nil {
+		return fmt.Errorf("error moving provider credentials to cert store: %w", migrateErr)
+	}
 	return nil
 }
 
@@ -368,8 +462,339 @@ func (ks *KeyServiceImpl) ExportKeyForClipboard(password string) (string, error)
 	return fmt.Sprintf("%s:%s", cert.Algo, hex.EncodeToString(encKey)), nil
 }
 
+// SendKeys listens for the new device and serves the cert store in the background.
+// From inside the decoy vault, the decoy key is sent instead.
+func (ks *KeyServiceImpl) SendKeys(ctx context.Context, withSecrets bool) (*KeyTransfer, error) {
+	certs, err := ks.activeCertService().GetCerts()
+	if err != nil {
+		return nil, fmt.Errorf("could not load encryption keys: %w", err)
+	}
+	payload := keyTransferPayload{Keys: make([]model.EncKey, 0, len(certs))}
+	for _, cert := range certs {
+		if cert.Name == common.DURESS_WIPE_MARKER || (cert.Algo == common.CERT_ALGO_SECRET && !withSecrets) {
+			continue
+		}
+		payload.Keys = append(payload.Keys, cert)
+	}
+	if keyName, err := ks.confService.GetConfig(common.CONFIG_CUR_ENCRYPTION_KEY_NAME); err == nil {
+		payload.CurrentKey = keyName
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	code, err := p2p.NewTransferCode()
+	if err != nil {
+		return nil, err
+	}
+	listenAddr := common.DEFAULT_KEY_TRANSFER_LISTEN_ADDR
+	if val, err := ks.confService.GetConfig(common.CONFIG_KEY_TRANSFER_LISTEN_ADDR); err == nil && val != "" {
+		listenAddr = val
+	}
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for the new device: %w", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- p2p.SendKeys(ctx, listener, code, data)
+	}()
+	transfer := &KeyTransfer{Code: code, Addresses: []string{listener.Addr().String()}, Done: done}
+	// listening on all the interfaces: the new device can use any of their addresses
+	if addr := listener.Addr().(*net.TCPAddr); addr.IP.IsUnspecified() {
+		transfer.Addresses = p2p.LocalAddresses(addr.Port)
+	}
+	return transfer, nil
+}
+
+// ReceiveKeys receives the cert store of another device, saves it, and activates
+// the key the other device uses by default.
+func (ks *KeyServiceImpl) ReceiveKeys(ctx context.Context, address, code, password string) (model.EncKey, error) {
+	data, err := p2p.ReceiveKeys(ctx, address, code)
+	if err != nil {
+		return model.EncKey{}, err
+	}
+	var payload keyTransferPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return model.EncKey{}, fmt.Errorf("invalid key transfer payload: %w", err)
+	}
+	if len(payload.Keys) == 0 {
+		return model.EncKey{}, errors.New(common.ERR_NO_KEY)
+	}
+	var current *model.EncKey
+	for _, cert := range payload.Keys {
+		cert := cert
+		// the secrets (eg. the OAuth tokens of the sync providers) come along with the keys
+		if cert.Algo != common.CERT_ALGO_SECRET {
+			if !common.IsSupportedEncryptionAlgorithm(cert.Algo) {
+				return model.EncKey{}, fmt.Errorf("unsupported encryption algorithm for key %q: %s", cert.Name, cert.Algo)
+			}
+			if current == nil || cert.Name == payload.CurrentKey {
+				current = &cert
+			}
+		}
+		if err := ks.certService.AddCert(cert); err != nil {
+			return model.EncKey{}, fmt.Errorf("error adding key to cert store: %w", err)
+		}
+	}
+	if current == nil {
+		return model.EncKey{}, errors.New(common.ERR_NO_KEY)
+	}
+	if err := ks.certService.SaveCerts(password); err != nil {
+		return model.EncKey{}, fmt.Errorf("error saving cert store: %w", err)
+	}
+	if err := ks.confService.SetConfig(common.CONFIG_CUR_ENCRYPTION_KEY_NAME, current.Name); err != nil {
+		return model.EncKey{}, fmt.Errorf("error persisting key name: %w", err)
+	}
+	if err := ks.confService.SaveConfig(); err != nil {
+		return model.EncKey{}, fmt.Errorf("error saving config: %w", err)
+	}
+	if err := ks.LoadKey(current.Name, password); err != nil {
+		return model.EncKey{}, err
+	}
+	return *current, nil
+}
+
+// GetSecret returns a secret of the loaded cert store.
+func (ks *KeyServiceImpl) GetSecret(name string) ([]byte, error) {
+	if ks.decoyActive.Load() {
+		return nil, errors.New(common.ERR_CERT_NOT_FOUND)
+	}
+	cert, err := ks.certService.GetCert(name)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Algo != common.CERT_ALGO_SECRET {
+		return nil, errors.New(common.ERR_CERT_NOT_FOUND)
+	}
+	return cert.Key, nil
+}
+
+// SaveSecret checks password by reloading the cert store, replaces the secret and
+// saves the store. Inside the decoy vault the secret goes to the decoy store.
+func (ks *KeyServiceImpl) SaveSecret(name string, secret []byte, password string) error {
+	certService := ks.activeCertService()
+	if err := certService.LoadCerts(password); err != nil {
+		return fmt.Errorf("invalid password: %w", err)
+	}
+	if err := putSecret(certService, name, secret); err != nil {
+		return err
+	}
+	if err := certService.SaveCerts(password); err != nil {
+		return fmt.Errorf("error saving cert store: %w", err)
+	}
+	return nil
+}
+
+// putSecret adds (or replaces) a secret in the loaded cert store, without saving it
+func putSecret(certService CertService, name string, secret []byte) error {
+	// a key is never replaced by a secret
+	if cert, err := certService.GetCert(name); err == nil && cert.Algo != common.CERT_ALGO_SECRET {
+		return fmt.Errorf("key %q already exists", name)
+	}
+	_ = certService.RemoveCert(name)
+	if err := certService.AddCert(model.EncKey{Name: name, Algo: common.CERT_ALGO_SECRET, Key: secret}); err != nil {
+		return fmt.Errorf("error adding secret to cert store: %w", err)
+	}
+	return nil
+}
+
+// migrateProviderCredentials moves the credentials of the sync providers found in the config dir (the secret
+// settings of config.toml and the key of the Google service account) into the loaded cert store, saved with
+// password. The plaintext copies are removed only once the cert store is saved.
+func (ks *KeyServiceImpl) migrateProviderCredentials(password string) error {
+	moved := make([]string, 0)
+	for _, key := range provider.SecretConfigKeys {
+		val, err := ks.confService.GetConfig(key)
+		if err != nil || val == "" {
+			continue
+		}
+		if err = putSecret(ks.certService, provider.ConfigSecretName(key), []byte(val)); err != nil {
+			return err
+		}
+		moved = append(moved, key)
+	}
+	// a missing credentials file is the default: nothing to move
+	credFilePath, _ := ks.confService.GetConfig(common.CONFIG_GOOGLE_CREDENTIALS_FILE_PATH)
+	credentials, _ := os.ReadFile(credFilePath)
+	if len(credentials) > 0 {
+		if err := putSecret(ks.certService, provider.GoogleServiceAccountSecretName, credentials); err != nil {
+			return err
+		}
+	}
+	if len(moved) == 0 && len(credentials) == 0 {
+		return nil
+	}
+	if err := ks.certService.SaveCerts(password); err != nil {
+		return fmt.Errorf("error saving cert store: %w", err)
+	}
+
+	if len(moved) > 0 {
+		// configs written before providers were selectable sync with Google Sheets when a sheet is set
+		if _, err := ks.confService.GetConfig(common.CONFIG_SYNC_PROVIDERS); err != nil {
+			if names := SyncProviderNames(ks.confService); len(names) > 0 {
+				if err = ks.confService.SetConfig(common.CONFIG_SYNC_PROVIDERS, strings.Join(names, ",")); err != nil {
+					return err
+				}
+			}
+		}
+		for _, key := range moved {
+			if err := ks.confService.DeleteConfig(key); err != nil {
+				return err
+			}
+		}
+		if err := ks.confService.SaveConfig(); err != nil {
+			return fmt.Errorf("error saving config: %w", err)
+		}
+	}
+	if len(credentials) > 0 {
+		if err := common.SecureDeleteFile(credFilePath); err != nil {
+			return fmt.Errorf("error deleting %s: %w", credFilePath, err)
+		}
+	}
+	return nil
+}
+
+// ConnectGoogleAccount checks password before opening the browser, so that the
+// consent given there isn't lost to a typo.
+func (ks *KeyServiceImpl) ConnectGoogleAccount(ctx context.Context, password string, openURL func(authURL string) error) error {
+	clientFilePath, err := ks.confService.GetConfig(common.CONFIG_GOOGLE_OAUTH_CLIENT_FILE)
+	if err != nil || clientFilePath == "" {
+		return errors.New(common.ERR_INVALID_GOOGLE_PROVIDER_CONFIG)
+	}
+	if err := ks.activeCertService().LoadCerts(password); err != nil {
+		return fmt.Errorf("invalid password: %w", err)
+	}
+	config, err := provider.NewGoogleOAuthConfig(clientFilePath)
+	if err != nil {
+		return err
+	}
+	refreshToken, err := provider.AuthorizeGoogle(ctx, config, openURL)
+	if err != nil {
+		return err
+	}
+	return ks.SaveSecret(provider.GoogleOAuthSecretName, []byte(refreshToken), password)
+}
+
+// activeCertService returns the cert store of the open vault: the decoy one once
+// the duress password has been used.
+func (ks *KeyServiceImpl) activeCertService() CertService {
+	if ks.decoyActive.Load() {
+		return ks.duressCertService
+	}
+	return ks.certService
+}
+
 // HasRecovery reports whether a recovery payload exists for the given key name.
 func (ks *KeyServiceImpl) HasRecovery(keyName string) bool {
 	q, err := ks.confService.GetConfig(keyName + "_recovery_question")
 	return err == nil && q != ""
 }
+
+// ConfigureDuress generates a decoy key with the same name and algorithm as the
+// active key and saves it in the duress cert store, encrypted with duressPassword.
+func (ks *KeyServiceImpl) ConfigureDuress(duressPassword string, wipeRealKey bool) error {
+	if ks.duressCertService == nil {
+		return fmt.Errorf("duress key store not configured")
+	}
+	if duressPassword == "" {
+		return errors.New(common.ERR_DURESS_PASSWORD_EMPTY)
+	}
+	// pretend it worked: replacing the decoy key from inside the decoy vault would
+	// lock its own notes out, and an error would give it away
+	if ks.decoyActive.Load() {
+		return nil
+	}
+	srv := ks.cryptoService.GetSrv()
+	if srv == nil || len(srv.GetKeyManager().GetCertificate().Key) == 0 {
+		return errors.New(common.ERR_NO_KEY)
+	}
+	active := srv.GetKeyManager().GetCertificate()
+	// passwordless keys are auto-loaded at startup, so the unlock dialog (and the
+	// duress password) would never be shown
+	if err := ks.certService.LoadCerts(""); err == nil {
+		return errors.New(common.ERR_DURESS_REQUIRES_PASSWORD)
+	}
+	if err := ks.certService.LoadCerts(duressPassword); err == nil {
+		return errors.New(common.ERR_DURESS_PASSWORD_REUSED)
+	}
+
+	decoySrv := NewCryptoServiceFactory(active.Algo)
+	if decoySrv == nil {
+		return fmt.Errorf("unsupported encryption algorithm: %q", active.Algo)
+	}
+	decoyKey, err := decoySrv.GetKeyManager().GenerateKey()
+	if err != nil {
+		return fmt.Errorf("error generating decoy key: %w", err)
+	}
+	// the decoy key carries the name of the real one, so nothing in the UI tells them apart
+	_ = ks.duressCertService.RemoveCert(active.Name)
+	_ = ks.duressCertService.RemoveCert(common.DURESS_WIPE_MARKER)
+	if err := ks.duressCertService.AddCert(model.EncKey{Name: active.Name, Algo: active.Algo, Key: decoyKey}); err != nil {
+		return fmt.Errorf("error adding decoy key: %w", err)
+	}
+	// the wipe flag lives inside the encrypted duress store, never in the plaintext config
+	if wipeRealKey {
+		if err := ks.duressCertService.AddCert(model.EncKey{Name: common.DURESS_WIPE_MARKER, Algo: active.Algo}); err != nil {
+			return fmt.Errorf("error adding decoy key: %w", err)
+		}
+	}
+	if err := ks.duressCertService.SaveCerts(duressPassword); err != nil {
+		return fmt.Errorf("error saving duress key store: %w", err)
+	}
+	return nil
+}
+
+// openDecoyVault activates the decoy key and vault if password opens the duress store.
+// It deliberately reports nothing but a boolean and never logs: a failed attempt must
+// look like a wrong password, a successful one like a normal unlock.
+func (ks *KeyServiceImpl) openDecoyVault(keyName, password string) bool {
+	if ks.duressCertService == nil {
+		return false
+	}
+	if err := ks.duressCertService.LoadCerts(password); err != nil {
+		return false
+	}
+	cert, err := ks.duressCertService.GetCert(keyName)
+	if err != nil || !common.IsSupportedEncryptionAlgorithm(cert.Algo) {
+		return false
+	}
+	srv := NewCryptoServiceFactory(cert.Algo)
+	if err := srv.GetKeyManager().ImportKey(cert.Key, cert.Name); err != nil {
+		return false
+	}
+	if err := ks.noteService.SwitchVault(common.DECOY_NOTES_BUCKET, true); err != nil {
+		return false
+	}
+	ks.cryptoService.SetSrv(srv)
+	ks.decoyActive.Store(true)
+	_ = ks.noteService.MigrateTitles()
+	if _, err := ks.duressCertService.GetCert(common.DURESS_WIPE_MARKER); err == nil {
+		ks.wipeRealKey(keyName, cert.Algo)
+	}
+	return true
+}
+
+// wipeRealKey destroys the real key material: the cert store is securely deleted and
+// replaced by a look-alike store holding a random key locked with a random password,
+// and the recovery payload is overwritten with random bytes. Next startup shows the
+// usual unlock dialog, but the real vault can no longer be decrypted.
+// Errors are ignored on purpose (see openDecoyVault).
+func (ks *KeyServiceImpl) wipeRealKey(keyName, algo string) {
+	_ = ks.certService.DestroyCerts()
+	if junkSrv := NewCryptoServiceFactory(algo); junkSrv != nil {
+		junkKey, keyErr := junkSrv.GetKeyManager().GenerateKey()
+		junkPwd, pwdErr := cryptoUtil.SecureRandomStr(32)
+		if keyErr == nil && pwdErr == nil {
+			_ = ks.certService.AddCert(model.EncKey{Name: keyName, Algo: algo, Key: junkKey})
+			_ = ks.certService.SaveCerts(junkPwd)
+		}
+	}
+	if encHex, err := ks.confService.GetConfig(keyName + "_recovery"); err == nil && encHex != "" {
+		junk, err := cryptoUtil.SecureRandomStr(len(encHex) / 2)
+		if err == nil {
+			_ = ks.confService.SetConfig(keyName+"_recovery", hex.EncodeToString([]byte(junk)))
+			_ = ks.confService.SaveConfig()
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package service_test
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -10,6 +14,7 @@ import (
 	toml "github.com/pelletier/go-toml"
 	"github.com/iltoga/ecnotes-go/lib/common"
 	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/provider"
 	"github.com/iltoga/ecnotes-go/service"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -24,6 +29,8 @@ type fakeCertService struct {
 	certs map[string]model.EncKey
 	count int // CountCerts return value
 	loadErr error
+	saveErr error
+	destroyed bool
 }
 
 func newFakeCertService() *fakeCertService {
@@ -31,7 +38,7 @@ func newFakeCertService() *fakeCertService {
 }
 func (f *fakeCertService) CountCerts() (int, error)        { return f.count, nil }
 func (f *fakeCertService) LoadCerts(pwd string) error      { return f.loadErr }
-func (f *fakeCertService) SaveCerts(pwd string) error      { return nil }
+func (f *fakeCertService) SaveCerts(pwd string) error      { return f.saveErr }
 func (f *fakeCertService) GetCert(name string) (*model.EncKey, error) {
 	f.mu.Lock(); defer f.mu.Unlock()
 	if c, ok := f.certs[name]; ok {
@@ -39,6 +46,18 @@ func (f *fakeCertService) GetCert(name string) (*model.EncKey, error) {
 	}
 	return nil, errors.New(common.ERR_CERT_NOT_FOUND)
 }
+func (f *fakeCertService) GetCerts() ([]model.EncKey, error) {
+	f.mu.Lock(); defer f.mu.Unlock()
+	if len(f.certs) == 0 {
+		return nil, errors.New(common.ERR_CERT_NOT_FOUND)
+	}
+	certs := make([]model.EncKey, 0, len(f.certs))
+	for _, c := range f.certs {
+		certs = append(certs, c)
+	}
+	sort.Slice(certs, func(i, j int) bool { return certs[i].Name < certs[j].Name })
+	return certs, nil
+}
 func (f *fakeCertService) AddCert(cert model.EncKey) error {
 	f.mu.Lock(); defer f.mu.Unlock()
 	f.certs[cert.Name] = cert
@@ -49,6 +68,12 @@ func (f *fakeCertService) RemoveCert(name string) error {
 	delete(f.certs, name)
 	return nil
 }
+func (f *fakeCertService) DestroyCerts() error {
+	f.mu.Lock(); defer f.mu.Unlock()
+	f.certs = make(map[string]model.EncKey)
+	f.destroyed = true
+	return nil
+}
 
 // fakeConfService stores key→value pairs in memory.
 type fakeConfService struct {
@@ -78,18 +103,27 @@ func (f *fakeConfService) SetConfig(key, value string) error {
 	f.mu.Lock(); defer f.mu.Unlock(); f.data[key] = value; return nil
 }
 func (f *fakeConfService) SetConfigBytes(key string, value []byte) error { return nil }
+func (f *fakeConfService) DeleteConfig(key string) error {
+	f.mu.Lock(); defer f.mu.Unlock(); delete(f.data, key); return nil
+}
 func (f *fakeConfService) LoadConfig() error                             { return nil }
 func (f *fakeConfService) ParseConfigTree(t *toml.Tree)                 {}
 func (f *fakeConfService) SaveConfig() error                             { return nil }
 
-// fakeNoteService — only ReEncryptNotes and GetNotes are called by KeyService.
-type fakeNoteService struct{ reEncCalled bool }
+// fakeNoteService — only ReEncryptNotes, GetNotes, SwitchVault and MigrateTitles are called by KeyService.
+type fakeNoteService struct {
+	reEncCalled bool
+	bucket      string
+	localOnly   bool
+	migrations  int
+}
 
 func (f *fakeNoteService) ReEncryptNotes(notes []model.Note, cert model.EncKey) error {
 	f.reEncCalled = true; return nil
 }
 func (f *fakeNoteService) SaveEncryptedNotes(notes []model.Note) error             { return nil }
 func (f *fakeNoteService) GetNotes() ([]model.Note, error)                         { return nil, nil }
+func (f *fakeNoteService) GetStoredNotes() ([]model.Note, error)                   { return nil, nil }
 func (f *fakeNoteService) GetNote(id int) (*model.Note, error)                     { return nil, nil }
 func (f *fakeNoteService) GetNoteWithContent(id int) (*model.Note, error)          { return nil, nil }
 func (f *fakeNoteService) GetNoteIDFromTitle(title string) int                     { return 0 }
@@ -102,6 +136,20 @@ func (f *fakeNoteService) UpdateNoteContent(n *model.Note) error
 func (f *fakeNoteService) DeleteNote(id int) error                                 { return nil }
 func (f *fakeNoteService) EncryptNote(n *model.Note) error                         { return nil }
 func (f *fakeNoteService) DecryptNote(n *model.Note) error                         { return nil }
+func (f *fakeNoteService) SwitchVault(bucket string, localOnly bool) error {
+	f.bucket, f.localOnly = bucket, localOnly; return nil
+}
+func (f *fakeNoteService) MigrateTitles() error { f.migrations++; return nil }
+func (f *fakeNoteService) GetTombstones() ([]model.Tombstone, error)            { return nil, nil }
+func (f *fakeNoteService) ApplyRemoteDeletes(tombstones []model.Tombstone) error { return nil }
+func (f *fakeNoteService) PurgeTombstones(before int64) error                    { return nil }
+func (f *fakeNoteService) GetSyncBases(p string) (map[int]int64, error)          { return nil, nil }
+func (f *fakeNoteService) SaveSyncBases(p string, notes []model.Note) error      { return nil }
+func (f *fakeNoteService) MergeConflicts(p string, remotes []model.Note) ([]model.Note, error) {
+	return remotes, nil
+}
+func (f *fakeNoteService) CanSync() bool     { return !f.localOnly }
+func (f *fakeNoteService) IsLocalOnly() bool { return f.localOnly }
 
 // ──────────────────────────────────────────────────────────────────────────────
 // Tests
@@ -112,10 +160,32 @@ func newTestKeyService() (service.KeyService, *fakeCertService, *fakeConfService
 	conf := newFakeConfService()
 	note := &fakeNoteService{}
 	crypto := &service.CryptoServiceFactoryImpl{}
-	ks := service.NewKeyService(cert, conf, crypto, note)
+	ks := service.NewKeyService(cert, nil, conf, crypto, note)
 	return ks, cert, conf, note
 }
 
+// newTestKeyServiceWithDuress wires a real, file-backed duress cert store and activates
+// a password-protected real key named "real".
+func newTestKeyServiceWithDuress(t *testing.T) (service.KeyService, *fakeCertService, service.CertService, *fakeConfService, *fakeNoteService, *service.CryptoServiceFactoryImpl) {
+	t.Helper()
+	cert := newFakeCertService()
+	duress := service.NewCertService(filepath.Join(t.TempDir(), "key_store_alt.json"))
+	conf := newFakeConfService()
+	note := &fakeNoteService{}
+	crypto := &service.CryptoServiceFactoryImpl{}
+	ks := service.NewKeyService(cert, duress, conf, crypto, note)
+
+	require.NoError(t, cert.AddCert(model.EncKey{
+		Name: "real",
+		Algo: common.ENCRYPTION_ALGORITHM_AES_256_CBC,
+		Key:  []byte("real-key-32-bytes-real-key-32-by"),
+	}))
+	require.NoError(t, ks.LoadKey("real", "secret"))
+	// from now on only the right password would open the real store, and the tests never use it
+	cert.loadErr = errors.New("cipher: message authentication failed")
+	return ks, cert, duress, conf, note, crypto
+}
+
 func TestKeyService_GenerateKey_StoresAndActivates(t *testing.T) {
 	ks, certSvc, confSvc, _ := newTestKeyService()
 
@@ -214,7 +284,7 @@ func TestKeyService_TryAutoLoad(t *testing.T) {
 }
 
 func TestKeyService_LoadKey(t *testing.T) {
-	ks, certSvc, confSvc, _ := newTestKeyService()
+	ks, certSvc, confSvc, noteSvc := newTestKeyService()
 
 	require.NoError(t, certSvc.AddCert(model.EncKey{
 		Name: "manual",
@@ -224,6 +294,7 @@ func TestKeyService_LoadKey(t *testing.T) {
 	require.NoError(t, confSvc.SetConfig(common.CONFIG_CUR_ENCRYPTION_KEY_NAME, "manual"))
 
 	require.NoError(t, ks.LoadKey("manual", "secret"))
+	assert.Equal(t, 1, noteSvc.migrations, "titles are migrated on unlock")
 
 	certSvc.loadErr = errors.New("cipher: message authentication failed")
 	err := ks.LoadKey("manual", "wrong")
@@ -308,3 +379,340 @@ func TestKeyService_RotateKey_DelegatesToNoteService(t *testing.T) {
 	require.NoError(t, err)
 	assert.True(t, noteSvc.reEncCalled)
 }
+
+func TestKeyService_ConfigureDuress_Validation(t *testing.T) {
+	ks, _, _, _ := newTestKeyService()
+	assert.Error(t, ks.ConfigureDuress("panic", false), "no duress store configured")
+
+	ks, cert, _, _, _, _ := newTestKeyServiceWithDuress(t)
+	err := ks.ConfigureDuress("", false)
+	require.Error(t, err)
+	assert.Equal(t, common.ERR_DURESS_PASSWORD_EMPTY, err.Error())
+
+	// the fake store opens with any password: the key isn't password-protected
+	cert.loadErr = nil
+	err = ks.ConfigureDuress("panic", false)
+	require.Error(t, err)
+	assert.Equal(t, common.ERR_DURESS_REQUIRES_PASSWORD, err.Error())
+
+	empty := service.NewKeyService(newFakeCertService(), service.NewCertService(filepath.Join(t.TempDir(), "d.json")),
+		newFakeConfService(), &service.CryptoServiceFactoryImpl{}, &fakeNoteService{})
+	err = empty.ConfigureDuress("panic", false)
+	require.Error(t, err)
+	assert.Equal(t, common.ERR_NO_KEY, err.Error())
+}
+
+func TestKeyService_LoadKey_DuressPasswordOpensDecoyVault(t *testing.T) {
+	ks, cert, _, _, note, crypto := newTestKeyServiceWithDuress(t)
+	realKey := crypto.GetSrv().GetKeyManager().GetCertificate().Key
+
+	require.NoError(t, ks.ConfigureDuress("panic", false))
+
+	err := ks.LoadKey("real", "wrong")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid password")
+	assert.Empty(t, note.bucket)
+
+	require.NoError(t, ks.LoadKey("real", "panic"))
+	active := crypto.GetSrv().GetKeyManager().GetCertificate()
+	assert.Equal(t, "real", active.Name, "the decoy key must look like the real one")
+	assert.NotEqual(t, realKey, active.Key)
+	assert.Equal(t, common.DECOY_NOTES_BUCKET, note.bucket)
+	assert.True(t, note.localOnly)
+	assert.False(t, cert.destroyed)
+
+	// reconfiguring from inside the decoy vault silently keeps the decoy key
+	require.NoError(t, ks.ConfigureDuress("other", false))
+	require.NoError(t, ks.LoadKey("real", "panic"))
+	assert.Equal(t, active.Key, crypto.GetSrv().GetKeyManager().GetCertificate().Key)
+}
+
+func TestKeyService_LoadKey_DuressPasswordWipesRealKey(t *testing.T) {
+	ks, cert, _, conf, _, crypto := newTestKeyServiceWithDuress(t)
+	realKey := crypto.GetSrv().GetKeyManager().GetCertificate().Key
+	require.NoError(t, conf.SetConfig("real_recovery", "00112233445566778899"))
+
+	require.NoError(t, ks.ConfigureDuress("panic", true))
+	require.NoError(t, ks.LoadKey("real", "panic"))
+
+	assert.True(t, cert.destroyed)
+	// a look-alike key takes the place of the real one
+	junk, err := cert.GetCert("real")
+	require.NoError(t, err)
+	assert.NotEqual(t, realKey, junk.Key)
+	recovery, err := conf.GetConfig("real_recovery")
+	require.NoError(t, err)
+	assert.Len(t, recovery, len("00112233445566778899"))
+	assert.NotEqual(t, "00112233445566778899", recovery)
+}
+
+func TestKeyService_SendReceiveKeys(t *testing.T) {
+	sender, senderCerts, senderConf, _ := newTestKeyService()
+	require.NoError(t, senderConf.SetConfig(common.CONFIG_KEY_TRANSFER_LISTEN_ADDR, "127.0.0.1:0"))
+	for _, name := range []string{"alpha", "beta"} {
+		require.NoError(t, senderCerts.AddCert(model.EncKey{
+			Name: name,
+			Algo: common.ENCRYPTION_ALGORITHM_AES_256_CBC,
+			Key:  []byte(name + "-key-32-bytes-0123456789abcdef")[:32],
+		}))
+	}
+	require.NoError(t, senderConf.SetConfig(common.CONFIG_CUR_ENCRYPTION_KEY_NAME, "beta"))
+
+	transfer, err := sender.SendKeys(context.Background(), true)
+	require.NoError(t, err)
+	require.Len(t, transfer.Addresses, 1)
+
+	receiverCerts, receiverConf := newFakeCertService(), newFakeConfService()
+	crypto := &service.CryptoServiceFactoryImpl{}
+	receiver := service.NewKeyService(receiverCerts, nil, receiverConf, crypto, &fakeNoteService{})
+	cert, err := receiver.ReceiveKeys(context.Background(), transfer.Addresses[0], transfer.Code, "new-password")
+	require.NoError(t, err)
+	require.NoError(t, <-transfer.Done)
+
+	// all the keys are received, and the default one is activated
+	assert.Equal(t, "beta", cert.Name)
+	assert.Len(t, receiverCerts.certs, 2)
+	alpha, err := receiverCerts.GetCert("alpha")
+	require.NoError(t, err)
+	assert.Equal(t, senderCerts.certs["alpha"].Key, alpha.Key)
+	defaultName, err := receiverConf.GetConfig(common.CONFIG_CUR_ENCRYPTION_KEY_NAME)
+	require.NoError(t, err)
+	assert.Equal(t, "beta", defaultName)
+	assert.Equal(t, senderCerts.certs["beta"].Key, crypto.GetSrv().GetKeyManager().GetCertificate().Key)
+}
+
+func TestKeyService_ReceiveKeys_WrongCode(t *testing.T) {
+	sender, senderCerts, senderConf, _ := newTestKeyService()
+	require.NoError(t, senderConf.SetConfig(common.CONFIG_KEY_TRANSFER_LISTEN_ADDR, "127.0.0.1:0"))
+	require.NoError(t, senderCerts.AddCert(model.EncKey{
+		Name: "alpha",
+		Algo: common.ENCRYPTION_ALGORITHM_AES_256_CBC,
+		Key:  []byte("alpha-key-32-bytes-alpha-key-32-"),
+	}))
+
+	transfer, err := sender.SendKeys(context.Background(), true)
+	require.NoError(t, err)
+	wrong := "AAAA-AAAA"
+	if transfer.Code == wrong {
+		wrong = "BBBB-BBBB"
+	}
+	receiver, receiverCerts, receiverConf, _ := newTestKeyService()
+	_, err = receiver.ReceiveKeys(context.Background(), transfer.Addresses[0], wrong, "new-password")
+	assert.EqualError(t, err, common.ERR_KEY_TRANSFER_FAILED)
+	assert.EqualError(t, <-transfer.Done, common.ERR_KEY_TRANSFER_FAILED)
+	assert.Empty(t, receiverCerts.certs)
+	_, err = receiverConf.GetConfig(common.CONFIG_CUR_ENCRYPTION_KEY_NAME)
+	assert.Error(t, err)
+}
+
+func TestKeyService_SendKeys_NoKeys(t *testing.T) {
+	ks, _, _, _ := newTestKeyService()
+	_, err := ks.SendKeys(context.Background(), true)
+	assert.Error(t, err)
+}
+
+func TestKeyService_SendKeys_FromDecoyVault(t *testing.T) {
+	ks, cert, _, conf, _, crypto := newTestKeyServiceWithDuress(t)
+	require.NoError(t, conf.SetConfig(common.CONFIG_CUR_ENCRYPTION_KEY_NAME, "real"))
+	require.NoError(t, conf.SetConfig(common.CONFIG_KEY_TRANSFER_LISTEN_ADDR, "127.0.0.1:0"))
+	require.NoError(t, ks.ConfigureDuress("panic", false))
+	require.NoError(t, ks.LoadKey("real", "panic"))
+	decoyKey := crypto.GetSrv().GetKeyManager().GetCertificate().Key
+
+	transfer, err := ks.SendKeys(context.Background(), true)
+	require.NoError(t, err)
+	receiver, _, _, _ := newTestKeyService()
+	received, err := receiver.ReceiveKeys(context.Background(), transfer.Addresses[0], transfer.Code, "")
+	require.NoError(t, err)
+	require.NoError(t, <-transfer.Done)
+
+	// the real key never leaves the device
+	assert.Equal(t, "real", received.Name)
+	assert.Equal(t, decoyKey, received.Key)
+	assert.NotEqual(t, cert.certs["real"].Key, received.Key)
+}
+
+func TestKeyService_SaveGetSecret(t *testing.T) {
+	ks, certSvc, _, _ := newTestKeyService()
+	_, err := ks.GetSecret(provider.GoogleOAuthSecretName)
+	assert.Error(t, err)
+
+	require.NoError(t, ks.SaveSecret(provider.GoogleOAuthSecretName, []byte("refresh-token"), "pwd"))
+	secret, err := ks.GetSecret(provider.GoogleOAuthSecretName)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("refresh-token"), secret)
+
+	// the secret is replaced when the account is connected again
+	require.NoError(t, ks.SaveSecret(provider.GoogleOAuthSecretName, []byte("new-refresh-token"), "pwd"))
+	secret, err = ks.GetSecret(provider.GoogleOAuthSecretName)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new-refresh-token"), secret)
+
+	// keys are not secrets
+	require.NoError(t, certSvc.AddCert(model.EncKey{Name: "myKey", Algo: common.ENCRYPTION_ALGORITHM_AES_256_CBC}))
+	_, err = ks.GetSecret("myKey")
+	assert.EqualError(t, err, common.ERR_CERT_NOT_FOUND)
+	assert.Error(t, ks.SaveSecret("myKey", []byte("secret"), "pwd"))
+
+	// the password is checked first
+	certSvc.loadErr = errors.New("message authentication failed")
+	assert.ErrorContains(t, ks.SaveSecret(provider.GoogleOAuthSecretName, []byte("other"), "wrong"), "invalid password")
+}
+
+func TestKeyService_ReceiveKeys_WithSecret(t *testing.T) {
+	sender, senderCerts, senderConf, _ := newTestKeyService()
+	require.NoError(t, senderConf.SetConfig(common.CONFIG_KEY_TRANSFER_LISTEN_ADDR, "127.0.0.1:0"))
+	require.NoError(t, senderCerts.AddCert(model.EncKey{
+		Name: "zeta",
+		Algo: common.ENCRYPTION_ALGORITHM_AES_256_CBC,
+		Key:  []byte("zeta-key-32-bytes-zeta-key-32-by"),
+	}))
+	// the secret sorts before the key, and isn't the default key of the sender
+	require.NoError(t, sender.SaveSecret("a_secret", []byte("refresh-token"), ""))
+
+	transfer, err := sender.SendKeys(context.Background(), true)
+	require.NoError(t, err)
+	receiver, receiverCerts, _, _ := newTestKeyService()
+	cert, err := receiver.ReceiveKeys(context.Background(), transfer.Addresses[0], transfer.Code, "")
+	require.NoError(t, err)
+	require.NoError(t, <-transfer.Done)
+
+	assert.Equal(t, "zeta", cert.Name)
+	assert.Len(t, receiverCerts.certs, 2)
+	secret, err := receiver.GetSecret("a_secret")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("refresh-token"), secret)
+}
+
+func TestKeyService_SendKeys_WithoutSecrets(t *testing.T) {
+	sender, senderCerts, senderConf, _ := newTestKeyService()
+	require.NoError(t, senderConf.SetConfig(common.CONFIG_KEY_TRANSFER_LISTEN_ADDR, "127.0.0.1:0"))
+	require.NoError(t, senderCerts.AddCert(model.EncKey{
+		Name: "zeta",
+		Algo: common.ENCRYPTION_ALGORITHM_AES_256_CBC,
+		Key:  []byte("zeta-key-32-bytes-zeta-key-32-by"),
+	}))
+	require.NoError(t, sender.SaveSecret("a_secret", []byte("refresh-token"), ""))
+
+	transfer, err := sender.SendKeys(context.Background(), false)
+	require.NoError(t, err)
+	receiver, receiverCerts, _, _ := newTestKeyService()
+	cert, err := receiver.ReceiveKeys(context.Background(), transfer.Addresses[0], transfer.Code, "")
+	require.NoError(t, err)
+	require.NoError(t, <-transfer.Done)
+
+	// only the encryption keys are received
+	assert.Equal(t, "zeta", cert.Name)
+	assert.Len(t, receiverCerts.certs, 1)
+	_, err = receiver.GetSecret("a_secret")
+	assert.Error(t, err)
+}
+
+func TestKeyService_GetSecret_FromDecoyVault(t *testing.T) {
+	ks, cert, _, conf, _, _ := newTestKeyServiceWithDuress(t)
+	require.NoError(t, conf.SetConfig(common.CONFIG_CUR_ENCRYPTION_KEY_NAME, "real"))
+	require.NoError(t, cert.AddCert(model.EncKey{
+		Name: provider.GoogleOAuthSecretName, Algo: common.CERT_ALGO_SECRET, Key: []byte("refresh-token"),
+	}))
+	_, err := ks.GetSecret(provider.GoogleOAuthSecretName)
+	require.NoError(t, err)
+	require.NoError(t, ks.ConfigureDuress("panic", false))
+	// the providers keep reading their secrets while the vault is opened
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ks.GetSecret(provider.GoogleOAuthSecretName)
+	}()
+	require.NoError(t, ks.LoadKey("real", "panic"))
+	<-done
+
+	// the decoy vault is never synced
+	_, err = ks.GetSecret(provider.GoogleOAuthSecretName)
+	assert.Error(t, err)
+}
+
+func TestKeyService_ConnectGoogleAccount_NotConfigured(t *testing.T) {
+	ks, _, _, _ := newTestKeyService()
+	err := ks.ConnectGoogleAccount(context.Background(), "", func(string) error {
+		t.Fatal("the browser must not be opened")
+		return nil
+	})
+	assert.EqualError(t, err, common.ERR_INVALID_GOOGLE_PROVIDER_CONFIG)
+}
+
+func TestKeyService_LoadKey_MigratesProviderCredentials(t *testing.T) {
+	dir := t.TempDir()
+	certSvc := service.NewCertService(filepath.Join(dir, "key_store.json"))
+	require.NoError(t, certSvc.AddCert(model.EncKey{
+		Name: "manual",
+		Algo: common.ENCRYPTION_ALGORITHM_AES_256_CBC,
+		Key:  []byte("manual-key-32-bytes-manual-key-"),
+	}))
+	require.NoError(t, certSvc.SaveCerts("pwd"))
+	credFilePath := filepath.Join(dir, "cred_serviceaccount.json")
+	require.NoError(t, os.WriteFile(credFilePath, []byte(`{"type":"service_account"}`), 0o600))
+	conf := newFakeConfService()
+	require.NoError(t, conf.SetConfig(common.CONFIG_GOOGLE_SHEET_ID, "sheet-id"))
+	require.NoError(t, conf.SetConfig(common.CONFIG_WEBDAV_PASSWORD, "dav-password"))
+	require.NoError(t, conf.SetConfig(common.CONFIG_WEBDAV_URL, "https://dav.example.com"))
+	require.NoError(t, conf.SetConfig(common.CONFIG_GOOGLE_CREDENTIALS_FILE_PATH, credFilePath))
+	ks := service.NewKeyService(certSvc, nil, conf, &service.CryptoServiceFactoryImpl{}, &fakeNoteService{})
+
+	require.NoError(t, ks.LoadKey("manual", "pwd"))
+
+	// the plaintext copies are gone
+	for _, key := range []string{common.CONFIG_GOOGLE_SHEET_ID, common.CONFIG_WEBDAV_PASSWORD} {
+		_, err := conf.GetConfig(key)
+		assert.Error(t, err, key)
+	}
+	_, err := os.Stat(credFilePath)
+	assert.True(t, os.IsNotExist(err))
+	url, err := conf.GetConfig(common.CONFIG_WEBDAV_URL)
+	require.NoError(t, err)
+	assert.Equal(t, "https://dav.example.com", url)
+	// the legacy config keeps syncing with Google Sheets
+	names, err := conf.GetConfig(common.CONFIG_SYNC_PROVIDERS)
+	require.NoError(t, err)
+	assert.Equal(t, provider.GoogleProviderName, names)
+
+	// the secrets are saved encrypted with the password
+	reloaded := service.NewCertService(filepath.Join(dir, "key_store.json"))
+	require.Error(t, reloaded.LoadCerts("wrong"))
+	require.NoError(t, reloaded.LoadCerts("pwd"))
+	for name, want := range map[string]string{
+		provider.ConfigSecretName(common.CONFIG_GOOGLE_SHEET_ID): "sheet-id",
+		provider.ConfigSecretName(common.CONFIG_WEBDAV_PASSWORD): "dav-password",
+		provider.GoogleServiceAccountSecretName:                  `{"type":"service_account"}`,
+	} {
+		cert, err := reloaded.GetCert(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, common.CERT_ALGO_SECRET, cert.Algo)
+		assert.Equal(t, want, string(cert.Key))
+	}
+	secret, err := ks.GetSecret(provider.ConfigSecretName(common.CONFIG_WEBDAV_PASSWORD))
+	require.NoError(t, err)
+	assert.Equal(t, "dav-password", string(secret))
+
+	// nothing is left to move
+	require.NoError(t, ks.LoadKey("manual", "pwd"))
+}
+
+func TestKeyService_TryAutoLoad_MigrationFailureKeepsCredentials(t *testing.T) {
+	ks, certSvc, confSvc, _ := newTestKeyService()
+	require.NoError(t, certSvc.AddCert(model.EncKey{
+		Name: "auto",
+		Algo: common.ENCRYPTION_ALGORITHM_AES_256_CBC,
+		Key:  []byte("auto-key-32-bytes-auto-key-32-by"),
+	}))
+	require.NoError(t, confSvc.SetConfig(common.CONFIG_CUR_ENCRYPTION_KEY_NAME, "auto"))
+	require.NoError(t, confSvc.SetConfig(common.CONFIG_S3_SECRET_KEY, "s3-secret"))
+	certSvc.saveErr = errors.New("disk full")
+
+	// the vault is unlocked anyway, and the credentials stay where they are until the next unlock
+	ok, err := ks.TryAutoLoad()
+	assert.True(t, ok)
+	assert.ErrorContains(t, err, "disk full")
+	val, err := confSvc.GetConfig(common.CONFIG_S3_SECRET_KEY)
+	require.NoError(t, err)
+	assert.Equal(t, "s3-secret", val)
+}
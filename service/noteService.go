@@ -1,21 +1,30 @@
 package service
 
 import (
+	"crypto/rsa"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/lib/cryptoUtil"
 	"github.com/iltoga/ecnotes-go/model"
 	"github.com/iltoga/ecnotes-go/service/observer"
 	"github.com/lithammer/fuzzysearch/fuzzy"
+	log "github.com/sirupsen/logrus"
 )
 
 // NoteService ....
 type NoteService interface {
 	GetNoteWithContent(id int) (*model.Note, error)
 	GetNotes() ([]model.Note, error)
+	GetStoredNotes() ([]model.Note, error)
 	GetTitles() []string
 	SearchNotes(query string, fuzzySearch bool) ([]string, error)
 	CreateNote(note *model.Note) error
@@ -28,6 +37,16 @@ type NoteService interface {
 	EncryptNote(note *model.Note) error
 	DecryptNote(note *model.Note) error
 	GetNoteIDFromTitle(title string) int
+	SwitchVault(bucket string, localOnly bool) error
+	MigrateTitles() error
+	GetTombstones() ([]model.Tombstone, error)
+	ApplyRemoteDeletes(tombstones []model.Tombstone) error
+	PurgeTombstones(before int64) error
+	GetSyncBases(providerName string) (map[int]int64, error)
+	SaveSyncBases(providerName string, notes []model.Note) error
+	MergeConflicts(providerName string, remotes []model.Note) ([]model.Note, error)
+	CanSync() bool
+	IsLocalOnly() bool
 }
 
 // NoteServiceImpl ....
@@ -36,8 +55,16 @@ type NoteServiceImpl struct {
 	ConfigService ConfigService
 	Observer      observer.Observer
 	Crypto        CryptoServiceFactory
-	// Titles an array with all note Titles in db
+	Logger        *log.Logger
+	// Envelope how the note content is wrapped (compressed and padded) before encryption
+	Envelope cryptoUtil.EnvelopeOptions
+	// Titles an array with all (decrypted) note Titles in db
 	Titles []string
+	// titleIDs maps the decrypted titles to their note IDs
+	titleIDs map[string]int
+	indexMux sync.RWMutex
+	// localOnly when true, changes are never handed over to the sync providers
+	localOnly bool
 }
 
 // NewNoteService ....
@@ -46,19 +73,148 @@ func NewNoteService(
 	configService ConfigService,
 	observer observer.Observer,
 	crypto CryptoServiceFactory,
+	logger *log.Logger,
 ) NoteService {
 	return &NoteServiceImpl{
 		NoteRepo:      noteRepo,
 		ConfigService: configService,
 		Observer:      observer,
 		Crypto:        crypto,
+		Logger:        logger,
+		Envelope:      envelopeOptionsFromConfig(configService),
 		Titles:        []string{},
+		titleIDs:      map[string]int{},
 	}
 }
 
-// GetNoteIDFromTitle returns the note ID from the title
+// envelopeOptionsFromConfig reads the note padding and compression settings from the configuration,
+// falling back to the defaults
+func envelopeOptionsFromConfig(configService ConfigService) cryptoUtil.EnvelopeOptions {
+	padding := common.DEFAULT_NOTE_PADDING
+	compression := common.DEFAULT_NOTE_COMPRESSION
+	opts := cryptoUtil.EnvelopeOptions{BlockSize: common.DEFAULT_NOTE_PADDING_BLOCK_SIZE}
+	if configService != nil {
+		if val, err := configService.GetConfig(common.CONFIG_NOTE_PADDING); err == nil && val != "" {
+			padding = val
+		}
+		if val, err := configService.GetConfig(common.CONFIG_NOTE_COMPRESSION); err == nil && val != "" {
+			compression = val
+		}
+		if val, err := configService.GetConfig(common.CONFIG_NOTE_PADDING_BLOCK_SIZE); err == nil {
+			if blockSize, err := strconv.Atoi(val); err == nil && blockSize > 0 {
+				opts.BlockSize = blockSize
+			}
+		}
+	}
+	switch padding {
+	case common.NOTE_PADDING_NONE:
+		opts.Padding = cryptoUtil.PaddingNone
+	case common.NOTE_PADDING_BLOCK:
+		opts.Padding = cryptoUtil.PaddingBlock
+	default:
+		opts.Padding = cryptoUtil.PaddingPow2
+	}
+	opts.Compress = compression != common.NOTE_COMPRESSION_NONE
+	return opts
+}
+
+// encodeCiphertext encodes a ciphertext for storage. Base64 is a third shorter than the hex used by older versions
+func encodeCiphertext(ciphertext []byte) string {
+	return common.BASE64_CIPHERTEXT_PREFIX + base64.StdEncoding.EncodeToString(ciphertext)
+}
+
+// decodeCiphertext decodes a stored ciphertext, either base64 or (legacy) hex encoded
+func decodeCiphertext(encoded string) ([]byte, error) {
+	if strings.HasPrefix(encoded, common.BASE64_CIPHERTEXT_PREFIX) {
+		return base64.StdEncoding.DecodeString(strings.TrimPrefix(encoded, common.BASE64_CIPHERTEXT_PREFIX))
+	}
+	return hex.DecodeString(encoded)
+}
+
+// GetNoteIDFromTitle returns the note ID from the title.
+// Known titles resolve through the title index, the others to the blind index a new note would get
+// (0 when no key is loaded)
 func (ns *NoteServiceImpl) GetNoteIDFromTitle(title string) int {
-	return ns.NoteRepo.GetIDFromTitle(title)
+	if id, ok := ns.lookupTitle(title); ok {
+		return id
+	}
+	id, _ := ns.titleID(title)
+	return id
+}
+
+// SwitchVault points the service to another bucket of the db and reloads the note titles.
+// A localOnly vault never shares its changes with the sync providers and never accepts notes from them
+func (ns *NoteServiceImpl) SwitchVault(bucket string, localOnly bool) error {
+	ns.NoteRepo.SetBucket(bucket)
+	ns.localOnly = localOnly
+	ns.resetTitleIndex(nil, nil)
+	_, err := ns.GetNotes()
+	return err
+}
+
+// CanSync reports whether the open vault can be synced: it is shared with the sync providers and its key is loaded
+func (ns *NoteServiceImpl) CanSync() bool {
+	if ns.localOnly {
+		return false
+	}
+	_, err := ns.titleID("")
+	return err == nil
+}
+
+// IsLocalOnly reports whether the open vault is local-only: it is never shared with the sync providers
+func (ns *NoteServiceImpl) IsLocalOnly() bool {
+	return ns.localOnly
+}
+
+// MigrateTitles encrypts the legacy plaintext titles of the open vault with the active key and
+// rebuilds the title index. It is run whenever a key is unlocked
+func (ns *NoteServiceImpl) MigrateTitles() error {
+	notes, err := ns.NoteRepo.GetAllNotes()
+	if err != nil && err.Error() != common.ERR_BUCKET_EMPTY {
+		return err
+	}
+	for _, note := range notes {
+		if isSealedTitle(note.Title) {
+			continue
+		}
+		if err := ns.migrateTitle(note); err != nil {
+			return fmt.Errorf("error migrating note %d: %w", note.ID, err)
+		}
+	}
+	_, err = ns.GetNotes()
+	return err
+}
+
+// migrateTitle seals the plaintext title of a stored note and moves the note to its blind-index ID.
+// The old ID is announced as deleted, so that the sync providers drop the plaintext copy
+func (ns *NoteServiceImpl) migrateTitle(note model.Note) error {
+	oldNote := note
+	newID, err := ns.titleID(note.Title)
+	if err != nil {
+		return err
+	}
+	if err := ns.sealTitle(&note); err != nil {
+		return err
+	}
+	// on a collision with another note, keep the old ID
+	if newID != oldNote.ID {
+		if exists, _ := ns.NoteRepo.NoteExists(newID); !exists {
+			note.ID = newID
+		}
+	}
+	if err := ns.NoteRepo.RenameNote(oldNote.ID, &note); err != nil {
+		return err
+	}
+	if ns.localOnly {
+		return nil
+	}
+	if note.ID != oldNote.ID {
+		if err := ns.recordDeletion(&oldNote); err != nil {
+			return err
+		}
+	}
+	ns.Observer.Notify(observer.EVENT_PUSH_NOTE, &note, common.WindowMode_Edit, common.WindowAction_Update, &note)
+	return nil
 }
 
 // GetNote retreives a note from the db by id and decrypts it
@@ -67,15 +223,19 @@ func (ns *NoteServiceImpl) GetNoteWithContent(id int) (*model.Note, error) {
 	if err != nil {
 		return nil, err
 	}
-	// decrypt content before returning
+	// decrypt title and content before returning
+	if err := ns.openTitle(note, ns.Crypto.GetSrv()); err != nil {
+		return nil, err
+	}
 	if err := ns.DecryptNote(note); err != nil {
 		return nil, err
 	}
 	return note, nil
 }
 
-// GetNotes returns all note titles from the db and populate Titles array and TitlesIDMap with the results
-// note: the note content is returned encrypted
+// GetNotes returns all notes from the db and rebuilds the title index with their decrypted titles
+// note: the notes are returned as stored (title and content encrypted).
+// Titles that can't be decrypted with the active key are left out of the index
 func (ns *NoteServiceImpl) GetNotes() ([]model.Note, error) {
 	notes, err := ns.NoteRepo.GetAllNotes()
 	if err != nil {
@@ -86,38 +246,177 @@ func (ns *NoteServiceImpl) GetNotes() ([]model.Note, error) {
 			return nil, err
 		}
 	}
-	ns.Titles = []string{}
-	for idx, note := range notes {
-		ns.Titles = append(ns.Titles, note.Title)
-		// swap the note with the decrypted one
-		notes[idx] = note
+	srv := ns.Crypto.GetSrv()
+	titles := make([]string, 0, len(notes))
+	titleIDs := make(map[string]int, len(notes))
+	for _, note := range notes {
+		if err := ns.openTitle(&note, srv); err != nil {
+			ns.logger().Warnf("Unable to decrypt the title of note %d: %v", note.ID, err)
+			continue
+		}
+		titles = append(titles, note.Title)
+		titleIDs[note.Title] = note.ID
 	}
+	ns.resetTitleIndex(titles, titleIDs)
 	// emit a note titles' update event
-	ns.Observer.Notify(observer.EVENT_UPDATE_NOTE_TITLES, ns.Titles)
+	ns.Observer.Notify(observer.EVENT_UPDATE_NOTE_TITLES, ns.GetTitles())
 	return notes, nil
 }
 
-// GetTitles returns all note titles from memory
+// GetStoredNotes returns all notes from the db as stored (title and content encrypted).
+// Unlike GetNotes, it leaves the title index alone and notifies nobody
+func (ns *NoteServiceImpl) GetStoredNotes() ([]model.Note, error) {
+	notes, err := ns.NoteRepo.GetAllNotes()
+	if err != nil {
+		if err.Error() == common.ERR_BUCKET_EMPTY {
+			return []model.Note{}, nil
+		}
+		return nil, err
+	}
+	return notes, nil
+}
+
+// GetTitles returns a copy of all note titles from memory
 func (ns *NoteServiceImpl) GetTitles() []string {
-	return ns.Titles
+	ns.indexMux.RLock()
+	defer ns.indexMux.RUnlock()
+	return append([]string{}, ns.Titles...)
+}
+
+// logger returns the logger of the service, or the standard one if none is set
+func (ns *NoteServiceImpl) logger() *log.Logger {
+	if ns.Logger == nil {
+		return log.StandardLogger()
+	}
+	return ns.Logger
+}
+
+// resetTitleIndex replaces the title index
+func (ns *NoteServiceImpl) resetTitleIndex(titles []string, titleIDs map[string]int) {
+	ns.indexMux.Lock()
+	defer ns.indexMux.Unlock()
+	if titles == nil {
+		titles = []string{}
+	}
+	if titleIDs == nil {
+		titleIDs = map[string]int{}
+	}
+	ns.Titles = titles
+	ns.titleIDs = titleIDs
+}
+
+// lookupTitle returns the ID of the note with the given (decrypted) title
+func (ns *NoteServiceImpl) lookupTitle(title string) (int, bool) {
+	ns.indexMux.RLock()
+	defer ns.indexMux.RUnlock()
+	id, ok := ns.titleIDs[title]
+	return id, ok
+}
+
+// indexTitle adds a (decrypted) title to the title index
+func (ns *NoteServiceImpl) indexTitle(title string, id int) {
+	ns.indexMux.Lock()
+	defer ns.indexMux.Unlock()
+	if ns.titleIDs == nil {
+		ns.titleIDs = map[string]int{}
+	}
+	ns.titleIDs[title] = id
+	ns.Titles = append(ns.Titles, title)
+}
+
+// unindexTitle removes the title of the note with the given ID from the title index
+func (ns *NoteServiceImpl) unindexTitle(id int) {
+	ns.indexMux.Lock()
+	defer ns.indexMux.Unlock()
+	for title, titleID := range ns.titleIDs {
+		if titleID != id {
+			continue
+		}
+		delete(ns.titleIDs, title)
+		for i := range ns.Titles {
+			if ns.Titles[i] == title {
+				ns.Titles = append(ns.Titles[:i], ns.Titles[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+}
+
+// titleID returns the blind index of a title: a keyed hash, derived from the active key,
+// so that the IDs stored in the db and pushed to the providers don't reveal the titles
+func (ns *NoteServiceImpl) titleID(title string) (int, error) {
+	srv := ns.Crypto.GetSrv()
+	if srv == nil {
+		return 0, errors.New(common.ERR_NO_KEY)
+	}
+	key := srv.GetKeyManager().GetCertificate().Key
+	if len(key) == 0 {
+		return 0, errors.New(common.ERR_NO_KEY)
+	}
+	return int(cryptoUtil.BlindIndex(key, title)), nil
+}
+
+// isSealedTitle reports whether a title is encrypted
+func isSealedTitle(title string) bool {
+	return strings.HasPrefix(title, common.ENCRYPTED_TITLE_PREFIX)
+}
+
+// sealTitle encrypts the note title with the active key. Titles already encrypted are left as they are
+func (ns *NoteServiceImpl) sealTitle(note *model.Note) error {
+	if isSealedTitle(note.Title) {
+		return nil
+	}
+	srv := ns.Crypto.GetSrv()
+	if srv == nil {
+		return errors.New(common.ERR_NO_KEY)
+	}
+	encryptedTitle, err := srv.Encrypt([]byte(note.Title))
+	if err != nil {
+		return err
+	}
+	note.Title = common.ENCRYPTED_TITLE_PREFIX + encodeCiphertext(encryptedTitle)
+	return nil
+}
+
+// openTitle decrypts the note title with srv. Plaintext (legacy) titles are left as they are
+func (ns *NoteServiceImpl) openTitle(note *model.Note, srv CryptoService) error {
+	if !isSealedTitle(note.Title) {
+		return nil
+	}
+	if srv == nil {
+		return errors.New(common.ERR_NO_KEY)
+	}
+	encryptedTitle, err := decodeCiphertext(strings.TrimPrefix(note.Title, common.ENCRYPTED_TITLE_PREFIX))
+	if err != nil {
+		return err
+	}
+	title, err := srv.Decrypt(encryptedTitle)
+	if err != nil {
+		return err
+	}
+	note.Title = string(title)
+	return nil
 }
 
 // SearchNotes ....
 func (ns *NoteServiceImpl) SearchNotes(query string, fuzzySearch bool) ([]string, error) {
 	// get all notes if Titles is empty
-	if len(ns.Titles) == 0 {
+	if len(ns.GetTitles()) == 0 {
 		_, err := ns.GetNotes()
 		if err != nil {
 			return nil, err
 		}
 	}
 	// search the titles array and return the IDs of the notes that match the query
+	ns.indexMux.RLock()
 	var searchResult []string
 	if fuzzySearch {
 		searchResult = ns.searchFuzzy(query, ns.Titles)
 	} else {
 		searchResult = ns.searchExact(query, ns.Titles)
 	}
+	ns.indexMux.RUnlock()
 	// emit a note titles' update event
 	ns.Observer.Notify(observer.EVENT_UPDATE_NOTE_TITLES, searchResult)
 	return searchResult, nil
@@ -147,11 +446,28 @@ func (ns *NoteServiceImpl) searchExact(query string, titles []string) []string {
 // CreateEncryptedNotes save to db a batch of (already) encrypted notes
 // TODO: refactor this method to use a batch insert	instead of a loop
 func (ns *NoteServiceImpl) SaveEncryptedNotes(notes []model.Note) error {
+	// notes coming from a provider never belong to a local-only vault
+	if ns.localOnly {
+		return nil
+	}
 	// loop through the notes and save them to db
+	legacyTitles := false
 	for _, note := range notes {
 		if err := ns.NoteRepo.CreateNote(&note); err != nil {
 			return err
 		}
+		// a note recreated on another device supersedes its local deletion
+		if err := ns.NoteRepo.DeleteTombstones(note.ID); err != nil {
+			return err
+		}
+		legacyTitles = legacyTitles || !isSealedTitle(note.Title)
+	}
+	ns.emitRemoteUpdates(notes)
+	// notes pushed by a device that doesn't encrypt titles yet are migrated right away, when we can
+	if legacyTitles {
+		if _, err := ns.titleID(""); err == nil {
+			return ns.MigrateTitles()
+		}
 	}
 	// get all note titles from db and notify the observer
 	_, err := ns.GetNotes()
@@ -161,7 +477,20 @@ func (ns *NoteServiceImpl) SaveEncryptedNotes(notes []model.Note) error {
 	return nil
 }
 
-// ReEncryptNotes re-encrypts a batch of notes with a given key and encryption algorithm
+// emitRemoteUpdates tells the UI which (encrypted) notes changed on other devices, so that it can refresh them
+func (ns *NoteServiceImpl) emitRemoteUpdates(notes []model.Note) {
+	for _, note := range notes {
+		decNote, err := ns.openNote(note)
+		if err != nil {
+			continue
+		}
+		ns.Observer.Notify(observer.EVENT_REMOTE_UPDATE_NOTE, decNote)
+	}
+}
+
+// ReEncryptNotes re-encrypts a batch of notes with a given key and encryption algorithm.
+// The IDs are blind indexes of the titles under the old key: each note moves to its ID under the new key,
+// and the old ID is announced as deleted, so that the sync providers drop the old copy
 func (ns *NoteServiceImpl) ReEncryptNotes(notes []model.Note, cert model.EncKey) error {
 	oldSrv := ns.Crypto.GetSrv()
 	if oldSrv == nil {
@@ -179,19 +508,18 @@ func (ns *NoteServiceImpl) ReEncryptNotes(notes []model.Note, cert model.EncKey)
 	ns.Crypto.SetSrv(newSrv)
 	for _, note := range notes {
 		noteCopy := note
+		if err := ns.openTitle(&noteCopy, oldSrv); err != nil {
+			return err
+		}
 		if noteCopy.Encrypted {
-			encryptedContent, err := hex.DecodeString(noteCopy.Content)
+			decryptedContent, err := ns.decryptContent(oldSrv, noteCopy.Content)
 			if err != nil {
 				return err
 			}
-			decryptedContent, err := oldSrv.Decrypt(encryptedContent)
-			if err != nil {
-				return err
-			}
-			noteCopy.Content = string(decryptedContent)
+			noteCopy.Content = decryptedContent
 			noteCopy.Encrypted = false
 		}
-		if err := ns.UpdateNoteContent(&noteCopy); err != nil {
+		if err := ns.reEncryptNote(&noteCopy); err != nil {
 			return err
 		}
 	}
@@ -202,9 +530,44 @@ func (ns *NoteServiceImpl) ReEncryptNotes(notes []model.Note, cert model.EncKey)
 	return nil
 }
 
+// reEncryptNote saves a (decrypted) note with the active key, under the blind index of its title
+func (ns *NoteServiceImpl) reEncryptNote(note *model.Note) error {
+	oldID := note.ID
+	newID, err := ns.titleID(note.Title)
+	if err != nil {
+		return err
+	}
+	// on a collision with another note, keep the old ID
+	if newID != oldID {
+		if exists, _ := ns.NoteRepo.NoteExists(newID); !exists {
+			note.ID = newID
+		}
+	}
+	if note.ID == oldID {
+		return ns.UpdateNoteContent(note)
+	}
+	oldNote := *note
+	oldNote.ID = oldID
+	note.UpdatedAt = common.GetCurrentTimestamp()
+	savedNote, decNote, err := ns.processAndSave(note, func(n *model.Note) error {
+		return ns.NoteRepo.RenameNote(oldID, n)
+	})
+	if err != nil {
+		return err
+	}
+	if err := ns.recordDeletion(&oldNote); err != nil {
+		return err
+	}
+	ns.emitNoteChanged(observer.EVENT_UPDATE_NOTE, decNote, savedNote)
+	return nil
+}
+
 // processAndSave centralizes decryption, snapshotting, encryption, and repo saving
 func (ns *NoteServiceImpl) processAndSave(note *model.Note, action func(*model.Note) error) (savedNote *model.Note, decNote *model.Note, err error) {
 	noteCopy := *note
+	if err := ns.openTitle(&noteCopy, ns.Crypto.GetSrv()); err != nil {
+		return nil, nil, err
+	}
 	if noteCopy.Encrypted {
 		if err := ns.DecryptNote(&noteCopy); err != nil {
 			return nil, nil, err
@@ -214,15 +577,27 @@ func (ns *NoteServiceImpl) processAndSave(note *model.Note, action func(*model.N
 	if err := ns.EncryptNote(&noteCopy); err != nil {
 		return nil, nil, err
 	}
+	if err := ns.sealTitle(&noteCopy); err != nil {
+		return nil, nil, err
+	}
 	if err := action(&noteCopy); err != nil {
 		return nil, nil, err
 	}
+	// a note (re)created with the ID of a deleted one supersedes the deletion
+	if err := ns.NoteRepo.DeleteTombstones(noteCopy.ID); err != nil {
+		return nil, nil, err
+	}
 	savedNoteCopy := noteCopy
 	return &savedNoteCopy, &decNoteCopy, nil
 }
 
 // emitNoteChanged triggers the notification for the UI observer
+// note: the encrypted snapshot (last arg) is what the sync providers push, so it is withheld for local-only vaults
 func (ns *NoteServiceImpl) emitNoteChanged(event observer.Event, decNote *model.Note, savedNote *model.Note) {
+	if ns.localOnly {
+		ns.Observer.Notify(event, decNote, common.WindowMode_Edit, common.WindowAction_Update)
+		return
+	}
 	ns.Observer.Notify(event, decNote, common.WindowMode_Edit, common.WindowAction_Update, savedNote)
 }
 
@@ -231,8 +606,15 @@ func (ns *NoteServiceImpl) CreateNote(note *model.Note) error {
 	if note.Title == "" || note.Content == "" {
 		return errors.New(common.ERR_NOTE_EMPTY)
 	}
+	if _, ok := ns.lookupTitle(note.Title); ok {
+		return errors.New(common.ERR_NOTE_ALREADY_EXISTS)
+	}
 	if note.ID == 0 {
-		note.ID = ns.NoteRepo.GetIDFromTitle(note.Title)
+		id, err := ns.titleID(note.Title)
+		if err != nil {
+			return err
+		}
+		note.ID = id
 	}
 	if exists, _ := ns.NoteRepo.NoteExists(note.ID); exists {
 		return errors.New(common.ERR_NOTE_ALREADY_EXISTS)
@@ -242,8 +624,8 @@ func (ns *NoteServiceImpl) CreateNote(note *model.Note) error {
 
 	savedNote, decNote, err := ns.processAndSave(note, ns.NoteRepo.CreateNote)
 	if err == nil {
-		ns.Titles = append(ns.Titles, savedNote.Title)
-		ns.Observer.Notify(observer.EVENT_UPDATE_NOTE_TITLES, ns.Titles)
+		ns.indexTitle(decNote.Title, savedNote.ID)
+		ns.Observer.Notify(observer.EVENT_UPDATE_NOTE_TITLES, ns.GetTitles())
 		ns.emitNoteChanged(observer.EVENT_CREATE_NOTE, decNote, savedNote)
 	}
 	return err
@@ -270,7 +652,7 @@ func (ns *NoteServiceImpl) UpdateNoteContent(note *model.Note) error {
 
 // UpdateNoteTitle update the title of an existing UpdateNote
 func (ns *NoteServiceImpl) UpdateNoteTitle(oldTitle, newTitle string) (noteID int, err error) {
-	oldIndex := ns.NoteRepo.GetIDFromTitle(oldTitle)
+	oldIndex, _ := ns.lookupTitle(oldTitle)
 	noteID = oldIndex
 	if newTitle == "" {
 		err = errors.New(common.ERR_NOTE_TITLE_EMPTY)
@@ -287,16 +669,25 @@ func (ns *NoteServiceImpl) UpdateNoteTitle(oldTitle, newTitle string) (noteID in
 		err = errors.New(common.ERR_NOTE_NOT_FOUND)
 		return
 	}
+	if _, exists := ns.lookupTitle(newTitle); exists {
+		err = errors.New(common.ERR_NOTE_ALREADY_EXISTS)
+		return
+	}
 	var note *model.Note
 	note, err = ns.NoteRepo.GetNote(oldIndex)
 	if err != nil {
 		return
 	}
 	note.Title = newTitle
-	newIndex := ns.NoteRepo.GetIDFromTitle(newTitle)
+	var newIndex int
+	if newIndex, err = ns.titleID(newTitle); err != nil {
+		return
+	}
 	note.ID = newIndex
 	note.UpdatedAt = common.GetCurrentTimestamp()
 
+	oldNote := *note
+	oldNote.ID = oldIndex
 	_, _, err = ns.processAndSave(note, func(n *model.Note) error {
 		return ns.NoteRepo.RenameNote(oldIndex, n)
 	})
@@ -304,15 +695,23 @@ func (ns *NoteServiceImpl) UpdateNoteTitle(oldTitle, newTitle string) (noteID in
 		return noteID, err
 	}
 	noteID = newIndex
+	// the note moved to the ID of its new title: the old ID is gone
+	if err = ns.recordDeletion(&oldNote); err != nil {
+		return noteID, err
+	}
 
-	// update titles array
+	// update titles index
+	ns.indexMux.Lock()
+	delete(ns.titleIDs, oldTitle)
+	ns.titleIDs[newTitle] = newIndex
 	for i, title := range ns.Titles {
 		if title == oldTitle {
 			ns.Titles[i] = newTitle
 			break
 		}
 	}
-	ns.Observer.Notify(observer.EVENT_UPDATE_NOTE_TITLES, ns.Titles)
+	ns.indexMux.Unlock()
+	ns.Observer.Notify(observer.EVENT_UPDATE_NOTE_TITLES, ns.GetTitles())
 	return noteID, nil
 }
 
@@ -331,34 +730,215 @@ func (ns *NoteServiceImpl) DeleteNote(id int) error {
 		return err
 	}
 
-	// remove the note from the titles array only after the repo delete succeeds
-	for i, title := range ns.Titles {
-		if title == note.Title {
-			ns.Titles = append(ns.Titles[:i], ns.Titles[i+1:]...)
-			break
-		}
-	}
+	// remove the note from the titles index only after the repo delete succeeds
+	ns.unindexTitle(id)
 
 	// emit a note titles' update event
-	ns.Observer.Notify(observer.EVENT_UPDATE_NOTE_TITLES, ns.Titles)
-	ns.Observer.Notify(observer.EVENT_DELETE_NOTE, note, common.WindowMode_Edit, common.WindowAction_Update)
+	ns.Observer.Notify(observer.EVENT_UPDATE_NOTE_TITLES, ns.GetTitles())
+	if err = ns.recordDeletion(note); err != nil {
+		return err
+	}
 	// Note: no need to emit a note update/delete event. since we are deleting a note, we don't need to update the note details in the UI, but just clear the data and hide the note details window
 	return nil
 }
 
+// recordDeletion stores a tombstone for a deleted note ID and hands it over to the sync providers,
+// so that the deletion reaches the other devices. Local-only vaults don't keep tombstones
+func (ns *NoteServiceImpl) recordDeletion(note *model.Note) error {
+	if ns.localOnly {
+		return nil
+	}
+	tombstone := model.Tombstone{ID: note.ID, DeletedAt: common.GetCurrentTimestamp()}
+	if err := ns.NoteRepo.SaveTombstone(tombstone); err != nil {
+		return err
+	}
+	ns.Observer.Notify(observer.EVENT_DELETE_NOTE, note, common.WindowMode_Edit, common.WindowAction_Update, tombstone)
+	return nil
+}
+
+// GetTombstones returns the tombstones of the notes deleted from the open vault
+func (ns *NoteServiceImpl) GetTombstones() ([]model.Tombstone, error) {
+	return ns.NoteRepo.GetTombstones()
+}
+
+// ApplyRemoteDeletes deletes the notes deleted on other devices, without handing the deletions back to the sync providers.
+// The tombstones are kept, so that the deletions keep winning over stale copies
+func (ns *NoteServiceImpl) ApplyRemoteDeletes(tombstones []model.Tombstone) error {
+	if ns.localOnly || len(tombstones) == 0 {
+		return nil
+	}
+	for _, tombstone := range tombstones {
+		if exists, _ := ns.NoteRepo.NoteExists(tombstone.ID); exists {
+			if err := ns.NoteRepo.DeleteNote(tombstone.ID); err != nil {
+				return err
+			}
+			ns.unindexTitle(tombstone.ID)
+			ns.Observer.Notify(observer.EVENT_REMOTE_DELETE_NOTE, tombstone)
+		}
+		if err := ns.NoteRepo.SaveTombstone(tombstone); err != nil {
+			return err
+		}
+	}
+	ns.Observer.Notify(observer.EVENT_UPDATE_NOTE_TITLES, ns.GetTitles())
+	return nil
+}
+
+// PurgeTombstones garbage-collects the tombstones of notes deleted before the given timestamp (ms)
+func (ns *NoteServiceImpl) PurgeTombstones(before int64) error {
+	tombstones, err := ns.NoteRepo.GetTombstones()
+	if err != nil {
+		return err
+	}
+	expired := make([]int, 0)
+	for _, tombstone := range tombstones {
+		if tombstone.DeletedAt < before {
+			expired = append(expired, tombstone.ID)
+		}
+	}
+	return ns.NoteRepo.DeleteTombstones(expired...)
+}
+
+// GetSyncBases returns the UpdatedAt of the version of each note last synced with a provider, by note ID
+func (ns *NoteServiceImpl) GetSyncBases(providerName string) (map[int]int64, error) {
+	bases, err := ns.NoteRepo.GetSyncBases(providerName)
+	if err != nil {
+		return nil, err
+	}
+	updatedAt := make(map[int]int64, len(bases))
+	for _, base := range bases {
+		updatedAt[base.ID] = base.UpdatedAt
+	}
+	return updatedAt, nil
+}
+
+// SaveSyncBases records the (encrypted) notes a sync left equal on both sides, as the base of the next three-way merges
+// with the same provider
+func (ns *NoteServiceImpl) SaveSyncBases(providerName string, notes []model.Note) error {
+	if ns.localOnly {
+		return nil
+	}
+	return ns.NoteRepo.SaveSyncBases(providerName, notes)
+}
+
+// MergeConflicts three-way merges the local notes with their (encrypted) remote versions, changed on other devices
+// since the last sync with a provider, using the version last synced with it as the base.
+// The content is merged line by line; when the changes overlap, the local version is kept and the remote one
+// is saved as a conflicted copy. Either way the results are handed over to the sync providers and returned (encrypted)
+func (ns *NoteServiceImpl) MergeConflicts(providerName string, remotes []model.Note) ([]model.Note, error) {
+	if ns.localOnly || len(remotes) == 0 {
+		return []model.Note{}, nil
+	}
+	merged := make([]model.Note, 0, len(remotes))
+	for _, remote := range remotes {
+		savedNote, err := ns.mergeConflict(providerName, remote)
+		if err != nil {
+			return nil, fmt.Errorf("error merging note %d: %w", remote.ID, err)
+		}
+		merged = append(merged, *savedNote)
+	}
+	ns.Observer.Notify(observer.EVENT_UPDATE_NOTE_TITLES, ns.GetTitles())
+	return merged, nil
+}
+
+// mergeConflict merges a remote note with the local one and saves the result
+func (ns *NoteServiceImpl) mergeConflict(providerName string, remote model.Note) (*model.Note, error) {
+	local, err := ns.GetNoteWithContent(remote.ID)
+	if err != nil {
+		return nil, err
+	}
+	theirs, err := ns.openNote(remote)
+	if err != nil {
+		return nil, err
+	}
+	// without a (readable) base, only identical contents merge
+	base := &model.Note{Hidden: local.Hidden}
+	if stored, err := ns.NoteRepo.GetSyncBase(providerName, remote.ID); err == nil {
+		if opened, err := ns.openNote(*stored); err == nil {
+			base = opened
+		}
+	}
+	if local.Hidden == base.Hidden {
+		local.Hidden = theirs.Hidden
+	}
+	content, ok := common.MergeLines(base.Content, local.Content, theirs.Content)
+	if ok {
+		local.Content = content
+	}
+	// the result is newer than both versions, so that it replaces them everywhere
+	local.UpdatedAt = common.GetCurrentTimestamp()
+	savedNote, _, err := ns.processAndSave(local, ns.NoteRepo.UpdateNote)
+	if err != nil {
+		return nil, err
+	}
+	ns.Observer.Notify(observer.EVENT_PUSH_NOTE, savedNote, common.WindowMode_Edit, common.WindowAction_Update, savedNote)
+	if ok {
+		ns.Observer.Notify(observer.EVENT_REMOTE_UPDATE_NOTE, local)
+		return savedNote, nil
+	}
+
+	conflictCopy := model.Note{
+		Title:     ns.conflictCopyTitle(local.Title),
+		Content:   theirs.Content,
+		Hidden:    theirs.Hidden,
+		CreatedAt: local.UpdatedAt,
+		UpdatedAt: local.UpdatedAt,
+	}
+	if conflictCopy.ID, err = ns.titleID(conflictCopy.Title); err != nil {
+		return nil, err
+	}
+	savedCopy, decCopy, err := ns.processAndSave(&conflictCopy, ns.NoteRepo.CreateNote)
+	if err != nil {
+		return nil, err
+	}
+	ns.indexTitle(decCopy.Title, savedCopy.ID)
+	ns.Observer.Notify(observer.EVENT_PUSH_NOTE, savedCopy, common.WindowMode_Edit, common.WindowAction_Update, savedCopy)
+	ns.Observer.Notify(observer.EVENT_NOTE_CONFLICT, &model.NoteConflict{Note: *local, Copy: *decCopy})
+	return savedNote, nil
+}
+
+// openNote returns a decrypted copy of a stored note
+func (ns *NoteServiceImpl) openNote(note model.Note) (*model.Note, error) {
+	if err := ns.openTitle(&note, ns.Crypto.GetSrv()); err != nil {
+		return nil, err
+	}
+	if note.Encrypted {
+		if err := ns.DecryptNote(&note); err != nil {
+			return nil, err
+		}
+	}
+	return &note, nil
+}
+
+// conflictCopyTitle returns a free title for the conflicted copy of a note
+func (ns *NoteServiceImpl) conflictCopyTitle(title string) string {
+	copyTitle := fmt.Sprintf(common.CONFLICT_COPY_TITLE_FORMAT, title, time.Now().Format(common.CONFLICT_COPY_TIME_FORMAT))
+	candidate := copyTitle
+	for i := 2; ; i++ {
+		if _, exists := ns.lookupTitle(candidate); !exists {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s %d", copyTitle, i)
+	}
+}
+
 // EncryptNote ....
 func (ns *NoteServiceImpl) EncryptNote(note *model.Note) error {
 	// make sure the note is not empty
 	if note == nil || note.Title == "" || note.Content == "" {
 		return errors.New(common.ERR_NOTE_EMPTY)
 	}
-	note.EncKeyName = ns.Crypto.GetSrv().GetKeyManager().GetCertificate().Name
-	encryptedContent, err := ns.Crypto.GetSrv().Encrypt([]byte(note.Content))
+	srv := ns.Crypto.GetSrv()
+	note.EncKeyName = srv.GetKeyManager().GetCertificate().Name
+	// the padding is inside the ciphertext, so it is authenticated together with the content
+	encryptedContent, err := srv.Encrypt(cryptoUtil.SealEnvelope([]byte(note.Content), ns.Envelope))
+	// RSA keys can only encrypt short messages: don't let the padding make a note too long for them
+	if errors.Is(err, rsa.ErrMessageTooLong) && ns.Envelope.Padding != cryptoUtil.PaddingNone {
+		encryptedContent, err = srv.Encrypt(cryptoUtil.SealEnvelope([]byte(note.Content), cryptoUtil.EnvelopeOptions{}))
+	}
 	if err != nil {
 		return err
 	}
-	// hex encode the encrypted content
-	note.Content = hex.EncodeToString(encryptedContent)
+	note.Content = encodeCiphertext(encryptedContent)
 	note.Encrypted = true
 	return nil
 }
@@ -369,16 +949,28 @@ func (ns *NoteServiceImpl) DecryptNote(note *model.Note) error {
 	if note == nil || note.Title == "" || note.Content == "" {
 		return errors.New(common.ERR_NOTE_EMPTY)
 	}
-	// hex decode the encrypted content
-	encryptedContent, err := hex.DecodeString(note.Content)
+	decryptedContent, err := ns.decryptContent(ns.Crypto.GetSrv(), note.Content)
 	if err != nil {
 		return err
 	}
-	decryptedContent, err := ns.Crypto.GetSrv().Decrypt(encryptedContent)
-	if err != nil {
-		return err
-	}
-	note.Content = string(decryptedContent)
+	note.Content = decryptedContent
 	note.Encrypted = false
 	return nil
 }
+
+// decryptContent decrypts the encoded content of a note with srv and strips its envelope
+func (ns *NoteServiceImpl) decryptContent(srv CryptoService, content string) (string, error) {
+	encryptedContent, err := decodeCiphertext(content)
+	if err != nil {
+		return "", err
+	}
+	envelope, err := srv.Decrypt(encryptedContent)
+	if err != nil {
+		return "", err
+	}
+	decryptedContent, err := cryptoUtil.OpenEnvelope(envelope)
+	if err != nil {
+		return "", err
+	}
+	return string(decryptedContent), nil
+}
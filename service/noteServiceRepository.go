@@ -7,7 +7,6 @@ import (
 	"os"
 
 	"github.com/iltoga/ecnotes-go/lib/common"
-	"github.com/iltoga/ecnotes-go/lib/cryptoUtil"
 	"github.com/iltoga/ecnotes-go/model"
 	"github.com/xujiajun/nutsdb"
 )
@@ -21,7 +20,16 @@ type NoteServiceRepository interface {
 	DeleteNote(id int) error
 	RenameNote(oldID int, note *model.Note) error
 	NoteExists(id int) (bool, error)
-	GetIDFromTitle(title string) int
+	SetBucket(bucket string)
+	SaveTombstone(tombstone model.Tombstone) error
+	GetTombstones() ([]model.Tombstone, error)
+	DeleteTombstones(ids ...int) error
+	SaveSyncBases(providerName string, notes []model.Note) error
+	GetSyncBase(providerName string, id int) (*model.Note, error)
+	GetSyncBases(providerName string) ([]model.Note, error)
+	SaveOutboxEntry(queue string, entry model.OutboxEntry) error
+	GetOutboxEntries(queue string) ([]model.OutboxEntry, error)
+	DeleteOutboxEntries(queue string, ids ...int) error
 }
 
 // NoteServiceRepositoryImpl implementation of NoteServiceRepository that uses nutsdb
@@ -186,9 +194,207 @@ func (nsr *NoteServiceRepositoryImpl) NoteExists(id int) (bool, error) {
 	return true, nil
 }
 
-// GetIDFromTitle retreives a note's ID from its title
-func (nsr *NoteServiceRepositoryImpl) GetIDFromTitle(title string) int {
-	return int(cryptoUtil.IndexFromString(title))
+// SetBucket switches the bucket used by all subsequent queries
+func (nsr *NoteServiceRepositoryImpl) SetBucket(bucket string) {
+	nsr.bucket = bucket
+}
+
+// SaveTombstone records the deletion of a note. Tombstones are kept in a bucket next to the notes one
+func (nsr *NoteServiceRepositoryImpl) SaveTombstone(tombstone model.Tombstone) error {
+	value, err := common.MarshalJSON(tombstone)
+	if err != nil {
+		return err
+	}
+	return nsr.db.Update(
+		func(tx *nutsdb.Tx) error {
+			return tx.Put(nsr.tombstonesBucket(), nsr.getDBKeyFromID(tombstone.ID), value, 0)
+		})
+}
+
+// GetTombstones retreives all tombstones of the current bucket
+func (nsr *NoteServiceRepositoryImpl) GetTombstones() ([]model.Tombstone, error) {
+	tombstones := []model.Tombstone{}
+	if err := nsr.db.View(
+		func(tx *nutsdb.Tx) error {
+			entries, err := tx.GetAll(nsr.tombstonesBucket())
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				var tombstone model.Tombstone
+				if err := common.UnmarshalJSON(entry.Value, &tombstone); err != nil {
+					return err
+				}
+				tombstones = append(tombstones, tombstone)
+			}
+			return nil
+		}); err != nil {
+		if err.Error() == common.ERR_BUCKET_EMPTY {
+			return []model.Tombstone{}, nil
+		}
+		return nil, err
+	}
+	return tombstones, nil
+}
+
+// DeleteTombstones removes the tombstones of the given note IDs (missing ones are ignored)
+func (nsr *NoteServiceRepositoryImpl) DeleteTombstones(ids ...int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return nsr.db.Update(
+		func(tx *nutsdb.Tx) error {
+			for _, id := range ids {
+				_ = tx.Delete(nsr.tombstonesBucket(), nsr.getDBKeyFromID(id))
+			}
+			return nil
+		})
+}
+
+// tombstonesBucket returns the bucket holding the tombstones of the current notes bucket
+func (nsr *NoteServiceRepositoryImpl) tombstonesBucket() string {
+	return nsr.bucket + common.TOMBSTONES_BUCKET_SUFFIX
+}
+
+// SaveSyncBases replaces the version of the notes last synced with a provider (the base of the three-way merges)
+// with the given ones. The bases of the notes not in the list are dropped
+func (nsr *NoteServiceRepositoryImpl) SaveSyncBases(providerName string, notes []model.Note) error {
+	keep := make(map[string]bool, len(notes))
+	values := make(map[string][]byte, len(notes))
+	for _, note := range notes {
+		value, err := common.MarshalJSON(note)
+		if err != nil {
+			return err
+		}
+		key := string(nsr.getDBKeyFromID(note.ID))
+		keep[key] = true
+		values[key] = value
+	}
+	return nsr.db.Update(
+		func(tx *nutsdb.Tx) error {
+			entries, err := tx.GetAll(nsr.syncBasesBucket(providerName))
+			if err != nil && err.Error() != common.ERR_BUCKET_EMPTY {
+				return err
+			}
+			for _, entry := range entries {
+				if !keep[string(entry.Key)] {
+					if err := tx.Delete(nsr.syncBasesBucket(providerName), entry.Key); err != nil {
+						return err
+					}
+				}
+			}
+			for key, value := range values {
+				if err := tx.Put(nsr.syncBasesBucket(providerName), []byte(key), value, 0); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+}
+
+// GetSyncBase retreives the version of a note last synced with a provider
+func (nsr *NoteServiceRepositoryImpl) GetSyncBase(providerName string, id int) (*model.Note, error) {
+	var note *model.Note
+	if err := nsr.db.View(
+		func(tx *nutsdb.Tx) error {
+			dbEntry, err := tx.Get(nsr.syncBasesBucket(providerName), nsr.getDBKeyFromID(id))
+			if err != nil {
+				return err
+			}
+			return common.UnmarshalJSON(dbEntry.Value, &note)
+		}); err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+// GetSyncBases retreives the version of all notes of the current bucket last synced with a provider
+func (nsr *NoteServiceRepositoryImpl) GetSyncBases(providerName string) ([]model.Note, error) {
+	notes := []model.Note{}
+	if err := nsr.db.View(
+		func(tx *nutsdb.Tx) error {
+			entries, err := tx.GetAll(nsr.syncBasesBucket(providerName))
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				var note model.Note
+				if err := common.UnmarshalJSON(entry.Value, &note); err != nil {
+					return err
+				}
+				notes = append(notes, note)
+			}
+			return nil
+		}); err != nil {
+		if err.Error() == common.ERR_BUCKET_EMPTY {
+			return []model.Note{}, nil
+		}
+		return nil, err
+	}
+	return notes, nil
+}
+
+// syncBasesBucket returns the bucket holding the version of the notes of the current notes bucket last synced
+// with a provider
+func (nsr *NoteServiceRepositoryImpl) syncBasesBucket(providerName string) string {
+	return nsr.bucket + common.SYNC_BASES_BUCKET_SUFFIX + providerName
+}
+
+// SaveOutboxEntry stores a change waiting to be pushed to a sync provider (queue), replacing the pending one of the same note
+func (nsr *NoteServiceRepositoryImpl) SaveOutboxEntry(queue string, entry model.OutboxEntry) error {
+	value, err := common.MarshalJSON(entry)
+	if err != nil {
+		return err
+	}
+	return nsr.db.Update(
+		func(tx *nutsdb.Tx) error {
+			return tx.Put(nsr.outboxBucket(queue), nsr.getDBKeyFromID(entry.ID), value, 0)
+		})
+}
+
+// GetOutboxEntries retreives the changes waiting to be pushed to a sync provider (queue)
+func (nsr *NoteServiceRepositoryImpl) GetOutboxEntries(queue string) ([]model.OutboxEntry, error) {
+	outbox := []model.OutboxEntry{}
+	if err := nsr.db.View(
+		func(tx *nutsdb.Tx) error {
+			entries, err := tx.GetAll(nsr.outboxBucket(queue))
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				var outboxEntry model.OutboxEntry
+				if err := common.UnmarshalJSON(entry.Value, &outboxEntry); err != nil {
+					return err
+				}
+				outbox = append(outbox, outboxEntry)
+			}
+			return nil
+		}); err != nil {
+		if err.Error() == common.ERR_BUCKET_EMPTY {
+			return []model.OutboxEntry{}, nil
+		}
+		return nil, err
+	}
+	return outbox, nil
+}
+
+// DeleteOutboxEntries removes the changes of the given note IDs from a sync provider's queue (missing ones are ignored)
+func (nsr *NoteServiceRepositoryImpl) DeleteOutboxEntries(queue string, ids ...int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return nsr.db.Update(
+		func(tx *nutsdb.Tx) error {
+			for _, id := range ids {
+				_ = tx.Delete(nsr.outboxBucket(queue), nsr.getDBKeyFromID(id))
+			}
+			return nil
+		})
+}
+
+// outboxBucket returns the bucket holding the changes of the current notes bucket waiting to be pushed to a sync provider
+func (nsr *NoteServiceRepositoryImpl) outboxBucket(queue string) string {
+	return nsr.bucket + common.OUTBOX_BUCKET_SUFFIX + queue
 }
 
 // getDBKeyFromID returns the key formatted for nutsdb
@@ -72,6 +72,83 @@ func TestNoteServiceRepository_CRUDRoundTrip(t *testing.T) {
 	assert.False(t, exists)
 }
 
+func TestNoteServiceRepository_SetBucketIsolatesNotes(t *testing.T) {
+	repo := newTestNoteRepository(t)
+	require.NoError(t, repo.CreateNote(sampleRepoNote(1, "alpha")))
+
+	repo.SetBucket("other")
+	_, err := repo.GetAllNotes()
+	assert.Error(t, err, "a fresh bucket has no notes")
+	require.NoError(t, repo.CreateNote(sampleRepoNote(2, "beta")))
+
+	repo.SetBucket("notes")
+	allNotes, err := repo.GetAllNotes()
+	require.NoError(t, err)
+	require.Len(t, allNotes, 1)
+	assert.Equal(t, "alpha", allNotes[0].Title)
+}
+
+func TestNoteServiceRepository_Tombstones(t *testing.T) {
+	repo := newTestNoteRepository(t)
+
+	tombstones, err := repo.GetTombstones()
+	require.NoError(t, err)
+	assert.Empty(t, tombstones)
+
+	require.NoError(t, repo.SaveTombstone(model.Tombstone{ID: 1, DeletedAt: 100}))
+	require.NoError(t, repo.SaveTombstone(model.Tombstone{ID: 2, DeletedAt: 200}))
+	require.NoError(t, repo.SaveTombstone(model.Tombstone{ID: 1, DeletedAt: 300}))
+	tombstones, err = repo.GetTombstones()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []model.Tombstone{{ID: 1, DeletedAt: 300}, {ID: 2, DeletedAt: 200}}, tombstones)
+
+	// tombstones belong to the bucket of their notes
+	repo.SetBucket("other")
+	tombstones, err = repo.GetTombstones()
+	require.NoError(t, err)
+	assert.Empty(t, tombstones)
+	repo.SetBucket("notes")
+
+	require.NoError(t, repo.DeleteTombstones(1, 42))
+	tombstones, err = repo.GetTombstones()
+	require.NoError(t, err)
+	assert.Equal(t, []model.Tombstone{{ID: 2, DeletedAt: 200}}, tombstones)
+}
+
+func TestNoteServiceRepository_SyncBases(t *testing.T) {
+	repo := newTestNoteRepository(t)
+
+	bases, err := repo.GetSyncBases("google_sheets")
+	require.NoError(t, err)
+	assert.Empty(t, bases)
+
+	require.NoError(t, repo.SaveSyncBases("google_sheets", []model.Note{*sampleRepoNote(1, "alpha"), *sampleRepoNote(2, "beta")}))
+	base, err := repo.GetSyncBase("google_sheets", 2)
+	require.NoError(t, err)
+	assert.Equal(t, sampleRepoNote(2, "beta"), base)
+
+	// the bases of the notes no longer synced are dropped
+	updated := sampleRepoNote(1, "alpha")
+	updated.Content = "changed"
+	require.NoError(t, repo.SaveSyncBases("google_sheets", []model.Note{*updated}))
+	bases, err = repo.GetSyncBases("google_sheets")
+	require.NoError(t, err)
+	assert.Equal(t, []model.Note{*updated}, bases)
+	_, err = repo.GetSyncBase("google_sheets", 2)
+	assert.Error(t, err)
+
+	// each provider has its own bases
+	bases, err = repo.GetSyncBases("webdav")
+	require.NoError(t, err)
+	assert.Empty(t, bases)
+
+	// the bases belong to the bucket of their notes
+	repo.SetBucket("other")
+	bases, err = repo.GetSyncBases("google_sheets")
+	require.NoError(t, err)
+	assert.Empty(t, bases)
+}
+
 func TestNoteServiceRepository_RenameNoteAndLookupHelpers(t *testing.T) {
 	repo := newTestNoteRepository(t)
 
@@ -93,9 +170,6 @@ func TestNoteServiceRepository_RenameNoteAndLookupHelpers(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, renamed, got)
 
-	titleID := repo.GetIDFromTitle(renamed.Title)
-	assert.Equal(t, titleID, repo.GetIDFromTitle(renamed.Title))
-	assert.NotZero(t, titleID)
 	assert.Equal(t, []byte(fmt.Sprintf("%d", renamed.ID)), repo.(*NoteServiceRepositoryImpl).getDBKeyFromID(renamed.ID))
 }
 
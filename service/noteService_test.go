@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 
@@ -146,6 +147,10 @@ type ConfigServiceMockImpl struct {
 type NoteRepositoryMockImpl struct {
 	mockedNotes  []model.Note
 	mockedTitles []string
+	bucket       string
+	tombstones   map[int]model.Tombstone
+	syncBases    map[string]map[int]model.Note
+	outbox       map[string]map[int]model.OutboxEntry
 }
 
 // NewNoteRepositoryMock ....
@@ -257,9 +262,98 @@ func (nsr *NoteRepositoryMockImpl) NoteExists(id int) (bool, error) {
 	return false, nil
 }
 
-// GetIDFromTitle ....
-func (nsr *NoteRepositoryMockImpl) GetIDFromTitle(title string) int {
-	return int(cryptoUtil.IndexFromString(title))
+// SetBucket drops the notes of the previous bucket, as switching to an unused bucket would
+func (nsr *NoteRepositoryMockImpl) SetBucket(bucket string) {
+	nsr.bucket = bucket
+	nsr.mockedNotes = nil
+	nsr.tombstones = nil
+	nsr.syncBases = nil
+	nsr.outbox = nil
+}
+
+// SaveTombstone ....
+func (nsr *NoteRepositoryMockImpl) SaveTombstone(tombstone model.Tombstone) error {
+	if nsr.tombstones == nil {
+		nsr.tombstones = make(map[int]model.Tombstone)
+	}
+	nsr.tombstones[tombstone.ID] = tombstone
+	return nil
+}
+
+// GetTombstones ....
+func (nsr *NoteRepositoryMockImpl) GetTombstones() ([]model.Tombstone, error) {
+	tombstones := make([]model.Tombstone, 0, len(nsr.tombstones))
+	for _, tombstone := range nsr.tombstones {
+		tombstones = append(tombstones, tombstone)
+	}
+	return tombstones, nil
+}
+
+// DeleteTombstones ....
+func (nsr *NoteRepositoryMockImpl) DeleteTombstones(ids ...int) error {
+	for _, id := range ids {
+		delete(nsr.tombstones, id)
+	}
+	return nil
+}
+
+// SaveSyncBases ....
+func (nsr *NoteRepositoryMockImpl) SaveSyncBases(providerName string, notes []model.Note) error {
+	if nsr.syncBases == nil {
+		nsr.syncBases = make(map[string]map[int]model.Note)
+	}
+	nsr.syncBases[providerName] = make(map[int]model.Note, len(notes))
+	for _, note := range notes {
+		nsr.syncBases[providerName][note.ID] = note
+	}
+	return nil
+}
+
+// GetSyncBase ....
+func (nsr *NoteRepositoryMockImpl) GetSyncBase(providerName string, id int) (*model.Note, error) {
+	base, ok := nsr.syncBases[providerName][id]
+	if !ok {
+		return nil, errors.New(common.ERR_NOTE_NOT_FOUND)
+	}
+	return &base, nil
+}
+
+// GetSyncBases ....
+func (nsr *NoteRepositoryMockImpl) GetSyncBases(providerName string) ([]model.Note, error) {
+	bases := make([]model.Note, 0, len(nsr.syncBases[providerName]))
+	for _, base := range nsr.syncBases[providerName] {
+		bases = append(bases, base)
+	}
+	return bases, nil
+}
+
+// SaveOutboxEntry ....
+func (nsr *NoteRepositoryMockImpl) SaveOutboxEntry(queue string, entry model.OutboxEntry) error {
+	if nsr.outbox == nil {
+		nsr.outbox = make(map[string]map[int]model.OutboxEntry)
+	}
+	if nsr.outbox[queue] == nil {
+		nsr.outbox[queue] = make(map[int]model.OutboxEntry)
+	}
+	nsr.outbox[queue][entry.ID] = entry
+	return nil
+}
+
+// GetOutboxEntries ....
+func (nsr *NoteRepositoryMockImpl) GetOutboxEntries(queue string) ([]model.OutboxEntry, error) {
+	entries := make([]model.OutboxEntry, 0, len(nsr.outbox[queue]))
+	for _, entry := range nsr.outbox[queue] {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// DeleteOutboxEntries ....
+func (nsr *NoteRepositoryMockImpl) DeleteOutboxEntries(queue string, ids ...int) error {
+	for _, id := range ids {
+		delete(nsr.outbox[queue], id)
+	}
+	return nil
 }
 
 type noteConfigServiceMockImpl struct {
@@ -313,6 +407,11 @@ func (nsc *noteConfigServiceMockImpl) SetConfigBytes(key string, value []byte) e
 	panic("not implemented") // TODO: Implement
 }
 
+// DeleteConfig ....
+func (nsc *noteConfigServiceMockImpl) DeleteConfig(key string) error {
+	panic("not implemented") // TODO: Implement
+}
+
 // LoadConfig ....
 func (nsc *noteConfigServiceMockImpl) LoadConfig() error {
 	nsc.Loaded = true
@@ -391,6 +490,64 @@ func TestNoteServiceImpl_EncryptNote(t *testing.T) {
 	}
 }
 
+func TestNoteServiceImpl_EncryptNote_PaddingHidesLength(t *testing.T) {
+	ns, _ := newTestNoteService(t)
+	ns.Envelope = cryptoUtil.EnvelopeOptions{Padding: cryptoUtil.PaddingPow2}
+
+	pin := &model.Note{Title: "pin", Content: "1234"}
+	phrase := &model.Note{Title: "phrase", Content: "correct horse battery staple"}
+	require.NoError(t, ns.EncryptNote(pin))
+	require.NoError(t, ns.EncryptNote(phrase))
+	assert.Equal(t, len(pin.Content), len(phrase.Content))
+
+	require.NoError(t, ns.DecryptNote(pin))
+	assert.Equal(t, "1234", pin.Content)
+}
+
+func TestNoteServiceImpl_EncryptNote_CompressedBase64(t *testing.T) {
+	ns, _ := newTestNoteService(t)
+	ns.Envelope = cryptoUtil.EnvelopeOptions{Compress: true}
+
+	content := strings.Repeat("0123456789 ", 500)
+	note := &model.Note{Title: "big", Content: content}
+	require.NoError(t, ns.EncryptNote(note))
+	assert.True(t, strings.HasPrefix(note.Content, common.BASE64_CIPHERTEXT_PREFIX))
+	assert.Less(t, len(note.Content), len(content)/4)
+
+	require.NoError(t, ns.DecryptNote(note))
+	assert.Equal(t, content, note.Content)
+}
+
+func TestNoteServiceImpl_DecryptNote_LegacyUnpadded(t *testing.T) {
+	ns, _ := newTestNoteService(t)
+
+	// content encrypted before the envelope was introduced
+	encrypted, err := ns.Crypto.GetSrv().Encrypt([]byte("legacy content"))
+	require.NoError(t, err)
+	note := &model.Note{Title: "legacy", Content: hex.EncodeToString(encrypted), Encrypted: true}
+
+	require.NoError(t, ns.DecryptNote(note))
+	assert.Equal(t, "legacy content", note.Content)
+}
+
+func TestNoteServiceImpl_EncryptNote_PaddingFitsRSA(t *testing.T) {
+	rsaSrv := service.NewCryptoServiceRSA(service.NewKeyManagementServiceRSA())
+	key, err := rsaSrv.GetKeyManager().GenerateKey()
+	require.NoError(t, err)
+	require.NoError(t, rsaSrv.GetKeyManager().ImportKey(key, "rsaKey"))
+	ns := &service.NoteServiceImpl{
+		Crypto:   &service.CryptoServiceFactoryImpl{Srv: rsaSrv},
+		Envelope: cryptoUtil.EnvelopeOptions{Padding: cryptoUtil.PaddingPow2},
+	}
+
+	// 150 bytes fit a 2048 bit RSA key, the 256 bytes power of two bucket doesn't
+	content := strings.Repeat("x", 150)
+	note := &model.Note{Title: "long", Content: content}
+	require.NoError(t, ns.EncryptNote(note))
+	require.NoError(t, ns.DecryptNote(note))
+	assert.Equal(t, content, note.Content)
+}
+
 func TestNoteServiceImpl_CreateNote_EmitsSeparateSnapshots(t *testing.T) {
 	ns, _ := newTestNoteService(t)
 	obs := ns.Observer.(*capturingObserver)
@@ -426,7 +583,73 @@ func TestNoteServiceImpl_CreateNote_EmitsSeparateSnapshots(t *testing.T) {
 	assert.True(t, savedNote.Encrypted)
 	assert.NotEqual(t, "plain content", savedNote.Content)
 	assert.Equal(t, note.Title, decNote.Title)
-	assert.Equal(t, note.Title, savedNote.Title)
+	// titles are pushed encrypted too
+	assert.True(t, strings.HasPrefix(savedNote.Title, common.ENCRYPTED_TITLE_PREFIX))
+	assert.NotContains(t, savedNote.Title, note.Title)
+}
+
+func TestNoteServiceImpl_TitlesEncryptedAtRest(t *testing.T) {
+	ns, repo := newTestNoteService(t)
+
+	note := &model.Note{Title: "Coinbase 2FA seed", Content: "secret"}
+	require.NoError(t, ns.CreateNote(note))
+	assert.NotEqual(t, int(cryptoUtil.IndexFromString(note.Title)), note.ID, "IDs come from the blind index")
+	assert.Equal(t, note.ID, ns.GetNoteIDFromTitle(note.Title))
+
+	stored, err := repo.GetNote(note.ID)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(stored.Title, common.ENCRYPTED_TITLE_PREFIX))
+
+	loaded, err := ns.GetNoteWithContent(note.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Coinbase 2FA seed", loaded.Title)
+
+	// the index is rebuilt from the encrypted titles
+	ns.Titles = nil
+	_, err = ns.GetNotes()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Coinbase 2FA seed"}, ns.GetTitles())
+	found, err := ns.SearchNotes("coinbase", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Coinbase 2FA seed"}, found)
+
+	assert.Equal(t, common.ERR_NOTE_ALREADY_EXISTS, ns.CreateNote(&model.Note{Title: "Coinbase 2FA seed", Content: "x"}).Error())
+}
+
+func TestNoteServiceImpl_MigrateTitles(t *testing.T) {
+	ns, repo := newTestNoteService(t)
+	obs := ns.Observer.(*capturingObserver)
+	legacyID := int(cryptoUtil.IndexFromString("Legacy"))
+	legacy := model.Note{ID: legacyID, Title: "Legacy", Content: "old"}
+	require.NoError(t, ns.EncryptNote(&legacy))
+	require.NoError(t, repo.CreateNote(&legacy))
+
+	require.NoError(t, ns.MigrateTitles())
+
+	newID := ns.GetNoteIDFromTitle("Legacy")
+	assert.NotEqual(t, legacyID, newID)
+	exists, _ := repo.NoteExists(legacyID)
+	assert.False(t, exists)
+	stored, err := repo.GetNote(newID)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(stored.Title, common.ENCRYPTED_TITLE_PREFIX))
+	loaded, err := ns.GetNoteWithContent(newID)
+	require.NoError(t, err)
+	assert.Equal(t, "old", loaded.Content)
+
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	var deleted, pushed bool
+	for _, e := range obs.events {
+		switch e.event {
+		case observer.EVENT_DELETE_NOTE:
+			deleted = e.data.(*model.Note).ID == legacyID
+		case observer.EVENT_PUSH_NOTE:
+			pushed = e.args[2].(*model.Note).ID == newID
+		}
+	}
+	assert.True(t, deleted, "the plaintext copy is removed from the providers")
+	assert.True(t, pushed, "the encrypted copy is pushed to the providers")
 }
 
 func TestNoteServiceImpl_UpdateNoteContent_And_GetNoteWithContent(t *testing.T) {
@@ -494,6 +717,176 @@ func TestNoteServiceImpl_DeleteNote_RemovesNoteAndTitle(t *testing.T) {
 	assert.False(t, exists)
 }
 
+func TestNoteServiceImpl_DeleteNote_RecordsTombstone(t *testing.T) {
+	ns, repo := newTestNoteService(t)
+	obs := ns.Observer.(*capturingObserver)
+
+	note := &model.Note{Title: "Delete Me", Content: "Some content"}
+	require.NoError(t, ns.CreateNote(note))
+	require.NoError(t, ns.DeleteNote(note.ID))
+
+	tombstones, err := ns.GetTombstones()
+	require.NoError(t, err)
+	require.Len(t, tombstones, 1)
+	assert.Equal(t, note.ID, tombstones[0].ID)
+	assert.InDelta(t, common.GetCurrentTimestamp(), tombstones[0].DeletedAt, 2500)
+
+	// the sync providers get the same tombstone
+	obs.mu.Lock()
+	var deleted *capturedNotification
+	for i, e := range obs.events {
+		if e.event == observer.EVENT_DELETE_NOTE {
+			deleted = &obs.events[i]
+		}
+	}
+	obs.mu.Unlock()
+	require.NotNil(t, deleted)
+	require.Len(t, deleted.args, 3)
+	assert.Equal(t, tombstones[0], deleted.args[2])
+
+	// recreating the note supersedes the deletion
+	require.NoError(t, ns.CreateNote(&model.Note{Title: "Delete Me", Content: "again"}))
+	assert.Empty(t, repo.tombstones)
+}
+
+func TestNoteServiceImpl_UpdateNoteTitle_TombstonesOldID(t *testing.T) {
+	ns, _ := newTestNoteService(t)
+
+	note := &model.Note{Title: "Old Title", Content: "Some content"}
+	require.NoError(t, ns.CreateNote(note))
+	oldID := note.ID
+	newID, err := ns.UpdateNoteTitle("Old Title", "New Title")
+	require.NoError(t, err)
+
+	tombstones, err := ns.GetTombstones()
+	require.NoError(t, err)
+	require.Len(t, tombstones, 1)
+	assert.Equal(t, oldID, tombstones[0].ID)
+	assert.NotEqual(t, newID, tombstones[0].ID)
+}
+
+func TestNoteServiceImpl_ApplyRemoteDeletes_And_PurgeTombstones(t *testing.T) {
+	ns, repo := newTestNoteService(t)
+	obs := ns.Observer.(*capturingObserver)
+
+	keep := &model.Note{Title: "Keep", Content: "content"}
+	drop := &model.Note{Title: "Drop", Content: "content"}
+	require.NoError(t, ns.CreateNote(keep))
+	require.NoError(t, ns.CreateNote(drop))
+	obs.mu.Lock()
+	obs.events = nil
+	obs.mu.Unlock()
+
+	require.NoError(t, ns.ApplyRemoteDeletes([]model.Tombstone{
+		{ID: drop.ID, DeletedAt: 100},
+		{ID: 999, DeletedAt: 300},
+	}))
+	assert.Equal(t, []string{"Keep"}, ns.GetTitles())
+	exists, _ := repo.NoteExists(drop.ID)
+	assert.False(t, exists)
+	// remote deletions are not handed back to the sync providers
+	obs.mu.Lock()
+	for _, e := range obs.events {
+		assert.NotEqual(t, observer.EVENT_DELETE_NOTE, e.event)
+	}
+	obs.mu.Unlock()
+
+	require.NoError(t, ns.PurgeTombstones(200))
+	tombstones, err := ns.GetTombstones()
+	require.NoError(t, err)
+	assert.Equal(t, []model.Tombstone{{ID: 999, DeletedAt: 300}}, tombstones)
+
+	// the UI is told which of its notes are gone
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	var deleted []interface{}
+	for _, e := range obs.events {
+		if e.event == observer.EVENT_REMOTE_DELETE_NOTE {
+			deleted = append(deleted, e.data)
+		}
+	}
+	assert.Equal(t, []interface{}{model.Tombstone{ID: drop.ID, DeletedAt: 100}}, deleted)
+}
+
+// remoteVersion returns an encrypted copy of a note, as another device would push it
+func remoteVersion(t *testing.T, ns *service.NoteServiceImpl, id int, title, content string) model.Note {
+	t.Helper()
+	remote := model.Note{ID: id, Title: title, Content: content, UpdatedAt: common.GetCurrentTimestamp()}
+	require.NoError(t, ns.EncryptNote(&remote))
+	return remote
+}
+
+func TestNoteServiceImpl_MergeConflicts(t *testing.T) {
+	ns, repo := newTestNoteService(t)
+	obs := ns.Observer.(*capturingObserver)
+
+	note := &model.Note{Title: "Shopping", Content: "milk\neggs\nbread\n"}
+	require.NoError(t, ns.CreateNote(note))
+	base, err := repo.GetNote(note.ID)
+	require.NoError(t, err)
+	require.NoError(t, ns.SaveSyncBases("google_sheets", []model.Note{*base}))
+	bases, err := ns.GetSyncBases("google_sheets")
+	require.NoError(t, err)
+	assert.Equal(t, map[int]int64{note.ID: base.UpdatedAt}, bases)
+
+	t.Run("changes to different lines are merged", func(t *testing.T) {
+		local := &model.Note{ID: note.ID, Title: "Shopping", Content: "oat milk\neggs\nbread\n"}
+		require.NoError(t, ns.UpdateNoteContent(local))
+		remote := remoteVersion(t, ns, note.ID, "Shopping", "milk\neggs\nbread\nbutter\n")
+
+		merged, err := ns.MergeConflicts("google_sheets", []model.Note{remote})
+		require.NoError(t, err)
+		require.Len(t, merged, 1)
+		assert.Greater(t, merged[0].UpdatedAt, local.UpdatedAt-1)
+
+		got, err := ns.GetNoteWithContent(note.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "oat milk\neggs\nbread\nbutter\n", got.Content)
+		assert.Equal(t, []string{"Shopping"}, ns.GetTitles())
+	})
+
+	t.Run("changes to the same line make a conflicted copy", func(t *testing.T) {
+		current, err := repo.GetNote(note.ID)
+		require.NoError(t, err)
+		require.NoError(t, ns.SaveSyncBases("google_sheets", []model.Note{*current}))
+		local := &model.Note{ID: note.ID, Title: "Shopping", Content: "soy milk\neggs\nbread\nbutter\n"}
+		require.NoError(t, ns.UpdateNoteContent(local))
+		remote := remoteVersion(t, ns, note.ID, "Shopping", "almond milk\neggs\nbread\nbutter\n")
+		obs.mu.Lock()
+		obs.events = nil
+		obs.mu.Unlock()
+
+		_, err = ns.MergeConflicts("google_sheets", []model.Note{remote})
+		require.NoError(t, err)
+
+		got, err := ns.GetNoteWithContent(note.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "soy milk\neggs\nbread\nbutter\n", got.Content)
+		titles := ns.GetTitles()
+		require.Len(t, titles, 2)
+
+		obs.mu.Lock()
+		defer obs.mu.Unlock()
+		var conflict *model.NoteConflict
+		pushed := 0
+		for _, e := range obs.events {
+			switch e.event {
+			case observer.EVENT_NOTE_CONFLICT:
+				conflict = e.data.(*model.NoteConflict)
+			case observer.EVENT_PUSH_NOTE:
+				pushed++
+			}
+		}
+		require.NotNil(t, conflict)
+		assert.Equal(t, "Shopping", conflict.Note.Title)
+		assert.True(t, strings.HasPrefix(conflict.Copy.Title, "Shopping (conflicted copy "))
+		assert.Equal(t, "almond milk\neggs\nbread\nbutter\n", conflict.Copy.Content)
+		assert.Contains(t, titles, conflict.Copy.Title)
+		// both the kept note and the copy are handed over to the sync providers
+		assert.Equal(t, 2, pushed)
+	})
+}
+
 func TestNoteServiceImpl_SaveEncryptedNotes_AppendsAndRefreshesTitles(t *testing.T) {
 	ns, _ := newTestNoteService(t)
 
@@ -513,6 +906,67 @@ func TestNoteServiceImpl_SaveEncryptedNotes_AppendsAndRefreshesTitles(t *testing
 	assert.Len(t, saved, 2)
 }
 
+func TestNoteServiceImpl_SaveEncryptedNotes_EmitsRemoteUpdates(t *testing.T) {
+	ns, _ := newTestNoteService(t)
+	obs := ns.Observer.(*capturingObserver)
+	assert.True(t, ns.CanSync())
+
+	note := &model.Note{Title: "Remote", Content: "v1"}
+	require.NoError(t, ns.CreateNote(note))
+	remote := remoteVersion(t, ns, note.ID, "Remote", "v2")
+	obs.mu.Lock()
+	obs.events = nil
+	obs.mu.Unlock()
+
+	require.NoError(t, ns.SaveEncryptedNotes([]model.Note{remote}))
+
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	var updated []*model.Note
+	for _, e := range obs.events {
+		if e.event == observer.EVENT_REMOTE_UPDATE_NOTE {
+			updated = append(updated, e.data.(*model.Note))
+		}
+	}
+	require.Len(t, updated, 1)
+	assert.Equal(t, note.ID, updated[0].ID)
+	assert.Equal(t, "Remote", updated[0].Title)
+	assert.Equal(t, "v2", updated[0].Content, "the UI gets the decrypted note")
+}
+
+func TestNoteServiceImpl_SwitchVault_LocalOnly(t *testing.T) {
+	ns, repo := newTestNoteService(t)
+	obs := ns.Observer.(*capturingObserver)
+	require.NoError(t, ns.CreateNote(&model.Note{Title: "Real Note", Content: "real"}))
+
+	require.NoError(t, ns.SwitchVault(common.DECOY_NOTES_BUCKET, true))
+	assert.Equal(t, common.DECOY_NOTES_BUCKET, repo.bucket)
+	assert.Empty(t, ns.GetTitles())
+	assert.False(t, ns.CanSync(), "a local-only vault is never synced")
+
+	// downloaded notes must never land in the decoy vault
+	require.NoError(t, ns.SaveEncryptedNotes([]model.Note{{ID: 300, Title: "Remote", Content: "x"}}))
+	assert.Empty(t, ns.GetTitles())
+
+	obs.mu.Lock()
+	obs.events = nil
+	obs.mu.Unlock()
+	note := &model.Note{Title: "Decoy Note", Content: "decoy"}
+	require.NoError(t, ns.CreateNote(note))
+	require.NoError(t, ns.DeleteNote(note.ID))
+
+	assert.Empty(t, repo.tombstones, "a local-only vault keeps no tombstones")
+
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	for _, e := range obs.events {
+		assert.NotEqual(t, observer.EVENT_DELETE_NOTE, e.event)
+		if e.event == observer.EVENT_CREATE_NOTE {
+			assert.Len(t, e.args, 2, "no saved note means nothing to push")
+		}
+	}
+}
+
 func TestNoteServiceImpl_ReEncryptNotes_MigratesEncryptedNotes(t *testing.T) {
 	ns, _ := newTestNoteService(t)
 
@@ -540,9 +994,65 @@ func TestNoteServiceImpl_ReEncryptNotes_MigratesEncryptedNotes(t *testing.T) {
 	assert.Equal(t, "newKey", rotated[0].EncKeyName)
 	assert.NotEqual(t, oldEncryptedContent, rotated[0].Content)
 
-	decrypted, err := ns.GetNoteWithContent(note.ID)
+	// the note moved to the blind index of its title under the new key
+	newID := ns.GetNoteIDFromTitle("Rotate Me")
+	assert.NotEqual(t, note.ID, newID)
+	assert.Equal(t, newID, rotated[0].ID)
+	decrypted, err := ns.GetNoteWithContent(newID)
 	require.NoError(t, err)
 	assert.Equal(t, "Top secret content", decrypted.Content)
+
+	// the same title created on another device with the new key gets the same ID
+	other, _ := newTestNoteService(t)
+	require.NoError(t, other.ReEncryptNotes(nil, newCert))
+	assert.Equal(t, newID, other.GetNoteIDFromTitle("Rotate Me"))
+
+	// the old ID is announced as deleted
+	tombstones, err := ns.GetTombstones()
+	require.NoError(t, err)
+	require.Len(t, tombstones, 1)
+	assert.Equal(t, note.ID, tombstones[0].ID)
+}
+
+func TestNoteServiceImpl_GetNotes_SkipsUndecryptableTitles(t *testing.T) {
+	ns, repo := newTestNoteService(t)
+	require.NoError(t, ns.CreateNote(&model.Note{Title: "Readable", Content: "readable"}))
+	// a note sealed with another key
+	other, _ := newTestNoteService(t)
+	require.NoError(t, other.Crypto.GetSrv().GetKeyManager().ImportKey([]byte("6543210987654321"), "testKey2"))
+	foreign := &model.Note{Title: "Foreign", Content: "foreign"}
+	require.NoError(t, other.CreateNote(foreign))
+	stored, err := other.GetStoredNotes()
+	require.NoError(t, err)
+	require.NoError(t, repo.CreateNote(&stored[0]))
+
+	notes, err := ns.GetNotes()
+	require.NoError(t, err)
+	assert.Len(t, notes, 2)
+	assert.Equal(t, []string{"Readable"}, ns.GetTitles())
+	results, err := ns.SearchNotes("enc", true)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+func TestNoteServiceImpl_GetStoredNotes_NoSideEffects(t *testing.T) {
+	ns, _ := newTestNoteService(t)
+	require.NoError(t, ns.CreateNote(&model.Note{Title: "Stored", Content: "stored"}))
+	_, err := ns.SearchNotes("Sto", true)
+	require.NoError(t, err)
+	obs := ns.Observer.(*capturingObserver)
+	obs.mu.Lock()
+	obs.events = nil
+	obs.mu.Unlock()
+
+	notes, err := ns.GetStoredNotes()
+	require.NoError(t, err)
+	require.Len(t, notes, 1)
+	assert.True(t, strings.HasPrefix(notes[0].Title, common.ENCRYPTED_TITLE_PREFIX))
+	assert.Equal(t, []string{"Stored"}, ns.GetTitles())
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	assert.Empty(t, obs.events)
 }
 
 // TestNoteServiceImpl_SearchNotes ....
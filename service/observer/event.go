@@ -8,4 +8,26 @@ const (
 	EVENT_CREATE_NOTE        Event = "create_note"
 	EVENT_CREATE_NOTE_WINDOW Event = "create_note_window"
 	EVENT_DELETE_NOTE        Event = "delete_note"
+	// EVENT_PUSH_NOTE a stored note changed without user interaction (eg. a migration): only the sync providers listen to it
+	EVENT_PUSH_NOTE Event = "push_note"
+	// EVENT_NOTE_CONFLICT the sync couldn't merge the local and remote changes to a note and saved a conflicted copy
+	EVENT_NOTE_CONFLICT Event = "note_conflict"
+	// EVENT_SYNC_PENDING the number of changes waiting to be pushed to a sync provider (its queue depth) changed
+	// (data: count, args[0]: provider)
+	EVENT_SYNC_PENDING Event = "sync_pending"
+	// EVENT_SYNC_STARTED a sync with the active providers started (data: *model.SyncEvent)
+	EVENT_SYNC_STARTED Event = "sync_started"
+	// EVENT_SYNC_PROGRESS a sync is done with a provider, successfully or not (data: *model.SyncEvent)
+	EVENT_SYNC_PROGRESS Event = "sync_progress"
+	// EVENT_SYNC_COMPLETED a sync ended, or the background worker of a provider pushed the local changes
+	// (data: *model.SyncEvent, whose Err joins the errors of the providers that failed)
+	EVENT_SYNC_COMPLETED Event = "sync_completed"
+	// EVENT_SYNC_FAILED a provider couldn't be set up, synced or pushed to (data: *model.SyncEvent)
+	EVENT_SYNC_FAILED Event = "sync_failed"
+	// EVENT_SYNC_REQUESTED the user asked to sync the notes with the providers now
+	EVENT_SYNC_REQUESTED Event = "sync_requested"
+	// EVENT_REMOTE_UPDATE_NOTE a note changed on another device has been saved (data: the decrypted note)
+	EVENT_REMOTE_UPDATE_NOTE Event = "remote_update_note"
+	// EVENT_REMOTE_DELETE_NOTE a note deleted on another device has been deleted (data: its tombstone)
+	EVENT_REMOTE_DELETE_NOTE Event = "remote_delete_note"
 )
@@ -0,0 +1,251 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/p2p"
+	"github.com/iltoga/ecnotes-go/provider"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// peerPairingTTL how long a device waits for the other one to enter the pairing code
+	peerPairingTTL = 5 * time.Minute
+	// peerDiscoveryInterval how often the paired devices are looked for on the network, when mDNS is enabled
+	peerDiscoveryInterval = 5 * time.Minute
+	// peerDiscoveryTimeout how long the devices have to answer
+	peerDiscoveryTimeout = 3 * time.Second
+	// peersFileName the file holding the paired devices, in the p2p directory
+	peersFileName = "peers.json"
+)
+
+// PeerService pairs the device with the others on the local network, and syncs the notes with them without any
+// third party (see package p2p)
+type PeerService interface {
+	// Fingerprint returns the fingerprint of the device certificate, formatted to be compared by a person
+	Fingerprint() string
+	// Port returns the port the device listens on for the paired devices, 0 until started
+	Port() int
+	// Peers returns the paired devices
+	Peers() []p2p.Peer
+	// StartPairing waits for a device to pair for a few minutes, and returns the code to enter on it
+	StartPairing() (string, error)
+	// Pair pairs with the device waiting at address, which shows code
+	Pair(ctx context.Context, address string, code string) (*p2p.Peer, error)
+	// Discover returns the address of the devices announcing themselves on the network, by fingerprint
+	Discover(ctx context.Context) (map[string]string, error)
+	// Start serves the paired devices and syncs the notes with them, until ctx is done
+	Start(ctx context.Context) error
+}
+
+// PeerServiceImpl ....
+type PeerServiceImpl struct {
+	configService ConfigService
+	syncService   SyncService
+	observer      observer.Observer
+	logger        *log.Logger
+	identity      *p2p.Identity
+	peers         *p2p.Peers
+	server        *p2p.Server
+	// port the port the device listens on, once started
+	port    int
+	portMux sync.RWMutex
+}
+
+// NewPeerService loads the device certificate (created at the first run) and the paired devices from the p2p directory.
+// The notes of noteService are synced with the paired devices through syncService
+func NewPeerService(
+	configService ConfigService,
+	noteService NoteService,
+	syncService SyncService,
+	observer observer.Observer,
+	logger *log.Logger,
+) (PeerService, error) {
+	dir, err := configService.GetConfig(common.CONFIG_P2P_PATH)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := p2p.LoadIdentity(dir)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := p2p.LoadPeers(filepath.Join(dir, peersFileName))
+	if err != nil {
+		return nil, err
+	}
+	ps := &PeerServiceImpl{
+		configService: configService,
+		syncService:   syncService,
+		observer:      observer,
+		logger:        logger,
+		identity:      identity,
+		peers:         peers,
+	}
+	ps.server = p2p.NewServer(identity, peers, noteService, ps.deviceName(), logger)
+	ps.server.OnPaired(ps.paired)
+	return ps, nil
+}
+
+// PeerSyncEnabled tells whether the notes are synced with the paired devices
+func PeerSyncEnabled(configService ConfigService) bool {
+	val, err := configService.GetConfig(common.CONFIG_P2P_ENABLED)
+	return err == nil && strings.EqualFold(val, "true")
+}
+
+// Fingerprint returns the fingerprint of the device certificate, formatted to be compared by a person
+func (ps *PeerServiceImpl) Fingerprint() string {
+	return p2p.FormatFingerprint(ps.identity.Fingerprint)
+}
+
+// Port returns the port the device listens on for the paired devices, 0 until started
+func (ps *PeerServiceImpl) Port() int {
+	ps.portMux.RLock()
+	defer ps.portMux.RUnlock()
+	return ps.port
+}
+
+// Peers returns the paired devices
+func (ps *PeerServiceImpl) Peers() []p2p.Peer {
+	return ps.peers.List()
+}
+
+// StartPairing waits for a device to pair, and returns the code to enter on it
+func (ps *PeerServiceImpl) StartPairing() (string, error) {
+	if ps.Port() == 0 {
+		return "", errors.New(common.ERR_PEER_SYNC_NOT_STARTED)
+	}
+	return ps.server.StartPairing(peerPairingTTL)
+}
+
+// Pair pairs with the device waiting at address, and syncs the notes with it
+func (ps *PeerServiceImpl) Pair(ctx context.Context, address string, code string) (*p2p.Peer, error) {
+	peer, err := p2p.Pair(ctx, ps.identity, address, code, ps.deviceName(), ps.Port())
+	if err != nil {
+		return nil, err
+	}
+	if err := ps.peers.Add(*peer); err != nil {
+		return nil, err
+	}
+	ps.logger.Infof("Paired with %s (%s)", peer.Name, p2p.FormatFingerprint(peer.Fingerprint))
+	ps.paired(*peer)
+	return peer, nil
+}
+
+// Discover returns the address of the devices announcing themselves on the network, by fingerprint
+func (ps *PeerServiceImpl) Discover(ctx context.Context) (map[string]string, error) {
+	return p2p.Discover(ctx, peerDiscoveryTimeout)
+}
+
+// Start listens for the paired devices, announces the device on the network if mDNS is enabled, and hands the paired
+// devices over to the sync service
+func (ps *PeerServiceImpl) Start(ctx context.Context) error {
+	listenAddr := common.DEFAULT_P2P_LISTEN_ADDR
+	if val, err := ps.configService.GetConfig(common.CONFIG_P2P_LISTEN_ADDR); err == nil && val != "" {
+		listenAddr = val
+	}
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	ps.portMux.Lock()
+	ps.port = port
+	ps.portMux.Unlock()
+	go func() {
+		if err := ps.server.Serve(ctx, listener); err != nil {
+			ps.logger.Errorf("Error serving the paired devices: %v", err)
+		}
+	}()
+	ps.logger.Infof("Listening for the paired devices on %s (fingerprint %s)", listener.Addr(), ps.Fingerprint())
+
+	for _, peer := range ps.peers.List() {
+		ps.addProvider(peer)
+	}
+	if ps.mdnsEnabled() {
+		go func() {
+			if err := p2p.Announce(ctx, ps.identity.Fingerprint, port, ps.logger); err != nil {
+				ps.logger.Errorf("Error announcing the device with mDNS: %v", err)
+			}
+		}()
+		go ps.runDiscovery(ctx)
+	}
+	return nil
+}
+
+// paired syncs the notes with a device that just paired
+func (ps *PeerServiceImpl) paired(peer p2p.Peer) {
+	ps.addProvider(peer)
+	ps.observer.Notify(observer.EVENT_SYNC_REQUESTED, nil)
+}
+
+// addProvider hands a paired device over to the sync service, unless it already syncs with it
+func (ps *PeerServiceImpl) addProvider(peer p2p.Peer) {
+	// the provider gets a detached observer: note titles must reach the UI only through NoteService
+	p := provider.NewPeerProvider(ps.identity, ps.peers, peer.Fingerprint, ps.logger, &observer.ObserverImpl{})
+	for _, active := range ps.syncService.Providers() {
+		if active.Name() == p.Name() {
+			return
+		}
+	}
+	if err := p.Init(); err != nil {
+		ps.logger.Errorf("Error activating the sync with %s: %v", peer.Name, err)
+		return
+	}
+	ps.syncService.AddProvider(p)
+	ps.logger.Infof("Notes will be synced with %s", peer.Name)
+}
+
+// runDiscovery updates the address of the paired devices found on the network, every peerDiscoveryInterval,
+// until ctx is done
+func (ps *PeerServiceImpl) runDiscovery(ctx context.Context) {
+	ticker := time.NewTicker(peerDiscoveryInterval)
+	defer ticker.Stop()
+	for {
+		found, err := ps.Discover(ctx)
+		if err != nil && ctx.Err() == nil {
+			ps.logger.Errorf("Error looking for the paired devices: %v", err)
+		}
+		for fingerprint, address := range found {
+			peer, ok := ps.peers.Get(fingerprint)
+			if !ok || peer.Address == address {
+				continue
+			}
+			if err := ps.peers.SetAddress(fingerprint, address); err != nil {
+				ps.logger.Errorf("Error saving the address of %s: %v", peer.Name, err)
+				continue
+			}
+			ps.logger.Infof("%s found at %s", peer.Name, address)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deviceName returns the name of the device shown to the devices pairing with it: the configured one, or the host name
+func (ps *PeerServiceImpl) deviceName() string {
+	if val, err := ps.configService.GetConfig(common.CONFIG_P2P_DEVICE_NAME); err == nil && val != "" {
+		return val
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return "ecnotes"
+}
+
+// mdnsEnabled tells whether the device announces itself on the network and looks for the paired devices with mDNS
+func (ps *PeerServiceImpl) mdnsEnabled() bool {
+	val, err := ps.configService.GetConfig(common.CONFIG_P2P_MDNS)
+	return err == nil && strings.EqualFold(val, "true")
+}
@@ -0,0 +1,405 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/provider"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	log "github.com/sirupsen/logrus"
+)
+
+// syncPollInterval how often the sync loop checks whether the vault has been unlocked
+const syncPollInterval = 5 * time.Second
+
+// SyncService keeps the open vault in sync with the active sync providers
+type SyncService interface {
+	// AddProvider activates a provider. Providers pushing in the background must be added before Start
+	AddProvider(p provider.SyncNoteProvider)
+	// Providers returns the active providers
+	Providers() []provider.SyncNoteProvider
+	// Sync syncs the open vault with all the active providers, one after the other
+	Sync(ctx context.Context) error
+	// PlanSync returns what a sync would do with each active provider, without changing anything (dry run)
+	PlanSync(ctx context.Context) ([]*provider.SyncPlan, error)
+	// ApplyPlan syncs the open vault with the provider of a plan returned by PlanSync, provided that the sync would
+	// still do what the plan says: ERR_SYNC_PLAN_OUTDATED otherwise
+	ApplyPlan(ctx context.Context, plan *provider.SyncPlan) error
+	// WaitUnlocked blocks until the open vault can be synced, or ctx is done. The credentials of the providers can't
+	// be read before
+	WaitUnlocked(ctx context.Context) error
+	// Start starts pushing the local changes to the providers, and syncing as soon as the vault is unlocked,
+	// then periodically and on request, until ctx is done
+	Start(ctx context.Context)
+	// SyncRequestedListener returns the listener queueing a sync when the user asks for it
+	SyncRequestedListener() observer.Listener
+}
+
+// SyncServiceImpl ....
+type SyncServiceImpl struct {
+	noteService   NoteService
+	configService ConfigService
+	observer      observer.Observer
+	logger        *log.Logger
+	providers     []provider.SyncNoteProvider
+	providersMux  sync.RWMutex
+	// syncMux one sync at a time
+	syncMux      sync.Mutex
+	syncNow      chan struct{}
+	pollInterval time.Duration
+}
+
+// NewSyncService ....
+func NewSyncService(
+	noteService NoteService,
+	configService ConfigService,
+	observer observer.Observer,
+	logger *log.Logger,
+) SyncService {
+	return &SyncServiceImpl{
+		noteService:   noteService,
+		configService: configService,
+		observer:      observer,
+		logger:        logger,
+		syncNow:       make(chan struct{}, 1),
+		pollInterval:  syncPollInterval,
+	}
+}
+
+// SyncProviderNames returns the provider types listed (comma separated) in the config.
+// Configs written before providers were selectable sync with Google Sheets when a sheet is set
+func SyncProviderNames(configService ConfigService) []string {
+	val, err := configService.GetConfig(common.CONFIG_SYNC_PROVIDERS)
+	if err != nil {
+		if _, err := configService.GetConfig(common.CONFIG_GOOGLE_SHEET_ID); err == nil {
+			return []string{provider.GoogleProviderName}
+		}
+		return nil
+	}
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(val, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// AddProvider activates a provider
+func (s *SyncServiceImpl) AddProvider(p provider.SyncNoteProvider) {
+	s.providersMux.Lock()
+	defer s.providersMux.Unlock()
+	s.providers = append(s.providers, p)
+}
+
+// Providers returns the active providers
+func (s *SyncServiceImpl) Providers() []provider.SyncNoteProvider {
+	s.providersMux.RLock()
+	defer s.providersMux.RUnlock()
+	return append([]provider.SyncNoteProvider(nil), s.providers...)
+}
+
+// Start hands the local changes over to the providers that push them in the background, and starts the sync loop
+func (s *SyncServiceImpl) Start(ctx context.Context) {
+	for _, p := range s.Providers() {
+		if !p.Capabilities().Has(provider.CapabilityBackgroundPush) {
+			continue
+		}
+		s.observer.AddListener(observer.EVENT_CREATE_NOTE, p.UpdateNoteNotifier())
+		s.observer.AddListener(observer.EVENT_UPDATE_NOTE, p.UpdateNoteNotifier())
+		s.observer.AddListener(observer.EVENT_DELETE_NOTE, p.DeleteNoteNotifier())
+		s.observer.AddListener(observer.EVENT_PUSH_NOTE, p.UpdateNoteNotifier())
+		p.InitWorker(ctx)
+	}
+	s.observer.AddListener(observer.EVENT_SYNC_REQUESTED, s.SyncRequestedListener())
+	go s.run(ctx, s.syncInterval())
+}
+
+// SyncRequestedListener queues a sync. Requests made while a sync is queued are merged
+func (s *SyncServiceImpl) SyncRequestedListener() observer.Listener {
+	return observer.Listener{
+		OnNotify: func(data interface{}, args ...interface{}) {
+			select {
+			case s.syncNow <- struct{}{}:
+			default:
+			}
+		},
+	}
+}
+
+// run syncs as soon as the vault can be synced, then every interval (if > 0) and on request, until ctx is done
+func (s *SyncServiceImpl) run(ctx context.Context, interval time.Duration) {
+	// the notes can't be synced until the user unlocks the vault
+	if s.waitUnlocked(ctx, s.syncNow) != nil {
+		return
+	}
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		if err := s.Sync(ctx); err != nil && ctx.Err() == nil {
+			s.logger.Errorf("Error syncing notes: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case <-s.syncNow:
+		}
+	}
+}
+
+// WaitUnlocked blocks until the vault is unlocked
+func (s *SyncServiceImpl) WaitUnlocked(ctx context.Context) error {
+	return s.waitUnlocked(ctx, nil)
+}
+
+// waitUnlocked checks whether the vault can be synced every poll interval, and whenever wake receives
+func (s *SyncServiceImpl) waitUnlocked(ctx context.Context, wake <-chan struct{}) error {
+	poll := time.NewTicker(s.pollInterval)
+	defer poll.Stop()
+	for !s.noteService.CanSync() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-poll.C:
+		case <-wake:
+		}
+	}
+	return nil
+}
+
+// Sync syncs the open vault with the active providers. A failing provider doesn't stop the others
+func (s *SyncServiceImpl) Sync(ctx context.Context) error {
+	s.syncMux.Lock()
+	defer s.syncMux.Unlock()
+	if !s.noteService.CanSync() {
+		return nil
+	}
+	err := s.syncProviders(ctx, s.Providers())
+	// garbage-collect the tombstones older than the configured horizon
+	if err := s.noteService.PurgeTombstones(s.tombstoneHorizon()); err != nil {
+		s.logger.Errorf("Error purging local tombstones: %v", err)
+	}
+	return err
+}
+
+// syncProviders syncs the open vault with the given providers, one after the other, and tells the observer how it
+// goes. A failing provider doesn't stop the others
+func (s *SyncServiceImpl) syncProviders(ctx context.Context, providers []provider.SyncNoteProvider) error {
+	total := len(providers)
+	s.observer.Notify(observer.EVENT_SYNC_STARTED, &model.SyncEvent{Total: total, At: common.GetCurrentTimestamp()})
+	errs := make([]error, 0)
+	for i, p := range providers {
+		err := s.syncProvider(ctx, p)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+			s.observer.Notify(observer.EVENT_SYNC_FAILED, &model.SyncEvent{
+				Provider: p.Name(), Done: i + 1, Total: total, At: common.GetCurrentTimestamp(), Err: err,
+			})
+		}
+		s.observer.Notify(observer.EVENT_SYNC_PROGRESS, &model.SyncEvent{
+			Provider: p.Name(), Done: i + 1, Total: total, At: common.GetCurrentTimestamp(), Err: err,
+		})
+	}
+	err := errors.Join(errs...)
+	s.observer.Notify(observer.EVENT_SYNC_COMPLETED, &model.SyncEvent{
+		Done: total, Total: total, At: common.GetCurrentTimestamp(), Err: err,
+	})
+	return err
+}
+
+// PlanSync plans the sync with each active provider. A failing provider doesn't stop the others.
+// A local-only vault is never synced: its plans are empty, as if it were in sync, so that it can't be told apart
+func (s *SyncServiceImpl) PlanSync(ctx context.Context) ([]*provider.SyncPlan, error) {
+	s.syncMux.Lock()
+	defer s.syncMux.Unlock()
+	if s.noteService.IsLocalOnly() {
+		plans := make([]*provider.SyncPlan, 0)
+		for _, p := range s.Providers() {
+			plans = append(plans, &provider.SyncPlan{Provider: p.Name(), PlannedAt: common.GetCurrentTimestamp()})
+		}
+		return plans, nil
+	}
+	if !s.noteService.CanSync() {
+		return nil, errors.New(common.ERR_VAULT_LOCKED)
+	}
+	plans := make([]*provider.SyncPlan, 0)
+	errs := make([]error, 0)
+	for _, p := range s.Providers() {
+		plan, err := s.planProvider(ctx, p)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+			continue
+		}
+		plans = append(plans, plan)
+	}
+	return plans, errors.Join(errs...)
+}
+
+// ApplyPlan plans the sync with the provider of plan again, and syncs only if nothing changed in the meantime.
+// Nothing is applied to a local-only vault
+func (s *SyncServiceImpl) ApplyPlan(ctx context.Context, plan *provider.SyncPlan) error {
+	s.syncMux.Lock()
+	defer s.syncMux.Unlock()
+	if s.noteService.IsLocalOnly() {
+		return nil
+	}
+	if !s.noteService.CanSync() {
+		return errors.New(common.ERR_VAULT_LOCKED)
+	}
+	var p provider.SyncNoteProvider
+	for _, active := range s.Providers() {
+		if active.Name() == plan.Provider {
+			p = active
+			break
+		}
+	}
+	if p == nil {
+		return fmt.Errorf("%s: %s", common.ERR_SYNC_PROVIDER_NOT_ACTIVE, plan.Provider)
+	}
+	current, err := s.planProvider(ctx, p)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.Name(), err)
+	}
+	if !current.Matches(plan) {
+		return fmt.Errorf("%s: %s", p.Name(), common.ERR_SYNC_PLAN_OUTDATED)
+	}
+	return s.syncProviders(ctx, []provider.SyncNoteProvider{p})
+}
+
+// planProvider plans the sync with a provider, with the titles of the local notes
+func (s *SyncServiceImpl) planProvider(ctx context.Context, p provider.SyncNoteProvider) (*provider.SyncPlan, error) {
+	dbNotes, dbTombstones, bases, err := s.localState(p)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := provider.PlanSync(ctx, p, dbNotes, dbTombstones, bases)
+	if err != nil {
+		return nil, err
+	}
+	// GetNotes has indexed the decrypted titles
+	titles := make(map[int]string, len(dbNotes))
+	for _, title := range s.noteService.GetTitles() {
+		titles[s.noteService.GetNoteIDFromTitle(title)] = title
+	}
+	plan.SetTitles(titles)
+	return plan, nil
+}
+
+// localState returns the local notes, and the tombstones and the last synced versions if the provider uses them
+func (s *SyncServiceImpl) localState(p provider.SyncNoteProvider) ([]model.Note, []model.Tombstone, map[int]int64, error) {
+	capabilities := p.Capabilities()
+	dbNotes, err := s.noteService.GetNotes()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("fetching local notes: %w", err)
+	}
+	var dbTombstones []model.Tombstone
+	if capabilities.Has(provider.CapabilityTombstones) {
+		if dbTombstones, err = s.noteService.GetTombstones(); err != nil {
+			return nil, nil, nil, fmt.Errorf("fetching local tombstones: %w", err)
+		}
+	}
+	var bases map[int]int64
+	if capabilities.Has(provider.CapabilityMerge) {
+		if bases, err = s.noteService.GetSyncBases(p.Name()); err != nil {
+			return nil, nil, nil, fmt.Errorf("fetching the last synced notes: %w", err)
+		}
+	}
+	return dbNotes, dbTombstones, bases, nil
+}
+
+// syncProvider pulls the remote changes from a provider into the open vault, and pushes the local ones
+func (s *SyncServiceImpl) syncProvider(ctx context.Context, p provider.SyncNoteProvider) error {
+	s.logger.Infof("Syncing notes with %s...", p.Name())
+	capabilities := p.Capabilities()
+	dbNotes, dbTombstones, bases, err := s.localState(p)
+	if err != nil {
+		return err
+	}
+	result, err := p.SyncNotes(ctx, dbNotes, dbTombstones, bases)
+	if err != nil {
+		return err
+	}
+	// if downloaded notes are not empty, update db with downloaded notes
+	if len(result.Downloaded) > 0 {
+		if err = s.noteService.SaveEncryptedNotes(result.Downloaded); err != nil {
+			return err
+		}
+	}
+	// merge the notes changed both here and on other devices
+	merged, err := s.noteService.MergeConflicts(p.Name(), result.Conflicts)
+	if err != nil {
+		return err
+	}
+	// delete the notes deleted on other devices
+	if err = s.noteService.ApplyRemoteDeletes(result.Deleted); err != nil {
+		return err
+	}
+	// the notes are now the same on both sides: they are the base of the next merges
+	if capabilities.Has(provider.CapabilityMerge) {
+		if err = s.noteService.SaveSyncBases(p.Name(), syncedNotes(dbNotes, result, merged)); err != nil {
+			s.logger.Errorf("Error saving the notes synced with %s: %v", p.Name(), err)
+		}
+	}
+	if capabilities.Has(provider.CapabilityTombstones) {
+		if err = p.PurgeTombstones(s.tombstoneHorizon()); err != nil {
+			s.logger.Errorf("Error purging %s tombstones: %v", p.Name(), err)
+		}
+	}
+	s.logger.Infof("Sync with %s complete", p.Name())
+	return nil
+}
+
+// syncedNotes returns the version of each note a sync left in both the local database and the provider
+func syncedNotes(dbNotes []model.Note, result *provider.SyncResult, merged []model.Note) []model.Note {
+	versions := make(map[int]model.Note, len(dbNotes))
+	for _, notes := range [][]model.Note{dbNotes, result.Downloaded, merged} {
+		for _, note := range notes {
+			versions[note.ID] = note
+		}
+	}
+	for _, tombstone := range result.Deleted {
+		delete(versions, tombstone.ID)
+	}
+	synced := make([]model.Note, 0, len(versions))
+	for _, note := range versions {
+		synced = append(synced, note)
+	}
+	return synced
+}
+
+// tombstoneHorizon returns the timestamp (ms) before which deletion tombstones are garbage-collected
+func (s *SyncServiceImpl) tombstoneHorizon() int64 {
+	days := common.DEFAULT_TOMBSTONE_TTL_DAYS
+	if val, err := s.configService.GetConfig(common.CONFIG_TOMBSTONE_TTL_DAYS); err == nil {
+		if d, err := strconv.Atoi(val); err == nil && d > 0 {
+			days = d
+		}
+	}
+	return common.GetCurrentTimestamp() - int64(days)*24*time.Hour.Milliseconds()
+}
+
+// syncInterval returns how often the remote changes are pulled. 0 disables the periodic sync
+func (s *SyncServiceImpl) syncInterval() time.Duration {
+	minutes := common.DEFAULT_SYNC_INTERVAL_MINUTES
+	if val, err := s.configService.GetConfig(common.CONFIG_SYNC_INTERVAL_MINUTES); err == nil {
+		if m, err := strconv.Atoi(val); err == nil && m >= 0 {
+			minutes = m
+		}
+	}
+	return time.Duration(minutes) * time.Minute
+}
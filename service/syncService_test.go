@@ -0,0 +1,360 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/provider"
+	"github.com/iltoga/ecnotes-go/service"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSyncProvider a provider returning a canned SyncResult, recording what it is handed over
+type fakeSyncProvider struct {
+	name         string
+	capabilities provider.Capability
+	result       *provider.SyncResult
+	err          error
+	// remote the UpdatedAt of the notes in the provider
+	remote map[int]int64
+
+	mu         sync.Mutex
+	syncs      int
+	tombstones []model.Tombstone
+	bases      map[int]int64
+	purges     int
+	workerCtx  context.Context
+	synced     chan struct{}
+}
+
+func newFakeSyncProvider(name string, capabilities provider.Capability) *fakeSyncProvider {
+	return &fakeSyncProvider{
+		name:         name,
+		capabilities: capabilities,
+		result:       &provider.SyncResult{},
+		synced:       make(chan struct{}, 10),
+	}
+}
+
+func (fp *fakeSyncProvider) Name() string                               { return fp.name }
+func (fp *fakeSyncProvider) Capabilities() provider.Capability          { return fp.capabilities }
+func (fp *fakeSyncProvider) GetNotes(ids ...int) ([]model.Note, error)  { return nil, nil }
+func (fp *fakeSyncProvider) GetNoteIDs(forceRemote bool) ([]int, error) { return nil, nil }
+func (fp *fakeSyncProvider) GetNote(id int) (*model.Note, error)        { return nil, nil }
+func (fp *fakeSyncProvider) PutNote(note *model.Note) error             { return nil }
+func (fp *fakeSyncProvider) DeleteNote(id int) error                    { return nil }
+func (fp *fakeSyncProvider) Init() error                                { return nil }
+func (fp *fakeSyncProvider) UpdateNoteNotifier() observer.Listener {
+	return observer.Listener{OnNotify: func(data interface{}, args ...interface{}) {}}
+}
+func (fp *fakeSyncProvider) DeleteNoteNotifier() observer.Listener {
+	return observer.Listener{OnNotify: func(data interface{}, args ...interface{}) {}}
+}
+
+func (fp *fakeSyncProvider) RemoteVersions(ctx context.Context) (map[int]int64, map[int]int64, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.remote, nil, fp.err
+}
+
+func (fp *fakeSyncProvider) SyncNotes(
+	ctx context.Context,
+	dbNotes []model.Note,
+	dbTombstones []model.Tombstone,
+	bases map[int]int64,
+) (*provider.SyncResult, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.syncs++
+	fp.tombstones = dbTombstones
+	fp.bases = bases
+	fp.synced <- struct{}{}
+	if fp.err != nil {
+		return nil, fp.err
+	}
+	return fp.result, nil
+}
+
+func (fp *fakeSyncProvider) PurgeTombstones(before int64) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.purges++
+	return nil
+}
+
+func (fp *fakeSyncProvider) InitWorker(ctx context.Context) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.workerCtx = ctx
+}
+
+func newTestConfig(values map[string]string) service.ConfigService {
+	return &service.ConfigServiceImpl{
+		Config:     values,
+		Globals:    map[string]string{},
+		Loaded:     true,
+		ConfigMux:  &sync.RWMutex{},
+		GlobalsMux: &sync.RWMutex{},
+	}
+}
+
+func newTestLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func TestSyncProviderNames(t *testing.T) {
+	assert.Empty(t, service.SyncProviderNames(newTestConfig(map[string]string{})))
+	// configs written before providers were selectable
+	assert.Equal(t, []string{provider.GoogleProviderName}, service.SyncProviderNames(newTestConfig(map[string]string{
+		common.CONFIG_GOOGLE_SHEET_ID: "sheet-id",
+	})))
+	assert.Equal(t, []string{"webdav", provider.GoogleProviderName}, service.SyncProviderNames(newTestConfig(map[string]string{
+		common.CONFIG_GOOGLE_SHEET_ID: "sheet-id",
+		common.CONFIG_SYNC_PROVIDERS:  " webdav, google_sheets,,webdav",
+	})))
+	// an empty list disables the sync, even with a sheet set
+	assert.Empty(t, service.SyncProviderNames(newTestConfig(map[string]string{
+		common.CONFIG_GOOGLE_SHEET_ID: "sheet-id",
+		common.CONFIG_SYNC_PROVIDERS:  "",
+	})))
+}
+
+func TestSyncServiceImpl_Sync(t *testing.T) {
+	ns, repo := newTestNoteService(t)
+	local := &model.Note{Title: "Local", Content: "local"}
+	require.NoError(t, ns.CreateNote(local))
+	require.NoError(t, repo.SaveTombstone(model.Tombstone{ID: 42, DeletedAt: common.GetCurrentTimestamp()}))
+
+	full := newFakeSyncProvider("full", provider.CapabilityTombstones|provider.CapabilityMerge)
+	full.result.Downloaded = []model.Note{remoteVersion(t, ns, 7, "Remote", "remote")}
+	basic := newFakeSyncProvider("basic", 0)
+	broken := newFakeSyncProvider("broken", provider.CapabilityMerge)
+	broken.err = errors.New("offline")
+
+	ss := service.NewSyncService(ns, newTestConfig(map[string]string{}), &observer.ObserverImpl{}, newTestLogger())
+	ss.AddProvider(full)
+	ss.AddProvider(broken)
+	ss.AddProvider(basic)
+	require.Len(t, ss.Providers(), 3)
+
+	err := ss.Sync(context.Background())
+	// a failing provider doesn't stop the others
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "broken: offline")
+	assert.Equal(t, 1, full.syncs)
+	assert.Equal(t, 1, basic.syncs)
+	assert.ElementsMatch(t, []string{"Local", "Remote"}, ns.GetTitles())
+
+	// the providers get only what they can handle
+	assert.Len(t, full.tombstones, 1)
+	assert.NotNil(t, full.bases)
+	assert.Equal(t, 1, full.purges)
+	assert.Nil(t, basic.tombstones)
+	assert.Nil(t, basic.bases)
+	assert.Zero(t, basic.purges)
+
+	// each provider has its own bases
+	bases, err := ns.GetSyncBases("full")
+	require.NoError(t, err)
+	assert.Len(t, bases, 2)
+	bases, err = ns.GetSyncBases("broken")
+	require.NoError(t, err)
+	assert.Empty(t, bases)
+}
+
+func TestSyncServiceImpl_Sync_Events(t *testing.T) {
+	ns, _ := newTestNoteService(t)
+	ok := newFakeSyncProvider("ok", 0)
+	broken := newFakeSyncProvider("broken", 0)
+	broken.err = errors.New("offline")
+
+	obs := &observer.ObserverImpl{}
+	events := make(chan observer.Event, 10)
+	received := make(map[observer.Event][]*model.SyncEvent)
+	var mu sync.Mutex
+	for _, event := range []observer.Event{
+		observer.EVENT_SYNC_STARTED,
+		observer.EVENT_SYNC_PROGRESS,
+		observer.EVENT_SYNC_FAILED,
+		observer.EVENT_SYNC_COMPLETED,
+	} {
+		event := event
+		obs.AddListener(event, observer.Listener{OnNotify: func(data interface{}, args ...interface{}) {
+			mu.Lock()
+			received[event] = append(received[event], data.(*model.SyncEvent))
+			mu.Unlock()
+			events <- event
+		}})
+	}
+	ss := service.NewSyncService(ns, newTestConfig(map[string]string{}), obs, newTestLogger())
+	ss.AddProvider(ok)
+	ss.AddProvider(broken)
+	require.Error(t, ss.Sync(context.Background()))
+
+	for i := 0; i < 5; i++ {
+		select {
+		case <-events:
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the sync events")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, received[observer.EVENT_SYNC_STARTED], 1)
+	assert.Equal(t, 2, received[observer.EVENT_SYNC_STARTED][0].Total)
+	require.Len(t, received[observer.EVENT_SYNC_PROGRESS], 2)
+	require.Len(t, received[observer.EVENT_SYNC_FAILED], 1)
+	failed := received[observer.EVENT_SYNC_FAILED][0]
+	assert.Equal(t, "broken", failed.Provider)
+	assert.EqualError(t, failed.Err, "offline")
+	require.Len(t, received[observer.EVENT_SYNC_COMPLETED], 1)
+	completed := received[observer.EVENT_SYNC_COMPLETED][0]
+	assert.Equal(t, 2, completed.Done)
+	assert.ErrorContains(t, completed.Err, "broken: offline")
+}
+
+func TestSyncServiceImpl_Sync_LockedVault(t *testing.T) {
+	ns, _ := newTestNoteService(t)
+	require.NoError(t, ns.SwitchVault(common.DECOY_NOTES_BUCKET, true))
+	fp := newFakeSyncProvider("full", provider.CapabilityMerge)
+
+	ss := service.NewSyncService(ns, newTestConfig(map[string]string{}), &observer.ObserverImpl{}, newTestLogger())
+	ss.AddProvider(fp)
+	require.NoError(t, ss.Sync(context.Background()))
+	assert.Zero(t, fp.syncs, "a local-only vault is never synced")
+}
+
+func TestSyncServiceImpl_WaitUnlocked(t *testing.T) {
+	ns, _ := newTestNoteService(t)
+	ss := service.NewSyncService(ns, newTestConfig(map[string]string{}), &observer.ObserverImpl{}, newTestLogger())
+	require.NoError(t, ss.WaitUnlocked(context.Background()))
+
+	require.NoError(t, ns.SwitchVault(common.DECOY_NOTES_BUCKET, true))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, ss.WaitUnlocked(ctx), context.DeadlineExceeded)
+}
+
+func TestSyncServiceImpl_PlanAndApply(t *testing.T) {
+	ns, _ := newTestNoteService(t)
+	local := &model.Note{Title: "Local", Content: "local"}
+	require.NoError(t, ns.CreateNote(local))
+	fp := newFakeSyncProvider("full", provider.CapabilityTombstones|provider.CapabilityMerge)
+	broken := newFakeSyncProvider("broken", 0)
+	broken.err = errors.New("offline")
+
+	ss := service.NewSyncService(ns, newTestConfig(map[string]string{}), &observer.ObserverImpl{}, newTestLogger())
+	ss.AddProvider(fp)
+	ss.AddProvider(broken)
+	plans, err := ss.PlanSync(context.Background())
+	// a failing provider doesn't stop the others
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "broken: offline")
+	require.Len(t, plans, 1)
+	plan := plans[0]
+	assert.Equal(t, "full", plan.Provider)
+	require.Len(t, plan.Upload, 1)
+	assert.Equal(t, local.ID, plan.Upload[0].ID)
+	assert.Equal(t, "Local", plan.Upload[0].Title)
+	assert.Equal(t, plan.Upload, plan.LocalOnly)
+	// planning changes nothing
+	assert.Zero(t, fp.syncs)
+
+	// a plan is outdated once the notes change
+	fp.remote = map[int]int64{local.ID: common.GetCurrentTimestamp() + 1000}
+	err = ss.ApplyPlan(context.Background(), plan)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), common.ERR_SYNC_PLAN_OUTDATED)
+	assert.Zero(t, fp.syncs)
+
+	fp.remote = nil
+	require.NoError(t, ss.ApplyPlan(context.Background(), plan))
+	assert.Equal(t, 1, fp.syncs)
+	assert.Zero(t, broken.syncs)
+
+	plan.Provider = "unknown"
+	err = ss.ApplyPlan(context.Background(), plan)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), common.ERR_SYNC_PROVIDER_NOT_ACTIVE)
+}
+
+func TestSyncServiceImpl_PlanSync_LockedVault(t *testing.T) {
+	ns, _ := newTestNoteService(t)
+	// no key loaded
+	ns.Crypto = &service.CryptoServiceFactoryImpl{}
+	ss := service.NewSyncService(ns, newTestConfig(map[string]string{}), &observer.ObserverImpl{}, newTestLogger())
+	ss.AddProvider(newFakeSyncProvider("full", 0))
+	_, err := ss.PlanSync(context.Background())
+	assert.EqualError(t, err, common.ERR_VAULT_LOCKED)
+	assert.EqualError(t, ss.ApplyPlan(context.Background(), &provider.SyncPlan{Provider: "full"}), common.ERR_VAULT_LOCKED)
+}
+
+func TestSyncServiceImpl_PlanSync_LocalOnlyVault(t *testing.T) {
+	ns, _ := newTestNoteService(t)
+	require.NoError(t, ns.SwitchVault(common.DECOY_NOTES_BUCKET, true))
+	require.NoError(t, ns.CreateNote(&model.Note{Title: "Decoy", Content: "decoy"}))
+	fp := newFakeSyncProvider("full", provider.CapabilityMerge)
+	ss := service.NewSyncService(ns, newTestConfig(map[string]string{}), &observer.ObserverImpl{}, newTestLogger())
+	ss.AddProvider(fp)
+
+	// the local-only vault plans and applies nothing, without telling it apart from a vault in sync
+	plans, err := ss.PlanSync(context.Background())
+	require.NoError(t, err)
+	require.Len(t, plans, 1)
+	assert.Equal(t, "full", plans[0].Provider)
+	assert.True(t, plans[0].Empty())
+	require.NoError(t, ss.ApplyPlan(context.Background(), plans[0]))
+	require.NoError(t, ss.ApplyPlan(context.Background(), &provider.SyncPlan{Provider: "unknown"}))
+	assert.Zero(t, fp.syncs)
+}
+
+func TestSyncServiceImpl_Start(t *testing.T) {
+	ns, _ := newTestNoteService(t)
+	obs := &observer.ObserverImpl{}
+	cfg := newTestConfig(map[string]string{common.CONFIG_SYNC_INTERVAL_MINUTES: "0"})
+	pushing := newFakeSyncProvider("pushing", provider.CapabilityBackgroundPush)
+	pulling := newFakeSyncProvider("pulling", 0)
+
+	ss := service.NewSyncService(ns, cfg, obs, newTestLogger())
+	ss.AddProvider(pushing)
+	ss.AddProvider(pulling)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ss.Start(ctx)
+
+	pushing.mu.Lock()
+	assert.NotNil(t, pushing.workerCtx, "the providers pushing in the background get their worker started")
+	pushing.mu.Unlock()
+	pulling.mu.Lock()
+	assert.Nil(t, pulling.workerCtx)
+	pulling.mu.Unlock()
+
+	waitSync := func(fp *fakeSyncProvider) {
+		t.Helper()
+		select {
+		case <-fp.synced:
+		case <-time.After(time.Second):
+			t.Fatal("the notes were not synced")
+		}
+	}
+	// the first sync runs right away, the next ones on request (the periodic sync is disabled)
+	waitSync(pulling)
+	select {
+	case <-pulling.synced:
+		t.Fatal("unexpected sync")
+	case <-time.After(50 * time.Millisecond):
+	}
+	obs.Notify(observer.EVENT_SYNC_REQUESTED, nil)
+	waitSync(pulling)
+}
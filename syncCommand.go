@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/provider"
+	"github.com/iltoga/ecnotes-go/service"
+	"golang.org/x/term"
+)
+
+// runSyncCommand plans the sync with the configured providers without starting the GUI: it prints the plans (and
+// saves them to planOut, if not empty), or applies the plans saved in applyPath, if not empty.
+// The paired devices are not synced from the command line
+func runSyncCommand(planOut string, applyPath string) error {
+	h, err := openHeadless(os.Stdin, os.Stderr)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	syncService, err := h.syncService()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if applyPath != "" {
+		return applySyncPlans(ctx, syncService, applyPath, os.Stdout)
+	}
+	return printSyncPlans(ctx, syncService, planOut, os.Stdout)
+}
+
+// unlockVault loads the default key: without asking, if it has no password, or with the password read from in
+func unlockVault(keyService service.KeyService, configService service.ConfigService, in io.Reader, prompt io.Writer) error {
+	ok, err := keyService.TryAutoLoad()
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	keyName, err := configService.GetConfig(common.CONFIG_CUR_ENCRYPTION_KEY_NAME)
+	if err != nil || keyName == "" {
+		return errors.New(common.ERR_NO_KEY)
+	}
+	fmt.Fprintf(prompt, "Password of the key %q: ", keyName)
+	password, err := readPassword(in, prompt)
+	if err != nil {
+		return err
+	}
+	return keyService.LoadKey(keyName, password)
+}
+
+// readPassword reads a password from the terminal without echoing it or, when in is not a terminal, from its first
+// line. A *bufio.Reader is read from as is, so that what follows the password can still be read from it
+func readPassword(in io.Reader, prompt io.Writer) (string, error) {
+	if f, ok := in.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		password, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(prompt)
+		return string(password), err
+	}
+	reader, ok := in.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(in)
+	}
+	password, err := reader.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return strings.TrimRight(password, "\r\n"), nil
+}
+
+// printSyncPlans writes what a sync would do with each active provider to out, and saves the plans as JSON to
+// planOut, if not empty, to be applied later
+func printSyncPlans(ctx context.Context, syncService service.SyncService, planOut string, out io.Writer) error {
+	plans, planErr := syncService.PlanSync(ctx)
+	for _, plan := range plans {
+		if err := plan.WriteText(out); err != nil {
+			return err
+		}
+	}
+	if planOut != "" && len(plans) > 0 {
+		data, err := json.MarshalIndent(plans, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = os.WriteFile(planOut, data, 0o600); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Plans saved to %s\n", planOut)
+	}
+	return planErr
+}
+
+// applySyncPlans applies the plans saved by printSyncPlans in path, as long as they still hold
+func applySyncPlans(ctx context.Context, syncService service.SyncService, path string, out io.Writer) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var plans []*provider.SyncPlan
+	if err = json.Unmarshal(data, &plans); err != nil {
+		return fmt.Errorf("invalid sync plans file: %w", err)
+	}
+	errs := make([]error, 0)
+	for _, plan := range plans {
+		if err := syncService.ApplyPlan(ctx, plan); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Fprintf(out, "Synced with %s\n", plan.Provider)
+	}
+	return errors.Join(errs...)
+}
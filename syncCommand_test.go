@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/iltoga/ecnotes-go/lib/common"
+	"github.com/iltoga/ecnotes-go/provider"
+	"github.com/iltoga/ecnotes-go/service"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lockedSyncService returns a sync service of a vault whose key is not loaded, syncing with a local folder
+func lockedSyncService(t *testing.T) service.SyncService {
+	t.Helper()
+	syncService, _ := newFolderSyncService(t)
+	return syncService
+}
+
+// newFolderSyncService returns a sync service syncing with a local folder, and the note service of its vault
+func newFolderSyncService(t *testing.T) (service.SyncService, service.NoteService) {
+	t.Helper()
+	cfg := loadedConfig(map[string]string{
+		common.CONFIG_KVDB_PATH:      t.TempDir(),
+		common.CONFIG_SYNC_PROVIDERS: provider.FolderProviderName,
+		common.CONFIG_FOLDER_PATH:    t.TempDir(),
+	})
+	cryptoService, err := setupCryptoService()
+	require.NoError(t, err)
+	obs := &observer.ObserverImpl{}
+	noteService, noteRepository, err := setupDb(cfg, cryptoService, obs, logrus.StandardLogger())
+	require.NoError(t, err)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	syncService := service.NewSyncService(noteService, cfg, obs, logger)
+	require.NoError(t, activateProviders(cfg, syncService, noteRepository, nil, obs, logger))
+	require.Len(t, syncService.Providers(), 1)
+	return syncService, noteService
+}
+
+func TestPrintSyncPlans_LockedVault(t *testing.T) {
+	syncService := lockedSyncService(t)
+	planOut := filepath.Join(t.TempDir(), "plan.json")
+	out := &strings.Builder{}
+
+	err := printSyncPlans(context.Background(), syncService, planOut, out)
+	assert.EqualError(t, err, common.ERR_VAULT_LOCKED)
+	assert.Empty(t, out.String())
+	assert.NoFileExists(t, planOut)
+}
+
+func TestApplySyncPlans(t *testing.T) {
+	syncService := lockedSyncService(t)
+	dir := t.TempDir()
+
+	assert.Error(t, applySyncPlans(context.Background(), syncService, filepath.Join(dir, "missing.json"), io.Discard))
+
+	invalid := filepath.Join(dir, "invalid.json")
+	require.NoError(t, os.WriteFile(invalid, []byte("not json"), 0o600))
+	assert.ErrorContains(t, applySyncPlans(context.Background(), syncService, invalid, io.Discard), "invalid sync plans file")
+
+	// nothing is applied to a locked vault
+	data, err := json.Marshal([]*provider.SyncPlan{{Provider: provider.FolderProviderName}})
+	require.NoError(t, err)
+	planPath := filepath.Join(dir, "plan.json")
+	require.NoError(t, os.WriteFile(planPath, data, 0o600))
+	out := &strings.Builder{}
+	assert.EqualError(t, applySyncPlans(context.Background(), syncService, planPath, out), common.ERR_VAULT_LOCKED)
+	assert.Empty(t, out.String())
+}
+
+func TestSyncCommand_DecoyVault(t *testing.T) {
+	syncService, noteService := newFolderSyncService(t)
+	require.NoError(t, noteService.SwitchVault(common.DECOY_NOTES_BUCKET, true))
+	planOut := filepath.Join(t.TempDir(), "plan.json")
+	out := &strings.Builder{}
+
+	// the decoy vault plans and applies nothing, without telling it apart from the real one
+	require.NoError(t, printSyncPlans(context.Background(), syncService, planOut, out))
+	assert.Contains(t, out.String(), "nothing to sync")
+	out.Reset()
+	require.NoError(t, applySyncPlans(context.Background(), syncService, planOut, out))
+	assert.Equal(t, "Synced with "+provider.FolderProviderName+"\n", out.String())
+	assert.NoError(t, syncService.Sync(context.Background()))
+}
@@ -23,30 +23,51 @@
 package ui
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net/url"
+	"strings"
+	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/data/binding"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 	"github.com/iltoga/ecnotes-go/lib/common"
 	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/provider"
 	"github.com/iltoga/ecnotes-go/service"
 	"github.com/iltoga/ecnotes-go/service/observer"
 )
 
+const (
+	// pairingTimeout how long the pairing with another device may take
+	pairingTimeout = 30 * time.Second
+	// syncPlanTimeout how long planning or applying the sync with the providers may take
+	syncPlanTimeout = 2 * time.Minute
+	// googleAuthTimeout how long the user has to sign in to their Google account in the browser
+	googleAuthTimeout = 5 * time.Minute
+)
+
 type MainWindow interface {
 	WindowInterface
 	UpdateNoteListWidget() observer.Listener
+	NoteConflictListener() observer.Listener
+	SyncPendingListener() observer.Listener
+	SyncStatusListener(event observer.Event) observer.Listener
 }
 
 type MainWindowImpl struct {
 	UImpl
 	WindowDefaultOptions
 	titlesDataBinding binding.ExternalStringList
+	syncStatus        binding.String
+	syncState         *syncState
+	syncErrorsBtn     *widget.Button
 	selectedNote      *model.Note
 	selectedNoteID    int
 	w                 fyne.Window
@@ -60,6 +81,8 @@ func NewMainWindow(
 	return &MainWindowImpl{
 		UImpl:         *ui,
 		cryptoService: cryptoService,
+		syncStatus:    binding.NewString(),
+		syncState:     newSyncState(),
 	}
 }
 
@@ -159,8 +182,14 @@ func (ui *MainWindowImpl) createWindowContainer() *fyne.Container {
 	})
 
 	btnBar := container.New(layout.NewHBoxLayout(), newNoteBtn, hideBtn, deleteNoteBtn)
+	syncStatusLabel := widget.NewLabelWithData(ui.syncStatus)
+	ui.AddWidget(common.WDG_SYNC_STATUS, syncStatusLabel)
+	ui.syncErrorsBtn = widget.NewButtonWithIcon("", theme.WarningIcon(), ui.showSyncErrorsDialog)
+	ui.syncErrorsBtn.Hide()
+	syncStatusBox := container.NewHBox(syncStatusLabel, ui.syncErrorsBtn)
 	btnContainer := container.New(
-		layout.NewBorderLayout(nil, nil, nil, btnBar),
+		layout.NewBorderLayout(nil, nil, syncStatusBox, btnBar),
+		syncStatusBox,
 		btnBar,
 	)
 
@@ -265,10 +294,408 @@ func (ui *MainWindowImpl) createMainWindowMenu() *fyne.MainMenu {
 		},
 	}
 
+	menuItemSendKeys := &fyne.MenuItem{
+		Label: "Send encryption keys to a new device…",
+		Action: func() {
+			ui.showSendKeysDialog()
+		},
+	}
+
+	menuItemReceiveKeys := &fyne.MenuItem{
+		Label: "Receive encryption keys from another device…",
+		Action: func() {
+			ui.showReceiveKeysDialog(nil)
+		},
+	}
+
+	menuItemDuress := &fyne.MenuItem{
+		Label: "Set Duress Password",
+		Action: func() {
+			ui.showDuressDialog()
+		},
+	}
+
+	menuItemConnectGoogle := &fyne.MenuItem{
+		Label: "Connect Google account…",
+		Action: func() {
+			ui.showConnectGoogleDialog()
+		},
+	}
+
+	menuItemSyncNow := &fyne.MenuItem{
+		Label: "Sync now",
+		Action: func() {
+			ui.GetObserver().Notify(observer.EVENT_SYNC_REQUESTED, nil)
+		},
+	}
+
+	items := []*fyne.MenuItem{
+		menuItemCopyEncKey,
+		menuItemImportEncKey,
+		menuItemGenerateEncKey,
+		menuItemSendKeys,
+		menuItemReceiveKeys,
+		menuItemDuress,
+		fyne.NewMenuItemSeparator(),
+		menuItemSyncNow,
+		menuItemConnectGoogle,
+	}
+	if ui.syncService != nil {
+		items = append(items, &fyne.MenuItem{
+			Label: "Preview sync…",
+			Action: func() {
+				ui.showSyncPlanDialog()
+			},
+		})
+	}
+	if ui.peerService != nil {
+		items = append(items,
+			&fyne.MenuItem{
+				Label: "Pair a device…",
+				Action: func() {
+					ui.showStartPairingDialog()
+				},
+			},
+			&fyne.MenuItem{
+				Label: "Pair with a device…",
+				Action: func() {
+					ui.showPairDialog()
+				},
+			},
+		)
+	}
+
 	return fyne.NewMainMenu(&fyne.Menu{
 		Label: "File",
-		Items: []*fyne.MenuItem{menuItemCopyEncKey, menuItemImportEncKey, menuItemGenerateEncKey},
+		Items: items,
+	})
+}
+
+// ──────────────────────────────────────────────────────────────────────────────
+// Dialogs — Sync preview
+// ──────────────────────────────────────────────────────────────────────────────
+
+// showSyncPlanDialog shows what a sync would do with each provider (SyncService.PlanSync), and applies the reviewed
+// plans on request (SyncService.ApplyPlan).
+func (ui *MainWindowImpl) showSyncPlanDialog() {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), syncPlanTimeout)
+		defer cancel()
+		plans, err := ui.syncService.PlanSync(ctx)
+		if err != nil {
+			ui.ShowNotification("Error", err.Error())
+			if len(plans) == 0 {
+				return
+			}
+		}
+		text := &strings.Builder{}
+		pending := make([]*provider.SyncPlan, 0, len(plans))
+		for _, plan := range plans {
+			_ = plan.WriteText(text)
+			text.WriteString("\n")
+			if !plan.Empty() {
+				pending = append(pending, plan)
+			}
+		}
+		if len(plans) == 0 {
+			text.WriteString("No sync provider active")
+		}
+		planWdg := widget.NewLabelWithStyle(text.String(), fyne.TextAlignLeading, fyne.TextStyle{Monospace: true})
+
+		var dg dialog.Dialog
+		applyWdg := widget.NewButton("Apply", func() {
+			dg.Hide()
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), syncPlanTimeout)
+				defer cancel()
+				for _, plan := range pending {
+					if err := ui.syncService.ApplyPlan(ctx, plan); err != nil {
+						ui.ShowNotification("Error", err.Error())
+						return
+					}
+				}
+				ui.ShowNotification("", "Sync complete")
+			}()
+		})
+		if len(pending) == 0 {
+			applyWdg.Disable()
+		}
+		wdg := container.NewBorder(nil, applyWdg, nil, nil, container.NewScroll(planWdg))
+		dg = dialog.NewCustom("Sync Preview", "Close", wdg, ui.w)
+		dg.Resize(fyne.NewSize(900, 500))
+		dg.Show()
+	}()
+}
+
+// showSyncErrorsDialog shows the last error of each provider failing to sync, and
+// syncs again on request.
+func (ui *MainWindowImpl) showSyncErrorsDialog() {
+	errorsWdg := widget.NewLabel(ui.syncState.errorsText())
+	errorsWdg.Wrapping = fyne.TextWrapWord
+	var dg dialog.Dialog
+	retryWdg := widget.NewButton("Sync now", func() {
+		dg.Hide()
+		ui.GetObserver().Notify(observer.EVENT_SYNC_REQUESTED, nil)
 	})
+	wdg := container.NewBorder(nil, retryWdg, nil, nil, container.NewScroll(errorsWdg))
+	dg = dialog.NewCustom("Sync Errors", "Close", wdg, ui.w)
+	dg.Resize(fyne.NewSize(700, 300))
+	dg.Show()
+}
+
+// ──────────────────────────────────────────────────────────────────────────────
+// Dialogs — Device pairing
+// ──────────────────────────────────────────────────────────────────────────────
+
+// showStartPairingDialog puts the device in pairing mode through PeerService.StartPairing, and shows the code to
+// enter on the other device.
+func (ui *MainWindowImpl) showStartPairingDialog() {
+	code, err := ui.peerService.StartPairing()
+	if err != nil {
+		ui.ShowNotification("Error", err.Error())
+		return
+	}
+	codeWdg := widget.NewLabelWithStyle(code, fyne.TextAlignCenter, fyne.TextStyle{Monospace: true, Bold: true})
+	wdg := container.NewVBox(
+		widget.NewLabel(
+			"On the other device, choose \"Pair with a device…\" and enter this code.\n"+
+				"It can be used once, within a few minutes.",
+		),
+		codeWdg,
+		widget.NewLabel(fmt.Sprintf("This device listens on port %d. Its fingerprint:", ui.peerService.Port())),
+		widget.NewLabelWithStyle(ui.peerService.Fingerprint(), fyne.TextAlignLeading, fyne.TextStyle{Monospace: true}),
+	)
+	dg := dialog.NewCustom("Pair a Device", "Close", wdg, ui.w)
+	dg.Resize(fyne.NewSize(520, 220))
+	dg.Show()
+}
+
+// showPairDialog presents the pairing UI and delegates to PeerService.Pair.
+func (ui *MainWindowImpl) showPairDialog() {
+	addressWdg := widget.NewEntry()
+	addressWdg.SetPlaceHolder("Address of the other device (host:port)")
+	codeWdg := widget.NewEntry()
+	codeWdg.SetPlaceHolder("XXXX-XXXX-XXXX")
+
+	var dg dialog.Dialog
+	wdg := container.NewVBox(
+		widget.NewLabel("On the other device, choose \"Pair a device…\" and enter the code it shows."),
+		addressWdg,
+		codeWdg,
+		widget.NewButton("Pair", func() {
+			address, code := addressWdg.Text, codeWdg.Text
+			dg.Hide()
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), pairingTimeout)
+				defer cancel()
+				peer, err := ui.peerService.Pair(ctx, address, code)
+				if err != nil {
+					ui.ShowNotification("Error", err.Error())
+					return
+				}
+				ui.ShowNotification("", fmt.Sprintf("Paired with %s: the notes will be synced with it", peer.Name))
+			}()
+		}),
+	)
+	dg = dialog.NewCustom("Pair with a Device", "Cancel", wdg, ui.w)
+	dg.Resize(fyne.NewSize(520, 200))
+	dg.Show()
+}
+
+// ──────────────────────────────────────────────────────────────────────────────
+// Dialogs — Key transfer
+// ──────────────────────────────────────────────────────────────────────────────
+
+// showSendKeysDialog asks whether the credentials of the sync providers are sent along with the keys, then serves
+// them through showTransferCodeDialog
+func (ui *MainWindowImpl) showSendKeysDialog() {
+	secretsWdg := widget.NewCheck("Also send the sync credentials", nil)
+	secretsWdg.SetChecked(true)
+
+	var dg dialog.Dialog
+	wdg := container.NewVBox(
+		widget.NewLabel(
+			"The encryption keys are sent to the new device. The credentials of the\n"+
+				"sync providers (tokens, passwords) can be sent too, so that it syncs right away.",
+		),
+		secretsWdg,
+		widget.NewButton("Send", func() {
+			dg.Hide()
+			ui.showTransferCodeDialog(secretsWdg.Checked)
+		}),
+	)
+	dg = dialog.NewCustom("Send Encryption Keys", "Cancel", wdg, ui.w)
+	dg.Resize(fyne.NewSize(520, 200))
+	dg.Show()
+}
+
+// showTransferCodeDialog serves the keys through KeyService.SendKeys until the new device has received them or the
+// dialog is closed, and shows the code to enter on the new device.
+func (ui *MainWindowImpl) showTransferCodeDialog(withSecrets bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	transfer, err := ui.keyService.SendKeys(ctx, withSecrets)
+	if err != nil {
+		cancel()
+		ui.ShowNotification("Error", err.Error())
+		return
+	}
+	addresses := "No network address found"
+	if len(transfer.Addresses) > 0 {
+		addresses = strings.Join(transfer.Addresses, "\n")
+	}
+	wdg := container.NewVBox(
+		widget.NewLabel(
+			"On the new device, choose \"Receive encryption keys from another device…\"\n"+
+				"and enter this code. It can be used once, while this dialog is open.",
+		),
+		widget.NewLabelWithStyle(transfer.Code, fyne.TextAlignCenter, fyne.TextStyle{Monospace: true, Bold: true}),
+		widget.NewLabel("Address of this device:"),
+		widget.NewLabelWithStyle(addresses, fyne.TextAlignLeading, fyne.TextStyle{Monospace: true}),
+	)
+	dg := dialog.NewCustom("Send Encryption Keys", "Cancel", wdg, ui.w)
+	dg.SetOnClosed(cancel)
+	dg.Resize(fyne.NewSize(520, 240))
+	dg.Show()
+
+	go func() {
+		err := <-transfer.Done
+		switch {
+		case ctx.Err() != nil:
+			// closed by the user
+		case err != nil:
+			ui.ShowNotification("Error", err.Error())
+		default:
+			ui.ShowNotification("", "Encryption keys sent to the new device")
+		}
+		dg.Hide()
+	}()
+}
+
+// showReceiveKeysDialog presents the key transfer UI of a new device and delegates to KeyService.ReceiveKeys.
+// onReceived, if not nil, is called once the keys are received and activated.
+func (ui *MainWindowImpl) showReceiveKeysDialog(onReceived func()) {
+	addressWdg := widget.NewEntry()
+	addressWdg.SetPlaceHolder("Address of the other device (host:port)")
+	codeWdg := widget.NewEntry()
+	codeWdg.SetPlaceHolder("XXXX-XXXX")
+	pwdWdg := widget.NewPasswordEntry()
+	pwdWdg.SetPlaceHolder("Password of the keys on this device (optional)")
+
+	var dg dialog.Dialog
+	wdg := container.NewVBox(
+		widget.NewLabel(
+			"On the other device, choose \"Send encryption keys to a new device…\"\n"+
+				"and enter the code and the address it shows.",
+		),
+		addressWdg,
+		codeWdg,
+		pwdWdg,
+		widget.NewLabel(
+			"Attention! The received keys replace the ones saved on this device.",
+		),
+		widget.NewButton("Receive", func() {
+			address, code, password := addressWdg.Text, codeWdg.Text, pwdWdg.Text
+			dg.Hide()
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), pairingTimeout)
+				defer cancel()
+				cert, err := ui.keyService.ReceiveKeys(ctx, address, code, password)
+				if err != nil {
+					ui.ShowNotification("Error", err.Error())
+					return
+				}
+				ui.ShowNotification("", fmt.Sprintf("Encryption keys received: %s is now the default key", cert.Name))
+				if onReceived != nil {
+					onReceived()
+				}
+			}()
+		}),
+	)
+	dg = dialog.NewCustom("Receive Encryption Keys", "Cancel", wdg, ui.w)
+	dg.Resize(fyne.NewSize(520, 260))
+	dg.Show()
+}
+
+// ──────────────────────────────────────────────────────────────────────────────
+// Dialogs — Google account
+// ──────────────────────────────────────────────────────────────────────────────
+
+// showConnectGoogleDialog asks the password of the keys and delegates the sign-in
+// to KeyService.ConnectGoogleAccount, which opens the browser.
+func (ui *MainWindowImpl) showConnectGoogleDialog() {
+	pwdWdg := widget.NewPasswordEntry()
+	pwdWdg.SetPlaceHolder("Password of the encryption keys (optional)")
+
+	var dg dialog.Dialog
+	wdg := container.NewVBox(
+		widget.NewLabel(
+			"Sign in to the Google account holding the notes sheet in the browser.\n"+
+				"Its access is saved encrypted with the encryption keys.",
+		),
+		pwdWdg,
+		widget.NewButton("Connect", func() {
+			password := pwdWdg.Text
+			dg.Hide()
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), googleAuthTimeout)
+				defer cancel()
+				err := ui.keyService.ConnectGoogleAccount(ctx, password, func(authURL string) error {
+					u, err := url.Parse(authURL)
+					if err != nil {
+						return err
+					}
+					return ui.app.OpenURL(u)
+				})
+				if err != nil {
+					ui.ShowNotification("Error", err.Error())
+					return
+				}
+				ui.ShowNotification("", "Google account connected")
+				ui.GetObserver().Notify(observer.EVENT_SYNC_REQUESTED, nil)
+			}()
+		}),
+	)
+	dg = dialog.NewCustom("Connect Google Account", "Cancel", wdg, ui.w)
+	dg.Resize(fyne.NewSize(520, 200))
+	dg.Show()
+}
+
+// ──────────────────────────────────────────────────────────────────────────────
+// Dialogs — Duress password
+// ──────────────────────────────────────────────────────────────────────────────
+
+// showDuressDialog presents the duress-password UI and delegates to KeyService.ConfigureDuress.
+func (ui *MainWindowImpl) showDuressDialog() {
+	pwdWdg := widget.NewPasswordEntry()
+	pwdConfirmWdg := widget.NewPasswordEntry()
+	pwdConfirmWdg.SetPlaceHolder("Confirm duress password")
+	wipeWdg := widget.NewCheck("Destroy the real key when the duress password is used", nil)
+
+	var dg dialog.Dialog
+	wdg := container.NewVBox(
+		widget.NewLabel(
+			"Unlocking with the duress password opens a separate, empty vault\n"+
+				"that is never synced. Nothing in the app tells it apart from the real one.",
+		),
+		pwdWdg,
+		pwdConfirmWdg,
+		wipeWdg,
+		widget.NewButton("Confirm", func() {
+			if pwdWdg.Text != pwdConfirmWdg.Text {
+				ui.ShowNotification("Error", "Passwords do not match")
+				return
+			}
+			if err := ui.keyService.ConfigureDuress(pwdWdg.Text, wipeWdg.Checked); err != nil {
+				ui.ShowNotification("Error", err.Error())
+				return
+			}
+			dg.Hide()
+			ui.ShowNotification("", "Duress password set")
+		}),
+	)
+	dg = dialog.NewCustom("Set Duress Password", "Cancel", wdg, ui.w)
+	dg.Resize(fyne.NewSize(520, 260))
+	dg.Show()
 }
 
 // ──────────────────────────────────────────────────────────────────────────────
@@ -375,6 +802,11 @@ func (ui *MainWindowImpl) loadCertDialog(
 			ui.ShowNotification("Error", err.Error())
 			return
 		}
+		// the decoy vault is never synced: nothing about the sync of the real one must show
+		if !ui.noteService.CanSync() {
+			ui.syncState.hide()
+			ui.refreshSyncStatus()
+		}
 		ui.ShowNotification("Success", "Key decrypted successfully")
 		mainCompleted = true
 		notifyResult(true)
@@ -555,6 +987,16 @@ func (ui *MainWindowImpl) newCertDialog(
 			dg.Hide()
 		}),
 	)
+	if isStartup {
+		// a new device can receive the keys of another one instead of generating its own
+		scrollContent.Add(widget.NewButton("Receive the keys from another device…", func() {
+			ui.showReceiveKeysDialog(func() {
+				completed = true
+				notifyResult(true)
+				dg.Hide()
+			})
+		}))
+	}
 	wdg = container.NewScroll(scrollContent)
 	dg = dialog.NewCustom(dgTitle, "Cancel", wdg, ui.w)
 	dg.SetOnClosed(func() {
@@ -699,3 +1141,71 @@ func (ui *MainWindowImpl) UpdateNoteListWidget() observer.Listener {
 		},
 	}
 }
+
+// NoteConflictListener is the observer listener that tells the user when the sync
+// saved a conflicted copy of a note.
+func (ui *MainWindowImpl) NoteConflictListener() observer.Listener {
+	return observer.Listener{
+		OnNotify: func(data interface{}, args ...interface{}) {
+			conflict, ok := data.(*model.NoteConflict)
+			if !ok {
+				log.Println("NoteConflict: invalid message value")
+				return
+			}
+			ui.ShowNotification("Sync conflict", fmt.Sprintf(
+				"%q was changed on another device too: their version was saved as %q",
+				conflict.Note.Title, conflict.Copy.Title,
+			))
+		},
+	}
+}
+
+// SyncPendingListener is the observer listener that shows how many changes are
+// waiting to be pushed to the sync providers.
+func (ui *MainWindowImpl) SyncPendingListener() observer.Listener {
+	return observer.Listener{
+		OnNotify: func(data interface{}, args ...interface{}) {
+			count, ok := data.(int)
+			if !ok || len(args) == 0 {
+				log.Println("SyncPending: invalid message value")
+				return
+			}
+			queue, _ := args[0].(string)
+			ui.syncState.setPending(queue, count)
+			ui.refreshSyncStatus()
+		},
+	}
+}
+
+// SyncStatusListener is the observer listener that shows how the sync goes, when
+// the notes were last synced and whether it failed, for the given sync event.
+func (ui *MainWindowImpl) SyncStatusListener(event observer.Event) observer.Listener {
+	return observer.Listener{
+		OnNotify: func(data interface{}, args ...interface{}) {
+			e, ok := data.(*model.SyncEvent)
+			if !ok {
+				log.Println("SyncStatus: invalid message value")
+				return
+			}
+			ui.syncState.apply(event, e)
+			ui.refreshSyncStatus()
+		},
+	}
+}
+
+// refreshSyncStatus shows the sync state next to the buttons, and the button to
+// the sync errors if any.
+func (ui *MainWindowImpl) refreshSyncStatus() {
+	if err := ui.syncStatus.Set(ui.syncState.text()); err != nil {
+		log.Println("SyncStatus: error setting data:", err)
+	}
+	// the events may come before the window is created
+	if ui.syncErrorsBtn == nil {
+		return
+	}
+	if ui.syncState.failed() {
+		ui.syncErrorsBtn.Show()
+	} else {
+		ui.syncErrorsBtn.Hide()
+	}
+}
@@ -18,6 +18,8 @@ import (
 type NoteDetailsWindow interface {
 	WindowInterface
 	UpdateNoteDetailsWidget() observer.Listener
+	RemoteUpdateNoteListener() observer.Listener
+	RemoteDeleteNoteListener() observer.Listener
 	Close(clearData bool)
 }
 
@@ -25,9 +27,10 @@ type NoteDetailsWindow interface {
 type NoteDetailsWindowImpl struct {
 	UImpl
 	WindowDefaultOptions
-	note     *model.Note
-	oldTitle string // in case we update the note title we need to save the old one to be able to save the note
-	w        fyne.Window
+	note       *model.Note
+	oldTitle   string // in case we update the note title we need to save the old one to be able to save the note
+	oldContent string // the content shown when the note was opened, to tell whether the user is editing it
+	w          fyne.Window
 }
 
 // NewNoteDetailsWindow ....
@@ -111,6 +114,7 @@ func (ui *NoteDetailsWindowImpl) updateWidgetsData(n *model.Note) {
 	ui.note = n
 	// save the note title in case we update it (we need the old one to be able to save the note)
 	ui.oldTitle = n.Title
+	ui.oldContent = n.Content
 	if w, err := ui.GetWidget(common.WDG_NOTE_DETAILS_TITLE); err == nil {
 		w.(*widget.Entry).SetText(n.Title)
 	} else {
@@ -191,6 +195,51 @@ func (ui *NoteDetailsWindowImpl) UpdateNoteDetailsWidget() observer.Listener {
 	}
 }
 
+// RemoteUpdateNoteListener refreshes the open note when a sync brings a newer version of it.
+// Unsaved edits are never overwritten: the user is told the note changed instead
+func (ui *NoteDetailsWindowImpl) RemoteUpdateNoteListener() observer.Listener {
+	return observer.Listener{
+		OnNotify: func(note interface{}, args ...interface{}) {
+			n, ok := note.(*model.Note)
+			if !ok || !ui.showsNote(n.ID) {
+				return
+			}
+			if ui.hasUnsavedChanges() {
+				ui.ShowNotification("Note changed on another device", n.Title)
+				return
+			}
+			ui.updateWidgetsData(n)
+		},
+	}
+}
+
+// RemoteDeleteNoteListener closes the open note when a sync deletes it.
+// Unsaved edits are kept, so that the user can save them as a new note
+func (ui *NoteDetailsWindowImpl) RemoteDeleteNoteListener() observer.Listener {
+	return observer.Listener{
+		OnNotify: func(tombstone interface{}, args ...interface{}) {
+			t, ok := tombstone.(model.Tombstone)
+			if !ok || !ui.showsNote(t.ID) {
+				return
+			}
+			ui.ShowNotification("Note deleted on another device", ui.oldTitle)
+			if !ui.hasUnsavedChanges() {
+				ui.Close(true)
+			}
+		},
+	}
+}
+
+// showsNote tells whether the window is showing the given (saved) note
+func (ui *NoteDetailsWindowImpl) showsNote(id int) bool {
+	return ui.note != nil && ui.note.ID != 0 && ui.note.ID == id
+}
+
+// hasUnsavedChanges tells whether the user edited the note since it was opened
+func (ui *NoteDetailsWindowImpl) hasUnsavedChanges() bool {
+	return ui.note.Title != ui.oldTitle || ui.note.Content != ui.oldContent
+}
+
 // Close close note details window
 func (ui *NoteDetailsWindowImpl) Close(clearData bool) {
 	// just to make sure nothing is left in the window
@@ -0,0 +1,162 @@
+package ui
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/service/observer"
+)
+
+// syncSetupError the key of the errors setting up the sync providers, which don't come from a single provider
+const syncSetupError = ""
+
+// syncState what the main window shows about the sync, built from the sync events
+type syncState struct {
+	mux sync.Mutex
+	// pending the changes waiting to be pushed, by provider
+	pending map[string]int
+	// running the progress of the sync in progress, nil if none
+	running *model.SyncEvent
+	// lastSyncedAt when the notes were last synced successfully (ms)
+	lastSyncedAt int64
+	// failures the last error of each provider failing to sync
+	failures map[string]*model.SyncEvent
+	// hidden set when the open vault is never synced (the decoy vault): the sync of the real one must not show
+	hidden bool
+}
+
+func newSyncState() *syncState {
+	return &syncState{
+		pending:  map[string]int{},
+		failures: map[string]*model.SyncEvent{},
+	}
+}
+
+// setPending records the number of changes waiting to be pushed to a provider
+func (s *syncState) setPending(provider string, count int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.hidden {
+		return
+	}
+	s.pending[provider] = count
+}
+
+// hide forgets the sync state of the real vault, and ignores the sync events from now on.
+// The outboxes of the real vault keep reporting their pending changes while the decoy vault is open
+func (s *syncState) hide() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.hidden = true
+	s.pending = map[string]int{}
+	s.running = nil
+	s.lastSyncedAt = 0
+	s.failures = map[string]*model.SyncEvent{}
+}
+
+// apply updates the status with a sync event
+func (s *syncState) apply(event observer.Event, e *model.SyncEvent) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.hidden {
+		return
+	}
+	switch event {
+	case observer.EVENT_SYNC_STARTED:
+		s.running = e
+	case observer.EVENT_SYNC_PROGRESS:
+		s.running = e
+		if e.Err == nil {
+			delete(s.failures, e.Provider)
+		}
+	case observer.EVENT_SYNC_FAILED:
+		s.failures[e.Provider] = e
+	case observer.EVENT_SYNC_COMPLETED:
+		// the background pushes of a provider complete while a sync may be running
+		if e.Provider == "" {
+			s.running = nil
+		}
+		if e.Err != nil {
+			return
+		}
+		s.lastSyncedAt = e.At
+		for provider := range s.failures {
+			// a provider that couldn't be set up is not synced, whatever the others do
+			if provider == syncSetupError {
+				continue
+			}
+			if e.Provider == "" || provider == e.Provider {
+				delete(s.failures, provider)
+			}
+		}
+	}
+}
+
+// text returns the status shown next to the buttons of the main window: empty until there is something to tell
+func (s *syncState) text() string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	parts := make([]string, 0, 3)
+	switch {
+	case s.running != nil && s.running.Total > 1:
+		parts = append(parts, fmt.Sprintf("Syncing %d/%d...", s.running.Done+1, s.running.Total))
+	case s.running != nil:
+		parts = append(parts, "Syncing...")
+	case s.lastSyncedAt > 0:
+		parts = append(parts, "Synced "+formatSyncTime(s.lastSyncedAt, time.Now()))
+	}
+	if len(s.failures) > 0 {
+		parts = append(parts, "sync failed")
+	}
+	total := 0
+	for _, count := range s.pending {
+		total += count
+	}
+	if total > 0 {
+		parts = append(parts, fmt.Sprintf("%d changes to sync", total))
+	}
+	return strings.Join(parts, " · ")
+}
+
+// failed reports whether a provider is failing to sync
+func (s *syncState) failed() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.failures) > 0
+}
+
+// errorsText returns the last error of each provider failing to sync, one per line
+func (s *syncState) errorsText() string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	providers := make([]string, 0, len(s.failures))
+	for provider := range s.failures {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	b := &strings.Builder{}
+	for _, provider := range providers {
+		e := s.failures[provider]
+		at := time.UnixMilli(e.At).Format("2006-01-02 15:04:05")
+		// the setup errors already tell the provider they come from
+		if provider == syncSetupError {
+			fmt.Fprintf(b, "%s  %v\n", at, e.Err)
+			continue
+		}
+		fmt.Fprintf(b, "%s  %s: %v\n", at, provider, e.Err)
+	}
+	return b.String()
+}
+
+// formatSyncTime formats when the notes were synced: the time only, if today
+func formatSyncTime(at int64, now time.Time) string {
+	t := time.UnixMilli(at)
+	if y, m, d := t.Date(); y == now.Year() && m == now.Month() && d == now.Day() {
+		return "at " + t.Format("15:04")
+	}
+	return "on " + t.Format("Jan 2 15:04")
+}
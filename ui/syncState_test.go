@@ -0,0 +1,71 @@
+package ui
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/iltoga/ecnotes-go/model"
+	"github.com/iltoga/ecnotes-go/service/observer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncState(t *testing.T) {
+	s := newSyncState()
+	assert.Empty(t, s.text())
+	assert.False(t, s.failed())
+
+	s.setPending("webdav", 2)
+	s.setPending("s3", 1)
+	assert.Equal(t, "3 changes to sync", s.text())
+
+	now := time.Now().UnixMilli()
+	s.apply(observer.EVENT_SYNC_STARTED, &model.SyncEvent{Total: 2, At: now})
+	assert.Equal(t, "Syncing 1/2... · 3 changes to sync", s.text())
+	s.apply(observer.EVENT_SYNC_FAILED, &model.SyncEvent{Provider: "webdav", Done: 1, Total: 2, At: now, Err: errors.New("offline")})
+	s.apply(observer.EVENT_SYNC_PROGRESS, &model.SyncEvent{Provider: "webdav", Done: 1, Total: 2, At: now, Err: errors.New("offline")})
+	assert.Equal(t, "Syncing 2/2... · sync failed · 3 changes to sync", s.text())
+	s.apply(observer.EVENT_SYNC_PROGRESS, &model.SyncEvent{Provider: "s3", Done: 2, Total: 2, At: now})
+	s.apply(observer.EVENT_SYNC_COMPLETED, &model.SyncEvent{Done: 2, Total: 2, At: now, Err: errors.New("webdav: offline")})
+	s.setPending("webdav", 0)
+	s.setPending("s3", 0)
+	// the sync failed: the notes were never synced
+	assert.Equal(t, "sync failed", s.text())
+	assert.True(t, s.failed())
+	assert.Contains(t, s.errorsText(), "webdav: offline")
+
+	// the background pushes to the failing provider work again
+	s.apply(observer.EVENT_SYNC_FAILED, &model.SyncEvent{At: now, Err: errors.New("google_sheets: missing credentials")})
+	s.apply(observer.EVENT_SYNC_COMPLETED, &model.SyncEvent{Provider: "webdav", At: now})
+	assert.Equal(t, "Synced at "+time.UnixMilli(now).Format("15:04")+" · sync failed", s.text())
+	assert.NotContains(t, s.errorsText(), "webdav")
+
+	// the providers that couldn't be set up stay failed
+	s.apply(observer.EVENT_SYNC_COMPLETED, &model.SyncEvent{At: now})
+	assert.True(t, s.failed())
+	assert.Contains(t, s.errorsText(), "google_sheets: missing credentials")
+}
+
+func TestSyncState_Hide(t *testing.T) {
+	s := newSyncState()
+	now := time.Now().UnixMilli()
+	s.setPending("webdav", 2)
+	s.apply(observer.EVENT_SYNC_FAILED, &model.SyncEvent{Provider: "s3", At: now, Err: errors.New("offline")})
+	s.apply(observer.EVENT_SYNC_COMPLETED, &model.SyncEvent{Provider: "webdav", At: now})
+	assert.NotEmpty(t, s.text())
+
+	// the decoy vault is open: the real vault's last sync, errors and pending changes are gone
+	s.hide()
+	assert.Empty(t, s.text())
+	assert.False(t, s.failed())
+	assert.Empty(t, s.errorsText())
+	s.setPending("webdav", 1)
+	s.apply(observer.EVENT_SYNC_COMPLETED, &model.SyncEvent{At: now})
+	assert.Empty(t, s.text())
+}
+
+func TestFormatSyncTime(t *testing.T) {
+	now := time.Date(2024, 3, 5, 18, 0, 0, 0, time.Local)
+	assert.Equal(t, "at 09:30", formatSyncTime(time.Date(2024, 3, 5, 9, 30, 0, 0, time.Local).UnixMilli(), now))
+	assert.Equal(t, "on Mar 4 09:30", formatSyncTime(time.Date(2024, 3, 4, 9, 30, 0, 0, time.Local).UnixMilli(), now))
+}
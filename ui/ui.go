@@ -52,6 +52,8 @@ type UImpl struct {
 	certService service.CertService
 	noteService service.NoteService
 	keyService  service.KeyService
+	peerService service.PeerService
+	syncService service.SyncService
 	obs         observer.Observer
 }
 
@@ -142,6 +144,28 @@ func (ui *UImpl) GetKeyService() service.KeyService {
 	return ui.keyService
 }
 
+// SetPeerService sets the service pairing the device with the others on the local network.
+// The pairing menu items are only shown when it is set
+func (ui *UImpl) SetPeerService(peerService service.PeerService) {
+	ui.peerService = peerService
+}
+
+// GetPeerService returns the peer-to-peer sync service, nil if disabled
+func (ui *UImpl) GetPeerService() service.PeerService {
+	return ui.peerService
+}
+
+// SetSyncService sets the service syncing the notes with the providers.
+// The sync preview menu item is only shown when it is set
+func (ui *UImpl) SetSyncService(syncService service.SyncService) {
+	ui.syncService = syncService
+}
+
+// GetSyncService returns the sync service, nil if not set
+func (ui *UImpl) GetSyncService() service.SyncService {
+	return ui.syncService
+}
+
 // GetObserver ....
 func (ui *UImpl) GetObserver() observer.Observer {
 	return ui.obs